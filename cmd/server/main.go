@@ -4,12 +4,28 @@ import (
 	"email-blaze/internals/auth"
 	"email-blaze/internals/config"
 	"email-blaze/internals/email"
+	"email-blaze/internals/inbound"
 	"email-blaze/internals/logger"
+	"email-blaze/internals/onboarding"
+	"email-blaze/internals/queue"
 	"email-blaze/internals/ratelimit"
 	"email-blaze/internals/smtp"
+	"email-blaze/internals/storage"
+	"email-blaze/internals/webhook"
 	"email-blaze/pkg/domainVerifier"
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/mail"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
@@ -19,90 +35,1664 @@ func main() {
 	if err := logger.Init("debug", "development", "console"); err != nil {
 		panic(err)
 	}
+
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			logger.Fatal("Command failed", logger.Field("command", os.Args[1]), logger.Err(err))
+		}
+		return
+	}
+
 	cfg, err := config.Load("config.yaml")
 	if err != nil {
 		logger.Fatal("Failed to load config", logger.Err(err))
 	}
 
-	sender := email.NewSender(cfg)
-	rateLimiter := ratelimit.NewRateLimiter(cfg.RateLimit, cfg.RateLimit)
+	store, err := storage.Open(cfg.DatabaseURL)
+	if err != nil {
+		logger.Fatal("Failed to open database", logger.Err(err))
+	}
+	defer store.Close()
+	if err := store.Migrate(context.Background()); err != nil {
+		logger.Fatal("Failed to migrate database", logger.Err(err))
+	}
+	if err := auth.ImportUsers(context.Background(), store.Users(), store.Domains(), cfg.Users); err != nil {
+		logger.Fatal("Failed to import users", logger.Err(err))
+	}
+
+	sender, err := email.NewSender(cfg)
+	if err != nil {
+		logger.Fatal("Failed to create sender", logger.Err(err))
+	}
+	rateLimiter := ratelimit.NewRateLimiter(cfg.RateLimit, cfg.RateLimit)
+	tokens, err := auth.NewTokens(cfg, store)
+	if err != nil {
+		logger.Fatal("Failed to load JWT keys", logger.Err(err))
+	}
+	senders := auth.NewSenderPolicy(store.Domains())
+	resolver, err := newResolver(cfg.DNS)
+	if err != nil {
+		logger.Fatal("Failed to configure DNS resolver", logger.Err(err))
+	}
+	domainVerifier.DefaultResolver = resolver
+	sender.SetResolver(resolver)
+	if err := activateDKIMKeys(store.Domains(), sender); err != nil {
+		logger.Fatal("Failed to activate DKIM keys", logger.Err(err))
+	}
+
+	outbound, err := queue.New(cfg, sender)
+	if err != nil {
+		logger.Fatal("Failed to open outbound queue", logger.Err(err))
+	}
+	webhooks, err := webhook.New(cfg)
+	if err != nil {
+		logger.Fatal("Failed to open webhook store", logger.Err(err))
+	}
+	recorder := storage.NewRecorder(store)
+	outbound.AddObserver(recorder)
+	outbound.AddObserver(webhooks)
+	webhooks.Start()
+	outbound.Start()
+	router := inbound.NewRouter(cfg, webhooks, domainVerifier.DefaultResolver)
+	checker := onboarding.New(cfg, store.Domains(), store.DomainClaims(), sender, webhooks, domainVerifier.DefaultResolver)
+	checker.Start()
+
+	go func() {
+		if err := smtp.StartSMTPServer(cfg, outbound, store, router); err != nil {
+			logger.Error("Failed to start SMTP server", logger.Err(err))
+			logger.Fatal("Exiting due to SMTP server failure")
+		} else {
+			logger.Info("SMTP server started successfully")
+		}
+	}()
+
+	r := gin.Default()
+	r.Use(gin.Recovery())
+
+	api := r.Group("/api/v1")
+	{
+		api.POST("/send", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeSend), sendEmailHandler(outbound, cfg, senders, store.Suppressions()))
+		api.POST("/verify", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeVerify), verifyDomainHandler(cfg, sender, store.Domains(), store.DomainClaims()))
+		api.POST("/domains", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeVerify), addDomainHandler(store.Domains(), store.DomainClaims(), checker))
+		api.GET("/domains", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeVerify), listOwnDomainsHandler(store.Domains(), store.DomainClaims(), checker))
+		api.GET("/domains/:domain", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeVerify), getOwnDomainHandler(store.Domains(), store.DomainClaims(), checker))
+		api.POST("/domains/:domain/verify", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeVerify), checkOwnDomainHandler(store.Domains(), store.DomainClaims(), checker))
+		api.DELETE("/domains/:domain", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeVerify), removeOwnDomainHandler(store.Domains(), store.DomainClaims(), checker))
+		api.POST("/domains/:domain/dkim", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeVerify), generateDKIMKeyHandler(sender, senders))
+		api.POST("/domains/:domain/dkim/:selector/activate", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeVerify), activateDKIMKeyHandler(sender, store.Domains(), senders))
+		api.POST("/verify-sender", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeVerify), verifySenderHandler())
+		api.POST("/send-verified", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeSend), sendVerifiedEmailHandler(outbound, cfg, senders, store.Suppressions()))
+		api.GET("/messages", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeReadLogs), listMessagesHandler(store.Messages(), store.Domains()))
+		api.GET("/messages/:id", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeReadLogs), getMessageHandler(store, outbound))
+		api.POST("/messages/:id/events", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeSend), reportEventHandler(store, recorder, webhooks))
+		api.POST("/feedback", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeSend), feedbackHandler(cfg, store, recorder, webhooks))
+		api.GET("/suppressions", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeReadLogs), listSuppressionsHandler(store.Suppressions(), store.Domains()))
+		api.DELETE("/suppressions/:address", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeSend), deleteSuppressionHandler(store.Suppressions(), store.Domains()))
+		api.POST("/webhooks", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeWebhooks), createWebhookHandler(webhooks, store.Domains()))
+		api.GET("/webhooks", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeReadLogs), listWebhooksHandler(webhooks))
+		api.DELETE("/webhooks/:id", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeWebhooks), deleteWebhookHandler(webhooks))
+		api.GET("/webhooks/:id/deliveries", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeReadLogs), webhookDeliveriesHandler(webhooks))
+		api.POST("/routes", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeWebhooks), createRouteHandler(webhooks, senders))
+		api.GET("/routes", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeReadLogs), listRoutesHandler(webhooks))
+		api.DELETE("/routes/:id", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeWebhooks), deleteRouteHandler(webhooks))
+		api.GET("/routes/:id/deliveries", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), requireScope(auth.ScopeReadLogs), webhookDeliveriesHandler(webhooks))
+		api.POST("/keys", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), sessionOnly(), createAPIKeyHandler(store.APIKeys()))
+		api.GET("/keys", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), sessionOnly(), listAPIKeysHandler(store.APIKeys()))
+		api.DELETE("/keys/:id", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), sessionOnly(), revokeAPIKeyHandler(store.APIKeys()))
+	}
+
+	admin := r.Group("/api/v1/admin", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), sessionOnly(), adminMiddleware())
+	{
+		admin.GET("/users", listUsersHandler(store.Users()))
+		admin.POST("/users", createUserHandler(store.Users()))
+		admin.POST("/users/:email/disable", setUserDisabledHandler(store.Users(), true))
+		admin.POST("/users/:email/enable", setUserDisabledHandler(store.Users(), false))
+		admin.POST("/users/:email/password", resetPasswordHandler(store.Users(), tokens))
+		admin.PUT("/users/:email/senders", setAllowedSendersHandler(store.Users()))
+		admin.GET("/domains", listDomainsHandler(store.Domains()))
+		admin.POST("/domains", createDomainHandler(store.Users(), store.Domains()))
+		admin.DELETE("/domains/:name", deleteDomainHandler(store.Domains(), checker))
+	}
+
+	r.GET("/.well-known/jwks.json", jwksHandler(tokens))
+
+	auth := r.Group("/auth")
+	{
+		auth.POST("/login", rateLimitMiddleware(rateLimiter), loginHandler(tokens, store.Users()))
+		auth.POST("/refresh", rateLimitMiddleware(rateLimiter), refreshTokenHandler(tokens))
+		auth.POST("/logout", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), sessionOnly(), logoutHandler(tokens))
+		auth.POST("/logout-all", rateLimitMiddleware(rateLimiter), authMiddleware(tokens, store), sessionOnly(), logoutAllHandler(tokens))
+	}
+
+	logger.Info("Starting API server", logger.Field("port", cfg.APIPort))
+	if err := r.Run(fmt.Sprintf(":%d", cfg.APIPort)); err != nil {
+		logger.Fatal("Failed to start API server", logger.Err(err))
+	}
+}
+
+// runCommand runs a command-line subcommand instead of the server.
+func runCommand(args []string) error {
+	switch args[0] {
+	case "hash-password":
+		// Read from stdin so the password does not end up in shell history.
+		fmt.Fprint(os.Stderr, "Password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return err
+		}
+		password := strings.TrimRight(line, "\r\n")
+		if password == "" {
+			return errors.New("empty password")
+		}
+		hash, err := auth.HashPassword(password)
+		if err != nil {
+			return err
+		}
+		fmt.Println(hash)
+		return nil
+	case "migrate":
+		cfg, err := config.Load("config.yaml")
+		if err != nil {
+			return err
+		}
+		store, err := storage.Open(cfg.DatabaseURL)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		ctx := context.Background()
+		if len(args) > 1 && args[1] == "status" {
+			current, latest, err := store.Version(ctx)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("schema version %d, latest %d\n", current, latest)
+			return nil
+		}
+		if err := store.Migrate(ctx); err != nil {
+			return err
+		}
+		current, _, err := store.Version(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("database migrated to version %d\n", current)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q, expected migrate [status] or hash-password", args[0])
+	}
+}
+
+func sendEmailHandler(outbound *queue.Queue, cfg *config.Config, senders *auth.SenderPolicy, suppressions storage.SuppressionRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		out, ok := prepareSend(c, cfg, senders, suppressions)
+		if !ok {
+			return
+		}
+
+		queued := queue.NewMessage(out.from, out.envelope)
+		queued.ID = out.id
+		queued.Domain = out.domain
+		if _, err := outbound.Enqueue(queued, out.raw); err != nil {
+			logger.Error("Failed to queue email", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send email"})
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"message":    "Email queued for delivery",
+			"id":         out.id,
+			"message_id": "<" + out.messageID + ">",
+			"status":     queue.StatusQueued,
+			"recipients": out.recipients,
+		})
+	}
+}
+
+// outgoing is an API message that passed the send checks.
+type outgoing struct {
+	id         string
+	domain     string
+	from       string
+	envelope   []string
+	recipients []email.RecipientStatus
+	messageID  string
+	raw        []byte
+}
+
+// prepareSend binds a send request, checks it against the caller's sender
+// policy, suppression list and the configured limits, and builds the
+// message. It writes the error response and returns false if the message
+// cannot be sent.
+func prepareSend(c *gin.Context, cfg *config.Config, senders *auth.SenderPolicy, suppressions storage.SuppressionRepository) (*outgoing, bool) {
+	var req email.SendRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return nil, false
+	}
+
+	if err := req.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	if !authorizeSender(c, senders, req.From) {
+		return nil, false
+	}
+	// Messages, suppressions and webhooks belong to the sending domain.
+	userDomain := senderDomain(req.From)
+
+	if req.RecipientCount() > cfg.MaxRecipients {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Too many recipients, at most %d are allowed", cfg.MaxRecipients)})
+		return nil, false
+	}
+
+	envelope, recipients := req.Recipients()
+	envelope, ok := dropSuppressed(c, suppressions, userDomain, envelope, recipients)
+	if !ok {
+		return nil, false
+	}
+	if len(envelope) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No valid recipients", "recipients": recipients})
+		return nil, false
+	}
+
+	if req.AttachmentSize() > cfg.MaxFileSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Attachments are too large"})
+		return nil, false
+	}
+
+	msg, err := req.Message()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	id := queue.NewID()
+	msg.MessageID = id + "@" + userDomain
+	raw, err := msg.Bytes()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	return &outgoing{
+		id:         id,
+		domain:     userDomain,
+		from:       req.From,
+		envelope:   envelope,
+		recipients: recipients,
+		messageID:  msg.MessageID,
+		raw:        raw,
+	}, true
+}
+
+// authorizeSender checks that the caller may send as from, which is both
+// the From header and the envelope sender of API messages. It writes the
+// error response and returns false if not.
+func authorizeSender(c *gin.Context, senders *auth.SenderPolicy, from string) bool {
+	account := c.MustGet("account").(*storage.User)
+	err := senders.Authorize(c.Request.Context(), account, from)
+	if errors.Is(err, auth.ErrSenderNotAllowed) {
+		logger.Info("Sender rejected", logger.Field("email", account.Email), logger.Field("from", from))
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return false
+	}
+	if err != nil {
+		logger.Error("Failed to check sender", logger.Err(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check sender"})
+		return false
+	}
+	return true
+}
+
+// dropSuppressed removes the addresses domain may no longer send to from
+// envelope and marks them suppressed in statuses. It writes the error
+// response and returns false if the suppression list cannot be read.
+func dropSuppressed(c *gin.Context, suppressions storage.SuppressionRepository, domain string, envelope []string, statuses []email.RecipientStatus) ([]string, bool) {
+	var kept []string
+	reasons := make(map[string]string)
+	for _, addr := range envelope {
+		sup, err := suppressions.Get(c.Request.Context(), domain, addr)
+		if errors.Is(err, storage.ErrNotFound) {
+			kept = append(kept, addr)
+			continue
+		}
+		if err != nil {
+			logger.Error("Failed to check suppressions", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check suppressions"})
+			return nil, false
+		}
+		reasons[strings.ToLower(addr)] = sup.Reason
+	}
+	email.MarkSuppressed(statuses, reasons)
+	return kept, true
+}
+
+// callerEmail returns the email of the authenticated user.
+func callerEmail(c *gin.Context) string {
+	return c.MustGet("account").(*storage.User).Email
+}
+
+// senderDomain returns the lower-case domain of an authorized sender.
+func senderDomain(from string) string {
+	if addr, err := mail.ParseAddress(from); err == nil {
+		from = addr.Address
+	}
+	return strings.ToLower(from[strings.LastIndex(from, "@")+1:])
+}
+
+// callerDomains returns the domains whose messages, suppressions and
+// webhooks the caller manages: the domains they own, as *.name too when
+// the domain covers subdomains, and the domain of their account. It writes
+// the error response and returns false if they cannot be loaded.
+func callerDomains(c *gin.Context, domains storage.DomainRepository) ([]string, bool) {
+	account := c.MustGet("account").(*storage.User)
+	owned, err := domains.ListByOwner(c.Request.Context(), account.Email)
+	if err != nil {
+		logger.Error("Failed to load domains", logger.Err(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load domains"})
+		return nil, false
+	}
+	var names []string
+	if account.Domain != "" {
+		names = append(names, strings.ToLower(account.Domain))
+	}
+	for _, d := range owned {
+		name := strings.ToLower(d.Name)
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+		if d.Subdomains {
+			names = append(names, "*."+name)
+		}
+	}
+	return names, true
+}
+
+// matchDomain reports whether domain is one of names, or a subdomain of a
+// *.name entry.
+func matchDomain(names []string, domain string) bool {
+	domain = strings.ToLower(domain)
+	for _, name := range names {
+		if domain == name || strings.HasPrefix(name, "*.") && strings.HasSuffix(domain, name[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeDomains narrows the caller's domains to the one in the domain query
+// parameter, if any. Subdomain patterns are left out, as suppressions are
+// stored per exact domain. It writes the error response and returns false
+// if the domain is not one of theirs.
+func scopeDomains(c *gin.Context, domains storage.DomainRepository) ([]string, bool) {
+	names, ok := callerDomains(c, domains)
+	if !ok {
+		return nil, false
+	}
+	if domain := strings.ToLower(strings.TrimSuffix(c.Query("domain"), ".")); domain != "" {
+		if !matchDomain(names, domain) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
+			return nil, false
+		}
+		return []string{domain}, true
+	}
+	exact := names[:0:0]
+	for _, name := range names {
+		if !strings.HasPrefix(name, "*.") {
+			exact = append(exact, name)
+		}
+	}
+	return exact, true
+}
+
+func messageResponse(m *storage.Message) gin.H {
+	recipients := make([]gin.H, 0, len(m.Recipients))
+	for _, r := range m.Recipients {
+		rcpt := gin.H{
+			"address":    r.Address,
+			"status":     r.Status,
+			"updated_at": r.UpdatedAt,
+		}
+		if r.DSNStatus != "" {
+			rcpt["dsn_status"] = r.DSNStatus
+		}
+		if r.RemoteMTA != "" {
+			rcpt["remote_mta"] = r.RemoteMTA
+		}
+		if r.Response != "" {
+			rcpt["response"] = r.Response
+		}
+		recipients = append(recipients, rcpt)
+	}
+
+	resp := gin.H{
+		"id":         m.ID,
+		"from":       m.Sender,
+		"status":     m.Status,
+		"attempts":   m.Attempts,
+		"created_at": m.CreatedAt,
+		"updated_at": m.UpdatedAt,
+		"recipients": recipients,
+	}
+	if !m.CompletedAt.IsZero() {
+		resp["completed_at"] = m.CompletedAt
+	}
+	return resp
+}
+
+func getMessageHandler(store storage.Store, outbound *queue.Queue) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		msg, ok := ownMessage(c, store, c.Param("id"))
+		if !ok {
+			return
+		}
+		events, err := store.Events().ListByMessage(c.Request.Context(), msg.ID)
+		if err != nil {
+			logger.Error("Failed to load message events", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load message"})
+			return
+		}
+
+		resp := messageResponse(msg)
+		log := make([]gin.H, 0, len(events))
+		for _, e := range events {
+			entry := gin.H{"type": e.Type, "recipient": e.Recipient, "created_at": e.CreatedAt}
+			if e.Detail != "" {
+				entry["detail"] = e.Detail
+			}
+			log = append(log, entry)
+		}
+		resp["events"] = log
+		// The next attempt is only known to the queue.
+		if queued, ok := outbound.Get(msg.ID); ok && queued.CompletedAt.IsZero() {
+			resp["next_attempt"] = queued.NextAttempt
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// ownMessage loads message id if it was sent from one of the caller's
+// domains. It
+// writes the error response and returns false if not.
+func ownMessage(c *gin.Context, store storage.Store, id string) (*storage.Message, bool) {
+	names, ok := callerDomains(c, store.Domains())
+	if !ok {
+		return nil, false
+	}
+
+	msg, err := store.Messages().Get(c.Request.Context(), id)
+	if errors.Is(err, storage.ErrNotFound) || err == nil && !matchDomain(names, msg.Domain) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return nil, false
+	}
+	if err != nil {
+		logger.Error("Failed to load message", logger.Err(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load message"})
+		return nil, false
+	}
+	return msg, true
+}
+
+// messageRecipient returns the recipient of msg matching addr, ignoring case.
+func messageRecipient(msg *storage.Message, addr string) (string, bool) {
+	for _, r := range msg.Recipients {
+		if strings.EqualFold(r.Address, addr) {
+			return r.Address, true
+		}
+	}
+	return "", false
+}
+
+// recordEngagement logs an event reported after delivery and sends it to
+// the webhooks of the message's domain.
+func recordEngagement(c *gin.Context, recorder *storage.Recorder, webhooks *webhook.Manager, msg *storage.Message, eventType, rcpt, detail string) error {
+	if err := recorder.Engagement(c.Request.Context(), msg, eventType, rcpt, detail); err != nil {
+		return err
+	}
+	webhooks.Emit(&webhook.Event{
+		Type:      eventType,
+		MessageID: msg.ID,
+		Domain:    msg.Domain,
+		From:      msg.Sender,
+		Recipient: rcpt,
+		Attempts:  msg.Attempts,
+		Detail:    detail,
+	})
+	return nil
+}
+
+// reportEventHandler is the hook for the caller's open and click tracking,
+// and for complaints that reach them some other way than a feedback report.
+func reportEventHandler(store storage.Store, recorder *storage.Recorder, webhooks *webhook.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Type      string `json:"type" binding:"required"`
+			Recipient string `json:"recipient" binding:"required"`
+			URL       string `json:"url"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+		switch req.Type {
+		case storage.EventOpened, storage.EventComplained:
+		case storage.EventClicked:
+			if req.URL == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Clicks need the url that was followed"})
+				return
+			}
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown event type", "events": []string{storage.EventOpened, storage.EventClicked, storage.EventComplained}})
+			return
+		}
+
+		msg, ok := ownMessage(c, store, c.Param("id"))
+		if !ok {
+			return
+		}
+		rcpt, ok := messageRecipient(msg, req.Recipient)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not a recipient of the message"})
+			return
+		}
+
+		if err := recordEngagement(c, recorder, webhooks, msg, req.Type, rcpt, req.URL); err != nil {
+			logger.Error("Failed to record message event", logger.Field("id", msg.ID), logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record event"})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"message": "Event recorded"})
+	}
+}
+
+// feedbackHandler takes an abuse report (RFC 5965) forwarded from a
+// mailbox provider's feedback loop and records a complaint for each
+// recipient it names.
+func feedbackHandler(cfg *config.Config, store storage.Store, recorder *storage.Recorder, webhooks *webhook.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		raw, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, int64(cfg.MaxFileSize)))
+		if err != nil {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Report is too large"})
+			return
+		}
+		report, err := email.ParseFeedbackReport(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Our Message-IDs are the queue ID at the sending domain.
+		id, _, _ := strings.Cut(report.MessageID, "@")
+		if id == "" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+			return
+		}
+		msg, ok := ownMessage(c, store, id)
+		if !ok {
+			return
+		}
+
+		var recorded []string
+		for _, addr := range report.Recipients {
+			rcpt, ok := messageRecipient(msg, addr)
+			if !ok {
+				continue
+			}
+			if err := recordEngagement(c, recorder, webhooks, msg, storage.EventComplained, rcpt, report.FeedbackType); err != nil {
+				logger.Error("Failed to record complaint", logger.Field("id", msg.ID), logger.Err(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record complaint"})
+				return
+			}
+			recorded = append(recorded, rcpt)
+		}
+		if len(recorded) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "The report names no recipient of the message"})
+			return
+		}
+		logger.Info("Complaint recorded", logger.Field("id", msg.ID), logger.Field("to", recorded), logger.Field("type", report.FeedbackType))
+		c.JSON(http.StatusAccepted, gin.H{"message": "Complaint recorded", "id": msg.ID, "recipients": recorded})
+	}
+}
+
+func listMessagesHandler(messages storage.MessageRepository, domains storage.DomainRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		names, ok := callerDomains(c, domains)
+		if !ok {
+			return
+		}
+		if domain := c.Query("domain"); domain != "" {
+			if !matchDomain(names, domain) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
+				return
+			}
+			names = []string{domain}
+		}
+		if len(names) == 0 {
+			c.JSON(http.StatusOK, gin.H{"messages": []gin.H{}, "total": 0, "limit": 50, "offset": 0})
+			return
+		}
+
+		filter := storage.MessageFilter{
+			Domains:   names,
+			Status:    c.Query("status"),
+			Sender:    c.Query("from"),
+			Recipient: c.Query("to"),
+			Limit:     50,
+		}
+		switch filter.Status {
+		case "", queue.StatusQueued, queue.StatusSending, queue.StatusDelivered,
+			queue.StatusDeferred, queue.StatusBounced, queue.StatusFailed:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
+			return
+		}
+
+		var err error
+		if v := c.Query("since"); v != "" {
+			if filter.Since, err = time.Parse(time.RFC3339, v); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid since, expected RFC 3339 time"})
+				return
+			}
+		}
+		if v := c.Query("until"); v != "" {
+			if filter.Until, err = time.Parse(time.RFC3339, v); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid until, expected RFC 3339 time"})
+				return
+			}
+		}
+		if v := c.Query("limit"); v != "" {
+			if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 1 || filter.Limit > 500 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit, expected 1 to 500"})
+				return
+			}
+		}
+		if v := c.Query("offset"); v != "" {
+			if filter.Offset, err = strconv.Atoi(v); err != nil || filter.Offset < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset"})
+				return
+			}
+		}
+
+		list, total, err := messages.List(c.Request.Context(), filter)
+		if err != nil {
+			logger.Error("Failed to list messages", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list messages"})
+			return
+		}
+		results := make([]gin.H, 0, len(list))
+		for _, m := range list {
+			results = append(results, messageResponse(m))
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"messages": results,
+			"total":    total,
+			"limit":    filter.Limit,
+			"offset":   filter.Offset,
+		})
+	}
+}
+
+func listSuppressionsHandler(suppressions storage.SuppressionRepository, domains storage.DomainRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		names, ok := scopeDomains(c, domains)
+		if !ok {
+			return
+		}
+
+		results := make([]gin.H, 0)
+		for _, domain := range names {
+			list, err := suppressions.List(c.Request.Context(), domain)
+			if err != nil {
+				logger.Error("Failed to list suppressions", logger.Err(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list suppressions"})
+				return
+			}
+			for _, sup := range list {
+				results = append(results, gin.H{"domain": sup.Domain, "address": sup.Address, "reason": sup.Reason, "created_at": sup.CreatedAt})
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"suppressions": results})
+	}
+}
+
+// deleteSuppressionHandler lets the caller's domains, or the one given in
+// the domain parameter, send to an address again.
+func deleteSuppressionHandler(suppressions storage.SuppressionRepository, domains storage.DomainRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		names, ok := scopeDomains(c, domains)
+		if !ok {
+			return
+		}
+
+		removed := 0
+		for _, domain := range names {
+			err := suppressions.Delete(c.Request.Context(), domain, c.Param("address"))
+			if errors.Is(err, storage.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				logger.Error("Failed to delete suppression", logger.Err(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete suppression"})
+				return
+			}
+			removed++
+		}
+		if removed == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Address is not suppressed"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Suppression removed"})
+	}
+}
+
+func createWebhookHandler(webhooks *webhook.Manager, domains storage.DomainRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			URL    string   `json:"url" binding:"required"`
+			Domain string   `json:"domain"`
+			Events []string `json:"events"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		names, ok := callerDomains(c, domains)
+		if !ok {
+			return
+		}
+		userDomain := strings.ToLower(strings.TrimSuffix(req.Domain, "."))
+		if userDomain == "" {
+			userDomain = strings.ToLower(c.MustGet("account").(*storage.User).Domain)
+		}
+		if userDomain == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Specify the domain whose events the webhook receives"})
+			return
+		}
+		if !matchDomain(names, userDomain) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Not one of your domains"})
+			return
+		}
+
+		hook, err := webhooks.Create(callerEmail(c), userDomain, req.URL, req.Events)
+		if errors.Is(err, webhook.ErrInvalidURL) || errors.Is(err, webhook.ErrPrivateURL) || errors.Is(err, webhook.ErrInvalidEvent) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "events": webhook.Events})
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to register webhook", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register webhook"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, hook)
+	}
+}
+
+func listWebhooksHandler(webhooks *webhook.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		hooks := webhooks.List(callerEmail(c))
+		results := make([]gin.H, 0, len(hooks))
+		for _, h := range hooks {
+			results = append(results, gin.H{
+				"id":         h.ID,
+				"url":        h.URL,
+				"events":     h.Events,
+				"created_at": h.CreatedAt,
+			})
+		}
+		c.JSON(http.StatusOK, gin.H{"webhooks": results})
+	}
+}
+
+func deleteWebhookHandler(webhooks *webhook.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := webhooks.Delete(callerEmail(c), c.Param("id"))
+		if errors.Is(err, webhook.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to delete webhook", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted"})
+	}
+}
+
+func webhookDeliveriesHandler(webhooks *webhook.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := 50
+		if v := c.Query("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 500 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit, expected 1 to 500"})
+				return
+			}
+			limit = n
+		}
+
+		deliveries, err := webhooks.Deliveries(callerEmail(c), c.Param("id"), limit)
+		if errors.Is(err, webhook.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+	}
+}
+
+func routeResponse(r *webhook.Route) gin.H {
+	return gin.H{
+		"id":          r.ID,
+		"domain":      r.Domain,
+		"match":       r.Match,
+		"pattern":     r.Pattern,
+		"url":         r.URL,
+		"priority":    r.Priority,
+		"include_raw": r.IncludeRaw,
+		"reject":      r.Reject,
+		"created_at":  r.CreatedAt,
+	}
+}
+
+func createRouteHandler(webhooks *webhook.Manager, senders *auth.SenderPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Domain     string   `json:"domain" binding:"required"`
+			Match      string   `json:"match" binding:"required"`
+			Pattern    string   `json:"pattern"`
+			URL        string   `json:"url" binding:"required"`
+			Priority   int      `json:"priority"`
+			IncludeRaw bool     `json:"include_raw"`
+			Reject     []string `json:"reject"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		account := c.MustGet("account").(*storage.User)
+		owns, err := senders.OwnsDomain(c.Request.Context(), account, req.Domain)
+		if err != nil {
+			logger.Error("Failed to check domain ownership", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register route"})
+			return
+		}
+		if !owns {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Domain is not a verified domain of the user"})
+			return
+		}
+
+		route, err := webhooks.CreateRoute(callerEmail(c), &webhook.Route{
+			Domain:     req.Domain,
+			Match:      req.Match,
+			Pattern:    req.Pattern,
+			URL:        req.URL,
+			Priority:   req.Priority,
+			IncludeRaw: req.IncludeRaw,
+			Reject:     req.Reject,
+		})
+		if errors.Is(err, webhook.ErrInvalidURL) || errors.Is(err, webhook.ErrPrivateURL) || errors.Is(err, webhook.ErrInvalidRoute) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "match_types": webhook.MatchTypes, "reject_conditions": webhook.RejectConditions})
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to register route", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register route"})
+			return
+		}
+
+		resp := routeResponse(route)
+		resp["secret"] = route.Secret
+		c.JSON(http.StatusCreated, resp)
+	}
+}
+
+func listRoutesHandler(webhooks *webhook.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		routes := webhooks.Routes(callerEmail(c))
+		results := make([]gin.H, 0, len(routes))
+		for _, r := range routes {
+			results = append(results, routeResponse(r))
+		}
+		c.JSON(http.StatusOK, gin.H{"routes": results})
+	}
+}
+
+func deleteRouteHandler(webhooks *webhook.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := webhooks.DeleteRoute(callerEmail(c), c.Param("id"))
+		if errors.Is(err, webhook.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to delete route", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete route"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Route deleted"})
+	}
+}
+
+func verifyDomainHandler(cfg *config.Config, sender *email.Sender, domains storage.DomainRepository, claims storage.DomainClaimRepository) gin.HandlerFunc {
+	var sendingIPs []net.IP
+	for _, ip := range cfg.SendingIPs {
+		sendingIPs = append(sendingIPs, net.ParseIP(ip))
+	}
+	return func(c *gin.Context) {
+		var req struct {
+			Domain       string `json:"domain" binding:"required"`
+			DKIMSelector string `json:"dkim_selector"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		// Only the caller's own domain and the domains they added or claimed
+		// are checked
+		account := c.MustGet("account").(*storage.User)
+		name := strings.ToLower(strings.TrimSuffix(req.Domain, "."))
+		if name != strings.ToLower(account.Domain) {
+			d, err := domains.Get(c.Request.Context(), name)
+			if errors.Is(err, storage.ErrNotFound) || err == nil && d.OwnerEmail != account.Email {
+				_, err = claims.Get(c.Request.Context(), name, account.Email)
+			}
+			if errors.Is(err, storage.ErrNotFound) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Domain is not one of your domains; add it through /api/v1/domains first"})
+				return
+			}
+			if err != nil {
+				logger.Error("Failed to load domain", logger.Err(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify domain"})
+				return
+			}
+		}
+
+		results := make(map[string]string)
+
+		// Check MX record (essential)
+		if err := domainVerifier.VerifyMXRecord(name); err == nil {
+			results["MX"] = "Valid"
+		} else {
+			results["MX"] = fmt.Sprintf("Invalid: %v", err)
+		}
+
+		// Check SPF record (recommended), and that our sending IPs pass it
+		if err := domainVerifier.VerifySPFRecord(name, sendingIPs...); err == nil {
+			results["SPF"] = "Valid"
+		} else {
+			results["SPF"] = fmt.Sprintf("Invalid: %v", err)
+		}
+
+		// Check DMARC record (recommended) and explain what it enforces
+		var dmarc gin.H
+		if rec, at, err := domainVerifier.VerifyDMARCRecord(name); err == nil {
+			results["DMARC"] = "Valid"
+			dmarc = dmarcResponse(name, rec, at)
+		} else {
+			results["DMARC"] = fmt.Sprintf("Invalid: %v", err)
+		}
+
+		// Check the DKIM key of the given selector, or of the one in use
+		var dkim gin.H
+		selector := req.DKIMSelector
+		if selector == "" {
+			selector = sender.ActiveDKIMSelector(name)
+		}
+		if selector != "" {
+			key := sender.DKIMKey(name, selector)
+			rec, err := domainVerifier.VerifyDKIMRecord(name, selector, key)
+			if err == nil {
+				results["DKIM"] = "Valid"
+			} else {
+				results["DKIM"] = fmt.Sprintf("Invalid: %v", err)
+			}
+			dkim = dkimResponse(selector, rec)
+			dkim["active"] = sender.ActiveDKIMSelector(name) == selector
+		}
+
+		// Determine overall status
+		if results["MX"] == "Valid" {
+			status := "Domain verified for sending"
+			if results["SPF"] == "Valid" {
+				status += " with SPF"
+			} else {
+				status += " (SPF recommended)"
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"message": status,
+				"results": results,
+				"dkim":    dkim,
+				"dmarc":   dmarc,
+			})
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Domain not verified for sending",
+				"results": results,
+				"dkim":    dkim,
+				"dmarc":   dmarc,
+			})
+		}
+	}
+}
+
+// dkimResponse describes the key record published for selector; rec is
+// nil when none could be parsed.
+func dkimResponse(selector string, rec *domainVerifier.DKIMKeyRecord) gin.H {
+	resp := gin.H{"selector": selector}
+	if rec != nil {
+		resp["key_type"] = rec.KeyType
+		resp["bits"] = rec.Bits()
+		resp["revoked"] = rec.Revoked()
+		resp["testing"] = rec.Testing
+		resp["strict_identity"] = rec.StrictIdentity
+		resp["hash_algorithms"] = rec.HashAlgorithms
+		resp["service_types"] = rec.ServiceTypes
+	}
+	return resp
+}
+
+// activateDKIMKeyHandler makes a key generated for one of the caller's
+// verified domains sign its mail, once its record is published and matches.
+func activateDKIMKeyHandler(sender *email.Sender, domains storage.DomainRepository, senders *auth.SenderPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		domain := strings.ToLower(strings.TrimSuffix(c.Param("domain"), "."))
+		selector := strings.ToLower(c.Param("selector"))
+
+		owns, err := senders.OwnsDomain(ctx, c.MustGet("account").(*storage.User), domain)
+		if err != nil {
+			logger.Error("Failed to check domain ownership", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to activate DKIM key"})
+			return
+		}
+		if !owns {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Domain is not a verified domain of the user"})
+			return
+		}
+		key := sender.DKIMKey(domain, selector)
+		if key == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No DKIM key was generated for this selector"})
+			return
+		}
+		if _, err := domainVerifier.VerifyDKIMRecord(domain, selector, key); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("DKIM record is not ready: %v", err)})
+			return
+		}
+
+		d, err := domains.Get(ctx, domain)
+		if err != nil {
+			logger.Error("Failed to load domain", logger.Field("domain", domain), logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to activate DKIM key"})
+			return
+		}
+		d.DKIMSelector = selector
+		if err := domains.Update(ctx, d); err != nil {
+			logger.Error("Failed to update DKIM selector", logger.Field("domain", d.Name), logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to activate DKIM key"})
+			return
+		}
+		if err := sender.ActivateDKIMKey(d.Name, selector); err != nil {
+			logger.Error("Failed to activate DKIM key", logger.Field("domain", d.Name), logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to activate DKIM key"})
+			return
+		}
+		logger.Info("DKIM key activated", logger.Field("domain", d.Name), logger.Field("selector", selector), logger.Field("by", callerEmail(c)))
+		c.JSON(http.StatusOK, gin.H{"domain": d.Name, "selector": selector, "active": true})
+	}
+}
+
+// newResolver returns the resolver for domain checks: the configured
+// servers, or those in /etc/resolv.conf, behind a cache unless it is
+// disabled.
+func newResolver(cfg config.DNSConfig) (domainVerifier.Resolver, error) {
+	client, err := domainVerifier.NewClient(cfg.Servers, time.Duration(cfg.Timeout)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.DisableCache {
+		return client, nil
+	}
+	maxTTL, negativeTTL := 300, 60
+	if cfg.MaxTTL > 0 {
+		maxTTL = cfg.MaxTTL
+	}
+	if cfg.NegativeTTL > 0 {
+		negativeTTL = cfg.NegativeTTL
+	}
+	logger.Info("DNS cache enabled", logger.Field("servers", cfg.Servers), logger.Field("maxTTL", maxTTL), logger.Field("negativeTTL", negativeTTL))
+	return domainVerifier.NewCache(client, time.Duration(maxTTL)*time.Second, time.Duration(negativeTTL)*time.Second), nil
+}
+
+// activateDKIMKeys restores the DKIM selector recorded for each verified
+// domain.
+func activateDKIMKeys(domains storage.DomainRepository, sender *email.Sender) error {
+	list, err := domains.List(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, d := range list {
+		if d.DKIMSelector == "" || !d.Verified {
+			continue
+		}
+		if err := sender.ActivateDKIMKey(d.Name, d.DKIMSelector); err != nil {
+			logger.Error("Domain has no key for its DKIM selector", logger.Field("domain", d.Name), logger.Field("selector", d.DKIMSelector), logger.Err(err))
+		}
+	}
+	return nil
+}
+
+func generateDKIMKeyHandler(sender *email.Sender, senders *auth.SenderPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Selector  string `json:"selector"`
+			Algorithm string `json:"algorithm"`
+			Bits      int    `json:"bits"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+		if req.Selector == "" {
+			req.Selector = "eb" + time.Now().UTC().Format("20060102")
+		}
+		if req.Algorithm == "" {
+			req.Algorithm = "rsa"
+		}
+		if req.Bits == 0 && req.Algorithm == "rsa" {
+			req.Bits = 2048
+		}
+
+		domain := strings.ToLower(c.Param("domain"))
+		owns, err := senders.OwnsDomain(c.Request.Context(), c.MustGet("account").(*storage.User), domain)
+		if err != nil {
+			logger.Error("Failed to check domain ownership", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate DKIM key"})
+			return
+		}
+		if !owns {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Domain is not a verified domain of the user"})
+			return
+		}
+
+		key, err := sender.GenerateDKIMKey(domain, req.Selector, req.Algorithm, req.Bits)
+		if errors.Is(err, email.ErrInvalidDKIMKeyParam) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, email.ErrDKIMKeyExists) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to generate DKIM key", logger.Field("domain", domain), logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate DKIM key"})
+			return
+		}
+		record, err := domainVerifier.DKIMKeyRecordFor(key)
+		if err != nil {
+			logger.Error("Failed to format DKIM record", logger.Field("domain", domain), logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate DKIM key"})
+			return
+		}
+
+		logger.Info("DKIM key generated", logger.Field("domain", domain), logger.Field("selector", req.Selector), logger.Field("by", callerEmail(c)))
+		c.JSON(http.StatusCreated, gin.H{
+			"domain":   domain,
+			"selector": strings.ToLower(req.Selector),
+			"name":     strings.ToLower(req.Selector) + "._domainkey." + domain,
+			"type":     "TXT",
+			"value":    record,
+			"strings":  domainVerifier.SplitTXT(record), // 255 byte chunks for DNS providers that need them
+		})
+	}
+}
+
+// dmarcResponse reports the policy a DMARC record enforces on mail from
+// domain, which may have inherited it from its organizational domain.
+func dmarcResponse(domain string, rec *domainVerifier.DMARCRecord, at string) gin.H {
+	uris := func(list []domainVerifier.ReportURI) []gin.H {
+		out := make([]gin.H, 0, len(list))
+		for _, u := range list {
+			out = append(out, gin.H{"uri": u.URI, "max_size": u.MaxSize})
+		}
+		return out
+	}
+	return gin.H{
+		"record_domain":    at,
+		"inherited":        !strings.EqualFold(strings.TrimSuffix(domain, "."), at),
+		"policy":           rec.AppliedPolicy(domain, at),
+		"domain_policy":    rec.Policy,
+		"subdomain_policy": rec.SubdomainPolicy,
+		"percent":          rec.Percent,
+		"dkim_alignment":   rec.DKIMAlignment,
+		"spf_alignment":    rec.SPFAlignment,
+		"aggregate_uris":   uris(rec.AggregateURIs),
+		"failure_uris":     uris(rec.FailureURIs),
+		"failure_options":  rec.FailureOptions,
+		"report_interval":  int(rec.ReportInterval.Seconds()), // seconds
+		"summary":          rec.Describe(),
+	}
+}
+
+func verifySenderHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Email string `json:"email" binding:"required,email"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		isValid, err := auth.VerifyEmail(req.Email)
+		if err != nil {
+			logger.Error("Failed to verify email", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+			return
+		}
+
+		if !isValid {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email or domain not properly configured"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Email verified successfully"})
+	}
+}
+
+// sendVerifiedEmailHandler hands the message to the recipients' MX hosts
+// while the caller waits, reporting which recipients were sent or rejected.
+// The message is tracked by the queue like any other, so recipients whose
+// hosts fail temporarily are retried under the same ID.
+func sendVerifiedEmailHandler(outbound *queue.Queue, cfg *config.Config, senders *auth.SenderPolicy, suppressions storage.SuppressionRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		out, ok := prepareSend(c, cfg, senders, suppressions)
+		if !ok {
+			return
+		}
+		recipients := out.recipients
+
+		msg := queue.NewMessage(out.from, out.envelope)
+		msg.ID = out.id
+		msg.Domain = out.domain
+		results, err := outbound.Submit(msg, out.raw)
+		if err != nil {
+			logger.Error("Failed to queue email", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send email"})
+			return
+		}
+		email.ApplyResults(recipients, results)
+
+		sent, queued := 0, 0
+		for _, r := range recipients {
+			switch r.Status {
+			case email.RecipientSent:
+				sent++
+			case email.RecipientQueued:
+				queued++
+			}
+		}
+		resp := gin.H{"id": out.id, "message_id": "<" + out.messageID + ">", "recipients": recipients}
+		switch {
+		case queued > 0:
+			resp["message"] = "Email sent, some recipients are queued for retry"
+			c.JSON(http.StatusAccepted, resp)
+		case sent > 0:
+			resp["message"] = "Email sent successfully"
+			c.JSON(http.StatusOK, resp)
+		default:
+			resp["error"] = "No recipient accepted the email"
+			c.JSON(http.StatusBadGateway, resp)
+		}
+	}
+}
+
+// jwksHandler publishes the token verification keys for other services.
+func jwksHandler(tokens *auth.Tokens) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, tokens.JWKS())
+	}
+}
+
+func tokenResponse(pair *auth.TokenPair) gin.H {
+	return gin.H{
+		"token":              pair.AccessToken,
+		"token_type":         "Bearer",
+		"expires_at":         pair.AccessExpiresAt,
+		"refresh_token":      pair.RefreshToken,
+		"refresh_expires_at": pair.RefreshExpiresAt,
+	}
+}
+
+func loginHandler(tokens *auth.Tokens, users storage.UserRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Email    string `json:"email" binding:"required,email"`
+			Password string `json:"password" binding:"required"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		user, err := auth.AuthenticateUser(c.Request.Context(), users, req.Email, req.Password)
+		if err != nil {
+			logger.Error("Authentication failed", logger.Err(err))
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+			return
+		}
+
+		pair, err := tokens.Issue(c.Request.Context(), user)
+		if err != nil {
+			logger.Error("Failed to generate token", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+			return
+		}
+
+		c.JSON(http.StatusOK, tokenResponse(pair))
+	}
+}
+
+func refreshTokenHandler(tokens *auth.Tokens) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			RefreshToken string `json:"refresh_token" binding:"required"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		pair, err := tokens.Refresh(c.Request.Context(), req.RefreshToken)
+		if errors.Is(err, auth.ErrInvalidToken) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to refresh token", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh token"})
+			return
+		}
+
+		c.JSON(http.StatusOK, tokenResponse(pair))
+	}
+}
+
+// logoutHandler ends the caller's session. The refresh token is optional;
+// without it only the access token is revoked.
+func logoutHandler(tokens *auth.Tokens) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+				return
+			}
+		}
+
+		claims := c.MustGet("user").(*jwt.MapClaims)
+		if err := tokens.Logout(c.Request.Context(), claims, req.RefreshToken); err != nil {
+			logger.Error("Failed to log out", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+	}
+}
+
+func logoutAllHandler(tokens *auth.Tokens) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := tokens.LogoutAll(c.Request.Context(), callerEmail(c)); err != nil {
+			logger.Error("Failed to log out all sessions", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+			return
+		}
+
+		logger.Info("Logged out all sessions", logger.Field("email", callerEmail(c)))
+		c.JSON(http.StatusOK, gin.H{"message": "Logged out of all sessions"})
+	}
+}
+
+func apiKeyResponse(k *storage.APIKey) gin.H {
+	resp := gin.H{
+		"id":         k.ID,
+		"name":       k.Name,
+		"prefix":     k.Prefix,
+		"scopes":     k.Scopes,
+		"created_at": k.CreatedAt,
+	}
+	if !k.ExpiresAt.IsZero() {
+		resp["expires_at"] = k.ExpiresAt
+	}
+	if !k.LastUsedAt.IsZero() {
+		resp["last_used_at"] = k.LastUsedAt
+	}
+	if !k.RevokedAt.IsZero() {
+		resp["revoked_at"] = k.RevokedAt
+	}
+	return resp
+}
+
+func createAPIKeyHandler(keys storage.APIKeyRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Name      string     `json:"name" binding:"required,max=100"`
+			Scopes    []string   `json:"scopes"`
+			ExpiresAt *time.Time `json:"expires_at"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		var expires time.Time
+		if req.ExpiresAt != nil {
+			if !req.ExpiresAt.After(time.Now()) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+				return
+			}
+			expires = *req.ExpiresAt
+		}
+
+		k, secret, err := auth.CreateAPIKey(c.Request.Context(), keys, callerEmail(c), req.Name, req.Scopes, expires)
+		if errors.Is(err, auth.ErrInvalidScope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "scopes": auth.Scopes})
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to create API key", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+			return
+		}
+
+		logger.Info("API key created", logger.Field("email", callerEmail(c)), logger.Field("key", k.Prefix))
+		resp := apiKeyResponse(k)
+		resp["key"] = secret
+		c.JSON(http.StatusCreated, resp)
+	}
+}
+
+func listAPIKeysHandler(keys storage.APIKeyRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		list, err := keys.ListByUser(c.Request.Context(), callerEmail(c))
+		if err != nil {
+			logger.Error("Failed to list API keys", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list API keys"})
+			return
+		}
 
-	go func() {
-		if err := smtp.StartSMTPServer(cfg, sender); err != nil {
-			logger.Error("Failed to start SMTP server", logger.Err(err))
-			logger.Fatal("Exiting due to SMTP server failure")
-		} else {
-			logger.Info("SMTP server started successfully")
+		results := make([]gin.H, 0, len(list))
+		for _, k := range list {
+			results = append(results, apiKeyResponse(k))
 		}
-	}()
+		c.JSON(http.StatusOK, gin.H{"keys": results})
+	}
+}
 
-	r := gin.Default()
-	r.Use(gin.Recovery())
+func revokeAPIKeyHandler(keys storage.APIKeyRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		k, err := keys.Get(c.Request.Context(), c.Param("id"))
+		if errors.Is(err, storage.ErrNotFound) || (err == nil && k.UserEmail != callerEmail(c)) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to load API key", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+			return
+		}
 
-	api := r.Group("/api/v1")
-	{
-		api.POST("/send", rateLimitMiddleware(rateLimiter), authMiddleware(cfg), sendEmailHandler(sender, cfg))
-		api.POST("/verify", rateLimitMiddleware(rateLimiter), authMiddleware(cfg), verifyDomainHandler())
-		api.POST("/verify-sender", rateLimitMiddleware(rateLimiter), authMiddleware(cfg), verifySenderHandler())
-		api.POST("/send-verified", rateLimitMiddleware(rateLimiter), authMiddleware(cfg), sendVerifiedEmailHandler(sender))
+		err = keys.Revoke(c.Request.Context(), k.ID, time.Now())
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusConflict, gin.H{"error": "API key is already revoked"})
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to revoke API key", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+			return
+		}
+
+		logger.Info("API key revoked", logger.Field("email", callerEmail(c)), logger.Field("key", k.Prefix))
+		c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
 	}
+}
 
-	auth := r.Group("/auth")
-	{
-		auth.POST("/login", rateLimitMiddleware(rateLimiter), loginHandler(cfg))
-		auth.POST("/refresh", rateLimitMiddleware(rateLimiter), refreshTokenHandler(cfg))
+func userResponse(u *storage.User) gin.H {
+	return gin.H{
+		"email":           u.Email,
+		"domain":          u.Domain,
+		"admin":           u.Admin,
+		"disabled":        u.Disabled,
+		"allowed_senders": u.AllowedSenders,
+		"scram":           u.SCRAMSHA256 != "",
+		"created_at":      u.CreatedAt,
+		"updated_at":      u.UpdatedAt,
 	}
+}
 
-	logger.Info("Starting API server", logger.Field("port", cfg.APIPort))
-	if err := r.Run(fmt.Sprintf(":%d", cfg.APIPort)); err != nil {
-		logger.Fatal("Failed to start API server", logger.Err(err))
+func listUsersHandler(users storage.UserRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		list, err := users.List(c.Request.Context())
+		if err != nil {
+			logger.Error("Failed to list users", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list users"})
+			return
+		}
+
+		results := make([]gin.H, 0, len(list))
+		for _, u := range list {
+			results = append(results, userResponse(u))
+		}
+		c.JSON(http.StatusOK, gin.H{"users": results})
 	}
 }
 
-func sendEmailHandler(sender *email.Sender, cfg *config.Config) gin.HandlerFunc {
+func createUserHandler(users storage.UserRepository) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var req email.SendRequest
+		var req struct {
+			Email    string `json:"email" binding:"required,email"`
+			Password string `json:"password" binding:"required,min=8"`
+			Domain   string `json:"domain" binding:"required,fqdn"`
+			Admin    bool   `json:"admin"`
+			// AllowedSenders optionally restricts the From addresses.
+			AllowedSenders []string `json:"allowed_senders"`
+			// SCRAM enables SCRAM-SHA-256 for SMTP AUTH.
+			SCRAM bool `json:"scram"`
+		}
+
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 			return
 		}
-
-		if err := req.Validate(); err != nil {
+		if err := auth.ValidateAllowedSenders(req.AllowedSenders); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		userClaims, _ := c.Get("user")
-		claims := userClaims.(*jwt.MapClaims)
-		userEmail := (*claims)["email"].(string)
-		logger.Info("User email", logger.Field("email", userClaims));
-		var userDomain string
-		for _, u := range cfg.Users {
-			if u.Email == userEmail {
-				userDomain = u.Domain
-				break
-			}
+		u := &storage.User{
+			Email:          req.Email,
+			Domain:         strings.ToLower(req.Domain),
+			Admin:          req.Admin,
+			AllowedSenders: req.AllowedSenders,
+		}
+		if err := auth.SetPassword(u, req.Password, req.SCRAM); err != nil {
+			logger.Error("Failed to hash password", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+			return
 		}
 
-		if userDomain == "" {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "User domain not found"})
+		err := users.Create(c.Request.Context(), u)
+		if errors.Is(err, storage.ErrConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to create user", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 			return
 		}
 
-		if err := sender.Send(req.From, req.To, req.Subject, req.Body, req.HTML, userDomain); err != nil {
-			logger.Error("Failed to send email", logger.Err(err))
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send email"})
+		logger.Info("User created", logger.Field("email", u.Email), logger.Field("by", callerEmail(c)))
+		c.JSON(http.StatusCreated, userResponse(u))
+	}
+}
+
+func setUserDisabledHandler(users storage.UserRepository, disabled bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		email := c.Param("email")
+		if disabled && email == callerEmail(c) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot disable your own account"})
+			return
+		}
+
+		u, err := users.Get(c.Request.Context(), email)
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to load user", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+			return
+		}
+
+		u.Disabled = disabled
+		if err := users.Update(c.Request.Context(), u); err != nil {
+			logger.Error("Failed to update user", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"message": "Email sent successfully"})
+		logger.Info("User updated", logger.Field("email", u.Email), logger.Field("disabled", disabled), logger.Field("by", callerEmail(c)))
+		c.JSON(http.StatusOK, userResponse(u))
 	}
 }
 
-func verifyDomainHandler() gin.HandlerFunc {
+func resetPasswordHandler(users storage.UserRepository, tokens *auth.Tokens) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req struct {
-			Domain string `json:"domain" binding:"required"`
+			Password string `json:"password" binding:"required,min=8"`
+			SCRAM    bool   `json:"scram"`
 		}
 
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -110,100 +1700,211 @@ func verifyDomainHandler() gin.HandlerFunc {
 			return
 		}
 
-		results := make(map[string]string)
-
-		// Check MX record (essential)
-		if err := domainVerifier.VerifyMXRecord(req.Domain); err == nil {
-			results["MX"] = "Valid"
-		} else {
-			results["MX"] = fmt.Sprintf("Invalid: %v", err)
+		u, err := users.Get(c.Request.Context(), c.Param("email"))
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
 		}
-
-		// Check SPF record (recommended)
-		if err := domainVerifier.VerifySPFRecord(req.Domain); err == nil {
-			results["SPF"] = "Valid"
-		} else {
-			results["SPF"] = fmt.Sprintf("Invalid: %v", err)
+		if err != nil {
+			logger.Error("Failed to load user", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+			return
 		}
 
-		// Determine overall status
-		if results["MX"] == "Valid" {
-			status := "Domain verified for sending"
-			if results["SPF"] == "Valid" {
-				status += " with SPF"
-			} else {
-				status += " (SPF recommended)"
-			}
-			c.JSON(http.StatusOK, gin.H{
-				"message": status,
-				"results": results,
-			})
-		} else {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error":   "Domain not verified for sending",
-				"results": results,
-			})
+		if err := auth.SetPassword(u, req.Password, req.SCRAM); err != nil {
+			logger.Error("Failed to hash password", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+			return
 		}
+		if err := users.Update(c.Request.Context(), u); err != nil {
+			logger.Error("Failed to update user", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+			return
+		}
+		if err := tokens.LogoutAll(c.Request.Context(), u.Email); err != nil {
+			logger.Error("Failed to revoke sessions after password reset", logger.Field("email", u.Email), logger.Err(err))
+		}
+
+		logger.Info("Password reset", logger.Field("email", u.Email), logger.Field("by", callerEmail(c)))
+		c.JSON(http.StatusOK, gin.H{"message": "Password updated"})
 	}
 }
 
-func verifySenderHandler() gin.HandlerFunc {
+// setAllowedSendersHandler replaces a user's sender allowlist. An empty
+// list lifts the restriction.
+func setAllowedSendersHandler(users storage.UserRepository) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req struct {
-			Email string `json:"email" binding:"required,email"`
+			AllowedSenders []string `json:"allowed_senders"`
 		}
 
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 			return
 		}
+		if err := auth.ValidateAllowedSenders(req.AllowedSenders); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
-		isValid, err := auth.VerifyEmail(req.Email)
+		u, err := users.Get(c.Request.Context(), c.Param("email"))
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
 		if err != nil {
-			logger.Error("Failed to verify email", logger.Err(err))
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+			logger.Error("Failed to load user", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
 			return
 		}
 
-		if !isValid {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email or domain not properly configured"})
+		u.AllowedSenders = req.AllowedSenders
+		if err := users.Update(c.Request.Context(), u); err != nil {
+			logger.Error("Failed to update user", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"message": "Email verified successfully"})
+		logger.Info("Allowed senders updated", logger.Field("email", u.Email), logger.Field("by", callerEmail(c)))
+		c.JSON(http.StatusOK, userResponse(u))
+	}
+}
+
+func domainResponse(d *storage.Domain) gin.H {
+	resp := gin.H{
+		"name":       d.Name,
+		"owner":      d.OwnerEmail,
+		"verified":   d.Verified,
+		"subdomains": d.Subdomains,
+		"created_at": d.CreatedAt,
+	}
+	if !d.VerifiedAt.IsZero() {
+		resp["verified_at"] = d.VerifiedAt
+	}
+	if !d.CheckedAt.IsZero() {
+		resp["checked_at"] = d.CheckedAt
+	}
+	if !d.FailingSince.IsZero() {
+		resp["failing_since"] = d.FailingSince
+	}
+	return resp
+}
+
+func listDomainsHandler(domains storage.DomainRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		list, err := domains.List(c.Request.Context())
+		if err != nil {
+			logger.Error("Failed to list domains", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list domains"})
+			return
+		}
+
+		results := make([]gin.H, 0, len(list))
+		for _, d := range list {
+			results = append(results, domainResponse(d))
+		}
+		c.JSON(http.StatusOK, gin.H{"domains": results})
 	}
 }
 
-func sendVerifiedEmailHandler(sender *email.Sender) gin.HandlerFunc {
+// createDomainHandler grants a user a sending domain. The administrator
+// vouches for it, so it counts as verified unless verified is false.
+func createDomainHandler(users storage.UserRepository, domains storage.DomainRepository) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var req email.SendRequest
+		var req struct {
+			Name       string `json:"name" binding:"required,fqdn"`
+			Owner      string `json:"owner" binding:"required,email"`
+			Verified   *bool  `json:"verified"`
+			Subdomains bool   `json:"subdomains"`
+		}
+
 		if err := c.ShouldBindJSON(&req); err != nil {
-			logger.Error("Failed to bind JSON", logger.Err(err))
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 			return
 		}
 
-		if err := req.Validate(); err != nil {
-			logger.Error("Invalid request", logger.Err(err))
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if _, err := users.Get(c.Request.Context(), req.Owner); errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Owner not found"})
+			return
+		} else if err != nil {
+			logger.Error("Failed to load user", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create domain"})
 			return
 		}
 
-		if err := sender.SendWithVerifiedSender(req.From, req.To, req.Subject, req.Body, req.ReplyTo); err != nil {
-			logger.Error("Failed to send email", logger.Err(err))
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send email"})
+		d := &storage.Domain{
+			Name:       strings.ToLower(req.Name),
+			OwnerEmail: req.Owner,
+			Verified:   req.Verified == nil || *req.Verified,
+			Subdomains: req.Subdomains,
+		}
+		if d.Verified {
+			d.VerifiedAt = time.Now()
+		}
+		err := domains.Create(c.Request.Context(), d)
+		if errors.Is(err, storage.ErrConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Domain already exists"})
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to create domain", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create domain"})
+			return
+		}
+
+		logger.Info("Domain created", logger.Field("domain", d.Name), logger.Field("owner", d.OwnerEmail), logger.Field("by", callerEmail(c)))
+		c.JSON(http.StatusCreated, domainResponse(d))
+	}
+}
+
+// deleteDomainHandler removes a domain with its DKIM keys and inbound
+// routes.
+func deleteDomainHandler(domains storage.DomainRepository, checker *onboarding.Checker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := strings.ToLower(c.Param("name"))
+		d, err := domains.Get(c.Request.Context(), name)
+		if err == nil {
+			err = checker.Release(c.Request.Context(), d)
+		}
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to delete domain", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete domain"})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"message": "Email sent successfully"})
+		logger.Info("Domain deleted", logger.Field("domain", name), logger.Field("by", callerEmail(c)))
+		c.JSON(http.StatusOK, gin.H{"message": "Domain deleted"})
+	}
+}
+
+func claimResponse(cl *storage.DomainClaim, checker *onboarding.Checker) gin.H {
+	resp := gin.H{
+		"name":       cl.Name,
+		"owner":      cl.OwnerEmail,
+		"verified":   false,
+		"subdomains": cl.Subdomains,
+		"created_at": cl.CreatedAt,
+		"expires_at": checker.ClaimExpiry(cl),
+		"records":    checker.ClaimRecords(cl),
+	}
+	if !cl.CheckedAt.IsZero() {
+		resp["checked_at"] = cl.CheckedAt
 	}
+	return resp
 }
 
-func loginHandler(cfg *config.Config) gin.HandlerFunc {
+// addDomainHandler lets a user claim a domain. Several users may claim the
+// same domain; the first to publish the records returned here gets it,
+// and claims still unverified after the claim TTL expire.
+func addDomainHandler(domains storage.DomainRepository, claims storage.DomainClaimRepository, checker *onboarding.Checker) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req struct {
-			Email    string `json:"email" binding:"required,email"`
-			Password string `json:"password" binding:"required"`
+			Name       string `json:"name" binding:"required,fqdn"`
+			Subdomains bool   `json:"subdomains"`
 		}
 
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -211,43 +1912,190 @@ func loginHandler(cfg *config.Config) gin.HandlerFunc {
 			return
 		}
 
-		user, err := auth.AuthenticateUser(cfg, req.Email, req.Password)
+		cl := &storage.DomainClaim{
+			Name:       strings.ToLower(strings.TrimSuffix(req.Name, ".")),
+			OwnerEmail: callerEmail(c),
+			Subdomains: req.Subdomains,
+			CreatedAt:  time.Now(),
+		}
+		if d, err := domains.Get(c.Request.Context(), cl.Name); err == nil && !onboarding.Claimable(d, cl.OwnerEmail) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Domain already exists"})
+			return
+		} else if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			logger.Error("Failed to load domain", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add domain"})
+			return
+		}
+		if _, err := claims.Get(c.Request.Context(), cl.Name, cl.OwnerEmail); err == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Domain already claimed; publish its records and verify it"})
+			return
+		} else if !errors.Is(err, storage.ErrNotFound) {
+			logger.Error("Failed to load domain claim", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add domain"})
+			return
+		}
+		if err := checker.Prepare(cl); err != nil {
+			logger.Error("Failed to prepare domain claim", logger.Field("domain", cl.Name), logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add domain"})
+			return
+		}
+		err := claims.Create(c.Request.Context(), cl)
 		if err != nil {
-			logger.Error("Authentication failed", logger.Err(err))
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+			checker.Abandon(cl)
+		}
+		if errors.Is(err, storage.ErrConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Domain already claimed; publish its records and verify it"})
 			return
 		}
+		if err != nil {
+			logger.Error("Failed to create domain claim", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add domain"})
+			return
+		}
+
+		logger.Info("Domain claimed", logger.Field("domain", cl.Name), logger.Field("owner", cl.OwnerEmail))
+		c.JSON(http.StatusCreated, claimResponse(cl, checker))
+	}
+}
 
-		token, err := auth.GenerateToken(user, cfg.JWTSecret)
+// listOwnDomainsHandler lists the domains of the caller followed by their
+// pending claims.
+func listOwnDomainsHandler(domains storage.DomainRepository, claims storage.DomainClaimRepository, checker *onboarding.Checker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		list, err := domains.ListByOwner(c.Request.Context(), callerEmail(c))
 		if err != nil {
-			logger.Error("Failed to generate token", logger.Err(err))
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+			logger.Error("Failed to list domains", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list domains"})
+			return
+		}
+		pending, err := claims.ListByOwner(c.Request.Context(), callerEmail(c))
+		if err != nil {
+			logger.Error("Failed to list domain claims", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list domains"})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"token": token})
+		results := make([]gin.H, 0, len(list)+len(pending))
+		for _, d := range list {
+			resp := domainResponse(d)
+			if d.VerificationToken != "" {
+				resp["records"] = checker.Records(d)
+			}
+			results = append(results, resp)
+		}
+		for _, cl := range pending {
+			results = append(results, claimResponse(cl, checker))
+		}
+		c.JSON(http.StatusOK, gin.H{"domains": results})
+	}
+}
+
+// ownDomain loads the :domain of the request if the caller owns it, or
+// else the caller's claim of it, and writes the error response if neither
+// exists.
+func ownDomain(c *gin.Context, domains storage.DomainRepository, claims storage.DomainClaimRepository) (*storage.Domain, *storage.DomainClaim, bool) {
+	name := strings.ToLower(strings.TrimSuffix(c.Param("domain"), "."))
+	d, err := domains.Get(c.Request.Context(), name)
+	if err == nil && d.OwnerEmail == callerEmail(c) {
+		return d, nil, true
+	}
+	var cl *storage.DomainClaim
+	if err == nil || errors.Is(err, storage.ErrNotFound) {
+		cl, err = claims.Get(c.Request.Context(), name, callerEmail(c))
+	}
+	if errors.Is(err, storage.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
+		return nil, nil, false
 	}
+	if err != nil {
+		logger.Error("Failed to load domain", logger.Err(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load domain"})
+		return nil, nil, false
+	}
+	return nil, cl, true
 }
 
-func refreshTokenHandler(cfg *config.Config) gin.HandlerFunc {
+func getOwnDomainHandler(domains storage.DomainRepository, claims storage.DomainClaimRepository, checker *onboarding.Checker) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var req struct {
-			Token string `json:"token" binding:"required"`
+		d, cl, ok := ownDomain(c, domains, claims)
+		if !ok {
+			return
 		}
+		if cl != nil {
+			c.JSON(http.StatusOK, claimResponse(cl, checker))
+			return
+		}
+		resp := domainResponse(d)
+		if d.VerificationToken != "" {
+			resp["records"] = checker.Records(d)
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
 
-		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+// checkOwnDomainHandler checks the records of a domain or claim right away
+// instead of waiting for the domain checker.
+func checkOwnDomainHandler(domains storage.DomainRepository, claims storage.DomainClaimRepository, checker *onboarding.Checker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		d, cl, ok := ownDomain(c, domains, claims)
+		if !ok {
+			return
+		}
+		if d != nil && d.VerificationToken == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Domain was set up by an administrator and is not checked"})
 			return
 		}
 
-		newToken, err := auth.RefreshToken(req.Token, cfg.JWTSecret)
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+		defer cancel()
+		var err error
+		if cl != nil {
+			d, err = checker.VerifyClaim(ctx, cl)
+		} else {
+			err = checker.Verify(ctx, d)
+		}
+		if errors.Is(err, onboarding.ErrDomainTaken) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Domain was verified by another user; the claim was dropped"})
+			return
+		}
 		if err != nil {
-			logger.Error("Failed to refresh token", logger.Err(err))
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			logger.Error("Failed to check domain", logger.Field("domain", c.Param("domain")), logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check domain"})
+			return
+		}
+
+		if d == nil {
+			c.JSON(http.StatusOK, claimResponse(cl, checker))
+			return
+		}
+		resp := domainResponse(d)
+		resp["records"] = checker.Records(d)
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// removeOwnDomainHandler removes a domain of the caller with its DKIM keys
+// and inbound routes, or withdraws their claim of it.
+func removeOwnDomainHandler(domains storage.DomainRepository, claims storage.DomainClaimRepository, checker *onboarding.Checker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		d, cl, ok := ownDomain(c, domains, claims)
+		if !ok {
+			return
+		}
+		var err error
+		if cl != nil {
+			err = checker.RemoveClaim(c.Request.Context(), cl)
+		} else {
+			err = checker.Release(c.Request.Context(), d)
+		}
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			logger.Error("Failed to delete domain", logger.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete domain"})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"token": newToken})
+		logger.Info("Domain removed", logger.Field("domain", c.Param("domain")), logger.Field("owner", callerEmail(c)))
+		c.JSON(http.StatusOK, gin.H{"message": "Domain deleted"})
 	}
 }
 
@@ -262,23 +2110,85 @@ func rateLimitMiddleware(limiter *ratelimit.RateLimiter) gin.HandlerFunc {
 	}
 }
 
-func authMiddleware(cfg *config.Config) gin.HandlerFunc {
+// authMiddleware accepts either a JWT from /auth/login or an API key, sent
+// as "Authorization: Bearer <token>" or in the X-API-Key header.
+func authMiddleware(tokens *auth.Tokens, store storage.Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		token := c.GetHeader("Authorization")
+		token := strings.TrimSpace(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+		if key := c.GetHeader("X-API-Key"); key != "" {
+			token = key
+		}
 		if token == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing authorization token"})
 			c.Abort()
 			return
 		}
 
-		claims, err := auth.VerifyToken(token, cfg.JWTSecret)
+		if auth.IsAPIKey(token) {
+			account, key, err := auth.AuthenticateAPIKey(c.Request.Context(), store.APIKeys(), store.Users(), token)
+			if err != nil {
+				if !errors.Is(err, auth.ErrInvalidAPIKey) {
+					logger.Error("Failed to check API key", logger.Err(err))
+				}
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+				c.Abort()
+				return
+			}
+			c.Set("account", account)
+			c.Set("apiKey", key)
+			c.Next()
+			return
+		}
+
+		account, claims, err := tokens.VerifyToken(c.Request.Context(), token)
 		if err != nil {
+			if !errors.Is(err, auth.ErrInvalidToken) {
+				logger.Error("Failed to check token", logger.Err(err))
+			}
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			c.Abort()
 			return
 		}
 
 		c.Set("user", claims)
+		c.Set("account", account)
+		c.Next()
+	}
+}
+
+// requireScope rejects API keys that were not granted scope. Logged-in
+// users have every scope.
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key, ok := c.Get("apiKey"); ok && !auth.HasScope(key.(*storage.APIKey), scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("API key lacks the %s scope", scope)})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// sessionOnly rejects API keys, so that a leaked key cannot be used to
+// mint more keys or manage users.
+func sessionOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get("apiKey"); ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "This endpoint requires a login token"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func adminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !c.MustGet("account").(*storage.User).Admin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			c.Abort()
+			return
+		}
 		c.Next()
 	}
-}
\ No newline at end of file
+}
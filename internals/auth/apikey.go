@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"email-blaze/internals/logger"
+	"email-blaze/internals/storage"
+)
+
+// APIKeyPrefix starts every API key so they are easy to recognise, both
+// in Authorization headers and by secret scanners.
+const APIKeyPrefix = "eb_"
+
+// API key scopes.
+const (
+	ScopeSend     = "send"
+	ScopeVerify   = "verify"
+	ScopeReadLogs = "read-logs"
+	ScopeWebhooks = "webhooks" // register and remove webhooks and inbound routes
+)
+
+// Scopes lists every scope an API key can be granted.
+var Scopes = []string{ScopeSend, ScopeVerify, ScopeReadLogs, ScopeWebhooks}
+
+var (
+	ErrInvalidAPIKey = errors.New("invalid API key")
+	ErrInvalidScope  = errors.New("unknown scope")
+)
+
+// touchInterval limits how often last_used_at is written for a busy key.
+const touchInterval = time.Minute
+
+// IsAPIKey reports whether token looks like an API key rather than a JWT.
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// HashAPIKey returns the digest stored in place of a key. API keys are
+// long random strings, so a fast unsalted hash is enough.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKey issues a new key for email and returns it with the secret,
+// which is not stored and cannot be recovered later. A zero expires means
+// the key does not expire; no scopes grants every scope.
+func CreateAPIKey(ctx context.Context, keys storage.APIKeyRepository, email, name string, scopes []string, expires time.Time) (*storage.APIKey, string, error) {
+	for _, s := range scopes {
+		if !validScope(s) {
+			return nil, "", fmt.Errorf("%w: %s", ErrInvalidScope, s)
+		}
+	}
+	if len(scopes) == 0 {
+		scopes = Scopes
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	key := APIKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	k := &storage.APIKey{
+		ID:        hex.EncodeToString(id),
+		UserEmail: email,
+		Name:      name,
+		Prefix:    key[:len(APIKeyPrefix)+8],
+		Hash:      HashAPIKey(key),
+		Scopes:    scopes,
+		ExpiresAt: expires,
+	}
+	if err := keys.Create(ctx, k); err != nil {
+		return nil, "", err
+	}
+	return k, key, nil
+}
+
+// AuthenticateAPIKey resolves key to its owner. Revoked and expired keys,
+// and keys of disabled users, are rejected.
+func AuthenticateAPIKey(ctx context.Context, keys storage.APIKeyRepository, users storage.UserRepository, key string) (*storage.User, *storage.APIKey, error) {
+	k, err := keys.GetByHash(ctx, HashAPIKey(key))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	if !k.RevokedAt.IsZero() || (!k.ExpiresAt.IsZero() && now.After(k.ExpiresAt)) {
+		return nil, nil, ErrInvalidAPIKey
+	}
+	u, err := users.Get(ctx, k.UserEmail)
+	if err != nil || u.Disabled {
+		return nil, nil, ErrInvalidAPIKey
+	}
+
+	if now.Sub(k.LastUsedAt) > touchInterval {
+		if err := keys.Touch(ctx, k.ID, now); err != nil {
+			logger.Error("Failed to record API key use", logger.Field("key", k.Prefix), logger.Err(err))
+		}
+		k.LastUsedAt = now
+	}
+	return u, k, nil
+}
+
+// HasScope reports whether k grants scope.
+func HasScope(k *storage.APIKey, scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func validScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
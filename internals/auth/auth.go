@@ -1,15 +1,16 @@
 package auth
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
 	"time"
 
 	"email-blaze/internals/config"
+	"email-blaze/internals/logger"
+	"email-blaze/internals/storage"
 	"email-blaze/pkg/domainVerifier"
-
-	"github.com/golang-jwt/jwt/v5"
 )
 
 type User struct {
@@ -17,87 +18,153 @@ type User struct {
 	Domain   string
 }
 
-func GenerateToken(user *User, secret string) (string, error) {
-	now := time.Now()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"email":   user.Email,
-		"domain":  user.Domain,
-		"iat":     now.Unix(),
-		"nbf":     now.Unix(),
-		"exp":     now.Add(time.Hour * 24).Unix(),
-	})
-
-	return token.SignedString([]byte(secret))
-}
-
-func RefreshToken(tokenString string, secret string) (string, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
-	})
+// VerifyEmail reports whether the domain of email accepts mail. The error
+// is only set when the DNS lookup failed and a later attempt may succeed.
+func VerifyEmail(email string) (bool, error) {
+	parts := strings.Split(email, "@")
+	if len(parts) != 2 || parts[1] == "" {
+		return false, nil
+	}
 
+	err := domainVerifier.CheckMailDomain(parts[1])
+	if errors.Is(err, domainVerifier.ErrNoMailDomain) {
+		return false, nil
+	}
 	if err != nil {
-		return "", err
+		return false, err
 	}
+	return true, nil
+}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		now := time.Now()
-		claims["iat"] = now.Unix()
-		claims["nbf"] = now.Unix()
-		claims["exp"] = now.Add(time.Hour * 24).Unix()
-
-		newToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-		return newToken.SignedString([]byte(secret))
-	}
 
-	return "", fmt.Errorf("invalid token")
-}
 
-func VerifyToken(tokenString string, secret string) (*jwt.MapClaims, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
-	})
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrUserDisabled       = errors.New("user is disabled")
+)
 
+// AuthenticateUser checks email and password against the stored users.
+func AuthenticateUser(ctx context.Context, users storage.UserRepository, email, password string) (*User, error) {
+	u, err := authenticate(ctx, users, email, password)
 	if err != nil {
 		return nil, err
 	}
+	return &User{Email: u.Email, Domain: u.Domain}, nil
+}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		return &claims, nil
+// AuthenticateSMTP checks SMTP AUTH credentials. The password may be the
+// user's password or one of their API keys with the send scope.
+func AuthenticateSMTP(ctx context.Context, store storage.Store, username, password string) (*storage.User, *storage.APIKey, error) {
+	if !IsAPIKey(password) {
+		u, err := authenticate(ctx, store.Users(), username, password)
+		return u, nil, err
 	}
 
-	return nil, errors.New("invalid token")
+	u, k, err := AuthenticateAPIKey(ctx, store.APIKeys(), store.Users(), password)
+	if errors.Is(err, ErrInvalidAPIKey) {
+		return nil, nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.EqualFold(u.Email, username) || !HasScope(k, ScopeSend) {
+		return nil, nil, ErrInvalidCredentials
+	}
+	return u, k, nil
 }
 
-func VerifyEmail(email string) (bool, error) {
-	parts := strings.Split(email, "@")
-	if len(parts) != 2 {
-		return false, errors.New("invalid email")
+func authenticate(ctx context.Context, users storage.UserRepository, email, password string) (*storage.User, error) {
+	u, err := users.Get(ctx, email)
+	if errors.Is(err, storage.ErrNotFound) {
+		checkDummy(password)
+		return nil, ErrInvalidCredentials
 	}
-
-	domain := parts[1]
-	results, err := domainVerifier.VerifyDomain(domain)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-
-	if v, ok := results["MX"]; !ok || v != "Valid" {
-		return false, nil
+	if !CheckPassword(u.PasswordHash, password) {
+		return nil, ErrInvalidCredentials
 	}
-
-	return true, nil
+	if u.Disabled {
+		return nil, ErrUserDisabled
+	}
+	return u, nil
 }
 
+// ImportUsers adds the users listed in config.yaml that are not in the
+// store yet. Plaintext passwords are hashed on the way in; existing users
+// are left alone so changes made through the API are not overwritten.
+//
+// The domain configured for a user is granted to them as a verified domain
+// unless it is registered already, which also covers users imported before
+// senders had to own their domain.
+func ImportUsers(ctx context.Context, users storage.UserRepository, domains storage.DomainRepository, configured []config.User) error {
+	for _, cu := range configured {
+		if err := importUser(ctx, users, cu); err != nil {
+			return err
+		}
+		if err := grantDomain(ctx, domains, cu); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+func importUser(ctx context.Context, users storage.UserRepository, cu config.User) error {
+	if _, err := users.Get(ctx, cu.Email); err == nil {
+		return nil
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
 
-func AuthenticateUser(cfg *config.Config, email, password string) (*User, error) {
-	for _, u := range cfg.Users {
-		if u.Email == email {
-			if u.Password == password {
-				return &User{Email: u.Email, Domain: u.Domain}, nil
-			}
+	if err := ValidateAllowedSenders(cu.AllowedSenders); err != nil {
+		return fmt.Errorf("failed to import user %s: %w", cu.Email, err)
+	}
+	u := &storage.User{
+		Email:          cu.Email,
+		PasswordHash:   cu.Password,
+		Domain:         cu.Domain,
+		Admin:          cu.Admin,
+		AllowedSenders: cu.AllowedSenders,
+	}
+	if !IsPasswordHash(cu.Password) {
+		logger.Info("Hashing plaintext password from config, consider replacing it with the output of hash-password",
+			logger.Field("email", cu.Email))
+		if err := SetPassword(u, cu.Password, cu.SCRAM); err != nil {
+			return err
+		}
+	}
+	if err := users.Create(ctx, u); err != nil {
+		return fmt.Errorf("failed to import user %s: %w", cu.Email, err)
+	}
+	logger.Info("Imported user from config", logger.Field("email", cu.Email))
+	return nil
+}
 
-			return nil, errors.New("invalid credentials")
+func grantDomain(ctx context.Context, domains storage.DomainRepository, cu config.User) error {
+	if cu.Domain == "" {
+		return nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(cu.Domain, "."))
+	d, err := domains.Get(ctx, name)
+	if err == nil {
+		if d.OwnerEmail != cu.Email {
+			logger.Info("Configured domain of user belongs to someone else, not granting it",
+				logger.Field("email", cu.Email),
+				logger.Field("domain", name),
+				logger.Field("owner", d.OwnerEmail))
 		}
+		return nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+
+	now := time.Now()
+	d = &storage.Domain{Name: name, OwnerEmail: cu.Email, Verified: true, CreatedAt: now, VerifiedAt: now}
+	if err := domains.Create(ctx, d); err != nil && !errors.Is(err, storage.ErrConflict) {
+		return fmt.Errorf("failed to grant domain %s to %s: %w", name, cu.Email, err)
 	}
-	return nil, errors.New("user not found")
+	logger.Info("Granted configured domain to user", logger.Field("email", cu.Email), logger.Field("domain", name))
+	return nil
 }
@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"time"
+
+	"email-blaze/internals/config"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is one entry of the key ring used for access tokens. The
+// HS256 key derived from JWT_SECRET has no id and is never published.
+type signingKey struct {
+	id         string
+	method     jwt.SigningMethod
+	sign       interface{}
+	verify     interface{}
+	activeFrom time.Time
+	expires    time.Time
+}
+
+func (k *signingKey) expired(now time.Time) bool {
+	return !k.expires.IsZero() && now.After(k.expires)
+}
+
+// loadKeys builds the key ring from config. Without jwt_keys, tokens are
+// signed with HS256 and JWT_SECRET as before.
+func loadKeys(cfg *config.Config) ([]*signingKey, error) {
+	if len(cfg.JWTKeys) == 0 {
+		secret := []byte(cfg.JWTSecret)
+		return []*signingKey{{method: jwt.SigningMethodHS256, sign: secret, verify: secret}}, nil
+	}
+
+	var keys []*signingKey
+	seen := make(map[string]bool)
+	for _, ck := range cfg.JWTKeys {
+		if ck.ID == "" {
+			return nil, errors.New("JWT key id is required")
+		}
+		if seen[ck.ID] {
+			return nil, fmt.Errorf("duplicate JWT key id %s", ck.ID)
+		}
+		seen[ck.ID] = true
+
+		k, err := loadKey(ck)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load JWT key %s: %w", ck.ID, err)
+		}
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].activeFrom.Before(keys[j].activeFrom) })
+	return keys, nil
+}
+
+func loadKey(ck config.JWTKey) (*signingKey, error) {
+	data, err := os.ReadFile(ck.PrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	var priv interface{}
+	if priv, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		if priv, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	}
+
+	k := &signingKey{id: ck.ID}
+	switch ck.Algorithm {
+	case "RS256":
+		rk, ok := priv.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("RS256 needs an RSA key, got %T", priv)
+		}
+		if rk.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA key is %d bits, at least 2048 are required", rk.N.BitLen())
+		}
+		k.method, k.sign, k.verify = jwt.SigningMethodRS256, rk, &rk.PublicKey
+	case "EdDSA":
+		ek, ok := priv.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("EdDSA needs an Ed25519 key, got %T", priv)
+		}
+		k.method, k.sign, k.verify = jwt.SigningMethodEdDSA, ek, ek.Public()
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q, use RS256 or EdDSA", ck.Algorithm)
+	}
+
+	if ck.ActiveFrom != "" {
+		if k.activeFrom, err = time.Parse(time.RFC3339, ck.ActiveFrom); err != nil {
+			return nil, fmt.Errorf("invalid active_from: %w", err)
+		}
+	}
+	if ck.Expires != "" {
+		if k.expires, err = time.Parse(time.RFC3339, ck.Expires); err != nil {
+			return nil, fmt.Errorf("invalid expires: %w", err)
+		}
+	}
+	return k, nil
+}
+
+// signer returns the key new tokens are signed with: the most recently
+// activated key that has not expired.
+func (t *Tokens) signer(now time.Time) (*signingKey, error) {
+	for i := len(t.keys) - 1; i >= 0; i-- {
+		k := t.keys[i]
+		if !k.activeFrom.After(now) && !k.expired(now) {
+			return k, nil
+		}
+	}
+	return nil, errors.New("no active JWT signing key")
+}
+
+// keyFunc picks the verification key named by the token's kid. The
+// algorithm must be the one configured for that key, so a token cannot
+// choose how it is verified.
+func (t *Tokens) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	for _, k := range t.keys {
+		if k.id != kid {
+			continue
+		}
+		if token.Method.Alg() != k.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s for key %q", token.Method.Alg(), kid)
+		}
+		if k.expired(time.Now()) {
+			return nil, fmt.Errorf("key %q has expired", kid)
+		}
+		return k.verify, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+func (t *Tokens) methods() []string {
+	var algs []string
+	seen := make(map[string]bool)
+	for _, k := range t.keys {
+		if alg := k.method.Alg(); !seen[alg] {
+			seen[alg] = true
+			algs = append(algs, alg)
+		}
+	}
+	return algs
+}
+
+// JWKS returns the public keys that can verify access tokens as a JSON Web
+// Key Set (RFC 7517). Keys that are not active yet are included so that
+// verifiers learn about them before they are used.
+func (t *Tokens) JWKS() map[string]interface{} {
+	now := time.Now()
+	keys := []map[string]string{}
+	for _, k := range t.keys {
+		if k.id == "" || k.expired(now) {
+			continue
+		}
+		jwk := map[string]string{"kid": k.id, "alg": k.method.Alg(), "use": "sig"}
+		switch pub := k.verify.(type) {
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		keys = append(keys, jwk)
+	}
+	return map[string]interface{}{"keys": keys}
+}
@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"email-blaze/internals/config"
+	"email-blaze/internals/storage"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// writeKey stores key as a PKCS #8 PEM file and returns its path.
+func writeKey(t *testing.T, name string, key interface{}) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), name+".pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newEd25519(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newRSA(t *testing.T, bits int) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func rfc3339(d time.Duration) string {
+	return time.Now().Add(d).Format(time.RFC3339)
+}
+
+func newTestStore(t *testing.T) storage.Store {
+	t.Helper()
+	ctx := context.Background()
+	store, err := storage.Open("sqlite::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Users().Create(ctx, &storage.User{Email: "a@example.com", PasswordHash: "x", Domain: "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	old, current, next, gone := newEd25519(t), newRSA(t, 2048), newEd25519(t), newEd25519(t)
+	tokens, err := NewTokens(&config.Config{JWTKeys: []config.JWTKey{
+		{ID: "next", Algorithm: "EdDSA", PrivateKeyFile: writeKey(t, "next", next), ActiveFrom: rfc3339(time.Hour)},
+		{ID: "current", Algorithm: "RS256", PrivateKeyFile: writeKey(t, "current", current), ActiveFrom: rfc3339(-time.Hour)},
+		{ID: "old", Algorithm: "EdDSA", PrivateKeyFile: writeKey(t, "old", old), ActiveFrom: rfc3339(-48 * time.Hour)},
+		{ID: "gone", Algorithm: "EdDSA", PrivateKeyFile: writeKey(t, "gone", gone), ActiveFrom: rfc3339(-72 * time.Hour), Expires: rfc3339(-time.Minute)},
+	}}, newTestStore(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pair, err := tokens.Issue(ctx, &User{Email: "a@example.com", Domain: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _, err := jwt.NewParser().ParseUnverified(pair.AccessToken, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header["kid"] != "current" || parsed.Method.Alg() != "RS256" {
+		t.Errorf("signed with kid %v and %s, want the latest active key current with RS256", parsed.Header["kid"], parsed.Method.Alg())
+	}
+	if _, _, err := tokens.VerifyToken(ctx, pair.AccessToken); err != nil {
+		t.Errorf("token signed with the current key: %v", err)
+	}
+
+	// sign returns an access token for a@example.com signed by key.
+	sign := func(kid string, method jwt.SigningMethod, key interface{}) string {
+		now := time.Now()
+		token := jwt.NewWithClaims(method, jwt.MapClaims{
+			"jti": "jti-" + kid, "email": "a@example.com", "domain": "example.com",
+			"iat": now.Unix(), "exp": now.Add(time.Hour).Unix(),
+		})
+		token.Header["kid"] = kid
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"rotated out key still verifies", sign("old", jwt.SigningMethodEdDSA, old), true},
+		{"key not active yet verifies", sign("next", jwt.SigningMethodEdDSA, next), true},
+		{"expired key", sign("gone", jwt.SigningMethodEdDSA, gone), false},
+		{"unknown kid", sign("other", jwt.SigningMethodEdDSA, old), false},
+		{"kid of another key", sign("old", jwt.SigningMethodEdDSA, next), false},
+		{"algorithm not configured for the kid", sign("current", jwt.SigningMethodHS256, []byte("secret")), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := tokens.VerifyToken(ctx, tt.token)
+			if tt.valid && err != nil {
+				t.Errorf("VerifyToken: %v", err)
+			}
+			if !tt.valid && err != ErrInvalidToken {
+				t.Errorf("VerifyToken = %v, want %v", err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	ed, rk := newEd25519(t), newRSA(t, 2048)
+	tokens, err := NewTokens(&config.Config{JWTKeys: []config.JWTKey{
+		{ID: "ed", Algorithm: "EdDSA", PrivateKeyFile: writeKey(t, "ed", ed)},
+		{ID: "rsa", Algorithm: "RS256", PrivateKeyFile: writeKey(t, "rsa", rk), ActiveFrom: rfc3339(time.Hour)},
+		{ID: "gone", Algorithm: "EdDSA", PrivateKeyFile: writeKey(t, "gone", newEd25519(t)), Expires: rfc3339(-time.Minute)},
+	}}, newTestStore(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := tokens.JWKS()["keys"].([]map[string]string)
+	byID := make(map[string]map[string]string)
+	for _, k := range keys {
+		byID[k["kid"]] = k
+	}
+	if len(keys) != 2 || byID["gone"] != nil {
+		t.Fatalf("JWKS = %v, want ed and rsa without the expired key", keys)
+	}
+
+	if k := byID["ed"]; k["kty"] != "OKP" || k["crv"] != "Ed25519" || k["alg"] != "EdDSA" || k["use"] != "sig" ||
+		k["x"] != base64.RawURLEncoding.EncodeToString(ed.Public().(ed25519.PublicKey)) {
+		t.Errorf("Ed25519 JWK = %v", k)
+	}
+	k := byID["rsa"]
+	n, _ := base64.RawURLEncoding.DecodeString(k["n"])
+	e, _ := base64.RawURLEncoding.DecodeString(k["e"])
+	if k["kty"] != "RSA" || k["alg"] != "RS256" || new(big.Int).SetBytes(n).Cmp(rk.N) != 0 || new(big.Int).SetBytes(e).Int64() != int64(rk.E) {
+		t.Errorf("RSA JWK = %v", k)
+	}
+
+	// The HS256 secret is never published.
+	secret, err := NewTokens(&config.Config{JWTSecret: "test secret"}, newTestStore(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := secret.JWKS()["keys"].([]map[string]string); len(keys) != 0 {
+		t.Errorf("JWKS with JWT_SECRET = %v, want no keys", keys)
+	}
+}
+
+func TestLoadKeysRejects(t *testing.T) {
+	ed := writeKey(t, "ed", newEd25519(t))
+	tests := []struct {
+		name string
+		keys []config.JWTKey
+	}{
+		{"missing id", []config.JWTKey{{Algorithm: "EdDSA", PrivateKeyFile: ed}}},
+		{"duplicate id", []config.JWTKey{{ID: "a", Algorithm: "EdDSA", PrivateKeyFile: ed}, {ID: "a", Algorithm: "EdDSA", PrivateKeyFile: ed}}},
+		{"algorithm does not match the key", []config.JWTKey{{ID: "a", Algorithm: "RS256", PrivateKeyFile: ed}}},
+		{"short RSA key", []config.JWTKey{{ID: "a", Algorithm: "RS256", PrivateKeyFile: writeKey(t, "short", newRSA(t, 1024))}}},
+		{"unsupported algorithm", []config.JWTKey{{ID: "a", Algorithm: "HS256", PrivateKeyFile: ed}}},
+		{"bad active_from", []config.JWTKey{{ID: "a", Algorithm: "EdDSA", PrivateKeyFile: ed, ActiveFrom: "tomorrow"}}},
+		{"no key active", []config.JWTKey{{ID: "a", Algorithm: "EdDSA", PrivateKeyFile: ed, ActiveFrom: rfc3339(time.Hour)}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewTokens(&config.Config{JWTKeys: tt.keys}, nil); err == nil {
+				t.Error("NewTokens succeeded, want an error")
+			}
+		})
+	}
+}
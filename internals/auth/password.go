@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+
+	"email-blaze/internals/storage"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// argon2id parameters, following the second recommended option of
+// RFC 9106 section 4 (64 MiB, 3 passes).
+const (
+	argonMemory  = 64 * 1024
+	argonTime    = 3
+	argonThreads = 4
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+// HashPassword returns an argon2id hash of password in the PHC string
+// format: $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// SetPassword stores a hash of password on u. With scram, the SCRAM
+// credentials used for SMTP AUTH are stored too; otherwise any previous
+// ones are dropped.
+func SetPassword(u *storage.User, password string, scram bool) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	var creds string
+	if scram {
+		if creds, err = DeriveSCRAM(password); err != nil {
+			return err
+		}
+	}
+	u.PasswordHash = hash
+	u.SCRAMSHA256 = creds
+	return nil
+}
+
+// IsPasswordHash reports whether s looks like a hash produced by
+// HashPassword or by bcrypt rather than a plaintext password.
+func IsPasswordHash(s string) bool {
+	return strings.HasPrefix(s, "$argon2id$") || strings.HasPrefix(s, "$2a$") ||
+		strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
+}
+
+// CheckPassword reports whether password matches hash. Both argon2id and
+// bcrypt hashes are accepted; the comparison is constant time.
+func CheckPassword(hash, password string) bool {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	var version int
+	var memory, time uint32
+	var threads uint8
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return false
+	}
+	got := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(want)))
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+var (
+	dummyOnce sync.Once
+	dummyHash string
+)
+
+// checkDummy spends the same time as CheckPassword on a real hash, so that
+// unknown users cannot be told apart from wrong passwords.
+func checkDummy(password string) {
+	dummyOnce.Do(func() { dummyHash, _ = HashPassword("email-blaze") })
+	CheckPassword(dummyHash, password)
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashPasswordRoundTrip(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2] != "v=19" || parts[3] != "m=65536,t=3,p=4" {
+		t.Fatalf("HashPassword = %q, want $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>", hash)
+	}
+	if !IsPasswordHash(hash) {
+		t.Error("IsPasswordHash(argon2id hash) = false")
+	}
+	if !CheckPassword(hash, "correct horse") {
+		t.Error("CheckPassword rejected the right password")
+	}
+	if CheckPassword(hash, "correct horse ") {
+		t.Error("CheckPassword accepted a wrong password")
+	}
+	if again, _ := HashPassword("correct horse"); again == hash {
+		t.Error("two hashes of the same password are equal, want a random salt")
+	}
+}
+
+func TestCheckPasswordParameters(t *testing.T) {
+	// Hashes keep verifying with the parameters they were made with.
+	hash, _ := HashPassword("secret")
+	parts := strings.Split(hash, "$")
+	tests := []struct {
+		name string
+		hash string
+		want bool
+	}{
+		{"valid", hash, true},
+		{"changed cost", strings.Replace(hash, "t=3", "t=2", 1), false},
+		{"other version", strings.Replace(hash, "v=19", "v=16", 1), false},
+		{"missing field", strings.Join(parts[:5], "$"), false},
+		{"bad salt", strings.Replace(hash, parts[4], "!!", 1), false},
+		{"empty hash", strings.TrimSuffix(hash, parts[5]), false},
+		{"plaintext", "secret", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CheckPassword(tt.hash, "secret"); got != tt.want {
+				t.Errorf("CheckPassword = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPasswordAcceptsBcrypt(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("legacy"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsPasswordHash(string(hash)) {
+		t.Errorf("IsPasswordHash(%q) = false", hash)
+	}
+	if !CheckPassword(string(hash), "legacy") {
+		t.Error("CheckPassword rejected a bcrypt hash of the right password")
+	}
+	if CheckPassword(string(hash), "wrong") {
+		t.Error("CheckPassword accepted a wrong password for a bcrypt hash")
+	}
+}
@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"bytes"
+	"testing"
+
+	"email-blaze/internals/storage"
+)
+
+func TestSetPasswordSCRAMOptIn(t *testing.T) {
+	u := &storage.User{SCRAMSHA256: "SCRAM-SHA-256$4096:c2FsdA==$old:old"}
+	if err := SetPassword(u, "secret", false); err != nil {
+		t.Fatal(err)
+	}
+	if u.SCRAMSHA256 != "" {
+		t.Errorf("SCRAM credentials kept without opt-in: %q", u.SCRAMSHA256)
+	}
+
+	if err := SetPassword(u, "secret", true); err != nil {
+		t.Fatal(err)
+	}
+	creds, err := ParseSCRAM(u.SCRAMSHA256)
+	if err != nil {
+		t.Fatalf("ParseSCRAM(%q): %v", u.SCRAMSHA256, err)
+	}
+	if creds.Iterations != scramIterations {
+		t.Errorf("iterations = %d, want %d", creds.Iterations, scramIterations)
+	}
+}
+
+func TestFakeSCRAM(t *testing.T) {
+	a := FakeSCRAM("secret", "nobody@example.com")
+	if b := FakeSCRAM("secret", "nobody@example.com"); !bytes.Equal(a.Salt, b.Salt) {
+		t.Error("salt differs between attempts for the same username")
+	}
+	if b := FakeSCRAM("secret", "other@example.com"); bytes.Equal(a.Salt, b.Salt) {
+		t.Error("salt is the same for different usernames")
+	}
+	if b := FakeSCRAM("other", "nobody@example.com"); bytes.Equal(a.Salt, b.Salt) {
+		t.Error("salt does not depend on the secret")
+	}
+	if _, ok := a.VerifyProof("message", make([]byte, 32)); ok {
+		t.Error("proof accepted for made-up credentials")
+	}
+}
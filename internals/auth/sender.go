@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"email-blaze/internals/storage"
+)
+
+var ErrSenderNotAllowed = errors.New("sender not allowed")
+
+// SenderPolicy decides which addresses a user may send as. An address is
+// allowed when its domain is a verified domain the user owns (including
+// subdomains when the domain permits them), and, if the user has an
+// allowlist, when it matches one of its entries. The user's own Domain is
+// no exception: it must be granted to them by an admin or by ImportUsers,
+// or verified by them.
+type SenderPolicy struct {
+	domains storage.DomainRepository
+}
+
+func NewSenderPolicy(domains storage.DomainRepository) *SenderPolicy {
+	return &SenderPolicy{domains: domains}
+}
+
+// Authorize checks each address, typically the From header and the
+// envelope sender. An empty address (the null reverse path) is skipped.
+func (p *SenderPolicy) Authorize(ctx context.Context, u *storage.User, addresses ...string) error {
+	var owned []*storage.Domain
+	loaded := false
+	for _, addr := range addresses {
+		if addr == "" {
+			continue
+		}
+		parsed, err := mail.ParseAddress(addr)
+		if err != nil {
+			return fmt.Errorf("%w: invalid address %s", ErrSenderNotAllowed, addr)
+		}
+		address := strings.ToLower(parsed.Address)
+		_, domain, ok := splitAddress(address)
+		if !ok {
+			return fmt.Errorf("%w: invalid address %s", ErrSenderNotAllowed, addr)
+		}
+
+		if len(u.AllowedSenders) > 0 && !matchAny(u.AllowedSenders, address) {
+			return fmt.Errorf("%w: %s is not in the user's allowed senders", ErrSenderNotAllowed, address)
+		}
+		if !loaded {
+			if owned, err = p.domains.ListByOwner(ctx, u.Email); err != nil {
+				return err
+			}
+			loaded = true
+		}
+		if !ownsDomain(owned, domain) {
+			return fmt.Errorf("%w: %s is not a verified domain of the user", ErrSenderNotAllowed, domain)
+		}
+	}
+	return nil
+}
+
+// AuthorizePatterns checks addresses against an allowlist alone, for
+// accounts that are not users such as the SMTP service account.
+func AuthorizePatterns(patterns []string, addresses ...string) error {
+	for _, addr := range addresses {
+		if addr == "" {
+			continue
+		}
+		parsed, err := mail.ParseAddress(addr)
+		if err != nil {
+			return fmt.Errorf("%w: invalid address %s", ErrSenderNotAllowed, addr)
+		}
+		address := strings.ToLower(parsed.Address)
+		if !matchAny(patterns, address) {
+			return fmt.Errorf("%w: %s is not in the allowed senders", ErrSenderNotAllowed, address)
+		}
+	}
+	return nil
+}
+
+// OwnsDomain reports whether domain is a verified domain owned by the user,
+// or a subdomain of one that covers subdomains. The user's Domain field is
+// not enough: nothing checks it is theirs.
+func (p *SenderPolicy) OwnsDomain(ctx context.Context, u *storage.User, domain string) (bool, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	owned, err := p.domains.ListByOwner(ctx, u.Email)
+	if err != nil {
+		return false, err
+	}
+	return ownsDomain(owned, domain), nil
+}
+
+// ValidateAllowedSenders checks allowlist entries: addresses, *@domain for
+// any address on a domain or *@*.domain for any subdomain.
+func ValidateAllowedSenders(patterns []string) error {
+	for _, pattern := range patterns {
+		local, domain, ok := splitAddress(pattern)
+		if !ok || strings.Contains(local, "*") && local != "*" ||
+			strings.Contains(strings.TrimPrefix(domain, "*."), "*") {
+			return fmt.Errorf("invalid sender pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+func ownsDomain(owned []*storage.Domain, domain string) bool {
+	for _, d := range owned {
+		if !d.Verified {
+			continue
+		}
+		name := strings.ToLower(d.Name)
+		if domain == name || d.Subdomains && strings.HasSuffix(domain, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, address string) bool {
+	local, domain, _ := splitAddress(address)
+	for _, pattern := range patterns {
+		pl, pd, ok := splitAddress(strings.ToLower(pattern))
+		if !ok || (pl != "*" && pl != local) {
+			continue
+		}
+		if pd == domain || strings.HasPrefix(pd, "*.") && strings.HasSuffix(domain, pd[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitAddress(address string) (local, domain string, ok bool) {
+	i := strings.LastIndex(address, "@")
+	if i <= 0 || i == len(address)-1 {
+		return "", "", false
+	}
+	return address[:i], address[i+1:], true
+}
@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"email-blaze/internals/config"
+	"email-blaze/internals/storage"
+)
+
+func TestAuthorizeSender(t *testing.T) {
+	ctx := context.Background()
+	store, err := storage.Open("sqlite::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []*storage.User{
+		{Email: "a@shared.example", PasswordHash: "x", Domain: "shared.example"},
+		{Email: "b@pending.example", PasswordHash: "x", Domain: "pending.example"},
+		{Email: "d@granted.example", PasswordHash: "x", Domain: "granted.example"},
+	} {
+		if err := store.Users().Create(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range []*storage.Domain{
+		{Name: "shared.example", OwnerEmail: "b@pending.example", Verified: true},
+		{Name: "granted.example", OwnerEmail: "d@granted.example", Verified: true},
+		{Name: "pending.example"},
+		{Name: "owned.example", OwnerEmail: "a@shared.example", Verified: true, Subdomains: true},
+		{Name: "unverified.example", OwnerEmail: "a@shared.example"},
+	} {
+		if err := store.Domains().Create(ctx, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, _ := store.Users().Get(ctx, "a@shared.example")
+	b, _ := store.Users().Get(ctx, "b@pending.example")
+	d, _ := store.Users().Get(ctx, "d@granted.example")
+	nodomain := &storage.User{Email: "c@missing.example", Domain: "missing.example"}
+
+	tests := []struct {
+		user    *storage.User
+		addr    string
+		allowed bool
+	}{
+		// Verified, but by another user.
+		{a, "a@shared.example", false},
+		{a, "Someone <other@Shared.Example>", false},
+		{d, "Someone <d@Granted.Example>", true},
+		{a, "news@owned.example", true},
+		{a, "news@mail.owned.example", true},
+		{a, "news@unverified.example", false},
+		{a, "b@pending.example", false},
+		{b, "b@pending.example", false},
+		{nodomain, "c@missing.example", false},
+	}
+	policy := NewSenderPolicy(store.Domains())
+	for _, tt := range tests {
+		err := policy.Authorize(ctx, tt.user, tt.addr)
+		if tt.allowed && err != nil || !tt.allowed && !errors.Is(err, ErrSenderNotAllowed) {
+			t.Errorf("Authorize(%s, %q) = %v, allowed %v", tt.user.Email, tt.addr, err, tt.allowed)
+		}
+	}
+
+	owns := []struct {
+		user   *storage.User
+		domain string
+		owns   bool
+	}{
+		{a, "owned.example", true},
+		{a, "mail.owned.example", true},
+		{a, "shared.example", false},
+		{a, "unverified.example", false},
+		{b, "pending.example", false},
+		{nodomain, "missing.example", false},
+	}
+	for _, tt := range owns {
+		got, err := policy.OwnsDomain(ctx, tt.user, tt.domain)
+		if err != nil || got != tt.owns {
+			t.Errorf("OwnsDomain(%s, %s) = %v, %v, want %v", tt.user.Email, tt.domain, got, err, tt.owns)
+		}
+	}
+}
+
+func TestImportUsersGrantsDomain(t *testing.T) {
+	ctx := context.Background()
+	store, err := storage.Open("sqlite::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// b was imported before configured domains were granted.
+	if err := store.Users().Create(ctx, &storage.User{Email: "b@b.example", PasswordHash: "x", Domain: "b.example"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Users().Create(ctx, &storage.User{Email: "owner@taken.example", PasswordHash: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Domains().Create(ctx, &storage.Domain{Name: "taken.example", OwnerEmail: "owner@taken.example", Verified: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	configured := []config.User{
+		{Email: "a@a.example", Password: "secret", Domain: "A.example"},
+		{Email: "b@b.example", Password: "secret", Domain: "b.example"},
+		{Email: "c@taken.example", Password: "secret", Domain: "taken.example"},
+	}
+	for i := 0; i < 2; i++ {
+		if err := ImportUsers(ctx, store.Users(), store.Domains(), configured); err != nil {
+			t.Fatalf("import %d: %v", i, err)
+		}
+	}
+
+	policy := NewSenderPolicy(store.Domains())
+	for _, tt := range []struct {
+		email   string
+		addr    string
+		allowed bool
+	}{
+		{"a@a.example", "a@a.example", true},
+		{"b@b.example", "b@b.example", true},
+		{"c@taken.example", "c@taken.example", false},
+	} {
+		u, err := store.Users().Get(ctx, tt.email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = policy.Authorize(ctx, u, tt.addr)
+		if tt.allowed && err != nil || !tt.allowed && !errors.Is(err, ErrSenderNotAllowed) {
+			t.Errorf("Authorize(%s, %q) = %v, allowed %v", tt.email, tt.addr, err, tt.allowed)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"email-blaze/internals/config"
+	"email-blaze/internals/logger"
+	"email-blaze/internals/storage"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// RefreshTokenPrefix starts every refresh token so they cannot be mistaken
+// for access tokens or API keys.
+const RefreshTokenPrefix = "ebr_"
+
+const (
+	defaultAccessTTL  = 15 * time.Minute
+	defaultRefreshTTL = 30 * 24 * time.Hour
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// TokenPair is what a client receives on login and on every refresh.
+type TokenPair struct {
+	AccessToken      string
+	RefreshToken     string
+	AccessExpiresAt  time.Time
+	RefreshExpiresAt time.Time
+}
+
+// Tokens issues short-lived JWT access tokens and long-lived opaque
+// refresh tokens. Refresh tokens are single use: each refresh returns a
+// new one, and presenting a token that was already exchanged revokes every
+// token descended from the same login.
+type Tokens struct {
+	keys       []*signingKey
+	store      storage.Store
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+func NewTokens(cfg *config.Config, store storage.Store) (*Tokens, error) {
+	keys, err := loadKeys(cfg)
+	if err != nil {
+		return nil, err
+	}
+	t := &Tokens{
+		keys:       keys,
+		store:      store,
+		accessTTL:  time.Duration(cfg.Tokens.AccessTTL) * time.Minute,
+		refreshTTL: time.Duration(cfg.Tokens.RefreshTTL) * time.Hour,
+	}
+	if t.accessTTL <= 0 {
+		t.accessTTL = defaultAccessTTL
+	}
+	if t.refreshTTL <= 0 {
+		t.refreshTTL = defaultRefreshTTL
+	}
+	if _, err := t.signer(time.Now()); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Issue starts a new session for user.
+func (t *Tokens) Issue(ctx context.Context, user *User) (*TokenPair, error) {
+	family, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	return t.issue(ctx, user, family)
+}
+
+// Refresh exchanges a refresh token for a new token pair.
+func (t *Tokens) Refresh(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	rt, err := t.store.RefreshTokens().GetByHash(ctx, HashAPIKey(refreshToken))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if !rt.RevokedAt.IsZero() || now.After(rt.ExpiresAt) {
+		return nil, ErrInvalidToken
+	}
+	if !rt.UsedAt.IsZero() {
+		return nil, t.reused(ctx, rt, now)
+	}
+	if err := t.store.RefreshTokens().MarkUsed(ctx, rt.ID, now); errors.Is(err, storage.ErrNotFound) {
+		// Another request exchanged the token in the meantime.
+		return nil, t.reused(ctx, rt, now)
+	} else if err != nil {
+		return nil, err
+	}
+
+	u, err := t.store.Users().Get(ctx, rt.UserEmail)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.Disabled {
+		return nil, ErrInvalidToken
+	}
+	return t.issue(ctx, &User{Email: u.Email, Domain: u.Domain}, rt.FamilyID)
+}
+
+// VerifyToken checks an access token and returns the user it was issued
+// to. Tokens that were revoked by logout, issued before the user logged out
+// of all sessions, or that belong to a disabled user are rejected.
+func (t *Tokens) VerifyToken(ctx context.Context, tokenString string) (*storage.User, *jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, t.keyFunc, jwt.WithValidMethods(t.methods()), jwt.WithIssuedAt())
+	if err != nil {
+		return nil, nil, ErrInvalidToken
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, nil, ErrInvalidToken
+	}
+
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return nil, nil, ErrInvalidToken
+	}
+	revoked, err := t.store.RevokedTokens().IsRevoked(ctx, jti)
+	if err != nil {
+		return nil, nil, err
+	}
+	if revoked {
+		return nil, nil, ErrInvalidToken
+	}
+
+	email, _ := claims["email"].(string)
+	u, err := t.store.Users().Get(ctx, email)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Disabled {
+		return nil, nil, ErrInvalidToken
+	}
+	iat, ok := issuedAt(claims)
+	if !ok || (!u.SessionsRevokedAt.IsZero() && !iat.After(u.SessionsRevokedAt.Truncate(time.Microsecond))) {
+		return nil, nil, ErrInvalidToken
+	}
+	return u, &claims, nil
+}
+
+// Logout revokes the access token described by claims and, if given, the
+// refresh token of the same session.
+func (t *Tokens) Logout(ctx context.Context, claims *jwt.MapClaims, refreshToken string) error {
+	jti, _ := (*claims)["jti"].(string)
+	exp, err := claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return ErrInvalidToken
+	}
+	now := time.Now()
+	if err := t.store.RevokedTokens().Purge(ctx, now); err != nil {
+		logger.Error("Failed to purge revoked tokens", logger.Err(err))
+	}
+	if err := t.store.RevokedTokens().Revoke(ctx, jti, exp.Time); err != nil {
+		return err
+	}
+
+	if refreshToken == "" {
+		return nil
+	}
+	rt, err := t.store.RefreshTokens().GetByHash(ctx, HashAPIKey(refreshToken))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if email, _ := (*claims)["email"].(string); rt.UserEmail != email {
+		return nil
+	}
+	return t.store.RefreshTokens().RevokeFamily(ctx, rt.FamilyID, now)
+}
+
+// LogoutAll ends every session of email: all refresh tokens are revoked
+// and access tokens issued until now stop being accepted.
+func (t *Tokens) LogoutAll(ctx context.Context, email string) error {
+	u, err := t.store.Users().Get(ctx, email)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	u.SessionsRevokedAt = now
+	if err := t.store.Users().Update(ctx, u); err != nil {
+		return err
+	}
+	return t.store.RefreshTokens().RevokeUser(ctx, email, now)
+}
+
+func (t *Tokens) issue(ctx context.Context, user *User, family string) (*TokenPair, error) {
+	now := time.Now()
+	key, err := t.signer(now)
+	if err != nil {
+		return nil, err
+	}
+	jti, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	pair := &TokenPair{
+		AccessExpiresAt:  now.Add(t.accessTTL),
+		RefreshExpiresAt: now.Add(t.refreshTTL),
+	}
+
+	token := jwt.NewWithClaims(key.method, jwt.MapClaims{
+		"jti":    jti,
+		"email":  user.Email,
+		"domain": user.Domain,
+		"iat":    float64(now.UnixMicro()) / 1e6,
+		"nbf":    now.Unix(),
+		"exp":    pair.AccessExpiresAt.Unix(),
+	})
+	if key.id != "" {
+		token.Header["kid"] = key.id
+	}
+	if pair.AccessToken, err = token.SignedString(key.sign); err != nil {
+		return nil, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	pair.RefreshToken = RefreshTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	if err := t.store.RefreshTokens().Create(ctx, &storage.RefreshToken{
+		ID:        id,
+		FamilyID:  family,
+		UserEmail: user.Email,
+		Hash:      HashAPIKey(pair.RefreshToken),
+		CreatedAt: now,
+		ExpiresAt: pair.RefreshExpiresAt,
+	}); err != nil {
+		return nil, fmt.Errorf("failed to store refresh token: %w", err)
+	}
+	return pair, nil
+}
+
+// issuedAt returns the iat claim, which access tokens carry with
+// microsecond precision so that a login right after LogoutAll is told apart
+// from the sessions it ended. jwt.NumericDate would round it to the second.
+func issuedAt(claims jwt.MapClaims) (time.Time, bool) {
+	iat, ok := claims["iat"].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.UnixMicro(int64(math.Round(iat * 1e6))), true
+}
+
+// reused handles a refresh token presented after it was exchanged. Either
+// the client misbehaves or the token leaked, so the whole session ends.
+func (t *Tokens) reused(ctx context.Context, rt *storage.RefreshToken, now time.Time) error {
+	logger.Info("Refresh token reused, revoking session",
+		logger.Field("email", rt.UserEmail), logger.Field("family", rt.FamilyID))
+	if err := t.store.RefreshTokens().RevokeFamily(ctx, rt.FamilyID, now); err != nil {
+		return err
+	}
+	return ErrInvalidToken
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
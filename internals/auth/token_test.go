@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"email-blaze/internals/config"
+	"email-blaze/internals/logger"
+	"email-blaze/internals/storage"
+)
+
+func init() {
+	logger.Init("fatal", "production", "console")
+}
+
+func TestLogoutAllKeepsLaterLogins(t *testing.T) {
+	ctx := context.Background()
+	store, err := storage.Open("sqlite::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Users().Create(ctx, &storage.User{Email: "a@example.com", PasswordHash: "x", Domain: "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := NewTokens(&config.Config{JWTSecret: "test secret"}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &User{Email: "a@example.com", Domain: "example.com"}
+
+	before, err := tokens.Issue(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tokens.LogoutAll(ctx, user.Email); err != nil {
+		t.Fatal(err)
+	}
+	// Issued within the same second as the logout.
+	after, err := tokens.Issue(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := tokens.VerifyToken(ctx, before.AccessToken); err != ErrInvalidToken {
+		t.Errorf("token issued before LogoutAll: err = %v, want %v", err, ErrInvalidToken)
+	}
+	if _, _, err := tokens.VerifyToken(ctx, after.AccessToken); err != nil {
+		t.Errorf("token issued after LogoutAll: %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"os"
 
 	"github.com/joho/godotenv"
@@ -12,6 +13,96 @@ type User struct {
 	Email    string `yaml:"email"`
 	Password string `yaml:"password"`
 	Domain   string `yaml:"domain"`
+	Admin    bool   `yaml:"admin"`
+	// AllowedSenders restricts the From addresses the user may use.
+	AllowedSenders []string `yaml:"allowed_senders"`
+	SCRAM          bool     `yaml:"scram"` // derive SCRAM-SHA-256 credentials from a plaintext password
+}
+
+type QueueConfig struct {
+	Dir              string `yaml:"dir"`
+	Workers          int    `yaml:"workers"`
+	RetryInterval    int    `yaml:"retry_interval"`     // seconds before the first retry
+	MaxRetryInterval int    `yaml:"max_retry_interval"` // upper bound for the backoff, in seconds
+	Lifetime         int    `yaml:"lifetime"`           // hours before a deferred message bounces
+	Retention        int    `yaml:"retention"`          // hours a finished message's status is kept
+}
+
+type WebhookConfig struct {
+	Dir              string `yaml:"dir"`
+	Workers          int    `yaml:"workers"`
+	Timeout          int    `yaml:"timeout"`            // seconds per request
+	MaxAttempts      int    `yaml:"max_attempts"`       // attempts before a delivery is given up
+	RetryInterval    int    `yaml:"retry_interval"`     // seconds before the first retry
+	MaxRetryInterval int    `yaml:"max_retry_interval"` // upper bound for the backoff, in seconds
+	Retention        int    `yaml:"retention"`          // hours the delivery log is kept
+
+	AllowPrivateNetworks bool `yaml:"allow_private_networks"` // let endpoints resolve to loopback or private addresses
+}
+
+// DomainConfig sets the DNS records users publish for the domains they add
+// through the API, and how often those records are checked.
+type DomainConfig struct {
+	SPFInclude      string `yaml:"spf_include"`      // domain customer SPF records include, defaults to _spf.<smtp_host>
+	ReturnPath      string `yaml:"return_path"`      // CNAME target of bounces.<domain>, defaults to smtp_host
+	DMARCReports    string `yaml:"dmarc_reports"`    // address suggested for rua= in DMARC records
+	CheckInterval   int    `yaml:"check_interval"`   // minutes between checks of verified domains
+	PendingInterval int    `yaml:"pending_interval"` // minutes between checks of domains awaiting verification
+	GracePeriod     int    `yaml:"grace_period"`     // hours records may be missing before a domain is unverified
+	ClaimTTL        int    `yaml:"claim_ttl"`        // hours an unverified claim is kept before it expires
+}
+
+// DNSConfig sets how the records of sender and customer domains are looked
+// up. Without servers the nameservers in /etc/resolv.conf are queried.
+type DNSConfig struct {
+	Servers      []string `yaml:"servers"`       // recursive resolvers as host or host:port
+	Timeout      int      `yaml:"timeout"`       // seconds per query before the next server is tried
+	MaxTTL       int      `yaml:"max_ttl"`       // seconds answers are cached at most, defaults to 300
+	NegativeTTL  int      `yaml:"negative_ttl"`  // seconds missing records are cached at most, defaults to 60
+	DisableCache bool     `yaml:"disable_cache"` // look every record up again
+}
+
+// RelayConfig decides who may use the SMTP server to reach which domains.
+// Authenticated sessions and trusted networks may relay anywhere; everyone
+// else may only deliver to the local domains. Mail for the local domains is
+// received here and posted to their inbound routes.
+type RelayConfig struct {
+	RequireAuth     bool     `yaml:"require_auth"`     // reject MAIL FROM before AUTH
+	TrustedNetworks []string `yaml:"trusted_networks"` // CIDRs that may relay without AUTH
+	LocalDomains    []string `yaml:"local_domains"`    // domains accepted from anyone
+}
+
+// ListenerConfig is one SMTP port. Typical setups run port 25 for inbound
+// MX traffic with optional STARTTLS, 587 for submission with STARTTLS and
+// 465 with implicit TLS.
+type ListenerConfig struct {
+	Name        string       `yaml:"name"`
+	Port        int          `yaml:"port"`
+	Mode        string       `yaml:"mode"`         // plain, starttls or tls
+	DisableAuth bool         `yaml:"disable_auth"` // do not offer AUTH on this port
+	Relay       *RelayConfig `yaml:"relay"`        // defaults to the top-level relay policy
+}
+
+type TokenConfig struct {
+	AccessTTL  int `yaml:"access_ttl"`  // minutes an access token is valid
+	RefreshTTL int `yaml:"refresh_ttl"` // hours a refresh token is valid
+}
+
+// JWTKey signs access tokens. Keys rotate by time: the key with the latest
+// ActiveFrom that has passed signs new tokens, and every key keeps
+// verifying until it Expires.
+type JWTKey struct {
+	ID             string `yaml:"id"`               // published as the token kid
+	Algorithm      string `yaml:"algorithm"`        // RS256 or EdDSA
+	PrivateKeyFile string `yaml:"private_key_file"` // PEM encoded RSA or Ed25519 key
+	ActiveFrom     string `yaml:"active_from"`      // RFC 3339, signs from this time on
+	Expires        string `yaml:"expires"`          // RFC 3339, stops verifying after this time
+}
+
+type DKIMKey struct {
+	Domain         string `yaml:"domain"`
+	Selector       string `yaml:"selector"`
+	PrivateKeyFile string `yaml:"private_key_file"`
 }
 
 type Config struct {
@@ -24,6 +115,10 @@ type Config struct {
 	MaxFileSize  int    `yaml:"max_file_size"`
 	SMTPUsername string `yaml:"smtp_username"`
 	SMTPPassword string
+	// SMTPAllowedSenders are the addresses the smtp_username service account
+	// may send as, in the format of a user's allowed_senders. Without them
+	// the service account cannot log in.
+	SMTPAllowedSenders []string `yaml:"smtp_allowed_senders"`
 	Users        []User `yaml:"users"`
 	DefaultUser  User   `yaml:"default_user"`
 	SSLCertFile  string `yaml:"ssl_cert_file"`
@@ -34,6 +129,20 @@ type Config struct {
 	MaxMessageSize   int    `yaml:"max_message_size"`
 	MaxRecipients    int    `yaml:"max_recipients"`
 	MaxLineLength    int    `yaml:"max_line_length"`
+	OutboundPort     int    `yaml:"outbound_port"`
+	OutboundTimeout  int    `yaml:"outbound_timeout"`
+	SendingIPs       []string `yaml:"sending_ips"` // public addresses outbound mail leaves from, checked against SPF
+	Queue            QueueConfig `yaml:"queue"`
+	DKIMKeys         []DKIMKey   `yaml:"dkim_keys"`
+	DKIMHeaders      []string    `yaml:"dkim_headers"`
+	DKIMKeyDir       string      `yaml:"dkim_key_dir"` // generated keys are stored here as <domain>/<selector>.pem
+	Webhooks         WebhookConfig `yaml:"webhooks"`
+	Tokens           TokenConfig   `yaml:"tokens"`
+	Relay            RelayConfig   `yaml:"relay"`
+	Domains          DomainConfig  `yaml:"domains"`
+	DNS              DNSConfig     `yaml:"dns"`
+	Listeners        []ListenerConfig `yaml:"listeners"`
+	JWTKeys          []JWTKey      `yaml:"jwt_keys"`
 }
 
 func Load(filename string) (*Config, error) {
@@ -68,6 +177,14 @@ func (c *Config) validate() error {
 	if c.SMTPPort == 0 {
 		return fmt.Errorf("SMTP port is required")
 	}
+	for _, l := range c.Listeners {
+		if l.Port == 0 {
+			return fmt.Errorf("listener %s: port is required", l.Name)
+		}
+		if l.Mode != "plain" && l.Mode != "starttls" && l.Mode != "tls" {
+			return fmt.Errorf("listener %s: mode must be plain, starttls or tls", l.Name)
+		}
+	}
 	if c.SMTPHost == "" {
 		return fmt.Errorf("SMTP host is required")
 	}
@@ -77,8 +194,8 @@ func (c *Config) validate() error {
 	if c.DatabaseURL == "" {
 		return fmt.Errorf("database url is required")
 	}
-	if c.JWTSecret == "" {
-		return fmt.Errorf("JWT secret is required")
+	if c.JWTSecret == "" && len(c.JWTKeys) == 0 {
+		return fmt.Errorf("JWT secret or JWT keys are required")
 	}
 	if c.RateLimit == 0 {
 		return fmt.Errorf("rate limit is required")
@@ -110,6 +227,11 @@ func (c *Config) validate() error {
 	if !c.DevelopmentMode && (c.SSLCertFile == "" || c.SSLKeyFile == "") {
 		return fmt.Errorf("SSL certificate and key file paths must be provided in production mode")
 	}
+	for _, ip := range c.SendingIPs {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid sending IP %q", ip)
+		}
+	}
 
 	return nil
 }
\ No newline at end of file
@@ -0,0 +1,418 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"email-blaze/internals/logger"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Resolver looks up the DNS records needed for direct-to-MX delivery.
+// *net.Resolver satisfies it, so a resolver pointed at a custom DNS server
+// can be injected with Sender.SetResolver.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DeliveryResult is the outcome of delivering a message to one recipient.
+// Err is nil when the remote host accepted the message.
+type DeliveryResult struct {
+	Recipient string
+	Host      string
+	Err       error
+}
+
+// HostAttempt records why delivery through a single MX host failed.
+type HostAttempt struct {
+	Host string
+	Addr string
+	Err  error
+}
+
+// DeliveryError is returned when none of the hosts for a domain could take
+// the message. It keeps every per-host failure for diagnostics.
+type DeliveryError struct {
+	Domain   string
+	Attempts []HostAttempt
+}
+
+func (e *DeliveryError) Error() string {
+	if len(e.Attempts) == 0 {
+		return fmt.Sprintf("no deliverable hosts for %s", e.Domain)
+	}
+	parts := make([]string, 0, len(e.Attempts))
+	for _, a := range e.Attempts {
+		if a.Addr != "" {
+			parts = append(parts, fmt.Sprintf("%s [%s]: %v", a.Host, a.Addr, a.Err))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s: %v", a.Host, a.Err))
+		}
+	}
+	return fmt.Sprintf("delivery to %s failed: %s", e.Domain, strings.Join(parts, "; "))
+}
+
+// Unwrap exposes the last host failure so callers can inspect the SMTP reply.
+func (e *DeliveryError) Unwrap() error {
+	if len(e.Attempts) == 0 {
+		return nil
+	}
+	return e.Attempts[len(e.Attempts)-1].Err
+}
+
+var (
+	errNullMX = &smtp.SMTPError{
+		Code:         556,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 10},
+		Message:      "Recipient domain does not accept mail (null MX)",
+	}
+	errNoDomain = &smtp.SMTPError{
+		Code:         553,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+		Message:      "Recipient address has no domain",
+	}
+)
+
+// IsPermanent reports whether a delivery error should not be retried: the
+// remote host answered with a 5xx reply or the recipient domain does not
+// exist. Everything else (4xx replies, network and DNS server failures) is
+// considered transient.
+func IsPermanent(err error) bool {
+	var derr *DeliveryError
+	if errors.As(err, &derr) {
+		for _, a := range derr.Attempts {
+			var smtpErr *smtp.SMTPError
+			if errors.As(a.Err, &smtpErr) && smtpErr.Code >= 500 {
+				return true
+			}
+		}
+		return false
+	}
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code >= 500
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsNotFound
+	}
+	return false
+}
+
+// Deliver sends a pre-built message to every recipient by looking up the MX
+// hosts of each recipient domain and handing the message over directly.
+// The message is DKIM signed first when a key for its From domain is
+// configured. opts holds the MAIL parameters the message was received with,
+// BODY and SMTPUTF8, which the next hop must support; it is nil for
+// messages built here. One result is returned per recipient.
+func (s *Sender) Deliver(from string, to []string, msg []byte, opts *smtp.MailOptions) []DeliveryResult {
+	msg = s.sign(msg)
+
+	byDomain := make(map[string][]string)
+	var domains []string
+	for _, rcpt := range to {
+		domain := strings.ToLower(domainOf(rcpt))
+		if _, ok := byDomain[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		byDomain[domain] = append(byDomain[domain], rcpt)
+	}
+
+	var results []DeliveryResult
+	for _, domain := range domains {
+		results = append(results, s.deliverDomain(domain, from, byDomain[domain], msg, opts)...)
+	}
+	return results
+}
+
+func (s *Sender) deliverDomain(domain, from string, rcpts []string, msg []byte, opts *smtp.MailOptions) []DeliveryResult {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout())
+	defer cancel()
+
+	if domain == "" {
+		return failAll(rcpts, "", errNoDomain)
+	}
+
+	hosts, err := s.lookupMX(ctx, domain)
+	if err != nil {
+		logger.Error("MX lookup failed", logger.Field("domain", domain), logger.Err(err))
+		return failAll(rcpts, "", err)
+	}
+
+	derr := &DeliveryError{Domain: domain}
+	for _, host := range hosts {
+		addrs, err := s.resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			derr.Attempts = append(derr.Attempts, HostAttempt{Host: host, Err: err})
+			continue
+		}
+		for _, ip := range addrs {
+			addr := ip.String()
+			logger.Info("Delivering to MX host",
+				logger.Field("domain", domain),
+				logger.Field("host", host),
+				logger.Field("addr", addr))
+			results, err := s.deliverHost(host, addr, from, rcpts, msg, opts)
+			if err == nil {
+				return results
+			}
+			logger.Error("MX host delivery failed",
+				logger.Field("host", host),
+				logger.Field("addr", addr),
+				logger.Err(err))
+			derr.Attempts = append(derr.Attempts, HostAttempt{Host: host, Addr: addr, Err: err})
+
+			// A 5xx reply to the transaction is authoritative for the whole
+			// domain, there is no point in asking the backup MX hosts. A
+			// missing extension only speaks for this host.
+			var smtpErr *smtp.SMTPError
+			if errors.As(err, &smtpErr) && smtpErr.Code >= 500 && !missingExtension(err) {
+				return failAll(rcpts, host, derr)
+			}
+		}
+	}
+	return failAll(rcpts, "", derr)
+}
+
+// lookupMX returns the hosts to try for domain in preference order, falling
+// back to the domain itself when it publishes no MX records (RFC 5321 5.1).
+func (s *Sender) lookupMX(ctx context.Context, domain string) ([]string, error) {
+	mxs, err := s.resolver.LookupMX(ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, err
+		}
+		mxs = nil
+	}
+
+	if len(mxs) == 0 {
+		if _, err := s.resolver.LookupIPAddr(ctx, domain); err != nil {
+			return nil, fmt.Errorf("no MX or address records for %s: %w", domain, err)
+		}
+		return []string{domain}, nil
+	}
+
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return nil, errNullMX
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+	}
+	return hosts, nil
+}
+
+// deliverHost runs a single SMTP transaction against addr. A nil error means
+// the transaction completed; individual recipients may still have been
+// refused, which is reported in their results.
+func (s *Sender) deliverHost(host, addr, from string, rcpts []string, msg []byte, opts *smtp.MailOptions) ([]DeliveryResult, error) {
+	client, err := s.dial(host, addr, true)
+	if err != nil {
+		var tlsErr *tlsHandshakeError
+		if !errors.As(err, &tlsErr) {
+			return nil, err
+		}
+		logger.Info("STARTTLS failed, retrying without TLS", logger.Field("host", host), logger.Err(err))
+		if client, err = s.dial(host, addr, false); err != nil {
+			return nil, err
+		}
+	}
+	defer client.Close()
+
+	mailOpts, err := nextHopOptions(client, opts, msg)
+	if err != nil {
+		client.Quit()
+		return nil, err
+	}
+	if err := client.Mail(from, mailOpts); err != nil {
+		return nil, err
+	}
+
+	results := make([]DeliveryResult, 0, len(rcpts))
+	accepted := 0
+	for _, rcpt := range rcpts {
+		err := client.Rcpt(rcpt, nil)
+		if err == nil {
+			accepted++
+		}
+		results = append(results, DeliveryResult{Recipient: rcpt, Host: host, Err: err})
+	}
+	if accepted == 0 {
+		client.Quit()
+		return results, nil
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	client.Quit()
+
+	return results, nil
+}
+
+// Errors for next hops that cannot take a message as it was received. The
+// message is not converted: its sender gets a DSN instead.
+var (
+	errNo8BitMIME   = &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 6, 3}, Message: "Remote host does not support 8BITMIME"}
+	errNoBinaryMIME = &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 6, 3}, Message: "Binary message cannot be relayed to the remote host"}
+	errNoSMTPUTF8   = &smtp.SMTPError{Code: 553, EnhancedCode: smtp.EnhancedCode{5, 6, 7}, Message: "Remote host does not support SMTPUTF8"}
+)
+
+func missingExtension(err error) bool {
+	return errors.Is(err, errNo8BitMIME) || errors.Is(err, errNoBinaryMIME) || errors.Is(err, errNoSMTPUTF8)
+}
+
+// nextHopOptions returns the MAIL parameters for the next hop, or an error
+// when it lacks an extension the message needs. The client always asks for
+// BODY=8BITMIME when the host offers it and cannot send BDAT, so binary
+// bodies are only relayed when they also fit the line rules of DATA.
+func nextHopOptions(client *smtp.Client, opts *smtp.MailOptions, msg []byte) (*smtp.MailOptions, error) {
+	next := &smtp.MailOptions{Size: int64(len(msg))}
+	if opts == nil {
+		return next, nil
+	}
+	has8Bit, _ := client.Extension("8BITMIME")
+	switch opts.Body {
+	case smtp.Body8BitMIME:
+		if !has8Bit {
+			return nil, errNo8BitMIME
+		}
+	case smtp.BodyBinaryMIME:
+		if !has8Bit || !fitsData(msg) {
+			return nil, errNoBinaryMIME
+		}
+	}
+	if opts.UTF8 {
+		if ok, _ := client.Extension("SMTPUTF8"); !ok {
+			return nil, errNoSMTPUTF8
+		}
+		next.UTF8 = true
+	}
+	return next, nil
+}
+
+// fitsData reports whether msg can be sent with DATA as 8-bit text: no NUL
+// bytes, CR and LF only as line breaks, and lines of at most 998 octets.
+func fitsData(msg []byte) bool {
+	line := 0
+	for i, b := range msg {
+		switch {
+		case b == 0:
+			return false
+		case b == '\r':
+			if i+1 >= len(msg) || msg[i+1] != '\n' {
+				return false
+			}
+		case b == '\n':
+			if i == 0 || msg[i-1] != '\r' {
+				return false
+			}
+			line = 0
+			continue
+		}
+		if line++; line > 999 {
+			return false
+		}
+	}
+	return true
+}
+
+type tlsHandshakeError struct {
+	err error
+}
+
+func (e *tlsHandshakeError) Error() string { return "STARTTLS: " + e.err.Error() }
+func (e *tlsHandshakeError) Unwrap() error { return e.err }
+
+// dial connects to addr and introduces the sender as smtp_host. With useTLS
+// the session is upgraded with STARTTLS first, which fails with a
+// tlsHandshakeError when the server does not offer it or the handshake does
+// not complete. Certificates are not verified: this is opportunistic
+// encryption in the sense of RFC 7435.
+func (s *Sender) dial(host, addr string, useTLS bool) (*smtp.Client, error) {
+	dialer := net.Dialer{Timeout: s.timeout()}
+	conn, err := dialer.Dial("tcp", net.JoinHostPort(addr, strconv.Itoa(s.port())))
+	if err != nil {
+		return nil, err
+	}
+
+	if !useTLS {
+		client := smtp.NewClient(conn)
+		if err := client.Hello(s.config.SMTPHost); err != nil {
+			client.Close()
+			return nil, err
+		}
+		return client, nil
+	}
+
+	// NewClientStartTLS checks the STARTTLS extension and upgrades the
+	// session, which go-smtp offers no other way to do. Its EHLO before the
+	// upgrade says "localhost"; ours follows on the encrypted session and
+	// also runs the handshake.
+	client, err := smtp.NewClientStartTLS(conn, &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	})
+	if err == nil {
+		if err = client.Hello(s.config.SMTPHost); err != nil {
+			client.Close()
+		}
+	}
+	if err != nil {
+		var smtpErr *smtp.SMTPError
+		if errors.As(err, &smtpErr) {
+			return nil, err
+		}
+		return nil, &tlsHandshakeError{err: err}
+	}
+	return client, nil
+}
+
+func failAll(rcpts []string, host string, err error) []DeliveryResult {
+	results := make([]DeliveryResult, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		results = append(results, DeliveryResult{Recipient: rcpt, Host: host, Err: err})
+	}
+	return results
+}
+
+func domainOf(address string) string {
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		return address[i+1:]
+	}
+	return ""
+}
+
+func (s *Sender) port() int {
+	if s.config.OutboundPort != 0 {
+		return s.config.OutboundPort
+	}
+	return 25
+}
+
+func (s *Sender) timeout() time.Duration {
+	if s.config.OutboundTimeout != 0 {
+		return time.Duration(s.config.OutboundTimeout) * time.Second
+	}
+	return 30 * time.Second
+}
@@ -0,0 +1,382 @@
+package email
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"email-blaze/internals/config"
+	"email-blaze/internals/logger"
+
+	"github.com/emersion/go-smtp"
+)
+
+func init() {
+	logger.Init("fatal", "production", "console")
+}
+
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if mxs, ok := r.mx[name]; ok {
+		return mxs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if addrs, ok := r.hosts[host]; ok {
+		var ips []net.IPAddr
+		for _, a := range addrs {
+			ips = append(ips, net.IPAddr{IP: net.ParseIP(a)})
+		}
+		return ips, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// fakeMTA is an SMTP server that records the messages it accepts. mailErr
+// and rcptErr make it refuse MAIL FROM or single recipients.
+type fakeMTA struct {
+	mailErr error
+	rcptErr map[string]error
+	utf8    bool // advertise SMTPUTF8
+
+	mu       sync.Mutex
+	messages []fakeDelivery
+}
+
+type fakeDelivery struct {
+	from string
+	opts smtp.MailOptions
+	to   []string
+	data []byte
+	tls  bool
+}
+
+type fakeSession struct {
+	mta *fakeMTA
+	tls bool
+	cur fakeDelivery
+}
+
+func (s *fakeSession) Reset()        { s.cur = fakeDelivery{} }
+func (s *fakeSession) Logout() error { return nil }
+
+func (s *fakeSession) Mail(from string, opts *smtp.MailOptions) error {
+	if s.mta.mailErr != nil {
+		return s.mta.mailErr
+	}
+	s.cur.from = from
+	if opts != nil {
+		s.cur.opts = *opts
+	}
+	return nil
+}
+
+func (s *fakeSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if err := s.mta.rcptErr[to]; err != nil {
+		return err
+	}
+	s.cur.to = append(s.cur.to, to)
+	return nil
+}
+
+func (s *fakeSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.cur.data, s.cur.tls = data, s.tls
+	s.mta.mu.Lock()
+	s.mta.messages = append(s.mta.messages, s.cur)
+	s.mta.mu.Unlock()
+	return nil
+}
+
+func (m *fakeMTA) received() []fakeDelivery {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]fakeDelivery(nil), m.messages...)
+}
+
+// listen starts m on addr, with STARTTLS when tlsConfig is set, and
+// returns the port it listens on.
+func (m *fakeMTA) listen(t *testing.T, addr string, tlsConfig *tls.Config) int {
+	t.Helper()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", addr, err)
+	}
+	srv := smtp.NewServer(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		_, isTLS := c.TLSConnectionState()
+		return &fakeSession{mta: m, tls: isTLS}, nil
+	}))
+	srv.Domain = "mx.test"
+	srv.TLSConfig = tlsConfig
+	srv.EnableSMTPUTF8 = m.utf8
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func selfSigned(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func newTestSender(t *testing.T, port int, r Resolver) *Sender {
+	t.Helper()
+	s, err := NewSender(&config.Config{
+		SMTPHost:        "sender.test",
+		OutboundPort:    port,
+		OutboundTimeout: 5,
+		DKIMKeyDir:      t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetResolver(r)
+	return s
+}
+
+var testMessage = []byte("From: a@sender.test\r\nTo: b@example.test\r\nSubject: hi\r\n\r\nhello\r\n")
+
+func TestDeliverMXOrder(t *testing.T) {
+	primary, backup := &fakeMTA{}, &fakeMTA{}
+	port := primary.listen(t, "127.0.0.1:0", nil)
+	backup.listen(t, "127.0.0.2:"+strconv.Itoa(port), nil)
+
+	s := newTestSender(t, port, &fakeResolver{
+		mx: map[string][]*net.MX{"example.test": {
+			{Host: "backup.example.test.", Pref: 20},
+			{Host: "primary.example.test.", Pref: 10},
+		}},
+		hosts: map[string][]string{
+			"primary.example.test": {"127.0.0.1"},
+			"backup.example.test":  {"127.0.0.2"},
+		},
+	})
+	results := s.Deliver("a@sender.test", []string{"b@example.test"}, testMessage, nil)
+	if len(results) != 1 || results[0].Err != nil || results[0].Host != "primary.example.test" {
+		t.Fatalf("results = %+v, want delivery through primary.example.test", results)
+	}
+	if got := primary.received(); len(got) != 1 || got[0].from != "a@sender.test" || string(got[0].data) != string(testMessage) {
+		t.Errorf("primary received %+v", got)
+	}
+	if got := backup.received(); len(got) != 0 {
+		t.Errorf("backup received %d messages, want none", len(got))
+	}
+}
+
+func TestDeliverFallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		primary *fakeMTA // nil when nothing listens on the primary address
+	}{
+		{"connection refused", nil},
+		{"temporary failure", &fakeMTA{mailErr: &smtp.SMTPError{Code: 451, Message: "try later"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backup := &fakeMTA{}
+			port := backup.listen(t, "127.0.0.1:0", nil)
+			if tt.primary != nil {
+				tt.primary.listen(t, "127.0.0.2:"+strconv.Itoa(port), nil)
+			}
+			s := newTestSender(t, port, &fakeResolver{
+				mx: map[string][]*net.MX{"example.test": {
+					{Host: "primary.example.test", Pref: 10},
+					{Host: "backup.example.test", Pref: 20},
+				}},
+				hosts: map[string][]string{
+					"primary.example.test": {"127.0.0.2"},
+					"backup.example.test":  {"127.0.0.1"},
+				},
+			})
+			results := s.Deliver("a@sender.test", []string{"b@example.test"}, testMessage, nil)
+			if len(results) != 1 || results[0].Err != nil || results[0].Host != "backup.example.test" {
+				t.Fatalf("results = %+v, want delivery through backup.example.test", results)
+			}
+			if got := backup.received(); len(got) != 1 {
+				t.Errorf("backup received %d messages, want 1", len(got))
+			}
+		})
+	}
+}
+
+func TestDeliverFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		mailErr    error
+		mx         []*net.MX
+		permanent  bool
+		backupUsed bool
+	}{
+		{
+			name:       "temporary failure on every host is deferred",
+			mailErr:    &smtp.SMTPError{Code: 451, Message: "try later"},
+			backupUsed: true,
+		},
+		{
+			name:      "permanent failure skips backup hosts",
+			mailErr:   &smtp.SMTPError{Code: 550, Message: "go away"},
+			permanent: true,
+		},
+		{
+			name:      "null MX",
+			mx:        []*net.MX{{Host: ".", Pref: 0}},
+			permanent: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary, backup := &fakeMTA{mailErr: tt.mailErr}, &fakeMTA{mailErr: tt.mailErr}
+			port := primary.listen(t, "127.0.0.1:0", nil)
+			backup.listen(t, "127.0.0.2:"+strconv.Itoa(port), nil)
+			mx := tt.mx
+			if mx == nil {
+				mx = []*net.MX{{Host: "primary.example.test", Pref: 10}, {Host: "backup.example.test", Pref: 20}}
+			}
+			s := newTestSender(t, port, &fakeResolver{
+				mx: map[string][]*net.MX{"example.test": mx},
+				hosts: map[string][]string{
+					"primary.example.test": {"127.0.0.1"},
+					"backup.example.test":  {"127.0.0.2"},
+				},
+			})
+
+			results := s.Deliver("a@sender.test", []string{"b@example.test"}, testMessage, nil)
+			if len(results) != 1 || results[0].Err == nil {
+				t.Fatalf("results = %+v, want a failure", results)
+			}
+			if got := IsPermanent(results[0].Err); got != tt.permanent {
+				t.Errorf("IsPermanent(%v) = %v, want %v", results[0].Err, got, tt.permanent)
+			}
+			var derr *DeliveryError
+			attempts := 0
+			if errors.As(results[0].Err, &derr) {
+				attempts = len(derr.Attempts)
+			}
+			if used := attempts == 2; used != tt.backupUsed {
+				t.Errorf("attempts = %d, backup used = %v, want %v", attempts, used, tt.backupUsed)
+			}
+		})
+	}
+}
+
+func TestDeliverRecipientRejection(t *testing.T) {
+	mta := &fakeMTA{rcptErr: map[string]error{
+		"gone@example.test": &smtp.SMTPError{Code: 550, Message: "no such user"},
+	}}
+	port := mta.listen(t, "127.0.0.1:0", nil)
+	s := newTestSender(t, port, &fakeResolver{
+		hosts: map[string][]string{"example.test": {"127.0.0.1"}},
+	})
+
+	results := s.Deliver("a@sender.test", []string{"b@example.test", "gone@example.test"}, testMessage, nil)
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	if results[0].Err != nil || results[1].Err == nil || !IsPermanent(results[1].Err) {
+		t.Errorf("results = %+v, want b accepted and gone rejected permanently", results)
+	}
+	if got := mta.received(); len(got) != 1 || len(got[0].to) != 1 || got[0].to[0] != "b@example.test" {
+		t.Errorf("received %+v, want one message for b@example.test", got)
+	}
+}
+
+func TestDeliverSTARTTLS(t *testing.T) {
+	mta := &fakeMTA{}
+	port := mta.listen(t, "127.0.0.1:0", selfSigned(t))
+	s := newTestSender(t, port, &fakeResolver{
+		mx:    map[string][]*net.MX{"example.test": {{Host: "mx.example.test", Pref: 10}}},
+		hosts: map[string][]string{"mx.example.test": {"127.0.0.1"}},
+	})
+
+	results := s.Deliver("a@sender.test", []string{"b@example.test"}, testMessage, nil)
+	if len(results) != 1 || results[0].Err != nil {
+		t.Fatalf("results = %+v", results)
+	}
+	if got := mta.received(); len(got) != 1 || !got[0].tls {
+		t.Errorf("received %+v, want one message over TLS", got)
+	}
+}
+
+func TestDeliverMailParameters(t *testing.T) {
+	binary := []byte("From: a@sender.test\r\nContent-Transfer-Encoding: binary\r\n\r\nbare\nline feed\r\n")
+	tests := []struct {
+		name       string
+		utf8       bool
+		opts       *smtp.MailOptions
+		msg        []byte
+		wantStatus string
+		want       smtp.MailOptions
+	}{
+		// The client asks for 8BITMIME whenever the host offers it.
+		{name: "7-bit", msg: testMessage, want: smtp.MailOptions{Body: smtp.Body8BitMIME, Size: int64(len(testMessage))}},
+		{name: "8BITMIME", opts: &smtp.MailOptions{Body: smtp.Body8BitMIME}, msg: testMessage, want: smtp.MailOptions{Body: smtp.Body8BitMIME, Size: int64(len(testMessage))}},
+		{name: "SMTPUTF8", utf8: true, opts: &smtp.MailOptions{UTF8: true}, msg: testMessage, want: smtp.MailOptions{Body: smtp.Body8BitMIME, UTF8: true, Size: int64(len(testMessage))}},
+		{name: "SMTPUTF8 not offered", opts: &smtp.MailOptions{UTF8: true}, msg: testMessage, wantStatus: "5.6.7"},
+		{name: "binary body that fits DATA", opts: &smtp.MailOptions{Body: smtp.BodyBinaryMIME}, msg: testMessage, want: smtp.MailOptions{Body: smtp.Body8BitMIME, Size: int64(len(testMessage))}},
+		{name: "binary body with bare line feeds", opts: &smtp.MailOptions{Body: smtp.BodyBinaryMIME}, msg: binary, wantStatus: "5.6.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mta := &fakeMTA{utf8: tt.utf8}
+			port := mta.listen(t, "127.0.0.1:0", nil)
+			s := newTestSender(t, port, &fakeResolver{
+				hosts: map[string][]string{"example.test": {"127.0.0.1"}},
+			})
+
+			results := s.Deliver("a@sender.test", []string{"b@example.test"}, tt.msg, tt.opts)
+			if len(results) != 1 {
+				t.Fatalf("got %d results, want 1", len(results))
+			}
+			if tt.wantStatus != "" {
+				if status, _ := DeliveryStatus(results[0].Err); !IsPermanent(results[0].Err) || status != tt.wantStatus {
+					t.Errorf("err = %v (%s), want a permanent %s failure", results[0].Err, status, tt.wantStatus)
+				}
+				if got := mta.received(); len(got) != 0 {
+					t.Errorf("host received %d messages, want none", len(got))
+				}
+				return
+			}
+			if results[0].Err != nil {
+				t.Fatal(results[0].Err)
+			}
+			if got := mta.received(); len(got) != 1 || got[0].opts != tt.want {
+				t.Errorf("received %+v, want MAIL parameters %+v", got, tt.want)
+			}
+		})
+	}
+}
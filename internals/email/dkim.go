@@ -0,0 +1,562 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDKIMHeaders is the header list signed when none is configured.
+var DefaultDKIMHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding", "List-Unsubscribe",
+}
+
+// DKIMSigner adds RFC 6376 signatures with relaxed/relaxed canonicalization.
+// Key must be an *rsa.PrivateKey (rsa-sha256) or an ed25519.PrivateKey
+// (ed25519-sha256, RFC 8463).
+type DKIMSigner struct {
+	Domain   string
+	Selector string
+	Key      crypto.Signer
+	Headers  []string
+}
+
+// Algorithm returns the value of the a= tag for the signer's key.
+func (s *DKIMSigner) Algorithm() (string, error) {
+	switch s.Key.(type) {
+	case *rsa.PrivateKey:
+		return "rsa-sha256", nil
+	case ed25519.PrivateKey:
+		return "ed25519-sha256", nil
+	default:
+		return "", fmt.Errorf("unsupported DKIM key type %T", s.Key)
+	}
+}
+
+// Sign returns msg with a DKIM-Signature header prepended.
+func (s *DKIMSigner) Sign(msg []byte) ([]byte, error) {
+	algo, err := s.Algorithm()
+	if err != nil {
+		return nil, err
+	}
+
+	headers, body := splitMessage(normalizeCRLF(msg))
+	bodyHash := sha256.Sum256(canonicalBody(body, "relaxed", -1))
+
+	signedNames := s.Headers
+	if len(signedNames) == 0 {
+		signedNames = DefaultDKIMHeaders
+	}
+	var names []string
+	for _, name := range signedNames {
+		if findHeader(headers, name) != nil {
+			names = append(names, strings.ToLower(name))
+		}
+	}
+	if !containsFold(names, "from") {
+		return nil, errors.New("message has no From header")
+	}
+
+	tags := []string{
+		"v=1",
+		"a=" + algo,
+		"c=relaxed/relaxed",
+		"d=" + s.Domain,
+		"s=" + s.Selector,
+		"t=" + strconv.FormatInt(time.Now().Unix(), 10),
+		"h=" + strings.Join(names, ":"),
+		"bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]),
+		"b=",
+	}
+	value := foldTags(tags)
+
+	hash := sha256.New()
+	for _, h := range selectHeaders(headers, names) {
+		hash.Write([]byte(canonicalHeader(h, "relaxed")))
+	}
+	sigHeader := "DKIM-Signature: " + value
+	hash.Write([]byte(strings.TrimSuffix(canonicalHeader(sigHeader+"\r\n", "relaxed"), "\r\n")))
+
+	var sig []byte
+	switch key := s.Key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(nil, key, crypto.SHA256, hash.Sum(nil))
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, hash.Sum(nil))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign message: %w", err)
+	}
+
+	var out bytes.Buffer
+	out.WriteString(sigHeader)
+	out.WriteString(foldBase64(base64.StdEncoding.EncodeToString(sig)))
+	out.WriteString("\r\n")
+	out.Write(msg)
+	return out.Bytes(), nil
+}
+
+// LoadDKIMKey reads a PEM encoded RSA or Ed25519 private key.
+func LoadDKIMKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseDKIMKey(data)
+}
+
+// ParseDKIMKey decodes a PEM encoded PKCS#1 or PKCS#8 private key.
+func ParseDKIMKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported DKIM key type %T", key)
+	}
+}
+
+// DKIM verification results, as used in Authentication-Results.
+const (
+	DKIMPass      = "pass"
+	DKIMFail      = "fail"
+	DKIMNeutral   = "neutral"
+	DKIMTempError = "temperror"
+	DKIMPermError = "permerror"
+)
+
+// DKIMResult is the outcome of checking one DKIM-Signature header.
+type DKIMResult struct {
+	Domain    string
+	Selector  string
+	Identity  string
+	Algorithm string
+	Status    string
+	Err       error
+}
+
+// DKIMKeyLookup returns the TXT records published at
+// <selector>._domainkey.<domain>. Implementations should return an error
+// that satisfies errors.Is(err, ErrDKIMKeyUnavailable) for transient
+// failures so the result can be reported as temperror.
+type DKIMKeyLookup func(domain, selector string) ([]string, error)
+
+var ErrDKIMKeyUnavailable = errors.New("DKIM key temporarily unavailable")
+
+// VerifyDKIM checks every DKIM-Signature in msg. A message without
+// signatures yields no results.
+func VerifyDKIM(msg []byte, lookup DKIMKeyLookup) []DKIMResult {
+	headers, body := splitMessage(normalizeCRLF(msg))
+
+	var results []DKIMResult
+	for i, h := range headers {
+		if !strings.EqualFold(headerName(h), "DKIM-Signature") {
+			continue
+		}
+		results = append(results, verifySignature(headers[:i], headers[i+1:], h, body, lookup))
+	}
+	return results
+}
+
+func verifySignature(above, below []string, sigHeader string, body []byte, lookup DKIMKeyLookup) DKIMResult {
+	tags, err := parseTags(headerValue(sigHeader))
+	result := DKIMResult{Domain: tags["d"], Selector: tags["s"], Algorithm: tags["a"], Identity: tags["i"]}
+	permFail := func(format string, args ...interface{}) DKIMResult {
+		result.Status = DKIMPermError
+		result.Err = fmt.Errorf(format, args...)
+		return result
+	}
+	if err != nil {
+		return permFail("malformed signature: %v", err)
+	}
+	for _, required := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[required]; !ok {
+			return permFail("signature is missing the %s= tag", required)
+		}
+	}
+	if tags["v"] != "1" {
+		return permFail("unsupported signature version %q", tags["v"])
+	}
+	if result.Identity == "" {
+		result.Identity = "@" + result.Domain
+	} else if !isSubdomain(domainOf(result.Identity), result.Domain) {
+		return permFail("identity %s is not within %s", result.Identity, result.Domain)
+	}
+	if x, ok := tags["x"]; ok {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return permFail("invalid x= tag")
+		}
+		if time.Now().Unix() > expires {
+			return permFail("signature expired")
+		}
+	}
+
+	headerCanon, bodyCanon := "simple", "simple"
+	if c, ok := tags["c"]; ok {
+		parts := strings.SplitN(c, "/", 2)
+		headerCanon = parts[0]
+		if len(parts) == 2 {
+			bodyCanon = parts[1]
+		}
+	}
+	for _, canon := range []string{headerCanon, bodyCanon} {
+		if canon != "simple" && canon != "relaxed" {
+			return permFail("unsupported canonicalization %q", canon)
+		}
+	}
+
+	signedNames := strings.Split(tags["h"], ":")
+	for i := range signedNames {
+		signedNames[i] = strings.TrimSpace(signedNames[i])
+	}
+	if !containsFold(signedNames, "from") {
+		return permFail("From header is not signed")
+	}
+
+	limit := int64(-1)
+	if l, ok := tags["l"]; ok {
+		if limit, err = strconv.ParseInt(l, 10, 64); err != nil || limit < 0 {
+			return permFail("invalid l= tag")
+		}
+	}
+
+	bodyHash, err := base64.StdEncoding.DecodeString(stripWSP(tags["bh"]))
+	if err != nil {
+		return permFail("invalid bh= tag")
+	}
+	signature, err := base64.StdEncoding.DecodeString(stripWSP(tags["b"]))
+	if err != nil {
+		return permFail("invalid b= tag")
+	}
+
+	records, err := lookup(result.Domain, result.Selector)
+	if err != nil {
+		result.Status = DKIMPermError
+		if errors.Is(err, ErrDKIMKeyUnavailable) {
+			result.Status = DKIMTempError
+		}
+		result.Err = fmt.Errorf("key lookup failed: %w", err)
+		return result
+	}
+	key, err := parseDKIMPublicKey(records, result.Algorithm)
+	if err != nil {
+		return permFail("%v", err)
+	}
+
+	computed := sha256.Sum256(canonicalBody(body, bodyCanon, limit))
+	if !bytes.Equal(computed[:], bodyHash) {
+		result.Status = DKIMFail
+		result.Err = errors.New("body hash did not verify")
+		return result
+	}
+
+	// Signed headers are taken from the bottom up, the signature itself is
+	// hashed last with an empty b= value.
+	all := append(append([]string{}, above...), below...)
+	hash := sha256.New()
+	for _, h := range selectHeaders(all, signedNames) {
+		hash.Write([]byte(canonicalHeader(h, headerCanon)))
+	}
+	hash.Write([]byte(strings.TrimSuffix(canonicalHeader(stripSignature(sigHeader), headerCanon), "\r\n")))
+	digest := hash.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, digest, signature) {
+			err = errors.New("ed25519 signature mismatch")
+		}
+	}
+	if err != nil {
+		result.Status = DKIMFail
+		result.Err = fmt.Errorf("signature did not verify: %w", err)
+		return result
+	}
+
+	result.Status = DKIMPass
+	return result
+}
+
+func parseDKIMPublicKey(records []string, algorithm string) (crypto.PublicKey, error) {
+	if len(records) == 0 {
+		return nil, errors.New("no key record found")
+	}
+	tags, err := parseTags(strings.Join(records, ""))
+	if err != nil {
+		return nil, fmt.Errorf("malformed key record: %v", err)
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, fmt.Errorf("unsupported key record version %q", v)
+	}
+	p := stripWSP(tags["p"])
+	if p == "" {
+		return nil, errors.New("key has been revoked")
+	}
+	raw, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, errors.New("invalid p= tag")
+	}
+
+	keyType := tags["k"]
+	if keyType == "" {
+		keyType = "rsa"
+	}
+	switch {
+	case keyType == "rsa" && algorithm == "rsa-sha256":
+		if pub, err := x509.ParsePKIXPublicKey(raw); err == nil {
+			if rsaKey, ok := pub.(*rsa.PublicKey); ok {
+				return rsaKey, nil
+			}
+			return nil, errors.New("key record does not hold an RSA key")
+		}
+		return x509.ParsePKCS1PublicKey(raw)
+	case keyType == "ed25519" && algorithm == "ed25519-sha256":
+		if len(raw) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key length")
+		}
+		return ed25519.PublicKey(raw), nil
+	default:
+		return nil, fmt.Errorf("key type %q does not match algorithm %q", keyType, algorithm)
+	}
+}
+
+// splitMessage returns the raw header fields (each including its folded
+// continuation lines and trailing CRLF) and the body of msg.
+func splitMessage(msg []byte) ([]string, []byte) {
+	var headers []string
+	rest := msg
+	for len(rest) > 0 {
+		end := bytes.Index(rest, []byte("\r\n"))
+		if end < 0 {
+			headers = append(headers, string(rest)+"\r\n")
+			return headers, nil
+		}
+		line := rest[:end+2]
+		rest = rest[end+2:]
+		if end == 0 {
+			return headers, rest
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1] += string(line)
+			continue
+		}
+		headers = append(headers, string(line))
+	}
+	return headers, nil
+}
+
+func headerName(h string) string {
+	if i := strings.IndexByte(h, ':'); i >= 0 {
+		return strings.TrimSpace(h[:i])
+	}
+	return ""
+}
+
+func headerValue(h string) string {
+	if i := strings.IndexByte(h, ':'); i >= 0 {
+		return h[i+1:]
+	}
+	return ""
+}
+
+func findHeader(headers []string, name string) *string {
+	for i := len(headers) - 1; i >= 0; i-- {
+		if strings.EqualFold(headerName(headers[i]), name) {
+			return &headers[i]
+		}
+	}
+	return nil
+}
+
+// selectHeaders picks the header instances named in h=, using the bottom
+// most unused instance for repeated names (RFC 6376 section 5.4.2).
+func selectHeaders(headers []string, names []string) []string {
+	used := make(map[int]bool)
+	var selected []string
+	for _, name := range names {
+		for i := len(headers) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(headerName(headers[i]), name) {
+				used[i] = true
+				selected = append(selected, headers[i])
+				break
+			}
+		}
+	}
+	return selected
+}
+
+var wspRun = regexp.MustCompile(`[ \t]+`)
+
+func canonicalHeader(h, canon string) string {
+	if canon == "simple" {
+		return h
+	}
+	name := strings.ToLower(headerName(h))
+	value := headerValue(h)
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = wspRun.ReplaceAllString(value, " ")
+	value = strings.TrimSpace(value)
+	return name + ":" + value + "\r\n"
+}
+
+// canonicalBody applies body canonicalization and truncates the result to
+// limit bytes when limit is not negative.
+func canonicalBody(body []byte, canon string, limit int64) []byte {
+	var out []byte
+	if canon == "relaxed" {
+		lines := strings.Split(string(body), "\r\n")
+		var b strings.Builder
+		for i, line := range lines {
+			line = wspRun.ReplaceAllString(line, " ")
+			line = strings.TrimRight(line, " ")
+			b.WriteString(line)
+			if i < len(lines)-1 {
+				b.WriteString("\r\n")
+			}
+		}
+		out = []byte(b.String())
+	} else {
+		out = append([]byte{}, body...)
+	}
+
+	for bytes.HasSuffix(out, []byte("\r\n\r\n")) {
+		out = out[:len(out)-2]
+	}
+	if len(out) > 0 && !bytes.HasSuffix(out, []byte("\r\n")) {
+		out = append(out, '\r', '\n')
+	}
+	if len(out) == 2 && canon == "relaxed" {
+		out = nil
+	}
+	if len(out) == 0 && canon == "simple" {
+		out = []byte("\r\n")
+	}
+
+	if limit >= 0 && int64(len(out)) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+var signatureValue = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+
+func stripSignature(h string) string {
+	name, value := h[:strings.IndexByte(h, ':')+1], headerValue(h)
+	trailer := ""
+	if strings.HasSuffix(value, "\r\n") {
+		value, trailer = strings.TrimSuffix(value, "\r\n"), "\r\n"
+	}
+	return name + signatureValue.ReplaceAllString(value, "$1$2") + trailer
+}
+
+// parseTags parses a DKIM tag=value list.
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid tag %q", part)
+		}
+		name := strings.TrimSpace(kv[0])
+		if _, dup := tags[name]; dup {
+			return nil, fmt.Errorf("duplicate tag %q", name)
+		}
+		tags[name] = strings.TrimSpace(kv[1])
+	}
+	return tags, nil
+}
+
+func stripWSP(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func foldTags(tags []string) string {
+	var b strings.Builder
+	lineLen := len("DKIM-Signature: ")
+	for i, tag := range tags {
+		if i > 0 {
+			b.WriteString(";")
+			lineLen++
+			if lineLen+len(tag)+1 > 76 {
+				b.WriteString("\r\n\t")
+				lineLen = 1
+			} else {
+				b.WriteString(" ")
+				lineLen++
+			}
+		}
+		b.WriteString(tag)
+		lineLen += len(tag)
+	}
+	return b.String()
+}
+
+func foldBase64(s string) string {
+	var b strings.Builder
+	for len(s) > 72 {
+		b.WriteString(s[:72])
+		b.WriteString("\r\n\t")
+		s = s[72:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+func normalizeCRLF(msg []byte) []byte {
+	if !bytes.Contains(msg, []byte("\n")) || bytes.Count(msg, []byte("\r\n")) == bytes.Count(msg, []byte("\n")) {
+		return msg
+	}
+	msg = bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(msg, []byte("\n"), []byte("\r\n"))
+}
+
+func isSubdomain(child, parent string) bool {
+	child, parent = strings.ToLower(child), strings.ToLower(parent)
+	return child == parent || strings.HasSuffix(child, "."+parent)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func crlf(s string) string {
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+// The example of RFC 6376 section 3.4.5.
+const (
+	rfc6376Headers = "A: X\r\nB : Y\t\r\n\tZ  \r\n"
+	rfc6376Body    = " C \r\nD \t E\r\n\r\n\r\n"
+)
+
+func TestCanonicalHeader(t *testing.T) {
+	headers, _ := splitMessage([]byte(rfc6376Headers + "\r\n"))
+	tests := []struct {
+		canon string
+		want  string
+	}{
+		{"relaxed", "a:X\r\nb:Y Z\r\n"},
+		{"simple", rfc6376Headers},
+	}
+	for _, tt := range tests {
+		var got strings.Builder
+		for _, h := range headers {
+			got.WriteString(canonicalHeader(h, tt.canon))
+		}
+		if got.String() != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.canon, got.String(), tt.want)
+		}
+	}
+}
+
+func TestCanonicalBody(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		canon string
+		limit int64
+		want  string
+	}{
+		{"relaxed", rfc6376Body, "relaxed", -1, " C\r\nD E\r\n"},
+		{"simple", rfc6376Body, "simple", -1, " C \r\nD \t E\r\n"},
+		{"relaxed empty", "", "relaxed", -1, ""},
+		{"simple empty", "", "simple", -1, "\r\n"},
+		{"relaxed blank lines only", "\r\n\r\n", "relaxed", -1, ""},
+		{"missing final CRLF", "abc", "simple", -1, "abc\r\n"},
+		{"length limit", rfc6376Body, "relaxed", 4, " C\r\n"},
+	}
+	for _, tt := range tests {
+		if got := string(canonicalBody([]byte(tt.body), tt.canon, tt.limit)); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// rfc8463Message is the Ed25519 example of RFC 8463 appendix A.
+var rfc8463Message = crlf(`DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;
+ d=football.example.com; i=@football.example.com;
+ q=dns/txt; s=brisbane; t=1528637909; h=from : to :
+ subject : date : message-id : from : subject : date;
+ bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;
+ b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus
+ Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==
+From: Joe SixPack <joe@football.example.com>
+To: Suzie Q <suzie@shopping.example.net>
+Subject: Is dinner ready?
+Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)
+Message-ID: <20030712040037.46341.5F8J@football.example.com>
+
+Hi.
+
+We lost the game.  Are you hungry yet?
+
+Joe.
+`)
+
+func TestVerifyDKIMRFC8463(t *testing.T) {
+	lookup := func(domain, selector string) ([]string, error) {
+		if domain != "football.example.com" || selector != "brisbane" {
+			t.Errorf("looked up %s._domainkey.%s", selector, domain)
+		}
+		return []string{"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="}, nil
+	}
+	tests := []struct {
+		name string
+		msg  string
+		want string
+	}{
+		{"original", rfc8463Message, DKIMPass},
+		{"body changed", strings.Replace(rfc8463Message, "lost", "won", 1), DKIMFail},
+		{"signed header changed", strings.Replace(rfc8463Message, "dinner", "lunch", 1), DKIMFail},
+		{"whitespace changed", strings.Replace(rfc8463Message, "Subject: Is", "Subject:   Is", 1), DKIMPass},
+	}
+	for _, tt := range tests {
+		results := VerifyDKIM([]byte(tt.msg), lookup)
+		if len(results) != 1 || results[0].Status != tt.want {
+			t.Errorf("%s: results = %+v, want %s", tt.name, results, tt.want)
+		}
+	}
+}
+
+func TestDKIMSignVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := []byte(crlf("From: Alice <alice@example.com>\nTo: bob@example.net\nSubject: Round  trip\n" +
+		"Message-ID: <1@example.com>\n\nHello  Bob, \n\n\n"))
+	tests := []struct {
+		name   string
+		key    crypto.Signer
+		record string
+	}{
+		{"rsa-sha256", rsaKey, "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPub)},
+		{"ed25519-sha256", edKey, "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edKey.Public().(ed25519.PublicKey))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer := &DKIMSigner{Domain: "example.com", Selector: "sel", Key: tt.key}
+			signed, err := signer.Sign(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasSuffix(signed, msg) {
+				t.Fatal("signing changed the message")
+			}
+			lookup := func(domain, selector string) ([]string, error) {
+				if domain != "example.com" || selector != "sel" {
+					t.Errorf("looked up %s._domainkey.%s", selector, domain)
+				}
+				return []string{tt.record}, nil
+			}
+
+			results := VerifyDKIM(signed, lookup)
+			if len(results) != 1 || results[0].Status != DKIMPass || results[0].Algorithm != tt.name {
+				t.Fatalf("results = %+v, want pass", results)
+			}
+			// Relaxed canonicalization survives whitespace changes in
+			// transit, but not changed content.
+			refolded := bytes.Replace(signed, []byte("Subject: Round  trip"), []byte("Subject:\r\n\tRound trip"), 1)
+			if results := VerifyDKIM(refolded, lookup); len(results) != 1 || results[0].Status != DKIMPass {
+				t.Errorf("refolded: results = %+v, want pass", results)
+			}
+			tampered := bytes.Replace(signed, []byte("Hello"), []byte("Jello"), 1)
+			if results := VerifyDKIM(tampered, lookup); len(results) != 1 || results[0].Status != DKIMFail {
+				t.Errorf("tampered: results = %+v, want fail", results)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package email
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrDKIMKeyExists       = errors.New("a DKIM key already exists for this selector")
+	ErrInvalidDKIMKeyParam = errors.New("invalid DKIM key parameters")
+)
+
+// dnsName matches lower case host names and selectors.
+var dnsName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+
+func dkimKeyName(domain, selector string) string {
+	return strings.ToLower(selector + "._domainkey." + domain)
+}
+
+// DKIMKey returns the private key held for selector on domain, or nil.
+func (s *Sender) DKIMKey(domain, selector string) crypto.Signer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys[dkimKeyName(domain, selector)]
+}
+
+// ActiveDKIMSelector returns the selector mail from domain is signed with,
+// or "" when it is not signed.
+func (s *Sender) ActiveDKIMSelector(domain string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if signer := s.signers[strings.ToLower(domain)]; signer != nil {
+		return signer.Selector
+	}
+	return ""
+}
+
+// ActivateDKIMKey signs mail from domain with the key held for selector.
+func (s *Sender) ActivateDKIMKey(domain, selector string) error {
+	key := s.DKIMKey(domain, selector)
+	if key == nil {
+		return fmt.Errorf("no DKIM key held for selector %s of %s", selector, domain)
+	}
+	s.SetDKIMSigner(&DKIMSigner{
+		Domain:   strings.ToLower(domain),
+		Selector: selector,
+		Key:      key,
+		Headers:  s.config.DKIMHeaders,
+	})
+	return nil
+}
+
+// GenerateDKIMKey creates a key pair for selector on domain and stores the
+// private key in the DKIM key directory. The key is held but not used for
+// signing until it is activated. Algorithm is "rsa", with bits of 2048,
+// 3072 or 4096, or "ed25519".
+func (s *Sender) GenerateDKIMKey(domain, selector, algorithm string, bits int) (crypto.Signer, error) {
+	domain, selector = strings.ToLower(domain), strings.ToLower(selector)
+	if !dnsName.MatchString(domain) || !dnsName.MatchString(selector) {
+		return nil, fmt.Errorf("%w: domain and selector must be DNS names", ErrInvalidDKIMKeyParam)
+	}
+
+	var key crypto.Signer
+	var err error
+	switch algorithm {
+	case "rsa":
+		if bits != 2048 && bits != 3072 && bits != 4096 {
+			return nil, fmt.Errorf("%w: RSA keys must be 2048, 3072 or 4096 bits", ErrInvalidDKIMKeyParam)
+		}
+		key, err = rsa.GenerateKey(rand.Reader, bits)
+	case "ed25519":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("%w: algorithm must be rsa or ed25519", ErrInvalidDKIMKeyParam)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate DKIM key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := dkimKeyName(domain, selector)
+	if s.keys[name] != nil {
+		return nil, ErrDKIMKeyExists
+	}
+	dir := filepath.Join(s.dkimKeyDir(), domain)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create DKIM key directory: %w", err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, selector+".pem"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		return nil, ErrDKIMKeyExists
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to store DKIM key: %w", err)
+	}
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to store DKIM key: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("failed to store DKIM key: %w", err)
+	}
+	s.keys[name] = key
+	return key, nil
+}
+
+// RemoveDKIMKey forgets the key held for selector on domain and deletes it
+// from the DKIM key directory. Mail from domain is no longer signed if it
+// was the active key.
+func (s *Sender) RemoveDKIMKey(domain, selector string) error {
+	domain, selector = strings.ToLower(domain), strings.ToLower(selector)
+	if !dnsName.MatchString(domain) || !dnsName.MatchString(selector) {
+		return fmt.Errorf("%w: domain and selector must be DNS names", ErrInvalidDKIMKeyParam)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, dkimKeyName(domain, selector))
+	if signer := s.signers[domain]; signer != nil && strings.EqualFold(signer.Selector, selector) {
+		delete(s.signers, domain)
+	}
+	err := os.Remove(filepath.Join(s.dkimKeyDir(), domain, selector+".pem"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete DKIM key: %w", err)
+	}
+	return nil
+}
+
+// RemoveDKIMKeys stops signing mail from domain and deletes the keys
+// generated for it, except those of the selectors in keep.
+func (s *Sender) RemoveDKIMKeys(domain string, keep ...string) error {
+	domain = strings.ToLower(domain)
+	if !dnsName.MatchString(domain) {
+		return fmt.Errorf("%w: domain must be a DNS name", ErrInvalidDKIMKeyParam)
+	}
+	kept := make(map[string]bool)
+	for _, selector := range keep {
+		kept[strings.ToLower(selector)] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.signers, domain)
+	for name := range s.keys {
+		selector, ok := strings.CutSuffix(name, "._domainkey."+domain)
+		if ok && !kept[selector] {
+			delete(s.keys, name)
+		}
+	}
+
+	dir := filepath.Join(s.dkimKeyDir(), domain)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read DKIM key directory: %w", err)
+	}
+	for _, e := range entries {
+		selector, ok := strings.CutSuffix(e.Name(), ".pem")
+		if !ok || kept[selector] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			return fmt.Errorf("failed to delete DKIM key: %w", err)
+		}
+	}
+	if len(kept) == 0 {
+		os.Remove(dir)
+	}
+	return nil
+}
+
+// loadDKIMKeyDir holds the keys stored as <dir>/<domain>/<selector>.pem.
+func (s *Sender) loadDKIMKeyDir() error {
+	domains, err := os.ReadDir(s.dkimKeyDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, d := range domains {
+		if !d.IsDir() {
+			continue
+		}
+		files, err := filepath.Glob(filepath.Join(s.dkimKeyDir(), d.Name(), "*.pem"))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			key, err := LoadDKIMKey(file)
+			if err != nil {
+				return fmt.Errorf("failed to load DKIM key %s: %w", file, err)
+			}
+			selector := strings.TrimSuffix(filepath.Base(file), ".pem")
+			s.keys[dkimKeyName(d.Name(), selector)] = key
+		}
+	}
+	return nil
+}
+
+func (s *Sender) dkimKeyDir() string {
+	if s.config.DKIMKeyDir == "" {
+		return "dkim"
+	}
+	return s.config.DKIMKeyDir
+}
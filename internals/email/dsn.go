@@ -0,0 +1,219 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// DSN actions, RFC 3464 section 2.3.3.
+const (
+	ActionFailed    = "failed"
+	ActionDelayed   = "delayed"
+	ActionDelivered = "delivered"
+	ActionRelayed   = "relayed"
+)
+
+// DSNRecipient is the per-recipient part of a delivery status notification.
+type DSNRecipient struct {
+	OriginalRecipient string
+	FinalRecipient    string
+	Action            string
+	Status            string
+	RemoteMTA         string
+	Diagnostic        string
+	LastAttempt       time.Time
+}
+
+// DSN describes a multipart/report delivery status notification (RFC 3464)
+// sent back to the envelope sender of a message.
+type DSN struct {
+	ReportingMTA string
+	EnvelopeID   string
+	To           string
+	ArrivalDate  time.Time
+	Recipients   []DSNRecipient
+	// Original is the message the report is about. Only its header is
+	// returned unless ReturnFull is set.
+	Original   []byte
+	ReturnFull bool
+}
+
+// Bytes renders the notification as a complete RFC 5322 message.
+func (d *DSN) Bytes() ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	var buf bytes.Buffer
+	from := "MAILER-DAEMON@" + d.ReportingMTA
+	fmt.Fprintf(&buf, "From: Mail Delivery System <%s>\r\n", from)
+	fmt.Fprintf(&buf, "To: <%s>\r\n", d.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", d.subject())
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", newMessageID(), d.ReportingMTA)
+	fmt.Fprintf(&buf, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/report; report-type=delivery-status; boundary=\"%s\"\r\n", mw.Boundary())
+	buf.WriteString("\r\n")
+
+	text, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"text/plain; charset=UTF-8"},
+		"Content-Description": {"Notification"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	text.Write([]byte(d.humanReadable()))
+
+	status, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"message/delivery-status"},
+		"Content-Description": {"Delivery report"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	status.Write([]byte(d.deliveryStatus()))
+
+	if len(d.Original) > 0 {
+		contentType, original := "text/rfc822-headers", headerOf(d.Original)
+		if d.ReturnFull {
+			contentType, original = "message/rfc822", d.Original
+		}
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":        {contentType},
+			"Content-Description": {"Undelivered message"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		part.Write(original)
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+func (d *DSN) action() string {
+	if len(d.Recipients) == 0 {
+		return ActionFailed
+	}
+	return d.Recipients[0].Action
+}
+
+func (d *DSN) subject() string {
+	switch d.action() {
+	case ActionDelayed:
+		return "Delayed Mail (still being retried)"
+	case ActionDelivered, ActionRelayed:
+		return "Successful Mail Delivery Report"
+	default:
+		return "Undelivered Mail Returned to Sender"
+	}
+}
+
+func (d *DSN) humanReadable() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "This is the mail system at host %s.\r\n\r\n", d.ReportingMTA)
+	switch d.action() {
+	case ActionDelayed:
+		b.WriteString("Your message could not be delivered yet to the following recipients.\r\n")
+		b.WriteString("The mail system will keep trying, no action is required on your part.\r\n\r\n")
+	case ActionDelivered, ActionRelayed:
+		b.WriteString("Your message was successfully delivered to the following recipients.\r\n\r\n")
+	default:
+		b.WriteString("Your message could not be delivered to one or more recipients.\r\n")
+		b.WriteString("This is a permanent error, the message will not be retried.\r\n\r\n")
+	}
+	for _, r := range d.Recipients {
+		fmt.Fprintf(&b, "<%s>", r.FinalRecipient)
+		if r.RemoteMTA != "" && r.Diagnostic != "" {
+			fmt.Fprintf(&b, ": host %s said: %s", r.RemoteMTA, strings.TrimPrefix(r.Diagnostic, "smtp; "))
+		} else if r.Diagnostic != "" {
+			fmt.Fprintf(&b, ": %s", strings.TrimPrefix(r.Diagnostic, "smtp; "))
+		}
+		b.WriteString("\r\n")
+	}
+	return b.String()
+}
+
+func (d *DSN) deliveryStatus() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\r\n", d.ReportingMTA)
+	if d.EnvelopeID != "" {
+		fmt.Fprintf(&b, "Original-Envelope-Id: %s\r\n", d.EnvelopeID)
+	}
+	if !d.ArrivalDate.IsZero() {
+		fmt.Fprintf(&b, "Arrival-Date: %s\r\n", d.ArrivalDate.Format(time.RFC1123Z))
+	}
+	for _, r := range d.Recipients {
+		b.WriteString("\r\n")
+		if r.OriginalRecipient != "" {
+			fmt.Fprintf(&b, "Original-Recipient: rfc822; %s\r\n", r.OriginalRecipient)
+		}
+		fmt.Fprintf(&b, "Final-Recipient: rfc822; %s\r\n", r.FinalRecipient)
+		fmt.Fprintf(&b, "Action: %s\r\n", r.Action)
+		fmt.Fprintf(&b, "Status: %s\r\n", r.Status)
+		if r.RemoteMTA != "" {
+			fmt.Fprintf(&b, "Remote-MTA: dns; %s\r\n", r.RemoteMTA)
+		}
+		if strings.HasPrefix(r.Diagnostic, "smtp; ") {
+			fmt.Fprintf(&b, "Diagnostic-Code: %s\r\n", r.Diagnostic)
+		}
+		if !r.LastAttempt.IsZero() {
+			fmt.Fprintf(&b, "Last-Attempt-Date: %s\r\n", r.LastAttempt.Format(time.RFC1123Z))
+		}
+	}
+	return b.String()
+}
+
+// DeliveryStatus maps a delivery error to an RFC 3463 status code and a
+// diagnostic suitable for a DSN. SMTP replies produce an "smtp; ..."
+// diagnostic carrying the remote reply verbatim.
+func DeliveryStatus(err error) (status, diagnostic string) {
+	if err == nil {
+		return "2.0.0", ""
+	}
+
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		ec := smtpErr.EnhancedCode
+		if ec == (smtp.EnhancedCode{}) || ec == smtp.NoEnhancedCode {
+			ec = smtp.EnhancedCode{smtpErr.Code / 100, 0, 0}
+		}
+		status = fmt.Sprintf("%d.%d.%d", ec[0], ec[1], ec[2])
+		diagnostic = fmt.Sprintf("smtp; %d %s %s", smtpErr.Code, status, strings.ReplaceAll(smtpErr.Message, "\n", " "))
+		return status, diagnostic
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return "5.1.2", err.Error()
+	}
+	return "4.4.1", err.Error()
+}
+
+// headerOf returns the header section of a message, including the blank
+// line that terminates it.
+func headerOf(msg []byte) []byte {
+	var out bytes.Buffer
+	r := bufio.NewReader(bytes.NewReader(msg))
+	for {
+		line, err := r.ReadBytes('\n')
+		out.Write(line)
+		if err != nil || len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+	}
+	return out.Bytes()
+}
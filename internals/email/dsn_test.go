@@ -0,0 +1,158 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const originalMessage = "From: alice@alice.test\r\nTo: bob@bob.test\r\nSubject: hi\r\n\r\nsecret body\r\n"
+
+// dsnParts parses a rendered DSN and returns its top-level header and the
+// content type and body of each part.
+func dsnParts(t *testing.T, raw []byte) (mail.Header, []string, [][]byte) {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || params["report-type"] != "delivery-status" {
+		t.Fatalf("Content-Type = %q, want multipart/report; report-type=delivery-status", msg.Header.Get("Content-Type"))
+	}
+	var types []string
+	var bodies [][]byte
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(part)
+		types = append(types, part.Header.Get("Content-Type"))
+		bodies = append(bodies, body)
+	}
+	return msg.Header, types, bodies
+}
+
+func TestDSNStructure(t *testing.T) {
+	last := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	d := &DSN{
+		ReportingMTA: "mx.sender.test",
+		EnvelopeID:   "env-1",
+		To:           "alice@alice.test",
+		ArrivalDate:  last.Add(-time.Hour),
+		Original:     []byte(originalMessage),
+		Recipients: []DSNRecipient{{
+			OriginalRecipient: "rfc822;Bob@bob.test",
+			FinalRecipient:    "bob@bob.test",
+			Action:            ActionFailed,
+			Status:            "5.1.1",
+			RemoteMTA:         "mx.bob.test",
+			Diagnostic:        "smtp; 550 5.1.1 No such user",
+			LastAttempt:       last,
+		}},
+	}
+	raw, err := d.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, types, bodies := dsnParts(t, raw)
+	if header.Get("To") != "<alice@alice.test>" || header.Get("Auto-Submitted") != "auto-replied" ||
+		header.Get("Subject") != "Undelivered Mail Returned to Sender" || !strings.HasPrefix(header.Get("From"), "Mail Delivery System <MAILER-DAEMON@mx.sender.test>") {
+		t.Errorf("header = %v", header)
+	}
+	if len(types) != 3 || !strings.HasPrefix(types[0], "text/plain") || types[1] != "message/delivery-status" || types[2] != "text/rfc822-headers" {
+		t.Fatalf("parts = %q, want text/plain, message/delivery-status, text/rfc822-headers", types)
+	}
+	if !strings.Contains(string(bodies[0]), "host mx.bob.test said: 550 5.1.1 No such user") {
+		t.Errorf("notification = %q", bodies[0])
+	}
+
+	// The per-message fields and each recipient are header blocks
+	// separated by blank lines (RFC 3464 section 2.1).
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(bodies[1])))
+	perMessage, err := r.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perMessage.Get("Reporting-MTA") != "dns; mx.sender.test" || perMessage.Get("Original-Envelope-Id") != "env-1" || perMessage.Get("Arrival-Date") == "" {
+		t.Errorf("per-message fields = %v", perMessage)
+	}
+	perRecipient, err := r.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"Original-Recipient": "rfc822; rfc822;Bob@bob.test",
+		"Final-Recipient":    "rfc822; bob@bob.test",
+		"Action":             "failed",
+		"Status":             "5.1.1",
+		"Remote-Mta":         "dns; mx.bob.test",
+		"Diagnostic-Code":    "smtp; 550 5.1.1 No such user",
+		"Last-Attempt-Date":  last.Format(time.RFC1123Z),
+	}
+	for field, value := range want {
+		if got := perRecipient.Get(field); got != value {
+			t.Errorf("%s = %q, want %q", field, got, value)
+		}
+	}
+
+	if strings.Contains(string(bodies[2]), "secret body") || !strings.Contains(string(bodies[2]), "Subject: hi") {
+		t.Errorf("returned headers = %q, want the header without the body", bodies[2])
+	}
+}
+
+func TestDSNReturnFull(t *testing.T) {
+	d := &DSN{ReportingMTA: "mx.sender.test", To: "alice@alice.test", Original: []byte(originalMessage), ReturnFull: true,
+		Recipients: []DSNRecipient{{FinalRecipient: "bob@bob.test", Action: ActionDelayed, Status: "4.4.1"}}}
+	raw, err := d.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, types, bodies := dsnParts(t, raw)
+	if header.Get("Subject") != "Delayed Mail (still being retried)" {
+		t.Errorf("Subject = %q", header.Get("Subject"))
+	}
+	if len(types) != 3 || types[2] != "message/rfc822" || string(bodies[2]) != originalMessage {
+		t.Errorf("parts = %q, want the full message returned", types)
+	}
+}
+
+func TestDeliveryStatus(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		status         string
+		diagnosticPart string
+	}{
+		{"delivered", nil, "2.0.0", ""},
+		{"enhanced code", &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Relay\ndenied"}, "5.7.1", "smtp; 550 5.7.1 Relay denied"},
+		{"basic code", &smtp.SMTPError{Code: 452, EnhancedCode: smtp.NoEnhancedCode, Message: "Full"}, "4.0.0", "smtp; 452 4.0.0 Full"},
+		{"unknown domain", &net.DNSError{Err: "no such host", Name: "nowhere.test", IsNotFound: true}, "5.1.2", "nowhere.test"},
+		{"network error", errors.New("connection refused"), "4.4.1", "connection refused"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, diagnostic := DeliveryStatus(tt.err)
+			if status != tt.status || !strings.Contains(diagnostic, tt.diagnosticPart) {
+				t.Errorf("DeliveryStatus = %q, %q, want %q, %q", status, diagnostic, tt.status, tt.diagnosticPart)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// ErrNotFeedbackReport is returned for messages that are not abuse reports.
+var ErrNotFeedbackReport = errors.New("message is not a feedback report")
+
+// FeedbackReport is an abuse report in the Abuse Reporting Format
+// (RFC 5965), as sent by the feedback loops of mailbox providers when a
+// recipient marks a message as spam.
+type FeedbackReport struct {
+	FeedbackType     string
+	UserAgent        string
+	OriginalMailFrom string
+	// Recipients are the Original-Rcpt-To fields, or the To addresses of
+	// the reported message when the report leaves them out.
+	Recipients []string
+	// MessageID is the Message-ID of the reported message, without angle
+	// brackets.
+	MessageID string
+}
+
+// ParseFeedbackReport extracts the report and the identity of the reported
+// message from a multipart/report message with report-type feedback-report.
+func ParseFeedbackReport(raw []byte) (*FeedbackReport, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse report: %w", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || !strings.EqualFold(params["report-type"], "feedback-report") || params["boundary"] == "" {
+		return nil, ErrNotFeedbackReport
+	}
+
+	report := &FeedbackReport{}
+	var found bool
+	var to []string
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read report: %w", err)
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch partType {
+		case "message/feedback-report":
+			fields, err := textproto.NewReader(bufio.NewReader(part)).ReadMIMEHeader()
+			if err != nil && err != io.EOF {
+				return nil, fmt.Errorf("failed to read feedback fields: %w", err)
+			}
+			found = true
+			report.FeedbackType = strings.ToLower(fields.Get("Feedback-Type"))
+			report.UserAgent = fields.Get("User-Agent")
+			report.OriginalMailFrom = strings.Trim(fields.Get("Original-Mail-From"), "<> ")
+			for _, rcpt := range fields.Values("Original-Rcpt-To") {
+				report.Recipients = append(report.Recipients, strings.Trim(rcpt, "<> "))
+			}
+		case "message/rfc822", "text/rfc822-headers":
+			data, err := io.ReadAll(part)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read reported message: %w", err)
+			}
+			// A bare header section has no blank line to end it.
+			original, err := mail.ReadMessage(io.MultiReader(bytes.NewReader(data), strings.NewReader("\r\n\r\n")))
+			if err != nil {
+				continue
+			}
+			report.MessageID = strings.Trim(original.Header.Get("Message-Id"), "<> ")
+			if addrs, err := original.Header.AddressList("To"); err == nil {
+				for _, a := range addrs {
+					to = append(to, a.Address)
+				}
+			}
+		}
+	}
+	if !found || report.FeedbackType == "" {
+		return nil, ErrNotFeedbackReport
+	}
+	if len(report.Recipients) == 0 {
+		report.Recipients = to
+	}
+	return report, nil
+}
@@ -0,0 +1,86 @@
+package email
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// arf builds a feedback report with the given feedback fields and the
+// reported message (or its header) as the third part.
+func arf(fields, originalType, original string) []byte {
+	return []byte(strings.ReplaceAll(`From: <fbl@isp.example>
+To: <fbl@mail.alice.test>
+Subject: FW: hello
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=feedback-report; boundary="part"
+
+--part
+Content-Type: text/plain
+
+This is an email abuse report.
+--part
+Content-Type: message/feedback-report
+
+`+fields+`
+--part
+Content-Type: `+originalType+`
+
+`+original+`
+--part--
+`, "\n", "\r\n"))
+}
+
+const reportedMessage = `From: alice@alice.test
+To: Bob <bob@bob.test>, carol@carol.test
+Message-ID: <18df3adfb1b4ebd5@alice.test>
+Subject: hello
+
+hi
+`
+
+func TestParseFeedbackReport(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		want FeedbackReport
+	}{
+		{
+			name: "full report",
+			raw: arf("Feedback-Type: abuse\nUser-Agent: ISP-FBL/1.0\nVersion: 1\nOriginal-Mail-From: <alice@alice.test>\nOriginal-Rcpt-To: <bob@bob.test>",
+				"message/rfc822", reportedMessage),
+			want: FeedbackReport{FeedbackType: "abuse", UserAgent: "ISP-FBL/1.0", OriginalMailFrom: "alice@alice.test", Recipients: []string{"bob@bob.test"}, MessageID: "18df3adfb1b4ebd5@alice.test"},
+		},
+		{
+			name: "recipients from the reported header",
+			raw:  arf("Feedback-Type: Abuse\nVersion: 1", "text/rfc822-headers", strings.Split(reportedMessage, "\n\n")[0]),
+			want: FeedbackReport{FeedbackType: "abuse", Recipients: []string{"bob@bob.test", "carol@carol.test"}, MessageID: "18df3adfb1b4ebd5@alice.test"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseFeedbackReport(tt.raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.FeedbackType != tt.want.FeedbackType || got.UserAgent != tt.want.UserAgent ||
+				got.OriginalMailFrom != tt.want.OriginalMailFrom || got.MessageID != tt.want.MessageID ||
+				strings.Join(got.Recipients, ",") != strings.Join(tt.want.Recipients, ",") {
+				t.Errorf("ParseFeedbackReport = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFeedbackReportRejectsOtherMessages(t *testing.T) {
+	for name, raw := range map[string]string{
+		"plain message":    reportedMessage,
+		"delivery report":  strings.Replace(string(arf("Feedback-Type: abuse", "message/rfc822", reportedMessage)), "feedback-report;", "delivery-status;", 1),
+		"no feedback type": string(arf("Version: 1", "message/rfc822", reportedMessage)),
+		"no feedback part": strings.Replace(string(arf("Feedback-Type: abuse", "message/rfc822", reportedMessage)), "message/feedback-report", "text/plain", 1),
+	} {
+		if _, err := ParseFeedbackReport([]byte(raw)); !errors.Is(err, ErrNotFeedbackReport) {
+			t.Errorf("%s: err = %v, want ErrNotFeedbackReport", name, err)
+		}
+	}
+}
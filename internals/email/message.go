@@ -0,0 +1,378 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Attachment is a file carried by a message. Attachments with a ContentID
+// are placed inline next to the HTML body so it can reference them with
+// cid: URLs.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	ContentID   string
+	Data        []byte
+}
+
+// ErrInvalidHeader is returned by Message.Bytes for header fields that would
+// break the message apart or replace one the builder writes itself.
+var ErrInvalidHeader = errors.New("invalid header")
+
+// builderHeaders are written by Message.Bytes and cannot be set through
+// Headers, nor can any Content-* field.
+var builderHeaders = map[string]bool{
+	"From": true, "Sender": true, "To": true, "Cc": true, "Bcc": true,
+	"Reply-To": true, "Subject": true, "Date": true, "Message-Id": true,
+	"Mime-Version": true,
+}
+
+// Message is an outgoing message rendered to RFC 5322 / RFC 2045 format by
+// Bytes. Bcc recipients are never written to the header.
+type Message struct {
+	From        string
+	To          []string
+	Cc          []string
+	ReplyTo     string
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []Attachment
+	Headers     map[string]string
+	MessageID   string
+	Date        time.Time
+}
+
+// Bytes renders the message.
+func (m *Message) Bytes() ([]byte, error) {
+	if m.Text == "" && m.HTML == "" && len(m.Attachments) == 0 {
+		return nil, errors.New("message has no content")
+	}
+
+	from, err := formatAddressList([]string{m.From})
+	if err != nil {
+		return nil, fmt.Errorf("invalid From address: %w", err)
+	}
+
+	var buf bytes.Buffer
+	writeHeader(&buf, "From", from)
+	if len(m.To) > 0 {
+		to, err := formatAddressList(m.To)
+		if err != nil {
+			return nil, fmt.Errorf("invalid To address: %w", err)
+		}
+		writeHeader(&buf, "To", to)
+	}
+	if len(m.Cc) > 0 {
+		cc, err := formatAddressList(m.Cc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Cc address: %w", err)
+		}
+		writeHeader(&buf, "Cc", cc)
+	}
+	if m.ReplyTo != "" {
+		replyTo, err := formatAddressList([]string{m.ReplyTo})
+		if err != nil {
+			return nil, fmt.Errorf("invalid Reply-To address: %w", err)
+		}
+		writeHeader(&buf, "Reply-To", replyTo)
+	}
+	if err := checkHeaderValue("Subject", m.Subject); err != nil {
+		return nil, err
+	}
+	writeHeader(&buf, "Subject", encodeHeaderValue(m.Subject))
+
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	writeHeader(&buf, "Date", date.Format(time.RFC1123Z))
+
+	messageID := m.MessageID
+	if err := checkHeaderValue("Message-ID", messageID); err != nil {
+		return nil, err
+	}
+	if messageID == "" {
+		messageID = newMessageID() + "@" + domainOf(m.From)
+	}
+	writeHeader(&buf, "Message-ID", "<"+strings.Trim(messageID, "<>")+">")
+
+	names := make([]string, 0, len(m.Headers))
+	for name := range m.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := checkHeader(name, m.Headers[name]); err != nil {
+			return nil, err
+		}
+		writeHeader(&buf, textproto.CanonicalMIMEHeaderKey(name), encodeHeaderValue(m.Headers[name]))
+	}
+
+	writeHeader(&buf, "MIME-Version", "1.0")
+
+	for _, a := range m.Attachments {
+		for name, value := range map[string]string{"Content-Type": a.ContentType, "Content-ID": a.ContentID, "filename": a.Filename} {
+			if err := checkHeaderValue(name, value); err != nil {
+				return nil, fmt.Errorf("attachment %q: %w", a.Filename, err)
+			}
+		}
+	}
+
+	header, body, err := m.root().render()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		writeHeader(&buf, k, header.Get(k))
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+// root builds the MIME tree:
+//
+//	mixed
+//	├── alternative
+//	│   ├── text/plain
+//	│   └── related
+//	│       ├── text/html
+//	│       └── inline images
+//	└── attachments
+//
+// collapsing every level that would only have one child.
+func (m *Message) root() *mimePart {
+	var inline, attached []Attachment
+	for _, a := range m.Attachments {
+		if a.ContentID != "" && m.HTML != "" {
+			inline = append(inline, a)
+		} else {
+			attached = append(attached, a)
+		}
+	}
+
+	var html *mimePart
+	if m.HTML != "" {
+		html = textPart("text/html", m.HTML)
+		if len(inline) > 0 {
+			related := &mimePart{subtype: "related", children: []*mimePart{html}}
+			for _, a := range inline {
+				related.children = append(related.children, attachmentPart(a, true))
+			}
+			html = related
+		}
+	}
+
+	var body *mimePart
+	switch {
+	case m.Text != "" && html != nil:
+		body = &mimePart{subtype: "alternative", children: []*mimePart{textPart("text/plain", m.Text), html}}
+	case html != nil:
+		body = html
+	case m.Text != "":
+		body = textPart("text/plain", m.Text)
+	}
+
+	if len(attached) == 0 {
+		return body
+	}
+	mixed := &mimePart{subtype: "mixed"}
+	if body != nil {
+		mixed.children = append(mixed.children, body)
+	}
+	for _, a := range attached {
+		mixed.children = append(mixed.children, attachmentPart(a, false))
+	}
+	return mixed
+}
+
+type mimePart struct {
+	header   textproto.MIMEHeader
+	body     []byte
+	subtype  string
+	children []*mimePart
+}
+
+func (p *mimePart) render() (textproto.MIMEHeader, []byte, error) {
+	if p.subtype == "" {
+		return p.header, p.body, nil
+	}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for _, child := range p.children {
+		header, body, err := child.render()
+		if err != nil {
+			return nil, nil, err
+		}
+		pw, err := w.CreatePart(header)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := pw.Write(body); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", fmt.Sprintf("multipart/%s; boundary=%q", p.subtype, w.Boundary()))
+	return header, buf.Bytes(), nil
+}
+
+func textPart(contentType, content string) *mimePart {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType+"; charset=UTF-8")
+
+	content = strings.ReplaceAll(strings.ReplaceAll(content, "\r\n", "\n"), "\n", "\r\n")
+	if needsEncoding(content) {
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		var buf bytes.Buffer
+		qp := quotedprintable.NewWriter(&buf)
+		qp.Write([]byte(content))
+		qp.Close()
+		return &mimePart{header: header, body: buf.Bytes()}
+	}
+	header.Set("Content-Transfer-Encoding", "7bit")
+	return &mimePart{header: header, body: []byte(content)}
+}
+
+func attachmentPart(a Attachment, inline bool) *mimePart {
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(a.Filename))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	header := textproto.MIMEHeader{}
+	disposition := "attachment"
+	if inline {
+		disposition = "inline"
+		header.Set("Content-ID", "<"+strings.Trim(a.ContentID, "<>")+">")
+	}
+	if a.Filename != "" {
+		header.Set("Content-Type", mime.FormatMediaType(contentType, map[string]string{"name": a.Filename}))
+		disposition = mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename})
+	} else {
+		header.Set("Content-Type", contentType)
+	}
+	header.Set("Content-Disposition", disposition)
+	header.Set("Content-Transfer-Encoding", "base64")
+
+	encoded := base64.StdEncoding.EncodeToString(a.Data)
+	var body bytes.Buffer
+	for len(encoded) > 76 {
+		body.WriteString(encoded[:76])
+		body.WriteString("\r\n")
+		encoded = encoded[76:]
+	}
+	body.WriteString(encoded)
+	body.WriteString("\r\n")
+	return &mimePart{header: header, body: body.Bytes()}
+}
+
+// needsEncoding reports whether content cannot be sent as 7bit: it has
+// non-ASCII characters or lines longer than RFC 5322 allows.
+func needsEncoding(content string) bool {
+	for _, line := range strings.Split(content, "\r\n") {
+		if len(line) > 76 {
+			return true
+		}
+	}
+	for i := 0; i < len(content); i++ {
+		if content[i] >= utf8.RuneSelf || (content[i] < ' ' && content[i] != '\r' && content[i] != '\n' && content[i] != '\t') {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHeader accepts an extra header field: its name must be an RFC 5322
+// field name that the builder does not write.
+func checkHeader(name, value string) error {
+	if name == "" {
+		return fmt.Errorf("%w: empty field name", ErrInvalidHeader)
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' || name[i] == ':' {
+			return fmt.Errorf("%w: %q is not a valid field name", ErrInvalidHeader, name)
+		}
+	}
+	canonical := textproto.CanonicalMIMEHeaderKey(name)
+	if builderHeaders[canonical] || strings.HasPrefix(canonical, "Content-") {
+		return fmt.Errorf("%w: %s is set by the message builder", ErrInvalidHeader, canonical)
+	}
+	return checkHeaderValue(canonical, value)
+}
+
+// checkHeaderValue refuses line breaks, which would end the field and let
+// the value add fields or start the body.
+func checkHeaderValue(name, value string) error {
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("%w: %s contains a line break", ErrInvalidHeader, name)
+	}
+	return nil
+}
+
+func formatAddressList(addresses []string) (string, error) {
+	formatted := make([]string, 0, len(addresses))
+	for _, a := range addresses {
+		addr, err := mail.ParseAddress(a)
+		if err != nil {
+			return "", err
+		}
+		formatted = append(formatted, addr.String())
+	}
+	return strings.Join(formatted, ", "), nil
+}
+
+// encodeHeaderValue applies RFC 2047 encoding to values that are not plain
+// ASCII.
+func encodeHeaderValue(value string) string {
+	for i := 0; i < len(value); i++ {
+		if value[i] >= utf8.RuneSelf {
+			return mime.QEncoding.Encode("UTF-8", value)
+		}
+	}
+	return value
+}
+
+// writeHeader writes a header field folded at whitespace so no line is
+// longer than 78 characters where possible.
+func writeHeader(buf *bytes.Buffer, name, value string) {
+	line := name + ":"
+	lineLen := len(line)
+	buf.WriteString(line)
+	for i, word := range strings.Split(value, " ") {
+		if i > 0 && lineLen+1+len(word) > 78 {
+			buf.WriteString("\r\n")
+			lineLen = 0
+		}
+		buf.WriteString(" ")
+		buf.WriteString(word)
+		lineLen += 1 + len(word)
+	}
+	buf.WriteString("\r\n")
+}
@@ -0,0 +1,70 @@
+package email
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMessageHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     Message
+		wantErr bool
+	}{
+		{"extra header", Message{Headers: map[string]string{"X-Campaign": "spring"}}, false},
+		{"line break in subject", Message{Subject: "hi\r\nBcc: victim@example.net"}, true},
+		{"bare LF in subject", Message{Subject: "hi\n\nbody"}, true},
+		{"line break in header value", Message{Headers: map[string]string{"X-Tag": "a\r\nTo: victim@example.net"}}, true},
+		{"line break in message id", Message{MessageID: "1@example.com>\r\nX-Evil: <2"}, true},
+		{"space in field name", Message{Headers: map[string]string{"X Tag": "a"}}, true},
+		{"colon in field name", Message{Headers: map[string]string{"X-Tag:": "a"}}, true},
+		{"empty field name", Message{Headers: map[string]string{"": "a"}}, true},
+		{"From", Message{Headers: map[string]string{"from": "ceo@example.org"}}, true},
+		{"Sender", Message{Headers: map[string]string{"Sender": "ceo@example.org"}}, true},
+		{"Message-ID", Message{Headers: map[string]string{"Message-ID": "<1@example.org>"}}, true},
+		{"MIME-Version", Message{Headers: map[string]string{"MIME-Version": "1.0"}}, true},
+		{"Content-Type", Message{Headers: map[string]string{"content-type": "text/html"}}, true},
+		{"line break in attachment content id", Message{Attachments: []Attachment{{Filename: "a.png", ContentID: "a\r\nX-Evil: 1", Data: []byte("x")}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.msg
+			m.From, m.To, m.Text = "alice@example.com", []string{"bob@example.net"}, "hello"
+			raw, err := m.Bytes()
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidHeader) {
+					t.Fatalf("err = %v, want ErrInvalidHeader", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range m.Headers {
+				if !strings.Contains(string(raw), name+": "+value+"\r\n") {
+					t.Errorf("message lacks %s header:\n%s", name, raw)
+				}
+			}
+		})
+	}
+}
+
+func TestMessageAddressInjection(t *testing.T) {
+	m := Message{
+		From:    `"Alice\r\nBcc: victim@example.net" <alice@example.com>`,
+		To:      []string{"bob@example.net"},
+		ReplyTo: "Evil\r\nX-Injected: 1 <evil@example.com>",
+		Text:    "hello",
+	}
+	raw, err := m.Bytes()
+	if err != nil {
+		return
+	}
+	header, _, _ := strings.Cut(string(raw), "\r\n\r\n")
+	for _, line := range strings.Split(header, "\r\n") {
+		if strings.HasPrefix(line, "Bcc:") || strings.HasPrefix(line, "X-Injected:") {
+			t.Errorf("address injected a header line %q", line)
+		}
+	}
+}
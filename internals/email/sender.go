@@ -2,16 +2,22 @@ package email
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/rand"
 	"email-blaze/internals/config"
 	"email-blaze/internals/logger"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"mime"
+	"net"
 	"net/mail"
-
-	"github.com/emersion/go-sasl"
-	"github.com/emersion/go-smtp"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Email struct {
@@ -22,142 +28,336 @@ type Email struct {
 }
 
 type Sender struct {
-	config *config.Config
-}
+	config   *config.Config
+	resolver Resolver
 
-func NewSender(cfg *config.Config) *Sender {
-	return &Sender{config: cfg}
+	mu      sync.RWMutex
+	signers map[string]*DKIMSigner
+	keys    map[string]crypto.Signer // every key held, by selector._domainkey.domain
 }
 
-func (s *Sender) Send(from, to, subject, body string, html bool, domain string) error {
-	logger.Info("Starting email send process",
-		logger.Field("from", from),
-		logger.Field("to", to),
-		logger.Field("subject", subject),
-		logger.Field("html", html),
-		logger.Field("domain", domain))
+func NewSender(cfg *config.Config) (*Sender, error) {
+	s := &Sender{
+		config:   cfg,
+		resolver: net.DefaultResolver,
+		signers:  make(map[string]*DKIMSigner),
+		keys:     make(map[string]crypto.Signer),
+	}
+	if err := s.loadDKIMKeyDir(); err != nil {
+		return nil, err
+	}
+	for _, k := range cfg.DKIMKeys {
+		key, err := LoadDKIMKey(k.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load DKIM key for %s: %w", k.Domain, err)
+		}
+		s.SetDKIMSigner(&DKIMSigner{
+			Domain:   k.Domain,
+			Selector: k.Selector,
+			Key:      key,
+			Headers:  cfg.DKIMHeaders,
+		})
+	}
+	return s, nil
+}
 
-	auth := sasl.NewPlainClient("", s.config.DefaultUser.Email, s.config.DefaultUser.Password)
+// SetDKIMSigner installs the signer used for messages whose From address is
+// on signer.Domain, replacing any previous one.
+func (s *Sender) SetDKIMSigner(signer *DKIMSigner) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.signers[strings.ToLower(signer.Domain)] = signer
+	s.keys[dkimKeyName(signer.Domain, signer.Selector)] = signer.Key
+}
 
-	logger.Info("Dialing SMTP server", logger.Field("address", fmt.Sprintf("%s:%d", domain, s.config.SMTPPort)))
-	client, err := smtp.DialTLS(fmt.Sprintf("%s:%d", domain, s.config.SMTPPort), nil)
+// sign adds a DKIM signature for the domain of the From header. Messages
+// from domains without a configured key are returned unchanged.
+func (s *Sender) sign(msg []byte) []byte {
+	parsed, err := mail.ReadMessage(bytes.NewReader(msg))
 	if err != nil {
-		logger.Error("Failed to connect to SMTP server", logger.Err(err))
-		return fmt.Errorf("failed to connect to SMTP server: %w", err)
+		return msg
 	}
-	defer client.Close()
-
-	logger.Info("Authenticating with SMTP server")
-	if err := client.Auth(auth); err != nil {
-		logger.Error("Failed to authenticate", logger.Err(err))
-		return fmt.Errorf("failed to authenticate: %w", err)
-	}
-
-	logger.Info("Setting sender", logger.Field("from", from))
-	if err := client.Mail(from, nil); err != nil {
-		logger.Error("Failed to set sender", logger.Err(err))
-		return fmt.Errorf("failed to set sender: %w", err)
+	from, err := parsed.Header.AddressList("From")
+	if err != nil || len(from) == 0 {
+		return msg
 	}
+	domain := strings.ToLower(domainOf(from[0].Address))
 
-	logger.Info("Setting recipient", logger.Field("to", to))
-	if err := client.Rcpt(to, nil); err != nil {
-		logger.Error("Failed to set recipient", logger.Err(err))
-		return fmt.Errorf("failed to set recipient: %w", err)
+	s.mu.RLock()
+	signer := s.signers[domain]
+	s.mu.RUnlock()
+	if signer == nil {
+		return msg
 	}
 
-	logger.Info("Opening data connection")
-	w, err := client.Data()
+	signed, err := signer.Sign(msg)
 	if err != nil {
-		logger.Error("Failed to open data connection", logger.Err(err))
-		return fmt.Errorf("failed to open data connection: %w", err)
+		logger.Error("Failed to DKIM sign message", logger.Field("domain", domain), logger.Err(err))
+		return msg
 	}
-	defer w.Close()
+	return signed
+}
 
-	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: %s\r\n\r\n%s\r\n.",
-		from, to, subject, contentType(html), body)
-	logger.Info("Writing email content")
-	_, err = fmt.Fprintf(w, "%s\r\n", msg)
-	if err != nil {
-		logger.Error("Failed to write email content", logger.Err(err))
-		return fmt.Errorf("failed to write email content: %w", err)
-	}
+// SetResolver replaces the resolver used to find MX hosts.
+func (s *Sender) SetResolver(r Resolver) {
+	s.resolver = r
+}
 
-	logger.Info("Closing SMTP connection")
-	if err := client.Quit(); err != nil {
-		logger.Error("Failed to close SMTP connection", logger.Err(err))
-		return fmt.Errorf("failed to close SMTP connection: %w", err)
+func validAddresses(list []string) []string {
+	var valid []string
+	for _, a := range list {
+		if addr, err := mail.ParseAddress(a); err == nil && domainOf(addr.Address) != "" {
+			valid = append(valid, a)
+		}
 	}
+	return valid
+}
 
-	logger.Info("Email sent successfully")
-	return nil
+func newMessageID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return fmt.Sprintf("%d.%s", time.Now().UnixNano(), hex.EncodeToString(b))
 }
 
-func (s *Sender) SendWithVerifiedSender(from, to, subject, body, replyTo string) error {
-	auth := sasl.NewPlainClient("", s.config.SMTPUsername, s.config.SMTPPassword)
+type SendRequest struct {
+	From        string           `json:"from" binding:"required,email"`
+	To          AddressList      `json:"to"`
+	Cc          AddressList      `json:"cc"`
+	Bcc         AddressList      `json:"bcc"`
+	Subject     string           `json:"subject" binding:"required"`
+	Body        string           `json:"body"`
+	Text        string           `json:"text"`
+	HTML        string           `json:"-"`
+	IsHTML      bool             `json:"-"`
+	ReplyTo     string           `json:"reply_to"`
+	Attachments []SendAttachment `json:"attachments"`
+}
 
-	client, err := smtp.DialTLS(fmt.Sprintf("%s:%d", s.config.SMTPHost, s.config.SMTPPort), nil)
-	if err != nil {
-		return fmt.Errorf("failed to connect to SMTP server: %w", err)
+// AddressList is a list of addresses that also accepts a single string in
+// JSON, so requests written for the single recipient API keep working.
+type AddressList []string
+
+func (l *AddressList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		if single == "" {
+			*l = nil
+		} else {
+			*l = AddressList{single}
+		}
+		return nil
 	}
-	defer client.Close()
-
-	if err := client.Auth(auth); err != nil {
-		return fmt.Errorf("failed to authenticate: %w", err)
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
 	}
+	*l = list
+	return nil
+}
 
-	if err := client.Mail(from, nil); err != nil {
-		return fmt.Errorf("failed to set sender: %w", err)
-	}
+const (
+	RecipientQueued     = "queued"
+	RecipientSent       = "sent"
+	RecipientRejected   = "rejected"
+	RecipientFailed     = "failed"
+	RecipientSuppressed = "suppressed"
+)
 
-	if err := client.Rcpt(to, nil); err != nil {
-		return fmt.Errorf("failed to set recipient: %w", err)
-	}
+// RecipientStatus reports what happened to one recipient of a request.
+type RecipientStatus struct {
+	Address string `json:"address"`
+	Type    string `json:"type"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
 
-	w, err := client.Data()
-	if err != nil {
-		return fmt.Errorf("failed to open data connection: %w", err)
-	}
+type SendAttachment struct {
+	Filename    string `json:"filename" binding:"required"`
+	ContentType string `json:"content_type"`
+	Content     string `json:"content" binding:"required"` // base64
+	ContentID   string `json:"content_id"`
+}
 
-	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nReply-To: %s\r\n\r\n%s", from, to, subject, replyTo, body)
-	if _, err := io.WriteString(w, msg); err != nil {
-		return fmt.Errorf("failed to write email content: %w", err)
+// UnmarshalJSON accepts "html" either as the HTML body or, for older
+// clients, as a boolean flag marking "body" as HTML.
+func (r *SendRequest) UnmarshalJSON(data []byte) error {
+	type plain SendRequest
+	aux := struct {
+		*plain
+		HTML json.RawMessage `json:"html"`
+	}{plain: (*plain)(r)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
 	}
-
-	if err := w.Close(); err != nil {
-		return fmt.Errorf("failed to close data connection: %w", err)
+	if len(aux.HTML) == 0 || string(aux.HTML) == "null" {
+		return nil
 	}
-
-	if err := client.Quit(); err != nil {
-		return fmt.Errorf("failed to close SMTP connection: %w", err)
+	if err := json.Unmarshal(aux.HTML, &r.IsHTML); err == nil {
+		return nil
 	}
-
-	return nil
-}
-
-type SendRequest struct {
-	From    string `json:"from" binding:"required,email"`
-	To      string `json:"to" binding:"required,email"`
-	Subject string `json:"subject" binding:"required"`
-	Body    string `json:"body" binding:"required"`
-	HTML    bool   `json:"html"`
-	ReplyTo string `json:"reply_to"`
+	return json.Unmarshal(aux.HTML, &r.HTML)
 }
 
 func (r *SendRequest) Validate() error {
 	if len(r.Subject) > 78 {
 		return errors.New("subject is too long")
 	}
-	if len(r.Body) > 1000000 { // 1MB limit
+	if len(r.To)+len(r.Cc)+len(r.Bcc) == 0 {
+		return errors.New("at least one recipient is required")
+	}
+	if r.Body == "" && r.Text == "" && r.HTML == "" {
+		return errors.New("one of body, text or html is required")
+	}
+	if len(r.Body)+len(r.Text)+len(r.HTML) > 1000000 { // 1MB limit
 		return errors.New("body is too large")
 	}
+	for _, a := range r.Attachments {
+		if _, err := base64.StdEncoding.DecodeString(a.Content); err != nil {
+			return fmt.Errorf("attachment %s is not valid base64", a.Filename)
+		}
+	}
 	return nil
 }
 
-func contentType(html bool) string {
-	if html {
-		return "text/html; charset=UTF-8"
+// RecipientCount returns the number of to, cc and bcc addresses.
+func (r *SendRequest) RecipientCount() int {
+	return len(r.To) + len(r.Cc) + len(r.Bcc)
+}
+
+// Recipients validates every to, cc and bcc address. It returns the
+// deduplicated envelope recipients and a status for each address; invalid
+// addresses are rejected without failing the whole request.
+func (r *SendRequest) Recipients() ([]string, []RecipientStatus) {
+	var envelope []string
+	var statuses []RecipientStatus
+	seen := make(map[string]bool)
+	for _, list := range []struct {
+		kind      string
+		addresses []string
+	}{{"to", r.To}, {"cc", r.Cc}, {"bcc", r.Bcc}} {
+		for _, a := range list.addresses {
+			status := RecipientStatus{Address: a, Type: list.kind, Status: RecipientQueued}
+			addr, err := mail.ParseAddress(a)
+			if err == nil && domainOf(addr.Address) == "" {
+				err = errors.New("missing domain")
+			}
+			if err != nil {
+				status.Status = RecipientRejected
+				status.Error = "invalid address: " + err.Error()
+				statuses = append(statuses, status)
+				continue
+			}
+			key := strings.ToLower(addr.Address)
+			if !seen[key] {
+				seen[key] = true
+				envelope = append(envelope, addr.Address)
+			}
+			statuses = append(statuses, status)
+		}
+	}
+	return envelope, statuses
+}
+
+// ApplyResults updates statuses with the outcome of a direct delivery:
+// recipients the remote host accepted are sent, those it refused for good
+// are rejected, and the rest stay queued for another attempt. It returns
+// the envelope addresses left queued.
+func ApplyResults(statuses []RecipientStatus, results []DeliveryResult) []string {
+	byAddress := make(map[string]DeliveryResult, len(results))
+	var deferred []string
+	for _, r := range results {
+		byAddress[strings.ToLower(r.Recipient)] = r
+		if r.Err != nil && !IsPermanent(r.Err) {
+			deferred = append(deferred, r.Recipient)
+		}
+	}
+	for i := range statuses {
+		st := &statuses[i]
+		if st.Status != RecipientQueued {
+			continue
+		}
+		addr, err := mail.ParseAddress(st.Address)
+		if err != nil {
+			continue
+		}
+		r, ok := byAddress[strings.ToLower(addr.Address)]
+		switch {
+		case !ok:
+		case r.Err == nil:
+			st.Status = RecipientSent
+		case IsPermanent(r.Err):
+			st.Status, st.Error = RecipientRejected, r.Err.Error()
+		default:
+			st.Error = r.Err.Error()
+		}
+	}
+	return deferred
+}
+
+// MarkSuppressed marks the queued statuses whose address is in reasons,
+// keyed by lower-case address, as suppressed.
+func MarkSuppressed(statuses []RecipientStatus, reasons map[string]string) {
+	for i := range statuses {
+		st := &statuses[i]
+		if st.Status != RecipientQueued {
+			continue
+		}
+		addr, err := mail.ParseAddress(st.Address)
+		if err != nil {
+			continue
+		}
+		if reason, ok := reasons[strings.ToLower(addr.Address)]; ok {
+			st.Status = RecipientSuppressed
+			st.Error = "address is suppressed"
+			if reason != "" {
+				st.Error += ": " + reason
+			}
+		}
+	}
+}
+
+// AttachmentSize returns the decoded size of all attachments in bytes.
+func (r *SendRequest) AttachmentSize() int {
+	size := 0
+	for _, a := range r.Attachments {
+		size += base64.StdEncoding.DecodedLen(len(a.Content))
 	}
-	return "text/plain; charset=UTF-8"
+	return size
+}
+
+// Message converts the request into a message ready to be rendered.
+func (r *SendRequest) Message() (*Message, error) {
+	msg := &Message{
+		From:    r.From,
+		To:      validAddresses(r.To),
+		Cc:      validAddresses(r.Cc),
+		ReplyTo: r.ReplyTo,
+		Subject: r.Subject,
+		Text:    r.Text,
+		HTML:    r.HTML,
+	}
+	if r.Body != "" {
+		if r.IsHTML {
+			if msg.HTML == "" {
+				msg.HTML = r.Body
+			}
+		} else if msg.Text == "" {
+			msg.Text = r.Body
+		}
+	}
+	for _, a := range r.Attachments {
+		data, err := base64.StdEncoding.DecodeString(a.Content)
+		if err != nil {
+			return nil, fmt.Errorf("attachment %s is not valid base64: %w", a.Filename, err)
+		}
+		msg.Attachments = append(msg.Attachments, Attachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			ContentID:   a.ContentID,
+			Data:        data,
+		})
+	}
+	return msg, nil
 }
 
 func Parse(r io.Reader) (*Email, error) {
@@ -202,4 +402,4 @@ func decodeRFC2047(s string) (string, error) {
 		return s, err
 	}
 	return header, nil
-}
\ No newline at end of file
+}
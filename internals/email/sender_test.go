@@ -0,0 +1,52 @@
+package email
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestApplyResults(t *testing.T) {
+	req := SendRequest{
+		To:  AddressList{"Bob <bob@example.net>", "not an address"},
+		Cc:  AddressList{"carol@example.net"},
+		Bcc: AddressList{"dave@example.org"},
+	}
+	envelope, statuses := req.Recipients()
+	if len(envelope) != 3 {
+		t.Fatalf("envelope = %v", envelope)
+	}
+	deferred := ApplyResults(statuses, []DeliveryResult{
+		{Recipient: "bob@example.net"},
+		{Recipient: "carol@example.net", Err: &smtp.SMTPError{Code: 550, Message: "no such user"}},
+		{Recipient: "dave@example.org", Err: errors.New("connection refused")},
+	})
+
+	if want := []string{"dave@example.org"}; !reflect.DeepEqual(deferred, want) {
+		t.Errorf("deferred = %v, want %v", deferred, want)
+	}
+	want := []string{RecipientSent, RecipientRejected, RecipientRejected, RecipientQueued}
+	for i, st := range statuses {
+		if st.Status != want[i] {
+			t.Errorf("%s: status %s, want %s", st.Address, st.Status, want[i])
+		}
+	}
+}
+
+func TestMarkSuppressed(t *testing.T) {
+	req := SendRequest{To: AddressList{"Bob <Bob@example.net>", "not an address", "carol@example.net"}}
+	_, statuses := req.Recipients()
+	MarkSuppressed(statuses, map[string]string{"bob@example.net": "bounced"})
+
+	want := []string{RecipientSuppressed, RecipientRejected, RecipientQueued}
+	for i, st := range statuses {
+		if st.Status != want[i] {
+			t.Errorf("%s: status %s, want %s", st.Address, st.Status, want[i])
+		}
+	}
+	if statuses[0].Error != "address is suppressed: bounced" {
+		t.Errorf("error = %q", statuses[0].Error)
+	}
+}
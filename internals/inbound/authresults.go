@@ -0,0 +1,211 @@
+package inbound
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/mail"
+	"strings"
+
+	"email-blaze/internals/email"
+	"email-blaze/pkg/domainVerifier"
+)
+
+// DMARC results, in addition to the policy names.
+const (
+	DMARCPass      = "pass"
+	DMARCFail      = "fail"
+	DMARCNone      = "none"
+	DMARCTempError = "temperror"
+	DMARCPermError = "permerror"
+)
+
+// AuthResults is the outcome of the SPF, DKIM and DMARC checks of an
+// inbound message.
+type AuthResults struct {
+	SPF       string       `json:"spf"`
+	SPFDomain string       `json:"spf_domain,omitempty"`
+	DKIM      []DKIMResult `json:"dkim"`
+	DMARC     string       `json:"dmarc"`
+	// DMARCPolicy is the policy the From domain asks receivers to apply to
+	// this message when DMARC fails, after sp= and pct= are taken into
+	// account.
+	DMARCPolicy string `json:"dmarc_policy,omitempty"`
+	FromDomain  string `json:"from_domain,omitempty"`
+
+	spfIdentity string // "smtp.mailfrom=..." or "smtp.helo=..."
+}
+
+type DKIMResult struct {
+	Result   string `json:"result"`
+	Domain   string `json:"domain"`
+	Selector string `json:"selector"`
+}
+
+// DKIMPassed reports whether at least one signature verified.
+func (a *AuthResults) DKIMPassed() bool {
+	for _, d := range a.DKIM {
+		if d.Result == email.DKIMPass {
+			return true
+		}
+	}
+	return false
+}
+
+// Header renders the RFC 8601 Authentication-Results header, including the
+// trailing CRLF.
+func (a *AuthResults) Header(authservID string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Authentication-Results: %s;\r\n\tspf=%s %s", authservID, a.SPF, a.spfIdentity)
+	if len(a.DKIM) == 0 {
+		b.WriteString(";\r\n\tdkim=none")
+	}
+	for _, d := range a.DKIM {
+		fmt.Fprintf(&b, ";\r\n\tdkim=%s header.d=%s header.s=%s", d.Result, d.Domain, d.Selector)
+	}
+	fmt.Fprintf(&b, ";\r\n\tdmarc=%s", a.DMARC)
+	if a.DMARCPolicy != "" {
+		fmt.Fprintf(&b, " (p=%s)", a.DMARCPolicy)
+	}
+	if a.FromDomain != "" {
+		fmt.Fprintf(&b, " header.from=%s", a.FromDomain)
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// Verifier runs the SPF, DKIM and DMARC checks against a resolver.
+type Verifier struct {
+	resolver domainVerifier.Resolver
+}
+
+func NewVerifier(resolver domainVerifier.Resolver) *Verifier {
+	return &Verifier{resolver: resolver}
+}
+
+// Check evaluates a message received with the given envelope.
+func (v *Verifier) Check(ctx context.Context, env Envelope, msg []byte) *AuthResults {
+	res := &AuthResults{}
+
+	// SPF checks the envelope sender, or the HELO name for bounces.
+	ip := net.ParseIP(env.Remote)
+	res.SPFDomain, res.spfIdentity = env.Helo, "smtp.helo="+env.Helo
+	if i := strings.LastIndex(env.From, "@"); i >= 0 {
+		res.SPFDomain, res.spfIdentity = env.From[i+1:], "smtp.mailfrom="+env.From
+	}
+	res.SPFDomain = strings.ToLower(res.SPFDomain)
+	if ip == nil || res.SPFDomain == "" {
+		res.SPF = domainVerifier.SPFNone
+	} else {
+		res.SPF = domainVerifier.CheckSPF(ctx, v.resolver, ip, res.SPFDomain, env.From, env.Helo).Result
+	}
+
+	lookup := func(domain, selector string) ([]string, error) {
+		txts, err := v.resolver.LookupTXT(ctx, selector+"._domainkey."+domain)
+		if err != nil && !domainVerifier.IsNotFound(err) {
+			return nil, fmt.Errorf("%w: %v", email.ErrDKIMKeyUnavailable, err)
+		}
+		return txts, nil
+	}
+	for _, d := range email.VerifyDKIM(msg, lookup) {
+		res.DKIM = append(res.DKIM, DKIMResult{Result: d.Status, Domain: strings.ToLower(d.Domain), Selector: d.Selector})
+	}
+
+	v.checkDMARC(ctx, res, msg)
+	return res
+}
+
+func (v *Verifier) checkDMARC(ctx context.Context, res *AuthResults, msg []byte) {
+	parsed, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		res.DMARC = DMARCPermError
+		return
+	}
+	from, err := parsed.Header.AddressList("From")
+	if err != nil || len(from) != 1 {
+		// Messages without exactly one author cannot be evaluated.
+		res.DMARC = DMARCPermError
+		return
+	}
+	res.FromDomain = strings.ToLower(from[0].Address[strings.LastIndex(from[0].Address, "@")+1:])
+
+	rec, at, err := domainVerifier.LookupDMARC(ctx, v.resolver, res.FromDomain)
+	switch {
+	case errors.Is(err, domainVerifier.ErrNoDMARCRecord):
+		res.DMARC = DMARCNone
+		return
+	case err != nil && at != "":
+		res.DMARC = DMARCPermError
+		return
+	case err != nil:
+		res.DMARC = DMARCTempError
+		return
+	}
+
+	if res.SPF == domainVerifier.SPFPass && rec.SPFAligned(res.SPFDomain, res.FromDomain) {
+		res.DMARC = DMARCPass
+		return
+	}
+	for _, d := range res.DKIM {
+		if d.Result == email.DKIMPass && rec.DKIMAligned(d.Domain, res.FromDomain) {
+			res.DMARC = DMARCPass
+			return
+		}
+	}
+
+	res.DMARC = DMARCFail
+	policy := rec.AppliedPolicy(res.FromDomain, at)
+	// Messages outside the pct= sample get the next weaker policy, RFC 7489
+	// section 6.6.4.
+	if rec.Percent < 100 && rand.Intn(100) >= rec.Percent {
+		switch policy {
+		case domainVerifier.DMARCReject:
+			policy = domainVerifier.DMARCQuarantine
+		case domainVerifier.DMARCQuarantine:
+			policy = domainVerifier.DMARCNone
+		}
+	}
+	res.DMARCPolicy = policy
+}
+
+// withAuthResults prepends header to msg after removing any
+// Authentication-Results headers that claim to come from authservID,
+// which a sender could have forged (RFC 8601 section 5).
+func withAuthResults(msg []byte, authservID, header string) []byte {
+	var out bytes.Buffer
+	out.WriteString(header)
+
+	rest := msg
+	skipping := false
+	for len(rest) > 0 {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+		rest = rest[len(line):]
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if !skipping {
+				out.Write(line)
+			}
+			continue
+		}
+		skipping = false
+		if name, value, ok := strings.Cut(string(line), ":"); ok && strings.EqualFold(strings.TrimSpace(name), "Authentication-Results") {
+			id, _, _ := strings.Cut(value, ";")
+			if fields := strings.Fields(id); len(fields) > 0 && strings.EqualFold(fields[0], authservID) {
+				skipping = true
+				continue
+			}
+		}
+		out.Write(line)
+	}
+	out.Write(rest)
+	return out.Bytes()
+}
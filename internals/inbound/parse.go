@@ -0,0 +1,251 @@
+package inbound
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// maxDepth bounds the nesting of multipart bodies.
+const maxDepth = 10
+
+// Header is one header field, decoded. Headers keep their order and
+// repeated fields appear once per occurrence.
+type Header struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Address is a parsed mailbox from an address header.
+type Address struct {
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address"`
+}
+
+// Attachment is a non-body part of a message. Content is base64 encoded
+// in JSON.
+type Attachment struct {
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type"`
+	Disposition string `json:"disposition,omitempty"`
+	ContentID   string `json:"content_id,omitempty"`
+	Size        int    `json:"size"`
+	Content     []byte `json:"content"`
+}
+
+// Message is an inbound message as posted to route webhooks.
+type Message struct {
+	Headers     []Header     `json:"headers"`
+	From        []Address    `json:"from,omitempty"`
+	To          []Address    `json:"to,omitempty"`
+	Cc          []Address    `json:"cc,omitempty"`
+	ReplyTo     []Address    `json:"reply_to,omitempty"`
+	Subject     string       `json:"subject"`
+	MessageID   string       `json:"message_id,omitempty"`
+	InReplyTo   string       `json:"in_reply_to,omitempty"`
+	References  []string     `json:"references,omitempty"`
+	Date        *time.Time   `json:"date,omitempty"`
+	Text        string       `json:"text,omitempty"`
+	HTML        string       `json:"html,omitempty"`
+	Attachments []Attachment `json:"attachments"`
+}
+
+var wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// Parse splits a raw RFC 5322 message into its headers, text and HTML
+// bodies and attachments. Parts that cannot be decoded are kept as
+// attachments rather than failing the whole message.
+func Parse(raw []byte) (*Message, error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw)))
+	header, err := r.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return nil, fmt.Errorf("failed to read message header: %w", err)
+	}
+	body, err := io.ReadAll(r.R)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message body: %w", err)
+	}
+
+	m := &Message{
+		Headers:     orderedHeaders(raw),
+		Attachments: []Attachment{},
+	}
+	h := mail.Header(header)
+	m.From = addressList(h, "From")
+	m.To = addressList(h, "To")
+	m.Cc = addressList(h, "Cc")
+	m.ReplyTo = addressList(h, "Reply-To")
+	m.Subject = decodeWords(h.Get("Subject"))
+	m.MessageID = strings.Trim(h.Get("Message-ID"), "<> ")
+	m.InReplyTo = strings.Trim(h.Get("In-Reply-To"), "<> ")
+	for _, ref := range strings.Fields(h.Get("References")) {
+		m.References = append(m.References, strings.Trim(ref, "<>"))
+	}
+	if date, err := h.Date(); err == nil {
+		m.Date = &date
+	}
+
+	m.walk(header, body, 0)
+	return m, nil
+}
+
+// walk adds the part with the given header and encoded body to m,
+// descending into multipart bodies.
+func (m *Message) walk(header textproto.MIMEHeader, body []byte, depth int) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{"charset": "us-ascii"}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" && depth < maxDepth {
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err != nil {
+				return
+			}
+			partBody, err := io.ReadAll(p)
+			if err != nil {
+				return
+			}
+			m.walk(p.Header, partBody, depth+1)
+		}
+	}
+
+	content := decodeTransfer(header.Get("Content-Transfer-Encoding"), body)
+	disposition, dparams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := decodeWords(dparams["filename"])
+	if filename == "" {
+		filename = decodeWords(params["name"])
+	}
+
+	if disposition != "attachment" && filename == "" {
+		switch mediaType {
+		case "text/plain":
+			if text, ok := decodeCharset(params["charset"], content); ok {
+				m.Text += text
+				return
+			}
+		case "text/html":
+			if html, ok := decodeCharset(params["charset"], content); ok {
+				m.HTML += html
+				return
+			}
+		}
+	}
+
+	m.Attachments = append(m.Attachments, Attachment{
+		Filename:    filename,
+		ContentType: mediaType,
+		Disposition: disposition,
+		ContentID:   strings.Trim(header.Get("Content-ID"), "<> "),
+		Size:        len(content),
+		Content:     content,
+	})
+}
+
+func decodeTransfer(encoding string, body []byte) []byte {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		clean := bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, body)
+		out := make([]byte, base64.StdEncoding.DecodedLen(len(clean)))
+		n, err := base64.StdEncoding.Decode(out, clean)
+		if err != nil {
+			n, _ = base64.RawStdEncoding.Decode(out, bytes.TrimRight(clean, "="))
+		}
+		return out[:n]
+	case "quoted-printable":
+		out, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+		if err != nil && len(out) == 0 {
+			return body
+		}
+		return out
+	}
+	return body
+}
+
+// decodeCharset converts content to UTF-8. It reports false for charsets
+// it does not know, in which case the part is kept as an attachment.
+func decodeCharset(charset string, content []byte) (string, bool) {
+	charset = strings.ToLower(strings.TrimSpace(charset))
+	if charset == "" || charset == "utf-8" || charset == "us-ascii" {
+		return string(content), true
+	}
+	r, err := charsetReader(charset, bytes.NewReader(content))
+	if err != nil {
+		return "", false
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return "", false
+	}
+	return string(out), true
+}
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %q", charset)
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+func decodeWords(s string) string {
+	if decoded, err := wordDecoder.DecodeHeader(s); err == nil {
+		return decoded
+	}
+	return s
+}
+
+func addressList(h mail.Header, name string) []Address {
+	parser := mail.AddressParser{WordDecoder: wordDecoder}
+	list, err := parser.ParseList(h.Get(name))
+	if err != nil {
+		return nil
+	}
+	addrs := make([]Address, 0, len(list))
+	for _, a := range list {
+		addrs = append(addrs, Address{Name: a.Name, Address: a.Address})
+	}
+	return addrs
+}
+
+// orderedHeaders returns the header fields of raw in their original order,
+// unfolded and with encoded words decoded.
+func orderedHeaders(raw []byte) []Header {
+	var headers []Header
+	for _, line := range strings.Split(strings.ReplaceAll(string(raw), "\r\n", "\n"), "\n") {
+		if line == "" {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1].Value += " " + strings.TrimSpace(line)
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		headers = append(headers, Header{Name: name, Value: strings.TrimSpace(value)})
+	}
+	for i := range headers {
+		headers[i].Value = decodeWords(headers[i].Value)
+	}
+	return headers
+}
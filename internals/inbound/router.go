@@ -0,0 +1,243 @@
+package inbound
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"email-blaze/internals/config"
+	"email-blaze/internals/logger"
+	"email-blaze/internals/webhook"
+	"email-blaze/pkg/domainVerifier"
+)
+
+// Envelope is the SMTP envelope of an inbound message.
+type Envelope struct {
+	From   string   `json:"from"`
+	To     []string `json:"to"`
+	Remote string   `json:"remote_ip,omitempty"`
+	Helo   string   `json:"helo,omitempty"`
+	// Trusted is set for authenticated clients and trusted networks, whose
+	// messages are not checked against SPF, DKIM and DMARC.
+	Trusted bool `json:"trusted"`
+	// ID identifies the SMTP transaction across retries of the client, for
+	// example a digest of the envelope and the message as submitted.
+	// Routes that already got the message under this ID are skipped.
+	ID string `json:"-"`
+}
+
+// Payload is the JSON body posted to a route.
+type Payload struct {
+	RouteID    string    `json:"route_id"`
+	ReceivedAt time.Time `json:"received_at"`
+	Envelope   Envelope  `json:"envelope"`
+	// Authentication is nil for messages from trusted clients.
+	Authentication *AuthResults `json:"authentication,omitempty"`
+	*Message
+	// Raw is the message as received, base64 encoded, for routes with
+	// include_raw set.
+	Raw string `json:"raw,omitempty"`
+}
+
+// RejectedError is returned by Deliver when the routes of some recipients
+// refused the message. Recipients lists them; the others were delivered.
+type RejectedError struct {
+	Condition  string
+	Recipients []string
+}
+
+func (e *RejectedError) Error() string {
+	return "message rejected by route rule " + e.Condition
+}
+
+// Router hands messages for hosted recipients to the routes registered
+// with the webhook manager, after checking their authentication.
+type Router struct {
+	hooks      *webhook.Manager
+	verifier   *Verifier
+	authservID string
+
+	mu        sync.Mutex
+	delivered map[string]time.Time // envelope ID and route ID
+}
+
+// deliveredTTL is how long a delivery is remembered to skip it when the
+// client retries the transaction.
+const deliveredTTL = 24 * time.Hour
+
+func NewRouter(cfg *config.Config, hooks *webhook.Manager, resolver domainVerifier.Resolver) *Router {
+	return &Router{
+		hooks:      hooks,
+		verifier:   NewVerifier(resolver),
+		authservID: cfg.SMTPHost,
+		delivered:  make(map[string]time.Time),
+	}
+}
+
+// Accepts reports whether a route exists for rcpt.
+func (r *Router) Accepts(rcpt string) bool {
+	return r.hooks.MatchRoute(rcpt) != nil
+}
+
+// Deliver checks raw, adds an Authentication-Results header and queues
+// one delivery per matching route, each listing the recipients it matched.
+// Authentication-Results headers claiming to come from us are removed, also
+// from trusted clients which are not checked. Routes whose reject
+// conditions are met are skipped and their recipients returned in a
+// *RejectedError, after the other routes got the message. Any other error
+// means a delivery could not be stored and the sender should retry; routes
+// that got the message are skipped when it comes again with the same
+// env.ID.
+func (r *Router) Deliver(env Envelope, raw []byte) error {
+	routes := make(map[string]*webhook.Route)
+	rcpts := make(map[string][]string)
+	var order []string
+	for _, rcpt := range env.To {
+		route := r.hooks.MatchRoute(rcpt)
+		if route == nil {
+			return fmt.Errorf("no route for %s", rcpt)
+		}
+		if _, ok := routes[route.ID]; !ok {
+			routes[route.ID] = route
+			order = append(order, route.ID)
+		}
+		rcpts[route.ID] = append(rcpts[route.ID], strings.ToLower(rcpt))
+	}
+
+	var results *AuthResults
+	var header string
+	if !env.Trusted {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		results = r.verifier.Check(ctx, env, raw)
+		cancel()
+		header = results.Header(r.authservID)
+	}
+	raw = withAuthResults(raw, r.authservID, header)
+
+	var accepted []string
+	var rejected *RejectedError
+	for _, id := range order {
+		if cond := rejects(routes[id], results); cond != "" {
+			logger.Info("Inbound message rejected by route",
+				logger.Field("route", id),
+				logger.Field("condition", cond),
+				logger.Field("from", env.From),
+				logger.Field("to", rcpts[id]))
+			if rejected == nil {
+				rejected = &RejectedError{Condition: cond}
+			}
+			rejected.Recipients = append(rejected.Recipients, rcpts[id]...)
+			continue
+		}
+		accepted = append(accepted, id)
+	}
+	if len(accepted) == 0 {
+		return rejected
+	}
+
+	msg, err := Parse(raw)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, id := range accepted {
+		route := routes[id]
+		payload := &Payload{
+			RouteID:    id,
+			ReceivedAt: now,
+			Envelope: Envelope{
+				From:    env.From,
+				To:      rcpts[id],
+				Remote:  env.Remote,
+				Helo:    env.Helo,
+				Trusted: env.Trusted,
+			},
+			Authentication: results,
+			Message:        msg,
+		}
+		if route.IncludeRaw {
+			payload.Raw = base64.StdEncoding.EncodeToString(raw)
+		}
+		if r.seen(env.ID, id) {
+			logger.Info("Inbound message already routed",
+				logger.Field("route", id),
+				logger.Field("from", env.From),
+				logger.Field("to", rcpts[id]),
+				logger.Field("messageID", msg.MessageID))
+			continue
+		}
+		d, err := r.hooks.DeliverInbound(id, payload)
+		if err != nil {
+			return err
+		}
+		r.remember(env.ID, id)
+		logger.Info("Inbound message routed",
+			logger.Field("route", id),
+			logger.Field("delivery", d.ID),
+			logger.Field("from", env.From),
+			logger.Field("to", rcpts[id]),
+			logger.Field("messageID", msg.MessageID))
+	}
+	if rejected != nil {
+		return rejected
+	}
+	return nil
+}
+
+// seen reports whether the route got the transaction envID before.
+func (r *Router) seen(envID, routeID string) bool {
+	if envID == "" {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	at, ok := r.delivered[envID+" "+routeID]
+	return ok && time.Since(at) < deliveredTTL
+}
+
+func (r *Router) remember(envID, routeID string) {
+	if envID == "" {
+		return
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, at := range r.delivered {
+		if now.Sub(at) >= deliveredTTL {
+			delete(r.delivered, key)
+		}
+	}
+	r.delivered[envID+" "+routeID] = now
+}
+
+// rejects returns the first reject condition of route that results meet.
+func rejects(route *webhook.Route, results *AuthResults) string {
+	if results == nil {
+		return ""
+	}
+	for _, cond := range route.Reject {
+		switch cond {
+		case webhook.RejectSPFFail:
+			if results.SPF == domainVerifier.SPFFail {
+				return cond
+			}
+		case webhook.RejectDKIMFail:
+			if len(results.DKIM) > 0 && !results.DKIMPassed() {
+				return cond
+			}
+		case webhook.RejectDMARCFail:
+			if results.DMARC == DMARCFail {
+				return cond
+			}
+		case webhook.RejectDMARCPolicy:
+			if results.DMARC == DMARCFail && results.DMARCPolicy == domainVerifier.DMARCReject {
+				return cond
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,181 @@
+package inbound
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"email-blaze/internals/config"
+	"email-blaze/internals/logger"
+	"email-blaze/internals/webhook"
+	"email-blaze/pkg/domainVerifier"
+)
+
+func init() {
+	logger.Init("fatal", "production", "console")
+}
+
+const owner = "owner@example.test"
+
+// newTestRouter returns a router for mx.test whose resolver fails SPF for
+// spoofed.test and passes it for sender.test from 192.0.2.1.
+func newTestRouter(t *testing.T) (*Router, *webhook.Manager) {
+	t.Helper()
+	hooks, err := webhook.New(&config.Config{Webhooks: config.WebhookConfig{Dir: t.TempDir()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := &domainVerifier.StaticResolver{
+		TXT: map[string][]string{
+			"spoofed.test": {"v=spf1 -all"},
+			"sender.test":  {"v=spf1 ip4:192.0.2.1 -all"},
+		},
+	}
+	return NewRouter(&config.Config{SMTPHost: "mx.test"}, hooks, resolver), hooks
+}
+
+func addRoute(t *testing.T, hooks *webhook.Manager, r *webhook.Route) string {
+	t.Helper()
+	r.Domain, r.URL, r.IncludeRaw = "example.test", "https://hooks.example.com/inbound", true
+	created, err := hooks.CreateRoute(owner, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return created.ID
+}
+
+// delivered returns the payloads queued for a route.
+func delivered(t *testing.T, hooks *webhook.Manager, routeID string) []*Payload {
+	t.Helper()
+	log, err := hooks.Deliveries(owner, routeID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payloads []*Payload
+	for _, d := range log {
+		var p Payload
+		if err := json.Unmarshal(d.Payload, &p); err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, &p)
+	}
+	return payloads
+}
+
+func rawOf(t *testing.T, p *Payload) string {
+	t.Helper()
+	raw, err := base64.StdEncoding.DecodeString(p.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
+
+var testMessage = "Authentication-Results: mx.test; spf=pass smtp.mailfrom=forged.test\r\n" +
+	"Authentication-Results: other.test; spf=pass\r\n" +
+	"From: someone@spoofed.test\r\nTo: a@example.test\r\nSubject: hi\r\n\r\nhello\r\n"
+
+func TestDeliverPartialRejection(t *testing.T) {
+	r, hooks := newTestRouter(t)
+	strict := addRoute(t, hooks, &webhook.Route{Match: webhook.MatchAddress, Pattern: "a@example.test", Reject: []string{webhook.RejectSPFFail}})
+	rest := addRoute(t, hooks, &webhook.Route{Match: webhook.MatchCatchAll})
+
+	env := Envelope{From: "x@spoofed.test", To: []string{"A@example.test", "b@example.test"}, Remote: "192.0.2.1", Helo: "client.test"}
+	err := r.Deliver(env, []byte(testMessage))
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) {
+		t.Fatalf("Deliver = %v, want a *RejectedError", err)
+	}
+	if rejected.Condition != webhook.RejectSPFFail || !reflect.DeepEqual(rejected.Recipients, []string{"a@example.test"}) {
+		t.Errorf("rejected = %+v, want a@example.test on %s", rejected, webhook.RejectSPFFail)
+	}
+	if got := delivered(t, hooks, strict); len(got) != 0 {
+		t.Errorf("rejecting route got %d deliveries", len(got))
+	}
+	got := delivered(t, hooks, rest)
+	if len(got) != 1 || !reflect.DeepEqual(got[0].Envelope.To, []string{"b@example.test"}) {
+		t.Fatalf("catch-all deliveries = %+v, want one for b@example.test", got)
+	}
+	if got[0].Authentication == nil || got[0].Authentication.SPF != domainVerifier.SPFFail {
+		t.Errorf("authentication = %+v, want spf fail", got[0].Authentication)
+	}
+
+	env.To = []string{"a@example.test"}
+	if err := r.Deliver(env, []byte(testMessage)); !errors.As(err, &rejected) || len(rejected.Recipients) != 1 {
+		t.Errorf("Deliver to the rejecting route only = %v", err)
+	}
+}
+
+func TestDeliverStripsForgedAuthResults(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     Envelope
+		results string
+	}{
+		{"untrusted", Envelope{From: "x@sender.test", Remote: "192.0.2.1", Helo: "client.test"}, "Authentication-Results: mx.test;\r\n\tspf=pass smtp.mailfrom=x@sender.test"},
+		{"trusted", Envelope{From: "x@sender.test", Trusted: true}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, hooks := newTestRouter(t)
+			id := addRoute(t, hooks, &webhook.Route{Match: webhook.MatchCatchAll})
+			tt.env.To = []string{"a@example.test"}
+			if err := r.Deliver(tt.env, []byte(testMessage)); err != nil {
+				t.Fatal(err)
+			}
+			got := delivered(t, hooks, id)
+			if len(got) != 1 {
+				t.Fatalf("got %d deliveries, want 1", len(got))
+			}
+			raw := rawOf(t, got[0])
+			if strings.Contains(raw, "forged.test") {
+				t.Errorf("forged Authentication-Results kept:\n%s", raw)
+			}
+			if !strings.Contains(raw, "Authentication-Results: other.test; spf=pass\r\n") {
+				t.Errorf("Authentication-Results of another server removed:\n%s", raw)
+			}
+			if tt.results != "" && !strings.HasPrefix(raw, tt.results) {
+				t.Errorf("message does not start with %q:\n%s", tt.results, raw)
+			}
+			if tt.results == "" && (got[0].Authentication != nil || strings.Contains(raw, "Authentication-Results: mx.test")) {
+				t.Errorf("trusted message was checked:\n%s", raw)
+			}
+		})
+	}
+}
+
+func TestDeliverSkipsRetriedTransaction(t *testing.T) {
+	r, hooks := newTestRouter(t)
+	id := addRoute(t, hooks, &webhook.Route{Match: webhook.MatchCatchAll})
+
+	env := Envelope{From: "x@sender.test", To: []string{"a@example.test"}, Trusted: true, ID: "tx-1"}
+	for i := 0; i < 2; i++ {
+		if err := r.Deliver(env, []byte(testMessage)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := delivered(t, hooks, id); len(got) != 1 {
+		t.Errorf("got %d deliveries for a retried transaction, want 1", len(got))
+	}
+
+	env.ID = "tx-2"
+	if err := r.Deliver(env, []byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	if got := delivered(t, hooks, id); len(got) != 2 {
+		t.Errorf("got %d deliveries after another transaction, want 2", len(got))
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	r, hooks := newTestRouter(t)
+	addRoute(t, hooks, &webhook.Route{Match: webhook.MatchAddress, Pattern: "a@example.test"})
+	for rcpt, want := range map[string]bool{"a@example.test": true, "A@Example.Test": true, "b@example.test": false} {
+		if got := r.Accepts(rcpt); got != want {
+			t.Errorf("Accepts(%s) = %v, want %v", rcpt, got, want)
+		}
+	}
+}
@@ -0,0 +1,509 @@
+package onboarding
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"email-blaze/internals/config"
+	"email-blaze/internals/email"
+	"email-blaze/internals/logger"
+	"email-blaze/internals/storage"
+	"email-blaze/internals/webhook"
+	"email-blaze/pkg/domainVerifier"
+)
+
+// Record purposes, also the keys of storage.Domain.Checks.
+const (
+	RecordOwnership  = "ownership"
+	RecordSPF        = "spf"
+	RecordDKIM       = "dkim"
+	RecordDMARC      = "dmarc"
+	RecordReturnPath = "return_path"
+)
+
+const (
+	challengeLabel  = "_email-blaze"
+	tokenPrefix     = "email-blaze-verification="
+	returnPathLabel = "bounces"
+)
+
+// ErrDomainTaken is returned for a claim on a domain that another user
+// verified first. The claim is dropped.
+var ErrDomainTaken = errors.New("domain was verified by another user")
+
+// Record is a DNS record the owner of a domain publishes. Status is empty
+// until the domain has been checked.
+type Record struct {
+	Purpose  string `json:"purpose"`
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Required bool   `json:"required"`
+	Status   string `json:"status,omitempty"` // valid or invalid
+	Error    string `json:"error,omitempty"`
+}
+
+// Checker verifies the domains users claim and keeps re-checking them.
+// Every claimant publishes their own token and DKIM key; the first whose
+// required records resolve gets the domain, and claims that stay
+// unverified expire. A verified domain whose records disappear raises a
+// domain_failing alert and loses its verification after the grace period.
+type Checker struct {
+	cfg      *config.Config
+	domains  storage.DomainRepository
+	claims   storage.DomainClaimRepository
+	sender   *email.Sender
+	hooks    *webhook.Manager
+	resolver domainVerifier.Resolver
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func New(cfg *config.Config, domains storage.DomainRepository, claims storage.DomainClaimRepository, sender *email.Sender, hooks *webhook.Manager, resolver domainVerifier.Resolver) *Checker {
+	return &Checker{
+		cfg:      cfg,
+		domains:  domains,
+		claims:   claims,
+		sender:   sender,
+		hooks:    hooks,
+		resolver: resolver,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Prepare gives a new claim its ownership token and a DKIM key. The
+// selector is random so that claimants of the same domain never share a
+// key.
+func (c *Checker) Prepare(cl *storage.DomainClaim) error {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	cl.VerificationToken = hex.EncodeToString(b[:16])
+
+	selector := "eb" + time.Now().UTC().Format("20060102") + hex.EncodeToString(b[16:])
+	if _, err := c.sender.GenerateDKIMKey(cl.Name, selector, "rsa", 2048); err != nil {
+		return err
+	}
+	cl.DKIMSelector = selector
+	return nil
+}
+
+// Abandon deletes the DKIM key Prepare generated for a claim that could
+// not be stored.
+func (c *Checker) Abandon(cl *storage.DomainClaim) {
+	if err := c.sender.RemoveDKIMKey(cl.Name, cl.DKIMSelector); err != nil {
+		logger.Error("Failed to delete DKIM key of domain claim", logger.Field("domain", cl.Name), logger.Err(err))
+	}
+}
+
+// Records lists the records to publish for d with the outcome of its last
+// check.
+func (c *Checker) Records(d *storage.Domain) []Record {
+	return c.records(d.Name, d.VerificationToken, d.DKIMSelector, d.Checks)
+}
+
+// ClaimRecords lists the records the claimant of cl publishes with the
+// outcome of its last check.
+func (c *Checker) ClaimRecords(cl *storage.DomainClaim) []Record {
+	return c.records(cl.Name, cl.VerificationToken, cl.DKIMSelector, cl.Checks)
+}
+
+// ClaimExpiry returns when cl is dropped if it is not verified by then.
+func (c *Checker) ClaimExpiry(cl *storage.DomainClaim) time.Time {
+	return cl.CreatedAt.Add(c.claimTTL())
+}
+
+func (c *Checker) records(name, token, selector string, checks map[string]string) []Record {
+	dmarc := "v=DMARC1; p=none"
+	if c.cfg.Domains.DMARCReports != "" {
+		dmarc += "; rua=mailto:" + c.cfg.Domains.DMARCReports
+	}
+	records := []Record{
+		{Purpose: RecordOwnership, Type: "TXT", Name: challengeLabel + "." + name, Value: tokenPrefix + token, Required: true},
+		{Purpose: RecordSPF, Type: "TXT", Name: name, Value: "v=spf1 include:" + c.spfInclude() + " ~all", Required: true},
+		{Purpose: RecordDKIM, Type: "TXT", Name: selector + "._domainkey." + name, Required: true},
+		{Purpose: RecordDMARC, Type: "TXT", Name: "_dmarc." + name, Value: dmarc},
+		{Purpose: RecordReturnPath, Type: "CNAME", Name: returnPathLabel + "." + name, Value: c.returnPath()},
+	}
+	if key := c.sender.DKIMKey(name, selector); key != nil {
+		records[2].Value, _ = domainVerifier.DKIMKeyRecordFor(key)
+	}
+
+	for i := range records {
+		r := &records[i]
+		checkErr, checked := checks[r.Purpose]
+		switch {
+		case !checked:
+		case checkErr == "":
+			r.Status = "valid"
+		default:
+			r.Status, r.Error = "invalid", checkErr
+		}
+	}
+	return records
+}
+
+// check looks up every record of a domain and returns the errors by
+// purpose.
+func (c *Checker) check(ctx context.Context, name, token, selector string) map[string]error {
+	errs := make(map[string]error)
+	errs[RecordOwnership] = domainVerifier.VerifyTXT(ctx, c.resolver, challengeLabel+"."+name, tokenPrefix+token)
+	errs[RecordSPF] = domainVerifier.VerifySPFInclude(ctx, c.resolver, name, c.spfInclude())
+	errs[RecordDKIM] = c.checkDKIM(ctx, name, selector)
+	_, _, errs[RecordDMARC] = domainVerifier.LookupDMARC(ctx, c.resolver, name)
+	errs[RecordReturnPath] = domainVerifier.VerifyCNAME(ctx, c.resolver, returnPathLabel+"."+name, c.returnPath())
+	return errs
+}
+
+func (c *Checker) checkDKIM(ctx context.Context, name, selector string) error {
+	key := c.sender.DKIMKey(name, selector)
+	if key == nil {
+		return fmt.Errorf("no DKIM key is held for selector %s", selector)
+	}
+	rec, err := domainVerifier.LookupDKIMKey(ctx, c.resolver, name, selector)
+	if err != nil {
+		return err
+	}
+	if err := rec.Check(); err != nil {
+		return err
+	}
+	if !rec.Matches(key) {
+		return errors.New("published key does not match the key generated for this domain")
+	}
+	return nil
+}
+
+// Verify checks the records of d, updates its verification state and
+// stores it. Lookups that fail temporarily leave the state unchanged.
+func (c *Checker) Verify(ctx context.Context, d *storage.Domain) error {
+	errs := c.check(ctx, d.Name, d.VerificationToken, d.DKIMSelector)
+	now := time.Now()
+
+	var missing []string
+	var temporary bool
+	d.Checks, missing, temporary = summarize(errs)
+	d.CheckedAt = now
+
+	if errs[RecordDKIM] == nil && c.sender.ActiveDKIMSelector(d.Name) != d.DKIMSelector {
+		if err := c.sender.ActivateDKIMKey(d.Name, d.DKIMSelector); err != nil {
+			logger.Error("Failed to activate DKIM key", logger.Field("domain", d.Name), logger.Err(err))
+		}
+	}
+
+	switch {
+	case len(missing) == 0 && !d.Verified:
+		d.Verified, d.VerifiedAt, d.FailingSince = true, now, time.Time{}
+		logger.Info("Domain verified", logger.Field("domain", d.Name), logger.Field("owner", d.OwnerEmail))
+		c.alert(d, webhook.EventDomainVerified, "verified", "")
+	case len(missing) == 0 && !d.FailingSince.IsZero():
+		d.FailingSince = time.Time{}
+		logger.Info("Domain records restored", logger.Field("domain", d.Name), logger.Field("owner", d.OwnerEmail))
+		c.alert(d, webhook.EventDomainVerified, "restored", "")
+	case len(missing) == 0 || !d.Verified || temporary:
+	case d.FailingSince.IsZero():
+		d.FailingSince = now
+		logger.Error("Domain records missing", logger.Field("domain", d.Name), logger.Field("owner", d.OwnerEmail), logger.Field("missing", missing))
+		c.alert(d, webhook.EventDomainFailing, "failing", strings.Join(missing, "; "))
+	case now.Sub(d.FailingSince) > c.gracePeriod():
+		d.Verified, d.VerifiedAt, d.FailingSince = false, time.Time{}, time.Time{}
+		logger.Error("Domain unverified after records stayed missing", logger.Field("domain", d.Name), logger.Field("owner", d.OwnerEmail), logger.Field("missing", missing))
+		c.alert(d, webhook.EventDomainFailing, "unverified", strings.Join(missing, "; "))
+	}
+
+	return c.domains.Update(ctx, d)
+}
+
+// summarize turns the errors of check into the stored checks and lists the
+// required records that are missing.
+func summarize(errs map[string]error) (checks map[string]string, missing []string, temporary bool) {
+	checks = make(map[string]string)
+	for purpose, err := range errs {
+		checks[purpose] = ""
+		if err == nil {
+			continue
+		}
+		checks[purpose] = err.Error()
+		if purpose == RecordDMARC || purpose == RecordReturnPath {
+			continue
+		}
+		missing = append(missing, purpose+": "+err.Error())
+		temporary = temporary || domainVerifier.IsTemporary(err)
+	}
+	sort.Strings(missing)
+	return checks, missing, temporary
+}
+
+// VerifyClaim checks the records of cl and stores the outcome. Once the
+// required records resolve, the claimant gets the domain, which is
+// returned, and the other claims of it are dropped. A domain that lost its
+// verification after its grace period may be taken over by another
+// claimant. ErrDomainTaken means someone else got the domain first.
+func (c *Checker) VerifyClaim(ctx context.Context, cl *storage.DomainClaim) (*storage.Domain, error) {
+	existing, err := c.domains.Get(ctx, cl.Name)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		existing = nil
+	case err != nil:
+		return nil, err
+	case !Claimable(existing, cl.OwnerEmail):
+		return nil, c.lose(ctx, cl)
+	}
+
+	errs := c.check(ctx, cl.Name, cl.VerificationToken, cl.DKIMSelector)
+	var missing []string
+	cl.Checks, missing, _ = summarize(errs)
+	cl.CheckedAt = time.Now()
+	if len(missing) > 0 {
+		return nil, c.claims.Update(ctx, cl)
+	}
+
+	if existing != nil {
+		if err := c.Release(ctx, existing); err != nil {
+			return nil, err
+		}
+		logger.Info("Lapsed domain taken over", logger.Field("domain", cl.Name), logger.Field("from", existing.OwnerEmail), logger.Field("owner", cl.OwnerEmail))
+	}
+	d := &storage.Domain{
+		Name:              cl.Name,
+		OwnerEmail:        cl.OwnerEmail,
+		Verified:          true,
+		Subdomains:        cl.Subdomains,
+		DKIMSelector:      cl.DKIMSelector,
+		VerificationToken: cl.VerificationToken,
+		Checks:            cl.Checks,
+		CheckedAt:         cl.CheckedAt,
+		VerifiedAt:        cl.CheckedAt,
+	}
+	err = c.domains.Create(ctx, d)
+	if errors.Is(err, storage.ErrConflict) {
+		return nil, c.lose(ctx, cl)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.claims.Delete(ctx, cl.Name, cl.OwnerEmail); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		logger.Error("Failed to delete domain claim", logger.Field("domain", cl.Name), logger.Err(err))
+	}
+	if err := c.DropClaims(ctx, cl.Name); err != nil {
+		logger.Error("Failed to drop domain claims", logger.Field("domain", cl.Name), logger.Err(err))
+	}
+	if err := c.sender.ActivateDKIMKey(d.Name, d.DKIMSelector); err != nil {
+		logger.Error("Failed to activate DKIM key", logger.Field("domain", d.Name), logger.Err(err))
+	}
+	logger.Info("Domain verified", logger.Field("domain", d.Name), logger.Field("owner", d.OwnerEmail))
+	c.alert(d, webhook.EventDomainVerified, "verified", "")
+	return d, nil
+}
+
+// Claimable reports whether claimant may claim d, which lost its
+// verification after its records went missing. Domains set up by an
+// administrator never lapse, and owners re-verify their own domains.
+func Claimable(d *storage.Domain, claimant string) bool {
+	return !d.Verified && d.VerificationToken != "" && d.OwnerEmail != claimant
+}
+
+func (c *Checker) lose(ctx context.Context, cl *storage.DomainClaim) error {
+	if err := c.RemoveClaim(ctx, cl); err != nil {
+		return err
+	}
+	logger.Info("Domain claim dropped, domain verified by another user", logger.Field("domain", cl.Name), logger.Field("owner", cl.OwnerEmail))
+	return ErrDomainTaken
+}
+
+// RemoveClaim deletes cl with its DKIM key.
+func (c *Checker) RemoveClaim(ctx context.Context, cl *storage.DomainClaim) error {
+	if err := c.claims.Delete(ctx, cl.Name, cl.OwnerEmail); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	c.Abandon(cl)
+	return nil
+}
+
+// DropClaims removes every claim of name.
+func (c *Checker) DropClaims(ctx context.Context, name string) error {
+	list, err := c.claims.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, cl := range list {
+		if cl.Name == name {
+			c.Abandon(cl)
+		}
+	}
+	return c.claims.DeleteByName(ctx, name)
+}
+
+// Release deletes d and everything set up for it: mail from it is no
+// longer signed and its inbound routes are removed. The keys of pending
+// claims of the domain are kept.
+func (c *Checker) Release(ctx context.Context, d *storage.Domain) error {
+	if err := c.domains.Delete(ctx, d.Name); err != nil {
+		return err
+	}
+	list, err := c.claims.List(ctx)
+	if err != nil {
+		return err
+	}
+	var keep []string
+	for _, cl := range list {
+		if cl.Name == d.Name {
+			keep = append(keep, cl.DKIMSelector)
+		}
+	}
+	if err := c.sender.RemoveDKIMKeys(d.Name, keep...); err != nil {
+		logger.Error("Failed to delete DKIM keys of domain", logger.Field("domain", d.Name), logger.Err(err))
+	}
+	if err := c.hooks.DeleteDomainRoutes(d.Name); err != nil {
+		logger.Error("Failed to delete inbound routes of domain", logger.Field("domain", d.Name), logger.Err(err))
+	}
+	return nil
+}
+
+// alert notifies the webhooks of the user who added d.
+func (c *Checker) alert(d *storage.Domain, event, status, detail string) {
+	c.hooks.EmitTo(d.OwnerEmail, &webhook.Event{
+		Type:   event,
+		Domain: d.Name,
+		Status: status,
+		Detail: detail,
+	})
+}
+
+// Start launches the background job that checks pending and verified
+// domains at their configured intervals.
+func (c *Checker) Start() {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			c.run()
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	logger.Info("Domain checker started", logger.Field("interval", c.interval(true)), logger.Field("pendingInterval", c.interval(false)))
+}
+
+// Stop waits for a running check to finish.
+func (c *Checker) Stop() {
+	close(c.stop)
+	c.wg.Wait()
+}
+
+func (c *Checker) run() {
+	list, err := c.domains.List(context.Background())
+	if err != nil {
+		logger.Error("Failed to list domains for checking", logger.Err(err))
+		return
+	}
+	for _, d := range list {
+		if d.VerificationToken == "" || time.Since(d.CheckedAt) < c.interval(d.Verified) {
+			continue
+		}
+		if c.stopping() {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := c.Verify(ctx, d); err != nil {
+			logger.Error("Failed to check domain", logger.Field("domain", d.Name), logger.Err(err))
+		}
+		cancel()
+	}
+
+	claims, err := c.claims.List(context.Background())
+	if err != nil {
+		logger.Error("Failed to list domain claims for checking", logger.Err(err))
+		return
+	}
+	for _, cl := range claims {
+		if c.stopping() {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := c.checkClaim(ctx, cl); err != nil && !errors.Is(err, ErrDomainTaken) {
+			logger.Error("Failed to check domain claim", logger.Field("domain", cl.Name), logger.Field("owner", cl.OwnerEmail), logger.Err(err))
+		}
+		cancel()
+	}
+}
+
+// checkClaim drops cl once it expired and verifies it when it is due.
+func (c *Checker) checkClaim(ctx context.Context, cl *storage.DomainClaim) error {
+	if time.Now().After(c.ClaimExpiry(cl)) {
+		if err := c.RemoveClaim(ctx, cl); err != nil {
+			return err
+		}
+		logger.Info("Domain claim expired", logger.Field("domain", cl.Name), logger.Field("owner", cl.OwnerEmail))
+		return nil
+	}
+	if time.Since(cl.CheckedAt) < c.interval(false) {
+		return nil
+	}
+	_, err := c.VerifyClaim(ctx, cl)
+	return err
+}
+
+func (c *Checker) stopping() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Checker) interval(verified bool) time.Duration {
+	minutes := c.cfg.Domains.PendingInterval
+	if minutes <= 0 {
+		minutes = 5
+	}
+	if verified {
+		if minutes = c.cfg.Domains.CheckInterval; minutes <= 0 {
+			minutes = 60
+		}
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+func (c *Checker) claimTTL() time.Duration {
+	if c.cfg.Domains.ClaimTTL <= 0 {
+		return 7 * 24 * time.Hour
+	}
+	return time.Duration(c.cfg.Domains.ClaimTTL) * time.Hour
+}
+
+func (c *Checker) gracePeriod() time.Duration {
+	if c.cfg.Domains.GracePeriod <= 0 {
+		return 72 * time.Hour
+	}
+	return time.Duration(c.cfg.Domains.GracePeriod) * time.Hour
+}
+
+func (c *Checker) spfInclude() string {
+	if c.cfg.Domains.SPFInclude != "" {
+		return c.cfg.Domains.SPFInclude
+	}
+	return "_spf." + c.cfg.SMTPHost
+}
+
+func (c *Checker) returnPath() string {
+	if c.cfg.Domains.ReturnPath != "" {
+		return c.cfg.Domains.ReturnPath
+	}
+	return c.cfg.SMTPHost
+}
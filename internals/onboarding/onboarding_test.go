@@ -0,0 +1,191 @@
+package onboarding
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"email-blaze/internals/config"
+	"email-blaze/internals/email"
+	"email-blaze/internals/logger"
+	"email-blaze/internals/storage"
+	"email-blaze/internals/webhook"
+	"email-blaze/pkg/domainVerifier"
+)
+
+func init() {
+	logger.Init("fatal", "production", "console")
+}
+
+const (
+	alice = "alice@alice.test"
+	bob   = "bob@bob.test"
+)
+
+type testEnv struct {
+	checker  *Checker
+	store    storage.Store
+	sender   *email.Sender
+	hooks    *webhook.Manager
+	resolver *domainVerifier.StaticResolver
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	cfg := &config.Config{
+		SMTPHost:   "mx.test",
+		DKIMKeyDir: t.TempDir(),
+		Webhooks:   config.WebhookConfig{Dir: t.TempDir()},
+		Domains:    config.DomainConfig{ClaimTTL: 24},
+	}
+	store, err := storage.Open("sqlite::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{alice, bob} {
+		if err := store.Users().Create(context.Background(), &storage.User{Email: u, PasswordHash: "x"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sender, err := email.NewSender(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooks, err := webhook.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := &domainVerifier.StaticResolver{TXT: make(map[string][]string)}
+	return &testEnv{
+		checker:  New(cfg, store.Domains(), store.DomainClaims(), sender, hooks, resolver),
+		store:    store,
+		sender:   sender,
+		hooks:    hooks,
+		resolver: resolver,
+	}
+}
+
+func (e *testEnv) claim(t *testing.T, owner, name string) *storage.DomainClaim {
+	t.Helper()
+	cl := &storage.DomainClaim{Name: name, OwnerEmail: owner, CreatedAt: time.Now()}
+	if err := e.checker.Prepare(cl); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.store.DomainClaims().Create(context.Background(), cl); err != nil {
+		t.Fatal(err)
+	}
+	return cl
+}
+
+// publish adds the required records of cl to the resolver.
+func (e *testEnv) publish(cl *storage.DomainClaim) {
+	for _, r := range e.checker.ClaimRecords(cl) {
+		if r.Required {
+			e.resolver.TXT[r.Name] = []string{r.Value}
+		}
+	}
+}
+
+func TestClaimFirstVerifiedWins(t *testing.T) {
+	e := newTestEnv(t)
+	ctx := context.Background()
+	hook, err := e.hooks.Create(bob, "bob.test", "https://hooks.example.com/bob", []string{webhook.EventDomainVerified})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := e.claim(t, alice, "example.test")
+	b := e.claim(t, bob, "example.test")
+	if a.VerificationToken == b.VerificationToken || a.DKIMSelector == b.DKIMSelector {
+		t.Fatalf("claims share a token or selector: %+v %+v", a, b)
+	}
+
+	e.publish(b)
+	if d, err := e.checker.VerifyClaim(ctx, a); d != nil || err != nil {
+		t.Fatalf("VerifyClaim(alice) = %v, %v, want nil, nil", d, err)
+	}
+	if a.Checks[RecordOwnership] == "" {
+		t.Error("ownership check of alice's claim passed on bob's token")
+	}
+
+	d, err := e.checker.VerifyClaim(ctx, b)
+	if err != nil || d == nil {
+		t.Fatalf("VerifyClaim(bob) = %v, %v", d, err)
+	}
+	if !d.Verified || d.OwnerEmail != bob || d.DKIMSelector != b.DKIMSelector {
+		t.Errorf("domain = %+v, want verified for bob with his selector", d)
+	}
+	if got := e.sender.ActiveDKIMSelector("example.test"); got != b.DKIMSelector {
+		t.Errorf("active selector = %q, want %q", got, b.DKIMSelector)
+	}
+	if e.sender.DKIMKey("example.test", a.DKIMSelector) != nil {
+		t.Error("key of the losing claim was kept")
+	}
+	if claims, _ := e.store.DomainClaims().List(ctx); len(claims) != 0 {
+		t.Errorf("claims left after verification: %d", len(claims))
+	}
+	if log, _ := e.hooks.Deliveries(bob, hook.ID, 0); len(log) != 1 {
+		t.Errorf("bob's webhook got %d deliveries, want 1", len(log))
+	}
+
+	if _, err := e.checker.VerifyClaim(ctx, a); !errors.Is(err, ErrDomainTaken) {
+		t.Errorf("VerifyClaim(alice) after bob won = %v, want ErrDomainTaken", err)
+	}
+}
+
+func TestClaimExpires(t *testing.T) {
+	e := newTestEnv(t)
+	ctx := context.Background()
+
+	cl := e.claim(t, alice, "example.test")
+	cl.CreatedAt = time.Now().Add(-25 * time.Hour)
+	if err := e.checker.checkClaim(ctx, cl); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.store.DomainClaims().Get(ctx, cl.Name, alice); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expired claim still stored: %v", err)
+	}
+	if e.sender.DKIMKey(cl.Name, cl.DKIMSelector) != nil {
+		t.Error("key of the expired claim was kept")
+	}
+}
+
+func TestReleaseTearsDownDomain(t *testing.T) {
+	e := newTestEnv(t)
+	ctx := context.Background()
+
+	won := e.claim(t, alice, "example.test")
+	e.publish(won)
+	d, err := e.checker.VerifyClaim(ctx, won)
+	if err != nil || d == nil {
+		t.Fatalf("VerifyClaim = %v, %v", d, err)
+	}
+	if _, err := e.hooks.CreateRoute(alice, &webhook.Route{Domain: "example.test", Match: webhook.MatchCatchAll, URL: "https://hooks.example.com/inbound"}); err != nil {
+		t.Fatal(err)
+	}
+	pending := e.claim(t, bob, "example.test")
+
+	if err := e.checker.Release(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.store.Domains().Get(ctx, "example.test"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("domain still stored: %v", err)
+	}
+	if got := e.sender.ActiveDKIMSelector("example.test"); got != "" {
+		t.Errorf("mail is still signed with %q", got)
+	}
+	if e.sender.DKIMKey("example.test", won.DKIMSelector) != nil {
+		t.Error("key of the released domain was kept")
+	}
+	if e.sender.DKIMKey("example.test", pending.DKIMSelector) == nil {
+		t.Error("key of a pending claim was deleted")
+	}
+	if routes := e.hooks.Routes(alice); len(routes) != 0 {
+		t.Errorf("routes left after release: %d", len(routes))
+	}
+}
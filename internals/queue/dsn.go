@@ -0,0 +1,97 @@
+package queue
+
+import (
+	"strings"
+
+	"email-blaze/internals/email"
+	"email-blaze/internals/logger"
+
+	"github.com/emersion/go-smtp"
+)
+
+// wants reports whether the recipient asked for a notification of the given
+// DSN action. Without a NOTIFY parameter only failures are reported
+// (RFC 3461 section 4.1).
+func (r *Recipient) wants(action string) bool {
+	if len(r.Notify) == 0 {
+		return action == email.ActionFailed
+	}
+	for _, n := range r.Notify {
+		switch smtp.DSNNotify(strings.ToUpper(n)) {
+		case smtp.DSNNotifyNever:
+			return false
+		case smtp.DSNNotifyFailure:
+			if action == email.ActionFailed {
+				return true
+			}
+		case smtp.DSNNotifyDelayed:
+			if action == email.ActionDelayed {
+				return true
+			}
+		case smtp.DSNNotifySuccess:
+			if action == email.ActionDelivered || action == email.ActionRelayed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// report queues a delivery status notification to the envelope sender for
+// the recipients that asked for one. Messages with a null reverse-path,
+// such as notifications themselves, never generate reports.
+func (q *Queue) report(msg *Message, data []byte, action string, rcpts []*Recipient) {
+	if msg.From == "" {
+		return
+	}
+
+	dsn := &email.DSN{
+		ReportingMTA: q.hostname,
+		EnvelopeID:   msg.EnvelopeID,
+		To:           msg.From,
+		ArrivalDate:  msg.CreatedAt,
+		Original:     data,
+		ReturnFull:   strings.EqualFold(msg.Return, string(smtp.DSNReturnFull)),
+	}
+	q.mu.Lock()
+	for _, rcpt := range rcpts {
+		if !rcpt.wants(action) {
+			continue
+		}
+		if action == email.ActionDelayed {
+			if rcpt.DelayNotified {
+				continue
+			}
+			rcpt.DelayNotified = true
+		}
+		dsn.Recipients = append(dsn.Recipients, email.DSNRecipient{
+			OriginalRecipient: rcpt.OriginalRecipient,
+			FinalRecipient:    rcpt.Address,
+			Action:            action,
+			Status:            rcpt.DSNStatus,
+			RemoteMTA:         rcpt.RemoteMTA,
+			Diagnostic:        rcpt.Diagnostic,
+			LastAttempt:       rcpt.LastAttempt,
+		})
+	}
+	q.mu.Unlock()
+	if len(dsn.Recipients) == 0 {
+		return
+	}
+
+	raw, err := dsn.Bytes()
+	if err != nil {
+		logger.Error("Failed to build delivery status notification", logger.Field("id", msg.ID), logger.Err(err))
+		return
+	}
+	id, err := q.Enqueue(NewMessage("", []string{msg.From}), raw)
+	if err != nil {
+		logger.Error("Failed to queue delivery status notification", logger.Field("id", msg.ID), logger.Err(err))
+		return
+	}
+	logger.Info("Delivery status notification queued",
+		logger.Field("id", msg.ID),
+		logger.Field("dsnID", id),
+		logger.Field("action", action),
+		logger.Field("to", msg.From))
+}
@@ -0,0 +1,116 @@
+package queue
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"email-blaze/internals/email"
+)
+
+func TestRecipientWants(t *testing.T) {
+	tests := []struct {
+		notify []string
+		wanted []string
+	}{
+		{nil, []string{email.ActionFailed}},
+		{[]string{"NEVER"}, nil},
+		{[]string{"SUCCESS"}, []string{email.ActionDelivered, email.ActionRelayed}},
+		{[]string{"delay"}, []string{email.ActionDelayed}},
+		{[]string{"FAILURE", "DELAY"}, []string{email.ActionFailed, email.ActionDelayed}},
+	}
+	actions := []string{email.ActionFailed, email.ActionDelayed, email.ActionDelivered, email.ActionRelayed}
+	for _, tt := range tests {
+		r := &Recipient{Notify: tt.notify}
+		for _, action := range actions {
+			want := false
+			for _, w := range tt.wanted {
+				want = want || w == action
+			}
+			if got := r.wants(action); got != want {
+				t.Errorf("NOTIFY=%v wants(%s) = %v, want %v", tt.notify, action, got, want)
+			}
+		}
+	}
+}
+
+// notifications returns the DSNs queued to the null reverse-path.
+func notifications(t *testing.T, q *Queue) [][]byte {
+	t.Helper()
+	msgs, _ := q.List(Filter{})
+	var dsns [][]byte
+	for _, m := range msgs {
+		if m.From != "" {
+			continue
+		}
+		data, err := os.ReadFile(q.dataPath(m.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dsns = append(dsns, data)
+	}
+	return dsns
+}
+
+func TestDelayNotifiedOnce(t *testing.T) {
+	d := &fakeDeliverer{errs: map[string]error{"bob@bob.test": tempFailure}}
+	q := newTestQueue(t, t.TempDir(), d)
+	msg := NewMessage("alice@alice.test", []string{"bob@bob.test"})
+	msg.Recipients[0].Notify = []string{"DELAY"}
+	id, err := q.Enqueue(msg, []byte("Subject: hi\r\n\r\nhi\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q.attempt(q.messages[id])
+	q.attempt(q.messages[id])
+	if d.attempts() != 2 {
+		t.Fatalf("attempted %d times, want 2", d.attempts())
+	}
+	dsns := notifications(t, q)
+	if len(dsns) != 1 || !bytes.Contains(dsns[0], []byte("Action: delayed")) {
+		t.Fatalf("queued %d notifications, want one delay notice", len(dsns))
+	}
+	if got, _ := q.Get(id); !got.Recipients[0].DelayNotified {
+		t.Error("recipient not marked as notified of the delay")
+	}
+}
+
+func TestNotifyControlsReports(t *testing.T) {
+	tests := []struct {
+		name   string
+		notify []string
+		err    error
+		action string
+	}{
+		{name: "failure by default", err: permFailure, action: "Action: failed"},
+		{name: "never on failure", notify: []string{"NEVER"}, err: permFailure},
+		{name: "success relayed", notify: []string{"SUCCESS"}, action: "Action: relayed"},
+		{name: "no success by default"},
+		{name: "no delay by default", err: tempFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &fakeDeliverer{errs: map[string]error{"bob@bob.test": tt.err}}
+			q := newTestQueue(t, t.TempDir(), d)
+			msg := NewMessage("alice@alice.test", []string{"bob@bob.test"})
+			msg.Recipients[0].Notify = tt.notify
+			id, err := q.Enqueue(msg, []byte("hi\r\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			q.attempt(q.messages[id])
+
+			dsns := notifications(t, q)
+			if tt.action == "" {
+				if len(dsns) != 0 {
+					t.Errorf("queued %d notifications, want none", len(dsns))
+				}
+				return
+			}
+			if len(dsns) != 1 || !bytes.Contains(dsns[0], []byte(tt.action)) {
+				t.Errorf("queued %d notifications, want one with %q", len(dsns), tt.action)
+			}
+		})
+	}
+}
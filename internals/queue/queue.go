@@ -0,0 +1,757 @@
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"email-blaze/internals/config"
+	"email-blaze/internals/email"
+	"email-blaze/internals/logger"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Lifecycle states of messages and their recipients. Sending only applies
+// to whole messages while a worker holds them.
+const (
+	StatusQueued    = "queued"
+	StatusSending   = "sending"
+	StatusDelivered = "delivered"
+	StatusDeferred  = "deferred"
+	StatusBounced   = "bounced"
+	StatusFailed    = "failed"
+)
+
+// Deliverer hands a message over to the remote hosts of its recipients.
+// *email.Sender satisfies it.
+type Deliverer interface {
+	Deliver(from string, to []string, msg []byte, opts *smtp.MailOptions) []email.DeliveryResult
+}
+
+// Observer is told whenever recipients of a message change state: once
+// when the message is accepted and after every delivery attempt. It gets
+// snapshots and is called outside the queue lock, but it runs on the
+// delivery worker so it should not block.
+type Observer interface {
+	Observe(msg *Message, rcpts []*Recipient)
+}
+
+type Recipient struct {
+	Address   string `json:"address"`
+	Status    string `json:"status"`
+	LastError string `json:"last_error,omitempty"`
+
+	// DSN parameters from RCPT TO (RFC 3461).
+	Notify            []string `json:"notify,omitempty"`
+	OriginalRecipient string   `json:"original_recipient,omitempty"`
+
+	RemoteMTA     string    `json:"remote_mta,omitempty"`
+	DSNStatus     string    `json:"dsn_status,omitempty"`
+	Diagnostic    string    `json:"diagnostic,omitempty"`
+	LastAttempt   time.Time `json:"last_attempt,omitempty"`
+	DelayNotified bool      `json:"delay_notified,omitempty"`
+}
+
+// Message is the spooled envelope of a queued message. The message body is
+// stored next to it in a separate file.
+type Message struct {
+	ID          string       `json:"id"`
+	Domain      string       `json:"domain,omitempty"`
+	From        string       `json:"from"`
+	Recipients  []*Recipient `json:"recipients"`
+	Status      string       `json:"status"`
+	Attempts    int          `json:"attempts"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+	NextAttempt time.Time    `json:"next_attempt"`
+	CompletedAt time.Time    `json:"completed_at,omitempty"`
+
+	// DSN parameters from MAIL FROM (RFC 3461).
+	EnvelopeID string `json:"envelope_id,omitempty"`
+	Return     string `json:"return,omitempty"`
+
+	// Body is the BODY parameter from MAIL FROM, empty for 7-bit mail.
+	// Together with UTF8 (SMTPUTF8) it says what the next hop must support.
+	Body string `json:"body,omitempty"`
+	UTF8 bool   `json:"smtputf8,omitempty"`
+}
+
+// NewMessage returns an envelope for from with default DSN settings.
+func NewMessage(from string, to []string) *Message {
+	msg := &Message{From: from}
+	for _, rcpt := range to {
+		msg.Recipients = append(msg.Recipients, &Recipient{Address: rcpt})
+	}
+	return msg
+}
+
+// mailOptions returns the MAIL parameters that must reach the next hop.
+func (m *Message) mailOptions() *smtp.MailOptions {
+	if m.Body == "" && !m.UTF8 {
+		return nil
+	}
+	return &smtp.MailOptions{Body: smtp.BodyType(m.Body), UTF8: m.UTF8}
+}
+
+func (m *Message) pending() []string {
+	var to []string
+	for _, r := range m.Recipients {
+		if r.Status == StatusQueued || r.Status == StatusDeferred {
+			to = append(to, r.Address)
+		}
+	}
+	return to
+}
+
+// finished reports whether every recipient has reached a final state.
+func (m *Message) finished() bool {
+	return !m.CompletedAt.IsZero()
+}
+
+// updateStatus derives the message status from its recipients. A message
+// is delivered once every recipient is, failed if any recipient expired or
+// could not be attempted, and bounced if the remaining ones were rejected.
+func (m *Message) updateStatus() {
+	var delivered, bounced, failed, deferred int
+	for _, r := range m.Recipients {
+		switch r.Status {
+		case StatusDelivered:
+			delivered++
+		case StatusBounced:
+			bounced++
+		case StatusFailed:
+			failed++
+		case StatusDeferred:
+			deferred++
+		}
+	}
+	switch {
+	case delivered+bounced+failed < len(m.Recipients):
+		if deferred > 0 || m.Attempts > 0 {
+			m.Status = StatusDeferred
+		} else {
+			m.Status = StatusQueued
+		}
+		return
+	case delivered == len(m.Recipients):
+		m.Status = StatusDelivered
+	case failed > 0:
+		m.Status = StatusFailed
+	default:
+		m.Status = StatusBounced
+	}
+	if m.CompletedAt.IsZero() {
+		m.CompletedAt = time.Now()
+	}
+}
+
+func (m *Message) clone() *Message {
+	c := *m
+	c.Recipients = make([]*Recipient, len(m.Recipients))
+	for i, r := range m.Recipients {
+		rcpt := *r
+		rcpt.Notify = append([]string(nil), r.Notify...)
+		c.Recipients[i] = &rcpt
+	}
+	return &c
+}
+
+// Filter selects messages for List. Zero fields match everything.
+type Filter struct {
+	Domain    string
+	Status    string
+	From      string
+	Recipient string
+	Since     time.Time
+	Until     time.Time
+	Offset    int
+	Limit     int
+}
+
+func (f *Filter) match(m *Message) bool {
+	if f.Domain != "" && !strings.EqualFold(m.Domain, f.Domain) {
+		return false
+	}
+	if f.Status != "" && m.Status != f.Status {
+		return false
+	}
+	if f.From != "" && !strings.EqualFold(m.From, f.From) {
+		return false
+	}
+	if f.Recipient != "" {
+		found := false
+		for _, r := range m.Recipients {
+			if strings.EqualFold(r.Address, f.Recipient) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && m.CreatedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !m.CreatedAt.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Queue is a durable on-disk spool of outbound messages. Messages are
+// written to disk before Enqueue returns and are retried with exponential
+// backoff until they are delivered or their lifetime expires. Once a
+// message is finished its body is dropped, but its envelope is kept for
+// the configured retention so its status can still be looked up.
+//
+// Workers only modify a message while holding mu, so Get and List can hand
+// out consistent copies at any time.
+type Queue struct {
+	dir       string
+	hostname  string
+	cfg       config.QueueConfig
+	deliverer Deliverer
+	observers []Observer
+
+	mu       sync.Mutex
+	messages map[string]*Message
+	inFlight map[string]bool
+
+	jobs chan *Message
+	wake chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func New(cfg *config.Config, deliverer Deliverer) (*Queue, error) {
+	q := &Queue{
+		dir:       cfg.Queue.Dir,
+		hostname:  cfg.SMTPHost,
+		cfg:       cfg.Queue,
+		deliverer: deliverer,
+		messages:  make(map[string]*Message),
+		inFlight:  make(map[string]bool),
+		jobs:      make(chan *Message),
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+	}
+	if q.dir == "" {
+		q.dir = "spool"
+	}
+	if err := os.MkdirAll(q.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %w", err)
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// AddObserver registers o to be told about status changes. It must be
+// called before Start.
+func (q *Queue) AddObserver(o Observer) {
+	q.observers = append(q.observers, o)
+}
+
+// Start launches the scheduler and the delivery workers.
+func (q *Queue) Start() {
+	workers := q.cfg.Workers
+	if workers <= 0 {
+		workers = 4
+	}
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+	q.wg.Add(1)
+	go q.schedule()
+
+	logger.Info("Outbound queue started",
+		logger.Field("dir", q.dir),
+		logger.Field("workers", workers),
+		logger.Field("queued", len(q.messages)))
+}
+
+// Stop waits for in-flight deliveries to finish. Messages still pending stay
+// on disk and are picked up on the next start.
+func (q *Queue) Stop() {
+	close(q.stop)
+	q.wg.Wait()
+}
+
+// Enqueue durably stores a message for delivery to the recipients of its
+// envelope and returns its queue ID. Callers that need to know the ID
+// before the message is rendered can set it beforehand with NewID.
+func (q *Queue) Enqueue(msg *Message, data []byte) (string, error) {
+	return q.enqueue(msg, data, false)
+}
+
+// Submit stores a message like Enqueue but makes the first delivery attempt
+// while the caller waits and returns its results. Recipients whose hosts
+// failed temporarily stay queued for retries under the same ID.
+func (q *Queue) Submit(msg *Message, data []byte) ([]email.DeliveryResult, error) {
+	if _, err := q.enqueue(msg, data, true); err != nil {
+		return nil, err
+	}
+	defer q.release(msg)
+
+	results := q.deliverer.Deliver(msg.From, msg.pending(), data, msg.mailOptions())
+	q.settle(msg, data, results)
+	return results, nil
+}
+
+// enqueue spools msg and, if claim is set, marks it in flight so the
+// workers leave it to the caller.
+func (q *Queue) enqueue(msg *Message, data []byte, claim bool) (string, error) {
+	if len(msg.Recipients) == 0 {
+		return "", errors.New("message has no recipients")
+	}
+
+	now := time.Now()
+	if msg.ID == "" {
+		msg.ID = NewID()
+	}
+	msg.Status = StatusQueued
+	msg.CreatedAt = now
+	msg.UpdatedAt = now
+	msg.NextAttempt = now
+	for _, rcpt := range msg.Recipients {
+		rcpt.Status = StatusQueued
+	}
+
+	q.mu.Lock()
+	_, exists := q.messages[msg.ID]
+	q.mu.Unlock()
+	if exists {
+		return "", fmt.Errorf("message %s is already queued", msg.ID)
+	}
+
+	if err := WriteFile(q.dataPath(msg.ID), data); err != nil {
+		return "", fmt.Errorf("failed to spool message: %w", err)
+	}
+	if err := q.save(msg); err != nil {
+		os.Remove(q.dataPath(msg.ID))
+		return "", fmt.Errorf("failed to spool message: %w", err)
+	}
+
+	to := msg.pending()
+	q.mu.Lock()
+	q.messages[msg.ID] = msg
+	if claim {
+		q.inFlight[msg.ID] = true
+	}
+	q.mu.Unlock()
+	if !claim {
+		q.notify()
+	}
+	q.observe(msg, msg.Recipients)
+
+	logger.Info("Message queued",
+		logger.Field("id", msg.ID),
+		logger.Field("from", msg.From),
+		logger.Field("to", to))
+	return msg.ID, nil
+}
+
+// Get returns a snapshot of the message with the given ID.
+func (q *Queue) Get(id string) (*Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	msg, ok := q.messages[id]
+	if !ok {
+		return nil, false
+	}
+	return msg.clone(), true
+}
+
+// List returns the messages matching f, newest first, along with the total
+// number of matches before Offset and Limit are applied.
+func (q *Queue) List(f Filter) ([]*Message, int) {
+	q.mu.Lock()
+	var matches []*Message
+	for _, msg := range q.messages {
+		if f.match(msg) {
+			matches = append(matches, msg.clone())
+		}
+	}
+	q.mu.Unlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].CreatedAt.Equal(matches[j].CreatedAt) {
+			return matches[i].ID > matches[j].ID
+		}
+		return matches[i].CreatedAt.After(matches[j].CreatedAt)
+	})
+
+	total := len(matches)
+	if f.Offset >= total {
+		return nil, total
+	}
+	matches = matches[f.Offset:]
+	if f.Limit > 0 && f.Limit < len(matches) {
+		matches = matches[:f.Limit]
+	}
+	return matches, total
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) schedule() {
+	defer q.wg.Done()
+	defer close(q.jobs)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-q.wake:
+		case <-timer.C:
+		}
+
+		q.purge()
+		for _, msg := range q.due() {
+			select {
+			case q.jobs <- msg:
+			case <-q.stop:
+				return
+			}
+		}
+
+		timer.Reset(q.untilNext())
+	}
+}
+
+// due claims every message whose next attempt has come.
+func (q *Queue) due() []*Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	var due []*Message
+	for id, msg := range q.messages {
+		if !msg.finished() && !q.inFlight[id] && !msg.NextAttempt.After(now) {
+			q.inFlight[id] = true
+			msg.Status = StatusSending
+			msg.UpdatedAt = now
+			due = append(due, msg)
+		}
+	}
+	return due
+}
+
+func (q *Queue) untilNext() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	next := time.Minute
+	now := time.Now()
+	for id, msg := range q.messages {
+		if msg.finished() || q.inFlight[id] {
+			continue
+		}
+		if d := msg.NextAttempt.Sub(now); d < next {
+			next = d
+		}
+	}
+	if next < 0 {
+		next = 0
+	}
+	return next
+}
+
+func (q *Queue) worker() {
+	defer q.wg.Done()
+	for msg := range q.jobs {
+		q.attempt(msg)
+	}
+}
+
+// release hands a message back to the scheduler after an attempt.
+func (q *Queue) release(msg *Message) {
+	q.mu.Lock()
+	delete(q.inFlight, msg.ID)
+	q.mu.Unlock()
+	q.notify()
+}
+
+func (q *Queue) attempt(msg *Message) {
+	defer q.release(msg)
+
+	data, err := os.ReadFile(q.dataPath(msg.ID))
+	if err != nil {
+		logger.Error("Failed to read spooled message", logger.Field("id", msg.ID), logger.Err(err))
+		var failed []*Recipient
+		q.mu.Lock()
+		for _, rcpt := range msg.Recipients {
+			if rcpt.Status == StatusQueued || rcpt.Status == StatusDeferred {
+				rcpt.Status = StatusFailed
+				rcpt.LastError = "message data lost from spool"
+				failed = append(failed, rcpt)
+			}
+		}
+		q.mu.Unlock()
+		q.finish(msg)
+		q.observe(msg, failed)
+		return
+	}
+
+	results := q.deliverer.Deliver(msg.From, msg.pending(), data, msg.mailOptions())
+	q.settle(msg, data, results)
+}
+
+// settle records the results of a delivery attempt, reports them to the
+// observers and the envelope sender, and finishes the message once no
+// recipient is left.
+func (q *Queue) settle(msg *Message, data []byte, results []email.DeliveryResult) {
+	q.mu.Lock()
+	now := time.Now()
+	msg.Attempts++
+	msg.UpdatedAt = now
+	expired := now.Sub(msg.CreatedAt) >= q.lifetime()
+	byAddress := make(map[string]*Recipient, len(msg.Recipients))
+	for _, r := range msg.Recipients {
+		byAddress[r.Address] = r
+	}
+	var delivered, failed, delayed []*Recipient
+	for _, result := range results {
+		rcpt := byAddress[result.Recipient]
+		if rcpt == nil {
+			continue
+		}
+		rcpt.RemoteMTA = result.Host
+		rcpt.DSNStatus, rcpt.Diagnostic = email.DeliveryStatus(result.Err)
+		rcpt.LastAttempt = now
+		switch {
+		case result.Err == nil:
+			rcpt.Status = StatusDelivered
+			rcpt.LastError = ""
+			delivered = append(delivered, rcpt)
+			logger.Info("Message delivered",
+				logger.Field("id", msg.ID),
+				logger.Field("to", rcpt.Address),
+				logger.Field("host", result.Host))
+		case email.IsPermanent(result.Err) || expired:
+			rcpt.Status = StatusBounced
+			if !email.IsPermanent(result.Err) {
+				rcpt.Status = StatusFailed
+			}
+			rcpt.LastError = result.Err.Error()
+			failed = append(failed, rcpt)
+			logger.Error("Message delivery failed permanently",
+				logger.Field("id", msg.ID),
+				logger.Field("to", rcpt.Address),
+				logger.Field("attempts", msg.Attempts),
+				logger.Err(result.Err))
+		default:
+			rcpt.Status = StatusDeferred
+			rcpt.LastError = result.Err.Error()
+			delayed = append(delayed, rcpt)
+			logger.Info("Message delivery deferred",
+				logger.Field("id", msg.ID),
+				logger.Field("to", rcpt.Address),
+				logger.Field("attempts", msg.Attempts),
+				logger.Err(result.Err))
+		}
+	}
+
+	msg.NextAttempt = now.Add(q.backoff(msg.Attempts))
+	msg.updateStatus()
+	q.mu.Unlock()
+
+	q.observe(msg, append(append(delivered, failed...), delayed...))
+	q.report(msg, data, email.ActionRelayed, delivered)
+	q.report(msg, data, email.ActionFailed, failed)
+	q.report(msg, data, email.ActionDelayed, delayed)
+
+	if msg.finished() {
+		q.finish(msg)
+		return
+	}
+	if err := q.save(msg); err != nil {
+		logger.Error("Failed to update spooled message", logger.Field("id", msg.ID), logger.Err(err))
+	}
+}
+
+func (q *Queue) observe(msg *Message, rcpts []*Recipient) {
+	if len(q.observers) == 0 || len(rcpts) == 0 {
+		return
+	}
+
+	q.mu.Lock()
+	snapshot := msg.clone()
+	changed := make([]*Recipient, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		for i, r := range msg.Recipients {
+			if r == rcpt {
+				changed = append(changed, snapshot.Recipients[i])
+			}
+		}
+	}
+	q.mu.Unlock()
+
+	for _, o := range q.observers {
+		o.Observe(snapshot, changed)
+	}
+}
+
+func (q *Queue) backoff(attempts int) time.Duration {
+	interval := time.Duration(q.cfg.RetryInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	max := time.Duration(q.cfg.MaxRetryInterval) * time.Second
+	if max <= 0 {
+		max = time.Hour
+	}
+	for i := 1; i < attempts && interval < max; i++ {
+		interval *= 2
+	}
+	if interval > max {
+		interval = max
+	}
+	return interval
+}
+
+func (q *Queue) lifetime() time.Duration {
+	if q.cfg.Lifetime <= 0 {
+		return 5 * 24 * time.Hour
+	}
+	return time.Duration(q.cfg.Lifetime) * time.Hour
+}
+
+func (q *Queue) retention() time.Duration {
+	if q.cfg.Retention <= 0 {
+		return 7 * 24 * time.Hour
+	}
+	return time.Duration(q.cfg.Retention) * time.Hour
+}
+
+// finish drops the body of a message that needs no further attempts and
+// keeps its envelope as a status record.
+func (q *Queue) finish(msg *Message) {
+	q.mu.Lock()
+	msg.updateStatus()
+	q.mu.Unlock()
+
+	os.Remove(q.dataPath(msg.ID))
+	if err := q.save(msg); err != nil {
+		logger.Error("Failed to update spooled message", logger.Field("id", msg.ID), logger.Err(err))
+	}
+	logger.Info("Message finished", logger.Field("id", msg.ID), logger.Field("status", msg.Status))
+}
+
+// purge forgets finished messages older than the retention period.
+func (q *Queue) purge() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	cutoff := time.Now().Add(-q.retention())
+	for id, msg := range q.messages {
+		if msg.finished() && msg.CompletedAt.Before(cutoff) {
+			delete(q.messages, id)
+			os.Remove(q.envelopePath(id))
+		}
+	}
+}
+
+func (q *Queue) load() error {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read queue directory: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		id := strings.TrimSuffix(name, ".json")
+		raw, err := os.ReadFile(filepath.Join(q.dir, name))
+		if err != nil {
+			return fmt.Errorf("failed to read queued message %s: %w", id, err)
+		}
+		var msg Message
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			logger.Error("Skipping corrupt queue entry", logger.Field("id", id), logger.Err(err))
+			continue
+		}
+		if !msg.finished() {
+			if _, err := os.Stat(q.dataPath(id)); err != nil {
+				logger.Error("Dropping queue entry without message data", logger.Field("id", id))
+				os.Remove(q.envelopePath(id))
+				continue
+			}
+			// Entries spooled before status tracking, or interrupted mid-attempt.
+			for _, rcpt := range msg.Recipients {
+				if rcpt.Status == "pending" {
+					rcpt.Status = StatusQueued
+				}
+			}
+			msg.updateStatus()
+		}
+		q.messages[msg.ID] = &msg
+	}
+	return nil
+}
+
+func (q *Queue) save(msg *Message) error {
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return WriteFile(q.envelopePath(msg.ID), raw)
+}
+
+func (q *Queue) envelopePath(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+func (q *Queue) dataPath(id string) string {
+	return filepath.Join(q.dir, id+".eml")
+}
+
+// WriteFile atomically replaces path with data, syncing it to disk first.
+func WriteFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// NewID returns a new unique queue ID.
+func NewID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%x%s", time.Now().UnixNano(), hex.EncodeToString(b))
+}
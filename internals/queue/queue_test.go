@@ -0,0 +1,260 @@
+package queue
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"email-blaze/internals/config"
+	"email-blaze/internals/email"
+	"email-blaze/internals/logger"
+
+	"github.com/emersion/go-smtp"
+)
+
+func init() {
+	logger.Init("fatal", "production", "console")
+}
+
+// fakeDeliverer fails the recipients in errs and accepts the rest.
+type fakeDeliverer struct {
+	mu    sync.Mutex
+	errs  map[string]error
+	calls [][]string
+	opts  []*smtp.MailOptions
+}
+
+func (d *fakeDeliverer) Deliver(from string, to []string, msg []byte, opts *smtp.MailOptions) []email.DeliveryResult {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls = append(d.calls, to)
+	d.opts = append(d.opts, opts)
+	var results []email.DeliveryResult
+	for _, rcpt := range to {
+		results = append(results, email.DeliveryResult{Recipient: rcpt, Host: "mx.remote.test", Err: d.errs[rcpt]})
+	}
+	return results
+}
+
+func (d *fakeDeliverer) attempts() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.calls)
+}
+
+var (
+	tempFailure = &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Try again later"}
+	permFailure = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+)
+
+func newTestQueue(t *testing.T, dir string, d Deliverer) *Queue {
+	t.Helper()
+	q, err := New(&config.Config{SMTPHost: "mx.test", Queue: config.QueueConfig{Dir: dir, Workers: 1}}, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// waitFor polls the status of id until it is want.
+func waitFor(t *testing.T, q *Queue, id, want string) *Message {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		msg, ok := q.Get(id)
+		if ok && msg.Status == want {
+			return msg
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("message %s = %+v, want status %s", id, msg, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedeliveryAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	crashed := newTestQueue(t, dir, &fakeDeliverer{})
+	env := NewMessage("alice@alice.test", []string{"bob@bob.test"})
+	env.Body, env.UTF8 = string(smtp.Body8BitMIME), true
+	id, err := crashed.Enqueue(env, []byte("Subject: hi\r\n\r\nhi\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The process dies while a worker holds the message.
+	msg := crashed.due()[0]
+	if err := crashed.save(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &fakeDeliverer{}
+	q := newTestQueue(t, dir, d)
+	if msg, ok := q.Get(id); !ok || msg.Status != StatusQueued {
+		t.Fatalf("reloaded message = %+v, %v, want queued", msg, ok)
+	}
+	q.Start()
+	defer q.Stop()
+
+	msg = waitFor(t, q, id, StatusDelivered)
+	if d.attempts() != 1 || msg.Recipients[0].RemoteMTA != "mx.remote.test" {
+		t.Errorf("delivered after %d attempts through %q, want 1 through mx.remote.test", d.attempts(), msg.Recipients[0].RemoteMTA)
+	}
+	if _, err := os.Stat(q.dataPath(id)); !os.IsNotExist(err) {
+		t.Errorf("message data kept after delivery: %v", err)
+	}
+	if opts := d.opts[0]; opts == nil || opts.Body != smtp.Body8BitMIME || !opts.UTF8 {
+		t.Errorf("delivered with MAIL parameters %+v, want BODY=8BITMIME SMTPUTF8", opts)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      config.QueueConfig
+		attempts int
+		want     time.Duration
+	}{
+		{name: "default first retry", attempts: 1, want: time.Minute},
+		{name: "default doubles", attempts: 3, want: 4 * time.Minute},
+		{name: "default capped at an hour", attempts: 10, want: time.Hour},
+		{name: "configured first retry", cfg: config.QueueConfig{RetryInterval: 30}, attempts: 1, want: 30 * time.Second},
+		{name: "configured doubles", cfg: config.QueueConfig{RetryInterval: 30}, attempts: 2, want: time.Minute},
+		{name: "configured cap", cfg: config.QueueConfig{RetryInterval: 30, MaxRetryInterval: 90}, attempts: 3, want: 90 * time.Second},
+		{name: "many attempts do not overflow", cfg: config.QueueConfig{MaxRetryInterval: 7200}, attempts: 1000, want: 2 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &Queue{cfg: tt.cfg}
+			if got := q.backoff(tt.attempts); got != tt.want {
+				t.Errorf("backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTemporaryFailureDefers(t *testing.T) {
+	d := &fakeDeliverer{errs: map[string]error{"bob@bob.test": tempFailure}}
+	q := newTestQueue(t, t.TempDir(), d)
+	id, err := q.Enqueue(NewMessage("alice@alice.test", []string{"bob@bob.test", "carol@carol.test"}), []byte("hi\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now()
+	q.attempt(q.messages[id])
+	msg, _ := q.Get(id)
+	if msg.Status != StatusDeferred || msg.Recipients[0].Status != StatusDeferred || msg.Recipients[1].Status != StatusDelivered {
+		t.Fatalf("after a temporary failure = %+v", msg)
+	}
+	if msg.NextAttempt.Before(before.Add(time.Minute)) {
+		t.Errorf("next attempt at %v, want a minute after the first", msg.NextAttempt)
+	}
+
+	q.attempt(q.messages[id])
+	if got := d.calls[1]; len(got) != 1 || got[0] != "bob@bob.test" {
+		t.Errorf("retried %v, want only the deferred recipient", got)
+	}
+}
+
+func TestLifetimeExpiry(t *testing.T) {
+	d := &fakeDeliverer{errs: map[string]error{"bob@bob.test": tempFailure}}
+	q := newTestQueue(t, t.TempDir(), d)
+	q.cfg.Lifetime = 1
+	id, err := q.Enqueue(NewMessage("alice@alice.test", []string{"bob@bob.test"}), []byte("hi\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.messages[id].CreatedAt = time.Now().Add(-2 * time.Hour)
+
+	q.attempt(q.messages[id])
+	msg, _ := q.Get(id)
+	if msg.Status != StatusFailed || msg.Recipients[0].Status != StatusFailed || !msg.finished() {
+		t.Fatalf("expired message = %+v, want failed", msg)
+	}
+	if _, err := os.Stat(q.dataPath(id)); !os.IsNotExist(err) {
+		t.Errorf("message data kept after expiry: %v", err)
+	}
+
+	bounces, _ := q.List(Filter{})
+	var dsn *Message
+	for _, m := range bounces {
+		if m.From == "" {
+			dsn = m
+		}
+	}
+	if dsn == nil || dsn.Recipients[0].Address != "alice@alice.test" {
+		t.Errorf("no failure notification queued to the sender: %+v", bounces)
+	}
+}
+
+func TestPermanentFailureBounces(t *testing.T) {
+	d := &fakeDeliverer{errs: map[string]error{"bob@bob.test": permFailure}}
+	q := newTestQueue(t, t.TempDir(), d)
+	id, err := q.Enqueue(NewMessage("alice@alice.test", []string{"bob@bob.test"}), []byte("hi\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q.attempt(q.messages[id])
+	msg, _ := q.Get(id)
+	if msg.Status != StatusBounced || msg.Recipients[0].DSNStatus != "5.1.1" {
+		t.Errorf("rejected message = %+v, want bounced with 5.1.1", msg)
+	}
+}
+
+// recordingObserver keeps the statuses it is told about.
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) Observe(msg *Message, rcpts []*Recipient) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, r := range rcpts {
+		o.events = append(o.events, msg.ID+" "+r.Address+" "+r.Status)
+	}
+}
+
+func TestSubmitTracksDirectDelivery(t *testing.T) {
+	d := &fakeDeliverer{errs: map[string]error{"bob@bob.test": tempFailure, "dave@dave.test": permFailure}}
+	q := newTestQueue(t, t.TempDir(), d)
+	obs := &recordingObserver{}
+	q.AddObserver(obs)
+
+	msg := NewMessage("alice@alice.test", []string{"bob@bob.test", "carol@carol.test", "dave@dave.test"})
+	msg.ID = NewID()
+	results, err := q.Submit(msg, []byte("hi\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || d.attempts() != 1 {
+		t.Fatalf("Submit returned %d results after %d attempts, want 3 after 1", len(results), d.attempts())
+	}
+
+	got, ok := q.Get(msg.ID)
+	if !ok || got.Status != StatusDeferred || got.Recipients[0].Status != StatusDeferred {
+		t.Fatalf("submitted message = %+v, want bob deferred under the same ID", got)
+	}
+	if q.inFlight[msg.ID] {
+		t.Error("message still claimed after Submit")
+	}
+	want := []string{
+		msg.ID + " bob@bob.test queued",
+		msg.ID + " carol@carol.test queued",
+		msg.ID + " dave@dave.test queued",
+		msg.ID + " carol@carol.test delivered",
+		msg.ID + " dave@dave.test bounced",
+		msg.ID + " bob@bob.test deferred",
+	}
+	// The bounce for dave is queued as a message of its own after these.
+	if len(obs.events) != len(want)+1 {
+		t.Fatalf("observed %q, want %q", obs.events, want)
+	}
+	for i := range want {
+		if obs.events[i] != want[i] {
+			t.Errorf("event %d = %q, want %q", i, obs.events[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package smtp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"email-blaze/internals/config"
+
+	"github.com/emersion/go-smtp"
+)
+
+var (
+	errAuthRequired = &smtp.SMTPError{
+		Code:         530,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+		Message:      "Authentication required",
+	}
+	errRelayDenied = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Relay access denied",
+	}
+	errNoMailbox = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "Mailbox unavailable",
+	}
+	errRouteRejected = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Message rejected by the recipient's authentication policy",
+	}
+	errSenderDomain = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 8},
+		Message:      "Sender domain does not accept mail",
+	}
+	errSenderLookup = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 4, 3},
+		Message:      "Sender domain lookup failed, try again later",
+	}
+)
+
+type relayPolicy struct {
+	requireAuth bool
+	trusted     []*net.IPNet
+	local       map[string]bool
+}
+
+func newRelayPolicy(cfg config.RelayConfig) (*relayPolicy, error) {
+	p := &relayPolicy{
+		requireAuth: cfg.RequireAuth,
+		local:       make(map[string]bool),
+	}
+	for _, cidr := range cfg.TrustedNetworks {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted network %q: %w", cidr, err)
+		}
+		p.trusted = append(p.trusted, n)
+	}
+	for _, d := range cfg.LocalDomains {
+		p.local[normalizeDomain(d)] = true
+	}
+	return p, nil
+}
+
+// trustedAddr reports whether addr is in one of the trusted networks.
+func (p *relayPolicy) trustedAddr(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range p.trusted {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocal reports whether the recipient address is on a local domain.
+func (p *relayPolicy) isLocal(rcpt string) bool {
+	i := strings.LastIndex(rcpt, "@")
+	return i >= 0 && p.local[normalizeDomain(rcpt[i+1:])]
+}
+
+func normalizeDomain(d string) string {
+	return strings.TrimSuffix(strings.ToLower(d), ".")
+}
@@ -0,0 +1,65 @@
+package smtp
+
+import (
+	"testing"
+
+	"email-blaze/internals/config"
+)
+
+func TestRelayPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		relay    config.RelayConfig
+		auth     bool
+		from     string
+		rcpt     string
+		mailCode string // enhanced code of the MAIL reply, "" for 250
+		rcptCode string
+	}{
+		{name: "open relay refused", from: "a@sender.test", rcpt: "b@remote.test", rcptCode: "5.7.1"},
+		{name: "local recipient accepted", from: "a@sender.test", rcpt: "inbox@example.test"},
+		{name: "local domain is case insensitive", from: "a@sender.test", rcpt: "Inbox@Example.Test"},
+		{name: "local recipient without route", from: "a@sender.test", rcpt: "nobody@example.test", rcptCode: "5.1.1"},
+		{name: "null sender to local recipient", from: "", rcpt: "inbox@example.test"},
+		{name: "sender domain without mail", from: "a@nomail.test", rcpt: "inbox@example.test", mailCode: "5.1.8"},
+		{name: "sender domain lookup failure", from: "a@flaky.test", rcpt: "inbox@example.test", mailCode: "4.4.3"},
+		{name: "auth required before MAIL", relay: config.RelayConfig{RequireAuth: true}, from: "a@sender.test", mailCode: "5.7.0"},
+		{name: "trusted network relays", relay: config.RelayConfig{TrustedNetworks: []string{"127.0.0.0/8"}}, from: "a@sender.test", rcpt: "b@remote.test"},
+		{name: "trusted single address", relay: config.RelayConfig{TrustedNetworks: []string{"127.0.0.1"}}, from: "a@sender.test", rcpt: "b@remote.test"},
+		{name: "other network not trusted", relay: config.RelayConfig{TrustedNetworks: []string{"192.0.2.0/24"}}, from: "a@sender.test", rcpt: "b@remote.test", rcptCode: "5.7.1"},
+		{name: "authenticated client relays", relay: config.RelayConfig{RequireAuth: true}, auth: true, from: "a@sender.test", rcpt: "b@remote.test"},
+		{name: "authenticated sender outside its allowlist", auth: true, from: "a@other.test", mailCode: "5.7.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.DevelopmentMode = true // AUTH without TLS
+			tt.relay.LocalDomains = []string{"example.test"}
+			srv := startServer(t, cfg, config.ListenerConfig{Name: "test", Mode: "plain", Relay: &tt.relay}, nil)
+			c := dial(t, srv.addr)
+			if tt.auth {
+				if err := authenticate(c); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := code(c.Mail(tt.from, nil)); got != tt.mailCode {
+				t.Fatalf("MAIL FROM:<%s> = %q, want %q", tt.from, got, tt.mailCode)
+			}
+			if tt.mailCode != "" {
+				return
+			}
+			if got := code(c.Rcpt(tt.rcpt, nil)); got != tt.rcptCode {
+				t.Errorf("RCPT TO:<%s> = %q, want %q", tt.rcpt, got, tt.rcptCode)
+			}
+		})
+	}
+}
+
+func TestNewRelayPolicyRejectsBadNetworks(t *testing.T) {
+	for _, cidr := range []string{"192.0.2.0/33", "not an address"} {
+		if _, err := newRelayPolicy(config.RelayConfig{TrustedNetworks: []string{cidr}}); err == nil {
+			t.Errorf("newRelayPolicy accepted trusted network %q", cidr)
+		}
+	}
+}
@@ -1,18 +1,26 @@
 package smtp
 
 import (
-	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
 	"email-blaze/internals/auth"
 	"email-blaze/internals/config"
-	"email-blaze/internals/email"
+	"email-blaze/internals/inbound"
 	"email-blaze/internals/logger"
+	"email-blaze/internals/queue"
+	"email-blaze/internals/storage"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"os"
+	"net"
+	"net/mail"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-sasl"
@@ -20,21 +28,69 @@ import (
 )
 
 type Backend struct {
-	config *config.Config
-	sender *email.Sender
+	config   *config.Config
+	listener config.ListenerConfig
+	queue    *queue.Queue
+	store    storage.Store
+	senders  *auth.SenderPolicy
+	relay    *relayPolicy
+	inbound  *inbound.Router
+	secret   string // keys the salts SCRAM makes up for unknown users
 }
 
-func NewBackend(cfg *config.Config, sender *email.Sender) *Backend {
+// NewBackend creates the backend for one listener, which brings its own
+// auth and relay settings. Mail for the local domains goes to router.
+func NewBackend(cfg *config.Config, l config.ListenerConfig, q *queue.Queue, store storage.Store, router *inbound.Router) (*Backend, error) {
+	relayCfg := cfg.Relay
+	if l.Relay != nil {
+		relayCfg = *l.Relay
+	}
+	relay, err := newRelayPolicy(relayCfg)
+	if err != nil {
+		return nil, fmt.Errorf("listener %s: %w", l.Name, err)
+	}
+	if err := auth.ValidateAllowedSenders(cfg.SMTPAllowedSenders); err != nil {
+		return nil, fmt.Errorf("smtp_allowed_senders: %w", err)
+	}
+	secret, err := scramSecret(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("SCRAM secret: %w", err)
+	}
 	return &Backend{
-		config: cfg,
-		sender: sender,
+		config:   cfg,
+		listener: l,
+		queue:    q,
+		store:    store,
+		senders:  auth.NewSenderPolicy(store.Domains()),
+		relay:    relay,
+		inbound:  router,
+		secret:   secret,
+	}, nil
+}
+
+// randomSecret is shared by all listeners so that they make up the same
+// SCRAM salts when jwt_secret is not set.
+var randomSecret = sync.OnceValues(func() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+})
+
+func scramSecret(cfg *config.Config) (string, error) {
+	if cfg.JWTSecret != "" {
+		return cfg.JWTSecret, nil
 	}
+	return randomSecret()
 }
 
-func (bkd *Backend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
+func (bkd *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
 	return &Session{
 		id:      generateUniqueID(),
 		backend: bkd,
+		conn:    c,
+		trusted: bkd.relay.trustedAddr(c.Conn().RemoteAddr()),
 	}, nil
 }
 
@@ -43,93 +99,181 @@ func generateUniqueID() string {
 }
 
 type Session struct {
-	id      string
-	backend *Backend
-	from    string
-	to      []string
+	id            string
+	backend       *Backend
+	conn          *smtp.Conn
+	authenticated bool
+	trusted       bool          // connected from a trusted network
+	account       *storage.User // authenticated user, whose sender policy applies
+	service       bool          // authenticated as smtp_username, limited to smtp_allowed_senders
+	apiKey        *storage.APIKey
+	from          string
+	to            []string
+	mailOpts      smtp.MailOptions
+	rcptOpts      []smtp.RcptOptions
+}
+
+var errAuthFailed = &smtp.SMTPError{
+	Code:         535,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+	Message:      "Authentication credentials invalid",
 }
 
 func (s *Session) AuthMechanisms() []string {
-	return []string{sasl.Plain}
+	if s.backend.listener.DisableAuth {
+		return nil
+	}
+	return []string{sasl.Plain, sasl.Login, scramSHA256}
 }
 
+// Auth authenticates against the user store. Passwords and API keys with
+// the send scope are both accepted as the password. The smtp_username
+// service account from the config is not bound to a user; it may only send
+// as smtp_allowed_senders and cannot log in without them.
 func (s *Session) Auth(mech string) (sasl.Server, error) {
-	return sasl.NewPlainServer(func(identity, username, password string) error {
-		logger.Info("Auth attempt",
-            logger.Field("identity", identity),
-            logger.Field("username", username),
-            logger.Field("password", password),
-            logger.Field("config_username", s.backend.config.SMTPUsername),
-            logger.Field("config_password", s.backend.config.SMTPPassword))
-		if username != s.backend.config.SMTPUsername || password != s.backend.config.SMTPPassword {
-			logger.Error("Authentication failed",
-			logger.Field("provided_username", username),
-			logger.Field("config_username", s.backend.config.SMTPUsername))
-			return fmt.Errorf("invalid username or password")
-		}
-		return nil
-	}), nil
+	if s.backend.listener.DisableAuth {
+		mech = ""
+	}
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			if identity != "" && identity != username {
+				return errAuthFailed
+			}
+			return s.login(mech, username, password)
+		}), nil
+	case sasl.Login:
+		return sasl.NewLoginServer(func(username, password string) error {
+			return s.login(mech, username, password)
+		}), nil
+	case scramSHA256:
+		return newScramServer(s.backend.store.Users(), s.backend.secret, func(u *storage.User) {
+			s.setAccount(mech, u, nil)
+		}), nil
+	}
+	return nil, &smtp.SMTPError{
+		Code:         504,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 4},
+		Message:      "Unsupported authentication mechanism",
+	}
 }
 
-func (s *Session) Mail(from string, _ *smtp.MailOptions) error {
-	isValid, err := auth.VerifyEmail(from)
+func (s *Session) login(mech, username, password string) error {
+	cfg := s.backend.config
+	if cfg.SMTPUsername != "" && len(cfg.SMTPAllowedSenders) > 0 && username == cfg.SMTPUsername &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(cfg.SMTPPassword)) == 1 {
+		s.authenticated = true
+		s.service = true
+		logger.Info("SMTP service account authenticated", logger.Field("sessionID", s.id), logger.Field("mechanism", mech))
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	account, key, err := auth.AuthenticateSMTP(ctx, s.backend.store, username, password)
+	if errors.Is(err, auth.ErrInvalidCredentials) || errors.Is(err, auth.ErrUserDisabled) {
+		logger.Info("SMTP authentication failed",
+			logger.Field("sessionID", s.id),
+			logger.Field("mechanism", mech),
+			logger.Field("username", username),
+			logger.Field("remote", s.conn.Conn().RemoteAddr().String()))
+		return errAuthFailed
+	}
 	if err != nil {
-		logger.Error("Email verification failed", logger.Err(err))
-		return fmt.Errorf("email verification failed: %w", err)
+		logger.Error("Failed to check SMTP credentials", logger.Field("sessionID", s.id), logger.Err(err))
+		return &smtp.SMTPError{
+			Code:         454,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+			Message:      "Temporary authentication failure",
+		}
 	}
-	if !isValid {
-		return errors.New("invalid email or domain not properly configured")
+	s.setAccount(mech, account, key)
+	return nil
+}
+
+func (s *Session) setAccount(mech string, account *storage.User, key *storage.APIKey) {
+	s.authenticated = true
+	s.account = account
+	s.apiKey = key
+	var keyPrefix string
+	if key != nil {
+		keyPrefix = key.Prefix
+	}
+	logger.Info("SMTP client authenticated",
+		logger.Field("sessionID", s.id),
+		logger.Field("mechanism", mech),
+		logger.Field("user", account.Email),
+		logger.Field("apiKey", keyPrefix))
+}
+
+func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+	if s.backend.relay.requireAuth && !s.mayRelay() {
+		return errAuthRequired
+	}
+	if err := s.checkSenderDomain(from); err != nil {
+		return err
+	}
+	if err := s.authorizeSender(from); err != nil {
+		return err
 	}
 	s.from = from
+	if opts != nil {
+		s.mailOpts = *opts
+	}
 	return nil
 }
 
-func (s *Session) Rcpt(to string, _ *smtp.RcptOptions) error {
+func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if s.backend.relay.isLocal(to) {
+		if s.backend.inbound == nil || !s.backend.inbound.Accepts(to) {
+			logger.Info("No route for local recipient",
+				logger.Field("sessionID", s.id),
+				logger.Field("from", s.from),
+				logger.Field("to", to))
+			return errNoMailbox
+		}
+	} else if !s.mayRelay() {
+		logger.Info("Relay denied",
+			logger.Field("sessionID", s.id),
+			logger.Field("remote", s.conn.Conn().RemoteAddr().String()),
+			logger.Field("from", s.from),
+			logger.Field("to", to))
+		return errRelayDenied
+	} else if err := s.checkSuppressed(to); err != nil {
+		return err
+	}
 	s.to = append(s.to, to)
+	if opts == nil {
+		opts = &smtp.RcptOptions{}
+	}
+	s.rcptOpts = append(s.rcptOpts, *opts)
 	return nil
 }
 
 func (s *Session) Data(r io.Reader) error {
 	logger.Info("Received email data", logger.Field("sessionID", s.id), logger.Field("from", s.from), logger.Field("to", s.to))
-	
-	var b bytes.Buffer
-	reader := bufio.NewReader(r)
-	
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				logger.Info("EOF reached", logger.Field("sessionID", s.id))
-				break
-			}
-			logger.Error("Failed to read email data", logger.Field("sessionID", s.id), logger.Err(err))
-			return fmt.Errorf("failed to read email data: %w", err)
-		}
-
-		// Check for end-of-data marker
-		if line == ".\r\n" || line == ".\n" {
-			logger.Info("End-of-data marker found", logger.Field("sessionID", s.id))
-			break
-		}
 
-		// Remove leading dot if line starts with ".."
-		if strings.HasPrefix(line, "..") {
-			line = line[1:]
-		}
-
-		if _, err := b.WriteString(line); err != nil {
-			logger.Error("Failed to write to buffer", logger.Field("sessionID", s.id), logger.Err(err))
-			return fmt.Errorf("failed to write to buffer: %w", err)
-		}
-
-		if b.Len() > s.backend.config.MaxMessageSize {
-			logger.Error("Message too large", logger.Field("sessionID", s.id), logger.Field("size", b.Len()))
-			return errors.New("message too large")
+	// The reader has already removed dot-stuffing and the end-of-data
+	// marker; what comes out of it is the message exactly as submitted.
+	var b bytes.Buffer
+	limit := int64(s.backend.config.MaxMessageSize)
+	n, err := io.Copy(&b, io.LimitReader(r, limit+1))
+	if err != nil {
+		logger.Error("Failed to read email data", logger.Field("sessionID", s.id), logger.Err(err))
+		return fmt.Errorf("failed to read email data: %w", err)
+	}
+	if n > limit {
+		io.Copy(io.Discard, r)
+		logger.Error("Message too large", logger.Field("sessionID", s.id), logger.Field("size", n))
+		return &smtp.SMTPError{
+			Code:         552,
+			EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+			Message:      "Message too large",
 		}
 	}
 
 	// Process the email
-	err := s.processEmail(&b)
+	err = s.processEmail(&b)
 	if err != nil {
 		logger.Error("Failed to process email", logger.Field("sessionID", s.id), logger.Err(err))
 		return err
@@ -139,74 +283,395 @@ func (s *Session) Data(r io.Reader) error {
 	return nil
 }
 
+// processEmail queues the submitted message unchanged apart from a
+// prepended Received trace header. Recipients on the local domains are
+// handed to their inbound routes instead.
 func (s *Session) processEmail(b *bytes.Buffer) error {
 	start := time.Now()
-	parsedEmail, err := email.Parse(bytes.NewReader(b.Bytes()))
-	if err != nil {
-		logger.Error("Failed to parse email", logger.Field("sessionID", s.id), logger.Err(err))
-		return fmt.Errorf("failed to parse email: %w", err)
+
+	var subject, messageID string
+	parsed, err := mail.ReadMessage(bytes.NewReader(b.Bytes()))
+	if err == nil {
+		subject = parsed.Header.Get("Subject")
+		messageID = parsed.Header.Get("Message-ID")
+	}
+	if s.account != nil || s.service {
+		if err != nil {
+			return &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+				Message:      "Message headers could not be parsed",
+			}
+		}
+		from, err := parsed.Header.AddressList("From")
+		if err != nil || len(from) == 0 {
+			return &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+				Message:      "Message has no valid From header",
+			}
+		}
+		if parsed.Header.Get("Sender") != "" {
+			sender, err := parsed.Header.AddressList("Sender")
+			if err != nil {
+				return &smtp.SMTPError{
+					Code:         550,
+					EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+					Message:      "Message has an invalid Sender header",
+				}
+			}
+			from = append(from, sender...)
+		}
+		for _, addr := range from {
+			if err := s.authorizeSender(addr.Address); err != nil {
+				return err
+			}
+		}
 	}
-	parseTime := time.Since(start)
 
-	// Determine if the email is HTML
-	isHTML := strings.Contains(b.String(), "Content-Type: text/html")
+	var msg bytes.Buffer
+	msg.WriteString(s.receivedHeader())
+	msg.Write(b.Bytes())
 
-	for _, recipient := range s.to {
-		sendStart := time.Now()
-		err := s.backend.sender.Send(s.from, recipient, parsedEmail.Subject, parsedEmail.Body, isHTML, s.backend.config.DefaultUser.Domain)
-		sendTime := time.Since(sendStart)
-		if err != nil {
-			logger.Error("Failed to send email", 
-				logger.Field("sessionID", s.id),
-				logger.Field("error", err),
-				logger.Field("from", s.from),
-				logger.Field("to", recipient),
-				logger.Field("subject", parsedEmail.Subject),
-				logger.Field("parseTime", parseTime),
-				logger.Field("sendTime", sendTime))
-			return fmt.Errorf("failed to send email: %w", err)
+	var local, remote []int
+	for i, rcpt := range s.to {
+		if s.backend.relay.isLocal(rcpt) {
+			local = append(local, i)
+		} else {
+			remote = append(remote, i)
 		}
-		logger.Info("Email sent successfully", 
+	}
+	if len(local) > 0 {
+		// A 451 for the remote recipients below makes the client retry the
+		// whole transaction; the digest keeps routes from getting it twice.
+		if err := s.deliverInbound(local, msg.Bytes(), s.digest(b.Bytes())); err != nil {
+			return err
+		}
+	}
+	if len(remote) == 0 {
+		return nil
+	}
+
+	id, err := s.backend.queue.Enqueue(s.envelope(remote), msg.Bytes())
+	if err != nil {
+		logger.Error("Failed to queue email",
 			logger.Field("sessionID", s.id),
 			logger.Field("from", s.from),
-			logger.Field("to", recipient),
-			logger.Field("subject", parsedEmail.Subject),
-			logger.Field("parseTime", parseTime),
-			logger.Field("sendTime", sendTime))
+			logger.Field("to", s.to),
+			logger.Err(err))
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Failed to queue message, try again later",
+		}
 	}
 
-	totalTime := time.Since(start)
-	logger.Info("Email processed successfully", 
+	logger.Info("Email queued successfully",
 		logger.Field("sessionID", s.id),
+		logger.Field("queueID", id),
 		logger.Field("from", s.from),
 		logger.Field("to", s.to),
-		logger.Field("subject", parsedEmail.Subject),
+		logger.Field("subject", subject),
+		logger.Field("messageID", messageID),
 		logger.Field("size", b.Len()),
-		logger.Field("isHTML", isHTML),
-		logger.Field("totalTime", totalTime))
+		logger.Field("totalTime", time.Since(start)))
+
+	return nil
+}
 
+// deliverInbound routes the message to the webhooks of the recipients at
+// the given indexes of s.to. Routes that got the transaction id before are
+// skipped.
+func (s *Session) deliverInbound(rcpts []int, msg []byte, id string) error {
+	env := inbound.Envelope{From: s.from, Helo: s.conn.Hostname(), Trusted: s.mayRelay(), ID: id}
+	if addr, ok := s.conn.Conn().RemoteAddr().(*net.TCPAddr); ok {
+		env.Remote = addr.IP.String()
+	}
+	for _, i := range rcpts {
+		env.To = append(env.To, s.to[i])
+	}
+	err := s.backend.inbound.Deliver(env, msg)
+	var rejected *inbound.RejectedError
+	if errors.As(err, &rejected) {
+		if len(rejected.Recipients) == len(s.to) {
+			return errRouteRejected
+		}
+		// Routes only reject messages that failed authentication, so the
+		// envelope sender is likely forged: a bounce to it would be
+		// backscatter. The refused recipients are dropped instead.
+		logger.Info("Dropped recipients refused by their route",
+			logger.Field("sessionID", s.id),
+			logger.Field("from", s.from),
+			logger.Field("to", rejected.Recipients),
+			logger.Field("condition", rejected.Condition))
+		return nil
+	}
+	if err != nil {
+		logger.Error("Failed to route inbound email",
+			logger.Field("sessionID", s.id),
+			logger.Field("from", s.from),
+			logger.Field("to", env.To),
+			logger.Err(err))
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Failed to accept message, try again later",
+		}
+	}
+	return nil
+}
+
+// digest identifies the transaction of data across retries of the client:
+// the envelope and the message as submitted, without our trace header.
+func (s *Session) digest(data []byte) string {
+	h := sha256.New()
+	io.WriteString(h, s.from+"\n"+strings.Join(s.to, ",")+"\n")
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// mayRelay reports whether the session may send to any domain.
+func (s *Session) mayRelay() bool {
+	return s.authenticated || s.trusted
+}
+
+// checkSenderDomain refuses reverse paths whose domain cannot receive
+// mail, since bounces to them would be lost. The null reverse path and the
+// local domains are not looked up.
+func (s *Session) checkSenderDomain(from string) error {
+	if from == "" || s.backend.relay.isLocal(from) {
+		return nil
+	}
+	isValid, err := auth.VerifyEmail(from)
+	if err != nil {
+		logger.Error("Sender domain lookup failed",
+			logger.Field("sessionID", s.id),
+			logger.Field("from", from),
+			logger.Err(err))
+		return errSenderLookup
+	}
+	if !isValid {
+		logger.Info("Sender domain does not accept mail",
+			logger.Field("sessionID", s.id),
+			logger.Field("from", from))
+		return errSenderDomain
+	}
+	return nil
+}
+
+// authorizeSender applies the sender policy of the authenticated user, or
+// the allowlist of the service account, to addr. Unauthenticated sessions
+// are not restricted here.
+func (s *Session) authorizeSender(addr string) error {
+	var err error
+	var user string
+	switch {
+	case s.service:
+		user = s.backend.config.SMTPUsername
+		err = auth.AuthorizePatterns(s.backend.config.SMTPAllowedSenders, addr)
+	case s.account != nil:
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		user = s.account.Email
+		err = s.backend.senders.Authorize(ctx, s.account, addr)
+	default:
+		return nil
+	}
+	if errors.Is(err, auth.ErrSenderNotAllowed) {
+		logger.Info("Sender rejected",
+			logger.Field("sessionID", s.id),
+			logger.Field("user", user),
+			logger.Field("from", addr))
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      fmt.Sprintf("Not authorized to send as <%s>", addr),
+		}
+	}
+	if err != nil {
+		logger.Error("Failed to check sender", logger.Field("sessionID", s.id), logger.Err(err))
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Failed to check sender, try again later",
+		}
+	}
 	return nil
 }
 
+// checkSuppressed refuses recipients the sender's domain may no longer send
+// to, typically because they bounced before.
+func (s *Session) checkSuppressed(to string) error {
+	i := strings.LastIndex(s.from, "@")
+	if i < 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := s.backend.store.Suppressions().Get(ctx, s.from[i+1:], to)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		logger.Error("Failed to check suppressions", logger.Field("sessionID", s.id), logger.Err(err))
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Failed to check recipient, try again later",
+		}
+	}
+	logger.Info("Suppressed recipient refused",
+		logger.Field("sessionID", s.id),
+		logger.Field("from", s.from),
+		logger.Field("to", to))
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "Recipient is on the sender's suppression list",
+	}
+}
+
+// receivedHeader builds the RFC 5321 trace header for this hop, with the
+// protocol keyword from RFC 3848.
+func (s *Session) receivedHeader() string {
+	protocol := "ESMTP"
+	var tlsInfo string
+	if state, ok := s.conn.TLSConnectionState(); ok {
+		protocol += "S"
+		tlsInfo = fmt.Sprintf("\r\n\t(using %s with cipher %s)", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	}
+	if s.authenticated {
+		protocol += "A"
+	}
+
+	remote := "unknown"
+	if addr, ok := s.conn.Conn().RemoteAddr().(*net.TCPAddr); ok {
+		remote = addr.IP.String()
+	}
+	helo := s.conn.Hostname()
+	if helo == "" {
+		helo = "unknown"
+	}
+
+	var forClause string
+	if len(s.to) == 1 {
+		forClause = fmt.Sprintf("\r\n\tfor <%s>", s.to[0])
+	}
+
+	return fmt.Sprintf("Received: from %s ([%s])%s\r\n\tby %s (Email Blaze) with %s id %s%s;\r\n\t%s\r\n",
+		helo, remote, tlsInfo, s.backend.config.SMTPHost, protocol, s.id, forClause,
+		time.Now().Format(time.RFC1123Z))
+}
+
+// envelope carries the DSN parameters given with MAIL FROM and RCPT TO
+// over to the queued message, for the recipients at the given indexes of
+// s.to.
+func (s *Session) envelope(rcpts []int) *queue.Message {
+	to := make([]string, 0, len(rcpts))
+	for _, i := range rcpts {
+		to = append(to, s.to[i])
+	}
+	env := queue.NewMessage(s.from, to)
+	if i := strings.LastIndex(s.from, "@"); i >= 0 {
+		env.Domain = strings.ToLower(s.from[i+1:])
+	}
+	env.EnvelopeID = s.mailOpts.EnvelopeID
+	env.Return = string(s.mailOpts.Return)
+	if s.mailOpts.Body != smtp.Body7Bit {
+		env.Body = string(s.mailOpts.Body)
+	}
+	env.UTF8 = s.mailOpts.UTF8
+	for i, rcpt := range env.Recipients {
+		opts := s.rcptOpts[rcpts[i]]
+		for _, n := range opts.Notify {
+			rcpt.Notify = append(rcpt.Notify, string(n))
+		}
+		rcpt.OriginalRecipient = opts.OriginalRecipient
+	}
+	return env
+}
+
 func (s *Session) Reset() {
 	s.from = ""
 	s.to = nil
+	s.mailOpts = smtp.MailOptions{}
+	s.rcptOpts = nil
 }
 
 func (s *Session) Logout() error {
 	return nil
 }
 
-func StartSMTPServer(cfg *config.Config, sender *email.Sender) error {
-	be := NewBackend(cfg, sender)
+// StartSMTPServer runs every configured listener and returns when one of
+// them fails. Without listeners in the config, a single one is started on
+// smtp_port: plaintext in development mode, implicit TLS otherwise.
+func StartSMTPServer(cfg *config.Config, q *queue.Queue, store storage.Store, router *inbound.Router) error {
+	listeners := cfg.Listeners
+	if len(listeners) == 0 {
+		mode := "tls"
+		if cfg.DevelopmentMode {
+			mode = "plain"
+		}
+		listeners = []config.ListenerConfig{{Name: "smtp", Port: cfg.SMTPPort, Mode: mode}}
+	}
+
+	var tlsConfig *tls.Config
+	for _, l := range listeners {
+		if l.Mode != "plain" && tlsConfig == nil {
+			cert, err := tls.LoadX509KeyPair(cfg.SSLCertFile, cfg.SSLKeyFile)
+			if err != nil {
+				return fmt.Errorf("failed to load TLS certificate: %w", err)
+			}
+			tlsConfig = &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				MinVersion:   tls.VersionTLS12,
+			}
+		}
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		be, err := NewBackend(cfg, l, q, store, router)
+		if err != nil {
+			return err
+		}
+		s := newServer(cfg, l, be, tlsConfig)
+
+		logger.Info("Starting SMTP listener",
+			logger.Field("name", l.Name),
+			logger.Field("addr", s.Addr),
+			logger.Field("mode", l.Mode),
+			logger.Field("domain", s.Domain),
+			logger.Field("auth", !l.DisableAuth),
+			logger.Field("allowInsecureAuth", s.AllowInsecureAuth),
+			logger.Field("maxMessageBytes", s.MaxMessageBytes),
+			logger.Field("maxRecipients", s.MaxRecipients))
+
+		go func(l config.ListenerConfig) {
+			var err error
+			if l.Mode == "tls" {
+				err = s.ListenAndServeTLS()
+			} else {
+				err = s.ListenAndServe()
+			}
+			errs <- fmt.Errorf("listener %s: %w", l.Name, err)
+		}(l)
+	}
+	return <-errs
+}
+
+func newServer(cfg *config.Config, l config.ListenerConfig, be *Backend, tlsConfig *tls.Config) *smtp.Server {
 	s := smtp.NewServer(be)
 
-	s.Addr = fmt.Sprintf(":%d", cfg.SMTPPort)
+	s.Addr = fmt.Sprintf(":%d", l.Port)
 	s.Domain = cfg.SMTPHost
 	s.ReadTimeout = time.Duration(cfg.SMTPReadTimeout) * time.Second
 	s.WriteTimeout = time.Duration(cfg.SMTPWriteTimeout) * time.Second
 	s.MaxMessageBytes = int64(cfg.MaxMessageSize)
 	s.MaxRecipients = cfg.MaxRecipients
+	// AUTH is only offered over TLS, so on starttls listeners clients
+	// must upgrade the connection first.
 	s.AllowInsecureAuth = cfg.DevelopmentMode
 
 	s.EnableSMTPUTF8 = true
@@ -214,26 +679,14 @@ func StartSMTPServer(cfg *config.Config, sender *email.Sender) error {
 	s.EnableDSN = true
 	s.MaxLineLength = cfg.MaxLineLength
 
-	logger.Info("Starting SMTP server", 
-		logger.Field("addr", s.Addr),
-		logger.Field("domain", s.Domain),
-		logger.Field("allowInsecureAuth", s.AllowInsecureAuth),
-		logger.Field("maxMessageBytes", s.MaxMessageBytes),
-		logger.Field("maxRecipients", s.MaxRecipients))
-
-	if cfg.DevelopmentMode {
-		s.Debug = os.Stdout
-		return s.ListenAndServe()
-	} else {
-		cert, err := tls.LoadX509KeyPair(cfg.SSLCertFile, cfg.SSLKeyFile)
-		if err != nil {
-			return fmt.Errorf("failed to load TLS certificate: %w", err)
-		}
-		s.TLSConfig = &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			MinVersion:   tls.VersionTLS12,
-		}
-		s.EnableREQUIRETLS = true
-		return s.ListenAndServeTLS()
+	// REQUIRETLS (RFC 8689) is not advertised: outbound delivery falls back
+	// to plaintext and does not verify certificates, so it cannot be honored.
+	if l.Mode != "plain" {
+		s.TLSConfig = tlsConfig
 	}
+	// The protocol trace (s.Debug) stays off even in development mode: all
+	// connections share the one writer, so the credentials sent after an
+	// AUTH challenge cannot be told apart from other sessions' lines and
+	// masked reliably.
+	return s
 }
@@ -0,0 +1,364 @@
+package smtp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"email-blaze/internals/config"
+	"email-blaze/internals/email"
+	"email-blaze/internals/inbound"
+	"email-blaze/internals/logger"
+	"email-blaze/internals/queue"
+	"email-blaze/internals/storage"
+	"email-blaze/internals/webhook"
+	"email-blaze/pkg/domainVerifier"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+// testResolver lets sender.test and other.test receive mail, nomail.test
+// not and fails lookups of flaky.test.
+var testResolver = &domainVerifier.StaticResolver{
+	MX: map[string][]*net.MX{
+		"sender.test": {{Host: "mx.sender.test", Pref: 10}},
+		"other.test":  {{Host: "mx.other.test", Pref: 10}},
+	},
+	Errors: map[string]error{
+		"flaky.test": &net.DNSError{Err: "server misbehaving", Name: "flaky.test", IsTemporary: true},
+	},
+}
+
+func init() {
+	logger.Init("fatal", "production", "console")
+	domainVerifier.DefaultResolver = testResolver
+}
+
+// nopDeliverer accepts every recipient; the queue is never started in
+// these tests, so messages stay where the session put them.
+type nopDeliverer struct{}
+
+func (nopDeliverer) Deliver(from string, to []string, msg []byte, opts *smtp.MailOptions) []email.DeliveryResult {
+	return nil
+}
+
+func testConfig(t *testing.T) *config.Config {
+	return &config.Config{
+		SMTPHost:           "mx.test",
+		SMTPUsername:       "relay",
+		SMTPPassword:       "relay secret",
+		SMTPAllowedSenders: []string{"*@sender.test"},
+		JWTSecret:          "test secret",
+		MaxMessageSize:     1 << 20,
+		MaxRecipients:      10,
+		MaxLineLength:      2000,
+		Queue:              config.QueueConfig{Dir: t.TempDir()},
+		Webhooks:           config.WebhookConfig{Dir: t.TempDir()},
+		Relay:              config.RelayConfig{LocalDomains: []string{"example.test"}},
+	}
+}
+
+type testServer struct {
+	addr  string
+	queue *queue.Queue
+	hooks *webhook.Manager
+	route string // id of the route for inbox@example.test
+	dir   string // queue directory
+}
+
+// startServer runs listener l on a loopback port. Mail for
+// inbox@example.test is routed to a webhook; other local addresses have no
+// route.
+func startServer(t *testing.T, cfg *config.Config, l config.ListenerConfig, tlsConfig *tls.Config) *testServer {
+	t.Helper()
+	store, err := storage.Open("sqlite::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	q, err := queue.New(cfg, nopDeliverer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooks, err := webhook.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route, err := hooks.CreateRoute("owner@example.test", &webhook.Route{
+		Domain: "example.test", Match: webhook.MatchAddress, Pattern: "inbox@example.test", URL: "https://hooks.example.com/inbound",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	be, err := NewBackend(cfg, l, q, store, inbound.NewRouter(cfg, hooks, testResolver))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(cfg, l, be, tlsConfig)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Mode == "tls" {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return &testServer{addr: ln.Addr().String(), queue: q, hooks: hooks, route: route.ID, dir: cfg.Queue.Dir}
+}
+
+func dial(t *testing.T, addr string) *smtp.Client {
+	t.Helper()
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if err := c.Hello("client.test"); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// code returns the enhanced status code of an SMTP reply error, or "" for
+// success.
+func code(err error) string {
+	if err == nil {
+		return ""
+	}
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) {
+		return err.Error()
+	}
+	e := smtpErr.EnhancedCode
+	return fmt.Sprintf("%d.%d.%d", e[0], e[1], e[2])
+}
+
+// send runs a transaction and returns the message body's DATA error.
+func send(c *smtp.Client, from string, to []string, msg string) error {
+	if err := c.Mail(from, nil); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt, nil); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func authenticate(c *smtp.Client) error {
+	return c.Auth(sasl.NewPlainClient("", "relay", "relay secret"))
+}
+
+// selfSigned returns a TLS config serving a certificate for mx.test.
+func selfSigned(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.test"},
+		DNSNames:     []string{"mx.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}, MinVersion: tls.VersionTLS12}
+}
+
+// queued returns the messages in the queue with their data.
+func (srv *testServer) queued(t *testing.T) map[*queue.Message]string {
+	t.Helper()
+	msgs, _ := srv.queue.List(queue.Filter{})
+	queued := make(map[*queue.Message]string)
+	for _, m := range msgs {
+		data, err := os.ReadFile(filepath.Join(srv.dir, m.ID+".eml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		queued[m] = string(data)
+	}
+	return queued
+}
+
+func TestListenerTLSModes(t *testing.T) {
+	serverTLS := selfSigned(t)
+	clientTLS := &tls.Config{ServerName: "mx.test", RootCAs: x509.NewCertPool()}
+	clientTLS.RootCAs.AddCert(mustParse(t, serverTLS.Certificates[0].Certificate[0]))
+
+	tests := []struct {
+		name        string
+		listener    config.ListenerConfig
+		startTLS    bool // STARTTLS is offered
+		authBefore  bool // AUTH is offered before TLS
+		authAfter   bool // AUTH is offered once TLS is up
+		wantReceive string
+	}{
+		{name: "plain", listener: config.ListenerConfig{Mode: "plain"}},
+		{name: "starttls", listener: config.ListenerConfig{Mode: "starttls"}, startTLS: true, authAfter: true, wantReceive: "with ESMTPSA"},
+		{name: "starttls without auth", listener: config.ListenerConfig{Mode: "starttls", DisableAuth: true}, startTLS: true},
+		{name: "implicit tls", listener: config.ListenerConfig{Mode: "tls"}, authAfter: true, wantReceive: "with ESMTPSA"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.listener.Name = tt.name
+			srv := startServer(t, testConfig(t), tt.listener, serverTLS)
+
+			var c *smtp.Client
+			var err error
+			if tt.listener.Mode == "tls" {
+				c, err = smtp.DialTLS(srv.addr, clientTLS)
+			} else {
+				plain := dial(t, srv.addr)
+				if ok, _ := plain.Extension("STARTTLS"); ok != tt.startTLS {
+					t.Fatalf("STARTTLS offered = %v, want %v", ok, tt.startTLS)
+				}
+				if ok, _ := plain.Extension("AUTH"); ok != tt.authBefore {
+					t.Errorf("AUTH offered before TLS = %v, want %v", ok, tt.authBefore)
+				}
+				if !tt.startTLS {
+					return
+				}
+				c, err = smtp.DialStartTLS(srv.addr, clientTLS)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { c.Close() })
+
+			if _, ok := c.TLSConnectionState(); !ok {
+				t.Fatal("connection is not encrypted")
+			}
+			if ok, _ := c.Extension("AUTH"); ok != tt.authAfter {
+				t.Fatalf("AUTH offered over TLS = %v, want %v", ok, tt.authAfter)
+			}
+			if !tt.authAfter {
+				return
+			}
+			if err := authenticate(c); err != nil {
+				t.Fatal(err)
+			}
+			if err := send(c, "a@sender.test", []string{"b@remote.test"}, "From: a@sender.test\r\nSubject: hi\r\n\r\nhi\r\n"); err != nil {
+				t.Fatal(err)
+			}
+			queued := srv.queued(t)
+			if len(queued) != 1 {
+				t.Fatalf("queued %d messages, want 1", len(queued))
+			}
+			for _, data := range queued {
+				if !strings.Contains(data, tt.wantReceive) || !strings.Contains(data, "(using TLS") {
+					t.Errorf("queued message = %q, want a Received header %s over TLS", data, tt.wantReceive)
+				}
+			}
+		})
+	}
+}
+
+func mustParse(t *testing.T, der []byte) *x509.Certificate {
+	t.Helper()
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// routed returns the envelopes posted to the inbox@example.test route.
+func (srv *testServer) routed(t *testing.T) []inbound.Envelope {
+	t.Helper()
+	deliveries, err := srv.hooks.Deliveries("owner@example.test", srv.route, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envs []inbound.Envelope
+	for _, d := range deliveries {
+		var p inbound.Payload
+		if err := json.Unmarshal(d.Payload, &p); err != nil {
+			t.Fatal(err)
+		}
+		envs = append(envs, p.Envelope)
+	}
+	return envs
+}
+
+func TestLocalAndRemoteRecipientsSplit(t *testing.T) {
+	cfg := testConfig(t)
+	relay := config.RelayConfig{TrustedNetworks: []string{"127.0.0.0/8"}, LocalDomains: []string{"example.test"}}
+	srv := startServer(t, cfg, config.ListenerConfig{Name: "test", Mode: "plain", Relay: &relay}, nil)
+	c := dial(t, srv.addr)
+
+	msg := "From: a@sender.test\r\nSubject: hi\r\n\r\nhi\r\n"
+	to := []string{"b@remote.test", "inbox@example.test", "c@remote.test"}
+	if err := send(c, "a@Sender.test", to, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	routed := srv.routed(t)
+	if len(routed) != 1 || len(routed[0].To) != 1 || routed[0].To[0] != "inbox@example.test" || !routed[0].Trusted {
+		t.Fatalf("routed %+v, want one trusted delivery to inbox@example.test", routed)
+	}
+	queued := srv.queued(t)
+	if len(queued) != 1 {
+		t.Fatalf("queued %d messages, want 1", len(queued))
+	}
+	for m, data := range queued {
+		if len(m.Recipients) != 2 || m.Recipients[0].Address != "b@remote.test" || m.Recipients[1].Address != "c@remote.test" {
+			t.Errorf("queued recipients = %+v, want only the remote ones", m.Recipients)
+		}
+		if m.Domain != "sender.test" {
+			t.Errorf("queued for domain %q, want sender.test", m.Domain)
+		}
+		if !strings.HasPrefix(data, "Received: from client.test ([127.0.0.1])") || !strings.HasSuffix(data, msg) {
+			t.Errorf("queued data = %q, want the message after a Received header", data)
+		}
+	}
+
+	// The client retrying the same transaction, as after a 451, does not
+	// post it to the route again.
+	if err := send(c, "a@Sender.test", to, msg); err != nil {
+		t.Fatal(err)
+	}
+	if routed := srv.routed(t); len(routed) != 1 {
+		t.Errorf("routed %d times after a retry, want 1", len(routed))
+	}
+
+	// Local recipients alone queue nothing.
+	if err := send(c, "a@sender.test", []string{"inbox@example.test"}, "From: a@sender.test\r\nSubject: local\r\n\r\nhi\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if queued := srv.queued(t); len(queued) != 2 {
+		t.Errorf("queued %d messages, want only the 2 with remote recipients", len(queued))
+	}
+}
@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"email-blaze/internals/logger"
+)
+
+type migration struct {
+	version    int
+	name       string
+	statements []string
+}
+
+// migrations are applied in order and must never be edited once released;
+// add a new one instead. The SQL has to run unchanged on PostgreSQL and
+// SQLite.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		statements: []string{
+			`CREATE TABLE users (
+				email TEXT PRIMARY KEY,
+				password_hash TEXT NOT NULL,
+				domain TEXT NOT NULL,
+				admin BOOLEAN NOT NULL DEFAULT FALSE,
+				created_at TIMESTAMP NOT NULL,
+				updated_at TIMESTAMP NOT NULL
+			)`,
+			`CREATE TABLE domains (
+				name TEXT PRIMARY KEY,
+				verified BOOLEAN NOT NULL DEFAULT FALSE,
+				dkim_selector TEXT NOT NULL DEFAULT '',
+				created_at TIMESTAMP NOT NULL,
+				verified_at TIMESTAMP
+			)`,
+			`CREATE TABLE api_keys (
+				id TEXT PRIMARY KEY,
+				user_email TEXT NOT NULL REFERENCES users(email) ON DELETE CASCADE,
+				name TEXT NOT NULL,
+				prefix TEXT NOT NULL,
+				hash TEXT NOT NULL UNIQUE,
+				created_at TIMESTAMP NOT NULL,
+				last_used_at TIMESTAMP,
+				revoked_at TIMESTAMP
+			)`,
+			`CREATE INDEX api_keys_user_email ON api_keys (user_email)`,
+			`CREATE TABLE messages (
+				id TEXT PRIMARY KEY,
+				domain TEXT NOT NULL,
+				sender TEXT NOT NULL,
+				status TEXT NOT NULL,
+				attempts INTEGER NOT NULL DEFAULT 0,
+				created_at TIMESTAMP NOT NULL,
+				updated_at TIMESTAMP NOT NULL,
+				completed_at TIMESTAMP
+			)`,
+			`CREATE INDEX messages_domain_created_at ON messages (domain, created_at)`,
+			`CREATE TABLE message_recipients (
+				message_id TEXT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+				address TEXT NOT NULL,
+				status TEXT NOT NULL,
+				dsn_status TEXT NOT NULL DEFAULT '',
+				response TEXT NOT NULL DEFAULT '',
+				remote_mta TEXT NOT NULL DEFAULT '',
+				updated_at TIMESTAMP NOT NULL,
+				PRIMARY KEY (message_id, address)
+			)`,
+			`CREATE TABLE events (
+				id TEXT PRIMARY KEY,
+				message_id TEXT NOT NULL,
+				domain TEXT NOT NULL,
+				type TEXT NOT NULL,
+				recipient TEXT NOT NULL DEFAULT '',
+				detail TEXT NOT NULL DEFAULT '',
+				created_at TIMESTAMP NOT NULL
+			)`,
+			`CREATE INDEX events_message_id ON events (message_id)`,
+			`CREATE TABLE suppressions (
+				domain TEXT NOT NULL,
+				address TEXT NOT NULL,
+				reason TEXT NOT NULL DEFAULT '',
+				created_at TIMESTAMP NOT NULL,
+				PRIMARY KEY (domain, address)
+			)`,
+		},
+	},
+	{
+		version: 2,
+		name:    "disabled users",
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE`,
+		},
+	},
+	{
+		version: 3,
+		name:    "api key scopes and expiry",
+		statements: []string{
+			`ALTER TABLE api_keys ADD COLUMN scopes TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE api_keys ADD COLUMN expires_at TIMESTAMP`,
+		},
+	},
+	{
+		version: 4,
+		name:    "refresh tokens and revocation",
+		statements: []string{
+			`CREATE TABLE refresh_tokens (
+				id TEXT PRIMARY KEY,
+				family_id TEXT NOT NULL,
+				user_email TEXT NOT NULL REFERENCES users(email) ON DELETE CASCADE,
+				hash TEXT NOT NULL UNIQUE,
+				created_at TIMESTAMP NOT NULL,
+				expires_at TIMESTAMP NOT NULL,
+				used_at TIMESTAMP,
+				revoked_at TIMESTAMP
+			)`,
+			`CREATE INDEX refresh_tokens_family_id ON refresh_tokens (family_id)`,
+			`CREATE INDEX refresh_tokens_user_email ON refresh_tokens (user_email)`,
+			`CREATE TABLE revoked_tokens (
+				jti TEXT PRIMARY KEY,
+				expires_at TIMESTAMP NOT NULL
+			)`,
+			`ALTER TABLE users ADD COLUMN sessions_revoked_at TIMESTAMP`,
+		},
+	},
+	{
+		version: 5,
+		name:    "sender authorization",
+		statements: []string{
+			`ALTER TABLE domains ADD COLUMN owner_email TEXT REFERENCES users(email) ON DELETE SET NULL`,
+			`ALTER TABLE domains ADD COLUMN subdomains BOOLEAN NOT NULL DEFAULT FALSE`,
+			`CREATE INDEX domains_owner_email ON domains (owner_email)`,
+			`ALTER TABLE users ADD COLUMN allowed_senders TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version: 6,
+		name:    "SCRAM credentials",
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN scram_sha256 TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version: 7,
+		name:    "domain onboarding",
+		statements: []string{
+			`ALTER TABLE domains ADD COLUMN verification_token TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE domains ADD COLUMN checks TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE domains ADD COLUMN checked_at TIMESTAMP`,
+			`ALTER TABLE domains ADD COLUMN failing_since TIMESTAMP`,
+		},
+	},
+	{
+		version: 8,
+		name:    "domain claims",
+		statements: []string{
+			`CREATE TABLE domain_claims (
+				name TEXT NOT NULL,
+				owner_email TEXT NOT NULL REFERENCES users(email) ON DELETE CASCADE,
+				subdomains BOOLEAN NOT NULL DEFAULT FALSE,
+				dkim_selector TEXT NOT NULL DEFAULT '',
+				verification_token TEXT NOT NULL,
+				checks TEXT NOT NULL DEFAULT '',
+				checked_at TIMESTAMP,
+				created_at TIMESTAMP NOT NULL,
+				PRIMARY KEY (name, owner_email)
+			)`,
+			// Domains added by users that are not verified become claims,
+			// so that others can claim them as well.
+			`INSERT INTO domain_claims (name, owner_email, subdomains, dkim_selector, verification_token, checks, checked_at, created_at)
+				SELECT name, owner_email, subdomains, dkim_selector, verification_token, checks, checked_at, created_at
+				FROM domains WHERE verified = FALSE AND verification_token <> '' AND owner_email IS NOT NULL`,
+			`DELETE FROM domains WHERE verified = FALSE AND verification_token <> '' AND owner_email IS NOT NULL`,
+		},
+	},
+}
+
+func (s *sqlStore) Migrate(ctx context.Context) error {
+	current, _, err := s.Version(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := s.apply(ctx, m); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+		logger.Info("Applied database migration", logger.Field("version", m.version), logger.Field("name", m.name))
+	}
+	return nil
+}
+
+func (s *sqlStore) apply(ctx context.Context, m migration) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range m.statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`),
+		m.version, m.name, time.Now().UTC()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) Version(ctx context.Context) (current, latest int, err error) {
+	latest = migrations[len(migrations)-1].version
+
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`); err != nil {
+		return 0, latest, fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	var v sql.NullInt64
+	err = s.db.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_migrations`).Scan(&v)
+	if err != nil {
+		return 0, latest, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return int(v.Int64), latest, nil
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"email-blaze/internals/logger"
+	"email-blaze/internals/queue"
+)
+
+// Recorder keeps the messages and events tables up to date with the
+// outbound queue, and suppresses recipients that bounced so their domain
+// does not send to them again. It implements queue.Observer.
+type Recorder struct {
+	store Store
+}
+
+func NewRecorder(store Store) *Recorder {
+	return &Recorder{store: store}
+}
+
+func (r *Recorder) Observe(msg *queue.Message, rcpts []*queue.Recipient) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	record := &Message{
+		ID:          msg.ID,
+		Domain:      msg.Domain,
+		Sender:      msg.From,
+		Status:      msg.Status,
+		Attempts:    msg.Attempts,
+		CreatedAt:   msg.CreatedAt,
+		UpdatedAt:   msg.UpdatedAt,
+		CompletedAt: msg.CompletedAt,
+	}
+	for _, rcpt := range msg.Recipients {
+		record.Recipients = append(record.Recipients, recipientRecord(rcpt, msg.UpdatedAt))
+	}
+	if err := r.store.Messages().Save(ctx, record); err != nil {
+		logger.Error("Failed to record message status", logger.Field("id", msg.ID), logger.Err(err))
+		return
+	}
+
+	now := time.Now().UnixNano()
+	for i, rcpt := range rcpts {
+		e := &Event{
+			ID:        fmt.Sprintf("%s-%x-%d", msg.ID, now, i),
+			MessageID: msg.ID,
+			Domain:    msg.Domain,
+			Type:      rcpt.Status,
+			Recipient: rcpt.Address,
+			Detail:    recipientRecord(rcpt, msg.UpdatedAt).Response,
+			CreatedAt: msg.UpdatedAt,
+		}
+		if err := r.store.Events().Add(ctx, e); err != nil {
+			logger.Error("Failed to record message event", logger.Field("id", msg.ID), logger.Err(err))
+		}
+
+		if rcpt.Status != queue.StatusBounced || msg.Domain == "" {
+			continue
+		}
+		sup := &Suppression{Domain: msg.Domain, Address: rcpt.Address, Reason: e.Detail, CreatedAt: msg.UpdatedAt}
+		if err := r.store.Suppressions().Add(ctx, sup); err != nil {
+			logger.Error("Failed to suppress bounced recipient", logger.Field("id", msg.ID), logger.Field("to", rcpt.Address), logger.Err(err))
+		}
+	}
+}
+
+// Engagement records an event reported after delivery, such as an open,
+// a click or a spam complaint, in the log of msg. Complaints suppress the
+// recipient like a hard bounce.
+func (r *Recorder) Engagement(ctx context.Context, msg *Message, eventType, rcpt, detail string) error {
+	now := time.Now().UTC()
+	e := &Event{
+		ID:        fmt.Sprintf("%s-%x-%s", msg.ID, now.UnixNano(), eventType),
+		MessageID: msg.ID,
+		Domain:    msg.Domain,
+		Type:      eventType,
+		Recipient: rcpt,
+		Detail:    detail,
+		CreatedAt: now,
+	}
+	if err := r.store.Events().Add(ctx, e); err != nil {
+		return fmt.Errorf("failed to record event: %w", err)
+	}
+	if eventType != EventComplained || msg.Domain == "" {
+		return nil
+	}
+	reason := "complaint"
+	if detail != "" {
+		reason += ": " + detail
+	}
+	if err := r.store.Suppressions().Add(ctx, &Suppression{Domain: msg.Domain, Address: rcpt, Reason: reason, CreatedAt: now}); err != nil {
+		return fmt.Errorf("failed to suppress complaining recipient: %w", err)
+	}
+	return nil
+}
+
+func recipientRecord(rcpt *queue.Recipient, updated time.Time) Recipient {
+	response := rcpt.Diagnostic
+	if response == "" {
+		response = rcpt.LastError
+	}
+	if !rcpt.LastAttempt.IsZero() {
+		updated = rcpt.LastAttempt
+	}
+	return Recipient{
+		Address:   rcpt.Address,
+		Status:    rcpt.Status,
+		DSNStatus: rcpt.DSNStatus,
+		Response:  response,
+		RemoteMTA: rcpt.RemoteMTA,
+		UpdatedAt: updated,
+	}
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"email-blaze/internals/logger"
+	"email-blaze/internals/queue"
+)
+
+func init() {
+	logger.Init("fatal", "production", "console")
+}
+
+func openTestStore(t *testing.T) Store {
+	t.Helper()
+	store, err := Open("sqlite::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestRecorderSuppressesBounces(t *testing.T) {
+	store := openTestStore(t)
+	ctx := context.Background()
+
+	msg := queue.NewMessage("a@Example.com", []string{"ok@example.net", "Gone@example.net"})
+	msg.ID = "m1"
+	msg.Domain = "Example.com"
+	msg.CreatedAt = time.Now()
+	msg.UpdatedAt = msg.CreatedAt
+	msg.Recipients[0].Status = queue.StatusDelivered
+	msg.Recipients[1].Status = queue.StatusBounced
+	msg.Recipients[1].Diagnostic = "smtp; 550 5.1.1 no such user"
+	msg.Status = queue.StatusBounced
+	NewRecorder(store).Observe(msg, msg.Recipients)
+
+	sup, err := store.Suppressions().Get(ctx, "example.com", "gone@example.net")
+	if err != nil {
+		t.Fatalf("bounced recipient not suppressed: %v", err)
+	}
+	if sup.Reason != "smtp; 550 5.1.1 no such user" {
+		t.Errorf("reason = %q", sup.Reason)
+	}
+	if _, err := store.Suppressions().Get(ctx, "example.com", "ok@example.net"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("delivered recipient suppressed: %v", err)
+	}
+
+	list, total, err := store.Messages().List(ctx, MessageFilter{Domain: "Example.com", Recipient: "GONE@example.net", Sender: "A@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || len(list) != 1 || list[0].ID != "m1" || len(list[0].Recipients) != 2 {
+		t.Errorf("List = %d messages of %d, want m1 with both recipients", len(list), total)
+	}
+	if _, total, _ := store.Messages().List(ctx, MessageFilter{Recipient: "other@example.net"}); total != 0 {
+		t.Errorf("List by another recipient matched %d messages", total)
+	}
+}
+
+func TestRecorderEngagement(t *testing.T) {
+	store := openTestStore(t)
+	ctx := context.Background()
+	rec := NewRecorder(store)
+	msg := &Message{ID: "m1", Domain: "example.com"}
+
+	if err := rec.Engagement(ctx, msg, EventClicked, "bob@example.net", "https://example.com/offer"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Suppressions().Get(ctx, "example.com", "bob@example.net"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("clicking recipient suppressed: %v", err)
+	}
+
+	if err := rec.Engagement(ctx, msg, EventComplained, "bob@example.net", "abuse"); err != nil {
+		t.Fatal(err)
+	}
+	sup, err := store.Suppressions().Get(ctx, "example.com", "bob@example.net")
+	if err != nil || sup.Reason != "complaint: abuse" {
+		t.Errorf("complaining recipient suppression = %+v, %v", sup, err)
+	}
+
+	events, err := store.Events().ListByMessage(ctx, "m1")
+	if err != nil || len(events) != 2 || events[0].Type != EventClicked || events[0].Detail != "https://example.com/offer" || events[1].Type != EventComplained {
+		t.Errorf("events = %+v, %v, want the click then the complaint", events, err)
+	}
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDomainClaims(t *testing.T) {
+	store := openTestStore(t)
+	ctx := context.Background()
+	for _, email := range []string{"a@a.test", "b@b.test"} {
+		if err := store.Users().Create(ctx, &User{Email: email, PasswordHash: "x"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	claims := store.DomainClaims()
+	for _, owner := range []string{"a@a.test", "b@b.test"} {
+		cl := &DomainClaim{Name: "example.test", OwnerEmail: owner, VerificationToken: "token-" + owner, CreatedAt: time.Now()}
+		if err := claims.Create(ctx, cl); err != nil {
+			t.Fatalf("claim by %s: %v", owner, err)
+		}
+	}
+	err := claims.Create(ctx, &DomainClaim{Name: "example.test", OwnerEmail: "a@a.test", VerificationToken: "again", CreatedAt: time.Now()})
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("second claim by the same user = %v, want ErrConflict", err)
+	}
+
+	cl, err := claims.Get(ctx, "example.test", "b@b.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl.Checks = map[string]string{"ownership": "missing"}
+	cl.CheckedAt = time.Now()
+	if err := claims.Update(ctx, cl); err != nil {
+		t.Fatal(err)
+	}
+	if cl, err = claims.Get(ctx, "example.test", "b@b.test"); err != nil || cl.Checks["ownership"] != "missing" || cl.CheckedAt.IsZero() {
+		t.Errorf("updated claim = %+v, %v", cl, err)
+	}
+	if list, err := claims.ListByOwner(ctx, "a@a.test"); err != nil || len(list) != 1 || list[0].VerificationToken != "token-a@a.test" {
+		t.Errorf("ListByOwner = %v, %v", list, err)
+	}
+
+	if err := claims.DeleteByName(ctx, "example.test"); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := claims.List(ctx); err != nil || len(list) != 0 {
+		t.Errorf("claims after DeleteByName = %v, %v", list, err)
+	}
+	if err := claims.Delete(ctx, "example.test", "a@a.test"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete of a missing claim = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMessageListDomains(t *testing.T) {
+	store := openTestStore(t)
+	ctx := context.Background()
+	for id, domain := range map[string]string{"m1": "Example.com", "m2": "news.example.com", "m3": "example.org", "m4": "notexample.com"} {
+		m := &Message{ID: id, Domain: domain, Sender: "a@" + domain, Status: "queued", CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := store.Messages().Save(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		domains []string
+		want    int
+	}{
+		{[]string{"example.com"}, 1},
+		{[]string{"example.com", "*.example.com"}, 2},
+		{[]string{"*.example.com", "EXAMPLE.ORG"}, 2},
+		{[]string{"other.test"}, 0},
+	}
+	for _, tt := range tests {
+		if _, total, err := store.Messages().List(ctx, MessageFilter{Domains: tt.domains}); err != nil || total != tt.want {
+			t.Errorf("List(%v) = %d, %v, want %d", tt.domains, total, err, tt.want)
+		}
+	}
+}
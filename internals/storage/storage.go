@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("record not found")
+	ErrConflict = errors.New("record already exists")
+)
+
+type User struct {
+	Email        string
+	PasswordHash string
+	Domain       string
+	Admin        bool
+	Disabled     bool
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	// SessionsRevokedAt invalidates every token issued up to that time.
+	SessionsRevokedAt time.Time
+	// AllowedSenders, when set, restricts the addresses the user may send
+	// as. Entries are addresses or *@domain patterns.
+	AllowedSenders []string
+	// SCRAMSHA256 holds the SCRAM-SHA-256 verifier for SMTP AUTH, empty if
+	// the password was only ever provided as a hash.
+	SCRAMSHA256 string
+}
+
+type Domain struct {
+	Name       string
+	OwnerEmail string
+	Verified   bool
+	// Subdomains lets the owner send from any subdomain of Name as well.
+	Subdomains   bool
+	DKIMSelector string
+	CreatedAt    time.Time
+	VerifiedAt   time.Time
+	// VerificationToken is set for domains added by their owner, who proves
+	// ownership by publishing it in DNS. Only these domains are re-checked.
+	VerificationToken string
+	// Checks holds the outcome of the last DNS check by record, an empty
+	// string for records that were found.
+	Checks    map[string]string
+	CheckedAt time.Time
+	// FailingSince is when a required record of a verified domain was first
+	// found missing, zero while all of them resolve.
+	FailingSince time.Time
+}
+
+// DomainClaim is a user's request to add a domain, pending until its
+// records are published. Several users may claim the same name, each with
+// their own token; the first whose records verify gets the domain.
+type DomainClaim struct {
+	Name              string
+	OwnerEmail        string
+	Subdomains        bool
+	DKIMSelector      string
+	VerificationToken string
+	Checks            map[string]string
+	CheckedAt         time.Time
+	CreatedAt         time.Time
+}
+
+// APIKey is a long-lived credential. Only a hash of the secret is stored;
+// Prefix is kept in clear so keys can be told apart in listings.
+type APIKey struct {
+	ID         string
+	UserEmail  string
+	Name       string
+	Prefix     string
+	Hash       string
+	Scopes     []string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastUsedAt time.Time
+	RevokedAt  time.Time
+}
+
+// RefreshToken is an opaque, single-use token exchanged for a new access
+// token. Tokens obtained from one login share a FamilyID so the whole
+// chain can be revoked when a used token is presented again.
+type RefreshToken struct {
+	ID        string
+	FamilyID  string
+	UserEmail string
+	Hash      string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    time.Time
+	RevokedAt time.Time
+}
+
+type Message struct {
+	ID          string
+	Domain      string
+	Sender      string
+	Status      string
+	Attempts    int
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	CompletedAt time.Time
+	Recipients  []Recipient
+}
+
+type Recipient struct {
+	Address   string
+	Status    string
+	DSNStatus string
+	Response  string
+	RemoteMTA string
+	UpdatedAt time.Time
+}
+
+// Event types reported after delivery. The other events carry the
+// recipient's queue status.
+const (
+	EventComplained = "complained"
+	EventOpened     = "opened"
+	EventClicked    = "clicked"
+)
+
+type Event struct {
+	ID        string
+	MessageID string
+	Domain    string
+	Type      string
+	Recipient string
+	Detail    string
+	CreatedAt time.Time
+}
+
+// Suppression stops a domain from sending to an address, typically after
+// a hard bounce or a complaint. Domains and addresses are stored in lower
+// case.
+type Suppression struct {
+	Domain    string
+	Address   string
+	Reason    string
+	CreatedAt time.Time
+}
+
+// MessageFilter selects messages for MessageRepository.List. Zero fields
+// match everything.
+type MessageFilter struct {
+	Domain    string
+	Domains   []string // messages sent from any of them; *.domain matches subdomains
+	Status    string
+	Sender    string
+	Recipient string
+	Since     time.Time
+	Until     time.Time
+	Offset    int
+	Limit     int
+}
+
+type UserRepository interface {
+	Create(ctx context.Context, u *User) error
+	Get(ctx context.Context, email string) (*User, error)
+	List(ctx context.Context) ([]*User, error)
+	Update(ctx context.Context, u *User) error
+	Delete(ctx context.Context, email string) error
+}
+
+type DomainRepository interface {
+	Create(ctx context.Context, d *Domain) error
+	Get(ctx context.Context, name string) (*Domain, error)
+	List(ctx context.Context) ([]*Domain, error)
+	ListByOwner(ctx context.Context, email string) ([]*Domain, error)
+	Update(ctx context.Context, d *Domain) error
+	Delete(ctx context.Context, name string) error
+}
+
+type DomainClaimRepository interface {
+	Create(ctx context.Context, cl *DomainClaim) error
+	Get(ctx context.Context, name, owner string) (*DomainClaim, error)
+	List(ctx context.Context) ([]*DomainClaim, error)
+	ListByOwner(ctx context.Context, email string) ([]*DomainClaim, error)
+	Update(ctx context.Context, cl *DomainClaim) error
+	Delete(ctx context.Context, name, owner string) error
+	// DeleteByName drops every claim of name, once one of them won.
+	DeleteByName(ctx context.Context, name string) error
+}
+
+type APIKeyRepository interface {
+	Create(ctx context.Context, k *APIKey) error
+	Get(ctx context.Context, id string) (*APIKey, error)
+	GetByHash(ctx context.Context, hash string) (*APIKey, error)
+	ListByUser(ctx context.Context, email string) ([]*APIKey, error)
+	Touch(ctx context.Context, id string, at time.Time) error
+	Revoke(ctx context.Context, id string, at time.Time) error
+}
+
+type RefreshTokenRepository interface {
+	Create(ctx context.Context, t *RefreshToken) error
+	GetByHash(ctx context.Context, hash string) (*RefreshToken, error)
+	// MarkUsed records that the token was exchanged. It returns ErrNotFound
+	// if the token was already used, so only one exchange can succeed.
+	MarkUsed(ctx context.Context, id string, at time.Time) error
+	RevokeFamily(ctx context.Context, familyID string, at time.Time) error
+	RevokeUser(ctx context.Context, email string, at time.Time) error
+}
+
+// RevokedTokenRepository is the deny list of access token IDs (jti).
+// Entries can be dropped once the token would have expired anyway.
+type RevokedTokenRepository interface {
+	Revoke(ctx context.Context, jti string, expiresAt time.Time) error
+	IsRevoked(ctx context.Context, jti string) (bool, error)
+	Purge(ctx context.Context, before time.Time) error
+}
+
+type MessageRepository interface {
+	// Save inserts the message or updates it and its recipients.
+	Save(ctx context.Context, m *Message) error
+	Get(ctx context.Context, id string) (*Message, error)
+	// List returns the matching messages, newest first, and the number of
+	// matches before Offset and Limit are applied.
+	List(ctx context.Context, f MessageFilter) ([]*Message, int, error)
+}
+
+type EventRepository interface {
+	Add(ctx context.Context, e *Event) error
+	ListByMessage(ctx context.Context, messageID string) ([]*Event, error)
+}
+
+type SuppressionRepository interface {
+	Add(ctx context.Context, s *Suppression) error
+	Get(ctx context.Context, domain, address string) (*Suppression, error)
+	List(ctx context.Context, domain string) ([]*Suppression, error)
+	Delete(ctx context.Context, domain, address string) error
+}
+
+// Store gives access to the repositories of a database.
+type Store interface {
+	Users() UserRepository
+	Domains() DomainRepository
+	DomainClaims() DomainClaimRepository
+	APIKeys() APIKeyRepository
+	RefreshTokens() RefreshTokenRepository
+	RevokedTokens() RevokedTokenRepository
+	Messages() MessageRepository
+	Events() EventRepository
+	Suppressions() SuppressionRepository
+
+	// Migrate applies the schema migrations that have not run yet.
+	Migrate(ctx context.Context) error
+	// Version returns the latest applied and the latest known migration.
+	Version(ctx context.Context) (current, latest int, err error)
+	Close() error
+}
@@ -0,0 +1,81 @@
+package webhook
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"email-blaze/internals/config"
+)
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr   string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:4700::1111", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"64:ff9b::a9fe:a9fe", false},
+	}
+	for _, tt := range tests {
+		if got := publicAddr(netip.MustParseAddr(tt.addr)); got != tt.public {
+			t.Errorf("publicAddr(%s) = %v, want %v", tt.addr, got, tt.public)
+		}
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	m := &Manager{}
+	tests := []struct {
+		url string
+		err error
+	}{
+		{"https://hooks.example.com/email", nil},
+		{"ftp://hooks.example.com/", ErrInvalidURL},
+		{"https:///path", ErrInvalidURL},
+		{"http://127.0.0.1:8080/", ErrPrivateURL},
+		{"http://[::1]/", ErrPrivateURL},
+		{"http://169.254.169.254/latest/meta-data/", ErrPrivateURL},
+		{"http://localhost/", ErrPrivateURL},
+	}
+	for _, tt := range tests {
+		if _, err := m.checkURL(tt.url); !errors.Is(err, tt.err) {
+			t.Errorf("checkURL(%q) = %v, want %v", tt.url, err, tt.err)
+		}
+	}
+
+	m.cfg = config.WebhookConfig{AllowPrivateNetworks: true}
+	if _, err := m.checkURL("http://127.0.0.1:8080/"); err != nil {
+		t.Errorf("checkURL with allow_private_networks = %v", err)
+	}
+}
+
+// A public-looking name can still resolve to a private address, so the
+// client must refuse the connection itself.
+func TestClientRefusesPrivateAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	if _, err := newClient(time.Second, false).Get(srv.URL); !errors.Is(err, ErrPrivateURL) {
+		t.Errorf("GET %s = %v, want %v", srv.URL, err, ErrPrivateURL)
+	}
+	resp, err := newClient(time.Second, true).Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET %s with private networks allowed: %v", srv.URL, err)
+	}
+	resp.Body.Close()
+}
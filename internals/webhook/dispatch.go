@@ -0,0 +1,269 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"email-blaze/internals/logger"
+	"email-blaze/internals/queue"
+)
+
+// Request headers set on every webhook POST.
+const (
+	SignatureHeader = "X-EmailBlaze-Signature"
+	EventHeader     = "X-EmailBlaze-Event"
+	DeliveryHeader  = "X-EmailBlaze-Delivery"
+)
+
+// Sign returns the signature header value for body sent at timestamp:
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">". Receivers should
+// recompute it with their secret and reject stale timestamps.
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return fmt.Sprintf("t=%s,v1=%s", t, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Start launches the delivery workers.
+func (m *Manager) Start() {
+	workers := m.cfg.Workers
+	if workers <= 0 {
+		workers = 2
+	}
+	jobs := make(chan *Delivery)
+	for i := 0; i < workers; i++ {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			for d := range jobs {
+				m.attempt(d)
+			}
+		}()
+	}
+	m.wg.Add(1)
+	go m.schedule(jobs)
+
+	logger.Info("Webhook dispatcher started", logger.Field("dir", m.dir), logger.Field("webhooks", len(m.webhooks)), logger.Field("routes", len(m.routes)))
+}
+
+// Stop waits for in-flight deliveries to finish.
+func (m *Manager) Stop() {
+	close(m.stop)
+	m.wg.Wait()
+}
+
+func (m *Manager) notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Manager) schedule(jobs chan<- *Delivery) {
+	defer m.wg.Done()
+	defer close(jobs)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-m.wake:
+		case <-timer.C:
+		}
+
+		m.purge()
+		for _, d := range m.due() {
+			select {
+			case jobs <- d:
+			case <-m.stop:
+				return
+			}
+		}
+
+		timer.Reset(m.untilNext())
+	}
+}
+
+func (m *Manager) due() []*Delivery {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var due []*Delivery
+	for id, d := range m.deliveries {
+		if d.Status == DeliveryPending && !m.inFlight[id] && !d.NextAttempt.After(now) {
+			m.inFlight[id] = true
+			due = append(due, d)
+		}
+	}
+	return due
+}
+
+func (m *Manager) untilNext() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	next := time.Minute
+	now := time.Now()
+	for id, d := range m.deliveries {
+		if d.Status != DeliveryPending || m.inFlight[id] {
+			continue
+		}
+		if wait := d.NextAttempt.Sub(now); wait < next {
+			next = wait
+		}
+	}
+	if next < 0 {
+		next = 0
+	}
+	return next
+}
+
+func (m *Manager) attempt(d *Delivery) {
+	defer func() {
+		m.mu.Lock()
+		delete(m.inFlight, d.ID)
+		m.mu.Unlock()
+		m.notify()
+	}()
+
+	m.mu.Lock()
+	url, secret, ok := m.endpoint(d)
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	code, err := m.post(url, secret, d)
+
+	m.mu.Lock()
+	now := time.Now()
+	d.Attempts++
+	d.ResponseCode = code
+	switch {
+	case err == nil:
+		d.Status = DeliverySucceeded
+		d.LastError = ""
+		d.CompletedAt = now
+	case d.Attempts >= m.maxAttempts():
+		d.Status = DeliveryFailed
+		d.LastError = err.Error()
+		d.CompletedAt = now
+	default:
+		d.LastError = err.Error()
+		d.NextAttempt = now.Add(m.backoff(d.Attempts))
+	}
+	// The endpoint may have been deleted while the request was in flight.
+	_, stored := m.deliveries[d.ID]
+	raw, saveErr := json.Marshal(d)
+	m.mu.Unlock()
+	if stored && saveErr == nil {
+		saveErr = queue.WriteFile(m.deliveryPath(d.ID), raw)
+	}
+	if stored && saveErr != nil {
+		logger.Error("Failed to update webhook delivery", logger.Field("id", d.ID), logger.Err(saveErr))
+	}
+
+	if err != nil {
+		logger.Error("Webhook delivery failed",
+			logger.Field("webhook", d.WebhookID),
+			logger.Field("route", d.RouteID),
+			logger.Field("delivery", d.ID),
+			logger.Field("attempts", d.Attempts),
+			logger.Err(err))
+	}
+}
+
+// endpoint returns the URL and secret the delivery is posted with. It must
+// be called with mu held.
+func (m *Manager) endpoint(d *Delivery) (url, secret string, ok bool) {
+	if d.RouteID != "" {
+		r, ok := m.routes[d.RouteID]
+		if !ok {
+			return "", "", false
+		}
+		return r.URL, r.Secret, true
+	}
+	w, ok := m.webhooks[d.WebhookID]
+	if !ok {
+		return "", "", false
+	}
+	return w.URL, w.Secret, true
+}
+
+// post sends the delivery and returns the HTTP status code. Any non-2xx
+// response is an error.
+func (m *Manager) post(url, secret string, d *Delivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Email-Blaze-Webhooks/1.0")
+	req.Header.Set(EventHeader, d.Event)
+	req.Header.Set(DeliveryHeader, d.ID)
+	req.Header.Set(SignatureHeader, Sign(secret, time.Now(), d.Payload))
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (m *Manager) maxAttempts() int {
+	if m.cfg.MaxAttempts <= 0 {
+		return 8
+	}
+	return m.cfg.MaxAttempts
+}
+
+func (m *Manager) backoff(attempts int) time.Duration {
+	interval := time.Duration(m.cfg.RetryInterval) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	max := time.Duration(m.cfg.MaxRetryInterval) * time.Second
+	if max <= 0 {
+		max = time.Hour
+	}
+	for i := 1; i < attempts && interval < max; i++ {
+		interval *= 2
+	}
+	if interval > max {
+		interval = max
+	}
+	return interval
+}
+
+// purge drops finished deliveries older than the retention period.
+func (m *Manager) purge() {
+	retention := time.Duration(m.cfg.Retention) * time.Hour
+	if retention <= 0 {
+		retention = 7 * 24 * time.Hour
+	}
+
+	cutoff := time.Now().Add(-retention)
+	m.dropDeliveries(func(d *Delivery) bool {
+		return d.Status != DeliveryPending && d.CompletedAt.Before(cutoff)
+	})
+}
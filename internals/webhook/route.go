@@ -0,0 +1,286 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"email-blaze/internals/logger"
+)
+
+// EventInbound is the event header of deliveries to routes. Webhooks
+// cannot subscribe to it.
+const EventInbound = "inbound"
+
+// Route match types.
+const (
+	MatchAddress  = "address"
+	MatchRegex    = "regex"
+	MatchCatchAll = "catch_all"
+)
+
+// MatchTypes lists every route match type.
+var MatchTypes = []string{MatchAddress, MatchRegex, MatchCatchAll}
+
+// Conditions under which a route rejects a message instead of posting it.
+const (
+	RejectSPFFail     = "spf_fail"     // SPF result is fail
+	RejectDKIMFail    = "dkim_fail"    // signed, but no signature verified
+	RejectDMARCFail   = "dmarc_fail"   // DMARC fails, whatever the policy
+	RejectDMARCPolicy = "dmarc_policy" // DMARC fails and the domain asks for reject
+)
+
+// RejectConditions lists every condition a route can reject on.
+var RejectConditions = []string{RejectSPFFail, RejectDKIMFail, RejectDMARCFail, RejectDMARCPolicy}
+
+var ErrInvalidRoute = errors.New("invalid route")
+
+// Route forwards inbound mail for a domain to a URL. An address route
+// matches one recipient, a regex route matches the recipients whose full
+// address matches Pattern and a catch-all route matches the rest of the
+// domain. Messages meeting one of the Reject conditions are refused
+// instead of posted.
+type Route struct {
+	ID         string    `json:"id"`
+	Owner      string    `json:"owner"`
+	Domain     string    `json:"domain"`
+	Match      string    `json:"match"`
+	Pattern    string    `json:"pattern,omitempty"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"secret"`
+	Priority   int       `json:"priority"`
+	IncludeRaw bool      `json:"include_raw"`
+	Reject     []string  `json:"reject,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+
+	re *regexp.Regexp
+}
+
+func (r *Route) compile() error {
+	for _, cond := range r.Reject {
+		if !validCondition(cond) {
+			return fmt.Errorf("%w: unknown reject condition %q", ErrInvalidRoute, cond)
+		}
+	}
+	switch r.Match {
+	case MatchAddress:
+		local, domain, ok := strings.Cut(r.Pattern, "@")
+		if !ok || local == "" || domain != r.Domain {
+			return fmt.Errorf("%w: address must be on %s", ErrInvalidRoute, r.Domain)
+		}
+	case MatchRegex:
+		re, err := regexp.Compile("(?i)^(?:" + r.Pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidRoute, err)
+		}
+		r.re = re
+	case MatchCatchAll:
+		if r.Pattern != "" {
+			return fmt.Errorf("%w: catch-all routes take no pattern", ErrInvalidRoute)
+		}
+	default:
+		return fmt.Errorf("%w: unknown match type %q", ErrInvalidRoute, r.Match)
+	}
+	return nil
+}
+
+func validCondition(cond string) bool {
+	for _, c := range RejectConditions {
+		if c == cond {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateRoute registers an inbound route for owner. The caller checks that
+// owner may receive mail for the route's domain.
+func (m *Manager) CreateRoute(owner string, r *Route) (*Route, error) {
+	u, err := m.checkURL(r.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	route := &Route{
+		ID:         newID(),
+		Owner:      owner,
+		Domain:     strings.TrimSuffix(strings.ToLower(r.Domain), "."),
+		Match:      r.Match,
+		Pattern:    r.Pattern,
+		URL:        u.String(),
+		Secret:     "whsec_" + randomHex(24),
+		Priority:   r.Priority,
+		IncludeRaw: r.IncludeRaw,
+		Reject:     r.Reject,
+		CreatedAt:  time.Now(),
+	}
+	if route.Match == MatchAddress {
+		route.Pattern = strings.ToLower(route.Pattern)
+	}
+	if err := route.compile(); err != nil {
+		return nil, err
+	}
+
+	err = m.update(m.routesPath(), m.sortedRoutes, func() error {
+		m.routes[route.ID] = route
+		return nil
+	}, func() {
+		delete(m.routes, route.ID)
+	})
+	if err != nil {
+		m.dropDeliveries(func(d *Delivery) bool { return d.RouteID == route.ID })
+		return nil, fmt.Errorf("failed to save routes: %w", err)
+	}
+	logger.Info("Inbound route registered",
+		logger.Field("id", route.ID),
+		logger.Field("owner", owner),
+		logger.Field("domain", route.Domain),
+		logger.Field("match", route.Match),
+		logger.Field("url", route.URL))
+	c := *route
+	return &c, nil
+}
+
+// Routes returns the routes of owner, oldest first.
+func (m *Manager) Routes(owner string) []*Route {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var routes []*Route
+	for _, r := range m.routes {
+		if r.Owner == owner {
+			c := *r
+			routes = append(routes, &c)
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].CreatedAt.Before(routes[j].CreatedAt) })
+	return routes
+}
+
+// DeleteRoute removes a route along with its delivery log.
+func (m *Manager) DeleteRoute(owner, id string) error {
+	var r *Route
+	err := m.update(m.routesPath(), m.sortedRoutes, func() error {
+		var ok bool
+		if r, ok = m.routes[id]; !ok || r.Owner != owner {
+			return ErrNotFound
+		}
+		delete(m.routes, id)
+		return nil
+	}, func() {
+		m.routes[id] = r
+	})
+	if errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save routes: %w", err)
+	}
+	m.dropDeliveries(func(d *Delivery) bool { return d.RouteID == id })
+	logger.Info("Inbound route deleted", logger.Field("id", id), logger.Field("owner", owner))
+	return nil
+}
+
+// DeleteDomainRoutes removes the routes of every owner for domain, along
+// with their delivery logs, when the domain is removed.
+func (m *Manager) DeleteDomainRoutes(domain string) error {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	removed := make(map[string]*Route)
+	err := m.update(m.routesPath(), m.sortedRoutes, func() error {
+		for id, r := range m.routes {
+			if r.Domain == domain {
+				removed[id] = r
+				delete(m.routes, id)
+			}
+		}
+		return nil
+	}, func() {
+		for id, r := range removed {
+			m.routes[id] = r
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save routes: %w", err)
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	m.dropDeliveries(func(d *Delivery) bool { return removed[d.RouteID] != nil })
+	logger.Info("Inbound routes of domain deleted", logger.Field("domain", domain), logger.Field("count", len(removed)))
+	return nil
+}
+
+// MatchRoute returns the route for an inbound recipient, or nil if there
+// is none. Address routes win over regex routes, which are tried by
+// ascending priority, and catch-all routes come last.
+func (m *Manager) MatchRoute(rcpt string) *Route {
+	rcpt = strings.ToLower(rcpt)
+	i := strings.LastIndex(rcpt, "@")
+	if i < 0 {
+		return nil
+	}
+	domain := strings.TrimSuffix(rcpt[i+1:], ".")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var candidates []*Route
+	for _, r := range m.routes {
+		if r.Domain == domain {
+			candidates = append(candidates, r)
+		}
+	}
+	rank := map[string]int{MatchAddress: 0, MatchRegex: 1, MatchCatchAll: 2}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if rank[a.Match] != rank[b.Match] {
+			return rank[a.Match] < rank[b.Match]
+		}
+		if a.Priority != b.Priority {
+			return a.Priority < b.Priority
+		}
+		return a.CreatedAt.Before(b.CreatedAt)
+	})
+	for _, r := range candidates {
+		if r.Match == MatchAddress && r.Pattern == rcpt ||
+			r.Match == MatchRegex && r.re.MatchString(rcpt) ||
+			r.Match == MatchCatchAll {
+			c := *r
+			return &c
+		}
+	}
+	return nil
+}
+
+// DeliverInbound queues payload for the route. It returns once the
+// delivery is stored, so the message can be accepted; the POST itself is
+// retried like any webhook delivery.
+func (m *Manager) DeliverInbound(routeID string, payload any) (*Delivery, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode inbound message: %w", err)
+	}
+
+	now := time.Now()
+	d := &Delivery{
+		ID:          newID(),
+		RouteID:     routeID,
+		Event:       EventInbound,
+		Payload:     raw,
+		Status:      DeliveryPending,
+		CreatedAt:   now,
+		NextAttempt: now,
+	}
+	c := *d
+	if err := m.addDelivery(d); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to store inbound delivery: %w", err)
+	}
+	return &c, nil
+}
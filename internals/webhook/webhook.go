@@ -0,0 +1,552 @@
+package webhook
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"email-blaze/internals/config"
+	"email-blaze/internals/logger"
+	"email-blaze/internals/queue"
+)
+
+// Event types sent to webhook endpoints.
+const (
+	EventAccepted  = "accepted"
+	EventDelivered = "delivered"
+	EventDeferred  = "deferred"
+	EventBounced   = "bounced"
+
+	// Engagement events are reported after delivery, by a feedback loop
+	// or by the sender's open and click tracking.
+	EventComplained = "complained"
+	EventOpened     = "opened"
+	EventClicked    = "clicked"
+
+	// Domain events report DNS checks of domains added through the API.
+	EventDomainVerified = "domain_verified"
+	EventDomainFailing  = "domain_failing"
+)
+
+// Events lists every event type a webhook can subscribe to.
+var Events = []string{EventAccepted, EventDelivered, EventDeferred, EventBounced, EventComplained, EventOpened, EventClicked, EventDomainVerified, EventDomainFailing}
+
+// Delivery states.
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+var (
+	ErrNotFound     = errors.New("webhook not found")
+	ErrInvalidURL   = errors.New("webhook URL must be an absolute http or https URL")
+	ErrInvalidEvent = errors.New("unknown event type")
+	ErrPrivateURL   = errors.New("webhook URL must not point to a loopback, link-local or private address")
+)
+
+// Webhook is an endpoint registered by a user. It receives the events of
+// the messages sent from the user's domain.
+type Webhook struct {
+	ID        string    `json:"id"`
+	Owner     string    `json:"owner"`
+	Domain    string    `json:"domain"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (w *Webhook) subscribed(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is the JSON payload posted to webhook endpoints.
+type Event struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	MessageID string    `json:"message_id"`
+	Domain    string    `json:"domain"`
+	From      string    `json:"from"`
+	Recipient string    `json:"recipient"`
+	Status    string    `json:"status,omitempty"`
+	Response  string    `json:"response,omitempty"`
+	RemoteMTA string    `json:"remote_mta,omitempty"`
+	Attempts  int       `json:"attempts"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// Delivery is a log entry for one event sent to one webhook.
+type Delivery struct {
+	ID           string          `json:"id"`
+	WebhookID    string          `json:"webhook_id,omitempty"`
+	RouteID      string          `json:"route_id,omitempty"`
+	Event        string          `json:"event"`
+	Payload      json.RawMessage `json:"payload"`
+	Status       string          `json:"status"`
+	Attempts     int             `json:"attempts"`
+	ResponseCode int             `json:"response_code,omitempty"`
+	LastError    string          `json:"last_error,omitempty"`
+	CreatedAt    time.Time       `json:"created_at"`
+	NextAttempt  time.Time       `json:"next_attempt"`
+	CompletedAt  time.Time       `json:"completed_at,omitempty"`
+}
+
+// Manager stores webhooks, inbound routes and their delivery log on disk
+// and posts events to them. It implements queue.Observer.
+type Manager struct {
+	dir    string
+	cfg    config.WebhookConfig
+	client *http.Client
+
+	// saveMu serializes writes of webhooks.json and routes.json, which are
+	// made without holding mu so that Emit and the workers never wait for
+	// the disk.
+	saveMu sync.Mutex
+
+	mu         sync.Mutex
+	webhooks   map[string]*Webhook
+	routes     map[string]*Route
+	deliveries map[string]*Delivery
+	inFlight   map[string]bool
+
+	wake chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func New(cfg *config.Config) (*Manager, error) {
+	m := &Manager{
+		dir:        cfg.Webhooks.Dir,
+		cfg:        cfg.Webhooks,
+		webhooks:   make(map[string]*Webhook),
+		routes:     make(map[string]*Route),
+		deliveries: make(map[string]*Delivery),
+		inFlight:   make(map[string]bool),
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}
+	if m.dir == "" {
+		m.dir = "webhooks"
+	}
+	timeout := time.Duration(m.cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	m.client = newClient(timeout, cfg.Webhooks.AllowPrivateNetworks)
+
+	if err := os.MkdirAll(filepath.Join(m.dir, "deliveries"), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create webhook directory: %w", err)
+	}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Create registers a webhook for owner. An empty events list subscribes to
+// every event.
+func (m *Manager) Create(owner, domain, rawURL string, events []string) (*Webhook, error) {
+	u, err := m.checkURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range events {
+		if !validEvent(e) {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidEvent, e)
+		}
+	}
+
+	w := &Webhook{
+		ID:        newID(),
+		Owner:     owner,
+		Domain:    strings.ToLower(domain),
+		URL:       u.String(),
+		Events:    events,
+		Secret:    "whsec_" + randomHex(24),
+		CreatedAt: time.Now(),
+	}
+
+	err = m.update(m.webhooksPath(), m.sortedWebhooks, func() error {
+		m.webhooks[w.ID] = w
+		return nil
+	}, func() {
+		delete(m.webhooks, w.ID)
+	})
+	if err != nil {
+		m.dropDeliveries(func(d *Delivery) bool { return d.WebhookID == w.ID })
+		return nil, fmt.Errorf("failed to save webhooks: %w", err)
+	}
+	logger.Info("Webhook registered", logger.Field("id", w.ID), logger.Field("owner", owner), logger.Field("url", w.URL))
+	return w, nil
+}
+
+// List returns the webhooks of owner, oldest first.
+func (m *Manager) List(owner string) []*Webhook {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var hooks []*Webhook
+	for _, w := range m.webhooks {
+		if w.Owner == owner {
+			c := *w
+			hooks = append(hooks, &c)
+		}
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].CreatedAt.Before(hooks[j].CreatedAt) })
+	return hooks
+}
+
+// Get returns the webhook with the given ID if it belongs to owner.
+func (m *Manager) Get(owner, id string) (*Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w, ok := m.webhooks[id]
+	if !ok || w.Owner != owner {
+		return nil, ErrNotFound
+	}
+	c := *w
+	return &c, nil
+}
+
+// Delete removes a webhook along with its delivery log.
+func (m *Manager) Delete(owner, id string) error {
+	var w *Webhook
+	err := m.update(m.webhooksPath(), m.sortedWebhooks, func() error {
+		var ok bool
+		if w, ok = m.webhooks[id]; !ok || w.Owner != owner {
+			return ErrNotFound
+		}
+		delete(m.webhooks, id)
+		return nil
+	}, func() {
+		m.webhooks[id] = w
+	})
+	if errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save webhooks: %w", err)
+	}
+	m.dropDeliveries(func(d *Delivery) bool { return d.WebhookID == id })
+	logger.Info("Webhook deleted", logger.Field("id", id), logger.Field("owner", owner))
+	return nil
+}
+
+// Deliveries returns the most recent deliveries of a webhook or a route,
+// newest first.
+func (m *Manager) Deliveries(owner, id string, limit int) ([]*Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w, isHook := m.webhooks[id]
+	r, isRoute := m.routes[id]
+	if !(isHook && w.Owner == owner) && !(isRoute && r.Owner == owner) {
+		return nil, ErrNotFound
+	}
+	var log []*Delivery
+	for _, d := range m.deliveries {
+		if d.WebhookID == id || d.RouteID == id {
+			c := *d
+			log = append(log, &c)
+		}
+	}
+	sort.Slice(log, func(i, j int) bool { return log[i].CreatedAt.After(log[j].CreatedAt) })
+	if limit > 0 && len(log) > limit {
+		log = log[:limit]
+	}
+	return log, nil
+}
+
+// Observe turns queue status changes into events.
+func (m *Manager) Observe(msg *queue.Message, rcpts []*queue.Recipient) {
+	for _, rcpt := range rcpts {
+		var event string
+		switch rcpt.Status {
+		case queue.StatusQueued:
+			event = EventAccepted
+		case queue.StatusDelivered:
+			event = EventDelivered
+		case queue.StatusDeferred:
+			event = EventDeferred
+		case queue.StatusBounced, queue.StatusFailed:
+			event = EventBounced
+		default:
+			continue
+		}
+		response := rcpt.Diagnostic
+		if response == "" {
+			response = rcpt.LastError
+		}
+		m.Emit(&Event{
+			Type:      event,
+			MessageID: msg.ID,
+			Domain:    msg.Domain,
+			From:      msg.From,
+			Recipient: rcpt.Address,
+			Status:    rcpt.DSNStatus,
+			Response:  response,
+			RemoteMTA: rcpt.RemoteMTA,
+			Attempts:  msg.Attempts,
+		})
+	}
+}
+
+// Emit queues the event for every webhook of its domain subscribed to it.
+func (m *Manager) Emit(e *Event) {
+	if e.Domain == "" {
+		return
+	}
+	m.emit(e, func(w *Webhook) bool { return strings.EqualFold(w.Domain, e.Domain) })
+}
+
+// EmitTo queues the event for every webhook of owner subscribed to it,
+// whatever their domain. Domain events go to the user who added the
+// domain, which need not be the domain their webhooks are for.
+func (m *Manager) EmitTo(owner string, e *Event) {
+	if owner == "" {
+		return
+	}
+	m.emit(e, func(w *Webhook) bool { return w.Owner == owner })
+}
+
+func (m *Manager) emit(e *Event, match func(w *Webhook) bool) {
+	if e.ID == "" {
+		e.ID = newID()
+	}
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now().UTC()
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		logger.Error("Failed to encode webhook event", logger.Field("event", e.Type), logger.Err(err))
+		return
+	}
+
+	m.mu.Lock()
+	var created []*Delivery
+	for _, w := range m.webhooks {
+		if !match(w) || !w.subscribed(e.Type) {
+			continue
+		}
+		now := time.Now()
+		created = append(created, &Delivery{
+			ID:          newID(),
+			WebhookID:   w.ID,
+			Event:       e.Type,
+			Payload:     payload,
+			Status:      DeliveryPending,
+			CreatedAt:   now,
+			NextAttempt: now,
+		})
+	}
+	m.mu.Unlock()
+
+	for _, d := range created {
+		if err := m.addDelivery(d); err != nil {
+			logger.Error("Failed to store webhook delivery", logger.Field("webhook", d.WebhookID), logger.Err(err))
+		}
+	}
+}
+
+// addDelivery stores a new delivery and schedules it. The file is written
+// without holding mu; if the endpoint was deleted meanwhile, the delivery
+// is dropped.
+func (m *Manager) addDelivery(d *Delivery) error {
+	if err := m.saveDelivery(d); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	_, _, ok := m.endpoint(d)
+	if ok {
+		m.deliveries[d.ID] = d
+	}
+	m.mu.Unlock()
+	if !ok {
+		os.Remove(m.deliveryPath(d.ID))
+		return ErrNotFound
+	}
+	m.notify()
+	return nil
+}
+
+// dropDeliveries forgets the deliveries matching drop and removes their
+// files.
+func (m *Manager) dropDeliveries(drop func(*Delivery) bool) {
+	m.mu.Lock()
+	var ids []string
+	for id, d := range m.deliveries {
+		if drop(d) {
+			delete(m.deliveries, id)
+			ids = append(ids, id)
+		}
+	}
+	m.mu.Unlock()
+	for _, id := range ids {
+		os.Remove(m.deliveryPath(id))
+	}
+}
+
+// update applies change to the in-memory state with mu held, then writes
+// path from encode with only saveMu held. If the write fails, undo reverts
+// change. An error from change is returned as is and nothing is written.
+func (m *Manager) update(path string, encode func() any, change func() error, undo func()) error {
+	m.saveMu.Lock()
+	defer m.saveMu.Unlock()
+
+	m.mu.Lock()
+	if err := change(); err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	raw, err := json.MarshalIndent(encode(), "", "  ")
+	m.mu.Unlock()
+	if err == nil {
+		err = queue.WriteFile(path, raw)
+	}
+	if err != nil {
+		m.mu.Lock()
+		undo()
+		m.mu.Unlock()
+	}
+	return err
+}
+
+func validEvent(event string) bool {
+	for _, e := range Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manager) load() error {
+	raw, err := os.ReadFile(m.webhooksPath())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read webhooks: %w", err)
+	}
+	if err == nil {
+		var hooks []*Webhook
+		if err := json.Unmarshal(raw, &hooks); err != nil {
+			return fmt.Errorf("failed to parse webhooks: %w", err)
+		}
+		for _, w := range hooks {
+			m.webhooks[w.ID] = w
+		}
+	}
+
+	raw, err = os.ReadFile(m.routesPath())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read routes: %w", err)
+	}
+	if err == nil {
+		var routes []*Route
+		if err := json.Unmarshal(raw, &routes); err != nil {
+			return fmt.Errorf("failed to parse routes: %w", err)
+		}
+		for _, r := range routes {
+			if err := r.compile(); err != nil {
+				return fmt.Errorf("route %s: %w", r.ID, err)
+			}
+			m.routes[r.ID] = r
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(m.dir, "deliveries"))
+	if err != nil {
+		return fmt.Errorf("failed to read webhook deliveries: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		raw, err := os.ReadFile(filepath.Join(m.dir, "deliveries", name))
+		if err != nil {
+			return fmt.Errorf("failed to read webhook delivery: %w", err)
+		}
+		var d Delivery
+		if err := json.Unmarshal(raw, &d); err != nil {
+			logger.Error("Skipping corrupt webhook delivery", logger.Field("file", name), logger.Err(err))
+			continue
+		}
+		if _, _, ok := m.endpoint(&d); !ok {
+			os.Remove(filepath.Join(m.dir, "deliveries", name))
+			continue
+		}
+		m.deliveries[d.ID] = &d
+	}
+	return nil
+}
+
+// sortedWebhooks returns the webhooks as stored in webhooks.json. It must
+// be called with mu held.
+func (m *Manager) sortedWebhooks() any {
+	hooks := make([]*Webhook, 0, len(m.webhooks))
+	for _, w := range m.webhooks {
+		hooks = append(hooks, w)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].CreatedAt.Before(hooks[j].CreatedAt) })
+	return hooks
+}
+
+// sortedRoutes returns the routes as stored in routes.json. It must be
+// called with mu held.
+func (m *Manager) sortedRoutes() any {
+	routes := make([]*Route, 0, len(m.routes))
+	for _, r := range m.routes {
+		routes = append(routes, r)
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].CreatedAt.Before(routes[j].CreatedAt) })
+	return routes
+}
+
+func (m *Manager) saveDelivery(d *Delivery) error {
+	raw, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return queue.WriteFile(m.deliveryPath(d.ID), raw)
+}
+
+func (m *Manager) routesPath() string {
+	return filepath.Join(m.dir, "routes.json")
+}
+
+func (m *Manager) webhooksPath() string {
+	return filepath.Join(m.dir, "webhooks.json")
+}
+
+func (m *Manager) deliveryPath(id string) string {
+	return filepath.Join(m.dir, "deliveries", id+".json")
+}
+
+func newID() string {
+	return fmt.Sprintf("%x%s", time.Now().UnixNano(), randomHex(8))
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
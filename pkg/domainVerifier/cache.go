@@ -0,0 +1,172 @@
+package domainVerifier
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ttlResolver is implemented by resolvers that know how long their answers
+// may be cached, such as Client.
+type ttlResolver interface {
+	lookupTXT(ctx context.Context, name string) ([]string, time.Duration, error)
+	lookupMX(ctx context.Context, name string) ([]*net.MX, time.Duration, error)
+	lookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error)
+	lookupAddr(ctx context.Context, addr string) ([]string, time.Duration, error)
+	lookupCNAME(ctx context.Context, host string) (string, time.Duration, error)
+}
+
+// maxCacheEntries bounds the cache; expired entries are dropped when it is
+// full, and everything when that is not enough.
+const maxCacheEntries = 10000
+
+// Cache remembers the answers of another Resolver. Answers are kept for
+// their TTL when the resolver reports it, and at most maxTTL. Names and
+// records that do not exist are remembered for negativeTTL; failed lookups
+// are never cached.
+type Cache struct {
+	inner       Resolver
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	value   any
+	err     error
+	expires time.Time
+}
+
+func NewCache(inner Resolver, maxTTL, negativeTTL time.Duration) *Cache {
+	return &Cache{
+		inner:       inner,
+		maxTTL:      maxTTL,
+		negativeTTL: negativeTTL,
+		entries:     make(map[string]cacheEntry),
+	}
+}
+
+func (c *Cache) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	v, err := c.lookup("TXT "+cacheKey(name), func() (any, time.Duration, error) {
+		if r, ok := c.inner.(ttlResolver); ok {
+			return r.lookupTXT(ctx, name)
+		}
+		txts, err := c.inner.LookupTXT(ctx, name)
+		return txts, -1, err
+	})
+	txts, _ := v.([]string)
+	return append([]string(nil), txts...), err
+}
+
+func (c *Cache) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	v, err := c.lookup("MX "+cacheKey(name), func() (any, time.Duration, error) {
+		if r, ok := c.inner.(ttlResolver); ok {
+			return r.lookupMX(ctx, name)
+		}
+		mxs, err := c.inner.LookupMX(ctx, name)
+		return mxs, -1, err
+	})
+	mxs, _ := v.([]*net.MX)
+	copied := make([]*net.MX, len(mxs))
+	for i, mx := range mxs {
+		copied[i] = &net.MX{Host: mx.Host, Pref: mx.Pref}
+	}
+	return copied, err
+}
+
+func (c *Cache) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	v, err := c.lookup("IP "+cacheKey(host), func() (any, time.Duration, error) {
+		if r, ok := c.inner.(ttlResolver); ok {
+			return r.lookupIPAddr(ctx, host)
+		}
+		addrs, err := c.inner.LookupIPAddr(ctx, host)
+		return addrs, -1, err
+	})
+	addrs, _ := v.([]net.IPAddr)
+	return append([]net.IPAddr(nil), addrs...), err
+}
+
+func (c *Cache) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	v, err := c.lookup("PTR "+addr, func() (any, time.Duration, error) {
+		if r, ok := c.inner.(ttlResolver); ok {
+			return r.lookupAddr(ctx, addr)
+		}
+		names, err := c.inner.LookupAddr(ctx, addr)
+		return names, -1, err
+	})
+	names, _ := v.([]string)
+	return append([]string(nil), names...), err
+}
+
+func (c *Cache) LookupCNAME(ctx context.Context, host string) (string, error) {
+	v, err := c.lookup("CNAME "+cacheKey(host), func() (any, time.Duration, error) {
+		if r, ok := c.inner.(ttlResolver); ok {
+			return r.lookupCNAME(ctx, host)
+		}
+		cname, err := c.inner.LookupCNAME(ctx, host)
+		return cname, -1, err
+	})
+	cname, _ := v.(string)
+	return cname, err
+}
+
+// Flush drops every cached answer.
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]cacheEntry)
+}
+
+// lookup returns the cached answer for key or calls fetch, which returns
+// the answer with its TTL, or a negative TTL when it is unknown.
+func (c *Cache) lookup(key string, fetch func() (any, time.Duration, error)) (any, error) {
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.value, e.err
+	}
+
+	value, ttl, err := fetch()
+	switch {
+	case err == nil:
+		if ttl < 0 || ttl > c.maxTTL {
+			ttl = c.maxTTL
+		}
+	case IsNotFound(err):
+		if ttl < 0 || ttl > c.negativeTTL {
+			ttl = c.negativeTTL
+		}
+	default:
+		ttl = 0
+	}
+	if ttl > 0 {
+		c.mu.Lock()
+		if len(c.entries) >= maxCacheEntries {
+			c.evict(now)
+		}
+		c.entries[key] = cacheEntry{value: value, err: err, expires: now.Add(ttl)}
+		c.mu.Unlock()
+	}
+	return value, err
+}
+
+func (c *Cache) evict(now time.Time) {
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+	if len(c.entries) >= maxCacheEntries {
+		c.entries = make(map[string]cacheEntry)
+	}
+}
+
+func cacheKey(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
@@ -0,0 +1,82 @@
+package domainVerifier
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCacheLookup(t *testing.T) {
+	notFound := &net.DNSError{Err: "no such host", Name: "example.test", IsNotFound: true}
+	failed := &net.DNSError{Err: "server misbehaving", Name: "example.test", IsTemporary: true}
+	tests := []struct {
+		name        string
+		ttl         time.Duration
+		err         error
+		maxTTL      time.Duration
+		negativeTTL time.Duration
+		wait        time.Duration
+		fetches     int
+	}{
+		{name: "answer cached for its TTL", ttl: time.Hour, maxTTL: time.Hour, fetches: 1},
+		{name: "answer expires after its TTL", ttl: 20 * time.Millisecond, maxTTL: time.Hour, wait: 40 * time.Millisecond, fetches: 2},
+		{name: "answer TTL capped by maxTTL", ttl: time.Hour, maxTTL: 20 * time.Millisecond, wait: 40 * time.Millisecond, fetches: 2},
+		{name: "unknown TTL uses maxTTL", ttl: -1, maxTTL: time.Hour, fetches: 1},
+		{name: "zero TTL not cached", ttl: 0, maxTTL: time.Hour, fetches: 2},
+		{name: "missing record cached", ttl: -1, err: notFound, maxTTL: time.Hour, negativeTTL: time.Hour, fetches: 1},
+		{name: "missing record expires after SOA TTL", ttl: 20 * time.Millisecond, err: notFound, negativeTTL: time.Hour, wait: 40 * time.Millisecond, fetches: 2},
+		{name: "missing record capped by negativeTTL", ttl: time.Hour, err: notFound, negativeTTL: 20 * time.Millisecond, wait: 40 * time.Millisecond, fetches: 2},
+		{name: "missing record not cached without negativeTTL", ttl: -1, err: notFound, maxTTL: time.Hour, fetches: 2},
+		{name: "failure not cached", ttl: time.Hour, err: failed, maxTTL: time.Hour, negativeTTL: time.Hour, fetches: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache(&StaticResolver{}, tt.maxTTL, tt.negativeTTL)
+			fetches := 0
+			fetch := func() (any, time.Duration, error) {
+				fetches++
+				return "answer", tt.ttl, tt.err
+			}
+			for i := 0; i < 2; i++ {
+				v, err := c.lookup("TXT example.test", fetch)
+				if err != tt.err || v != "answer" {
+					t.Fatalf("lookup %d = %v, %v, want answer, %v", i, v, err, tt.err)
+				}
+				time.Sleep(tt.wait)
+			}
+			if fetches != tt.fetches {
+				t.Errorf("fetched %d times, want %d", fetches, tt.fetches)
+			}
+		})
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	fill := func(c *Cache, n int, ttl time.Duration) {
+		for i := 0; i < n; i++ {
+			c.lookup(fmt.Sprintf("TXT %d.example.test", i), func() (any, time.Duration, error) {
+				return "answer", ttl, nil
+			})
+		}
+	}
+
+	c := NewCache(&StaticResolver{}, time.Hour, time.Hour)
+	fill(c, maxCacheEntries-1, 20*time.Millisecond)
+	c.lookup("TXT live.example.test", func() (any, time.Duration, error) { return "answer", time.Hour, nil })
+	time.Sleep(40 * time.Millisecond)
+	fill(c, 1, time.Hour)
+	if len(c.entries) != 2 {
+		t.Errorf("%d entries after evicting expired ones, want 2", len(c.entries))
+	}
+	if _, ok := c.entries["TXT live.example.test"]; !ok {
+		t.Error("live entry was evicted")
+	}
+
+	c = NewCache(&StaticResolver{}, time.Hour, time.Hour)
+	fill(c, maxCacheEntries, time.Hour)
+	c.lookup("TXT new.example.test", func() (any, time.Duration, error) { return "answer", time.Hour, nil })
+	if len(c.entries) != 1 {
+		t.Errorf("%d entries after overflowing a cache of live entries, want 1", len(c.entries))
+	}
+}
@@ -0,0 +1,379 @@
+package domainVerifier
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Client is a stub resolver that queries recursive name servers directly,
+// so that the TTLs of answers are known to the Cache.
+type Client struct {
+	servers []string
+	timeout time.Duration
+}
+
+// NewClient returns a Client for servers, given as host or host:port, or
+// for the name servers in /etc/resolv.conf when servers is empty. Every
+// query to a server times out after timeout; the next server is tried then.
+func NewClient(servers []string, timeout time.Duration) (*Client, error) {
+	if len(servers) == 0 {
+		var err error
+		if servers, err = systemServers("/etc/resolv.conf"); err != nil {
+			return nil, err
+		}
+	}
+	c := &Client{timeout: timeout}
+	if c.timeout <= 0 {
+		c.timeout = 5 * time.Second
+	}
+	for _, s := range servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(strings.Trim(s, "[]"), "53")
+		}
+		c.servers = append(c.servers, s)
+	}
+	return c, nil
+}
+
+func systemServers(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("no DNS servers configured: %w", err)
+	}
+	defer f.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no DNS servers configured: %s lists no nameserver", path)
+	}
+	return servers, scanner.Err()
+}
+
+func (c *Client) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	txts, _, err := c.lookupTXT(ctx, name)
+	return txts, err
+}
+
+func (c *Client) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	mxs, _, err := c.lookupMX(ctx, name)
+	return mxs, err
+}
+
+func (c *Client) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, _, err := c.lookupIPAddr(ctx, host)
+	return addrs, err
+}
+
+func (c *Client) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	names, _, err := c.lookupAddr(ctx, addr)
+	return names, err
+}
+
+// LookupCNAME returns the target of the CNAME record at host. Unlike
+// net.Resolver it does not follow the chain, and a host without a CNAME
+// record is not found.
+func (c *Client) LookupCNAME(ctx context.Context, host string) (string, error) {
+	cname, _, err := c.lookupCNAME(ctx, host)
+	return cname, err
+}
+
+func (c *Client) lookupTXT(ctx context.Context, name string) ([]string, time.Duration, error) {
+	rrs, ttl, err := c.lookup(ctx, name, dnsmessage.TypeTXT)
+	if err != nil {
+		return nil, ttl, err
+	}
+	txts := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		txts = append(txts, strings.Join(rr.Body.(*dnsmessage.TXTResource).TXT, ""))
+	}
+	return txts, ttl, nil
+}
+
+func (c *Client) lookupMX(ctx context.Context, name string) ([]*net.MX, time.Duration, error) {
+	rrs, ttl, err := c.lookup(ctx, name, dnsmessage.TypeMX)
+	if err != nil {
+		return nil, ttl, err
+	}
+	mxs := make([]*net.MX, 0, len(rrs))
+	for _, rr := range rrs {
+		mx := rr.Body.(*dnsmessage.MXResource)
+		mxs = append(mxs, &net.MX{Host: mx.MX.String(), Pref: mx.Pref})
+	}
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	return mxs, ttl, nil
+}
+
+// lookupIPAddr queries A and AAAA records; the host is only not found when
+// it has neither.
+func (c *Client) lookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	var addrs []net.IPAddr
+	var ttl time.Duration
+	var notFound error
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		rrs, t, err := c.lookup(ctx, host, qtype)
+		if ttl == 0 || t < ttl {
+			ttl = t
+		}
+		if IsNotFound(err) {
+			notFound = err
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, rr := range rrs {
+			switch body := rr.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, net.IPAddr{IP: net.IP(body.A[:])})
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, net.IPAddr{IP: net.IP(body.AAAA[:])})
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, ttl, notFound
+	}
+	return addrs, ttl, nil
+}
+
+func (c *Client) lookupAddr(ctx context.Context, addr string) ([]string, time.Duration, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, 0, &net.DNSError{Err: "unrecognized address", Name: addr}
+	}
+	rrs, ttl, err := c.lookup(ctx, reverseName(ip), dnsmessage.TypePTR)
+	if err != nil {
+		return nil, ttl, err
+	}
+	names := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		names = append(names, rr.Body.(*dnsmessage.PTRResource).PTR.String())
+	}
+	return names, ttl, nil
+}
+
+func (c *Client) lookupCNAME(ctx context.Context, host string) (string, time.Duration, error) {
+	rrs, ttl, err := c.lookup(ctx, host, dnsmessage.TypeCNAME)
+	if err != nil {
+		return "", ttl, err
+	}
+	return rrs[0].Body.(*dnsmessage.CNAMEResource).CNAME.String(), ttl, nil
+}
+
+// maxCNAMEs bounds the CNAME chain followed inside one answer.
+const maxCNAMEs = 8
+
+// lookup returns the records of qtype for name, following CNAMEs in the
+// answer, and how long the result may be cached: the smallest TTL of the
+// records used, or for negative answers the SOA TTL (RFC 2308 section 5).
+func (c *Client) lookup(ctx context.Context, name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, time.Duration, error) {
+	fqdn := strings.ToLower(name)
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+	q, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: "invalid domain name", Name: name, IsNotFound: true}
+	}
+	resp, server, err := c.exchange(ctx, dnsmessage.Question{Name: q, Type: qtype, Class: dnsmessage.ClassINET})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch resp.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, negativeTTL(resp), &net.DNSError{Err: "no such host", Name: name, Server: server, IsNotFound: true}
+	default:
+		return nil, 0, &net.DNSError{Err: "server misbehaving: " + resp.RCode.String(), Name: name, Server: server, IsTemporary: true}
+	}
+
+	var records []dnsmessage.Resource
+	ttl := time.Duration(-1)
+	target := fqdn
+	for hops := 0; hops <= maxCNAMEs && len(records) == 0; hops++ {
+		next := ""
+		for _, rr := range resp.Answers {
+			if !strings.EqualFold(rr.Header.Name.String(), target) {
+				continue
+			}
+			switch {
+			case rr.Header.Type == qtype:
+				records = append(records, rr)
+			case rr.Header.Type == dnsmessage.TypeCNAME:
+				next = rr.Body.(*dnsmessage.CNAMEResource).CNAME.String()
+			default:
+				continue
+			}
+			if t := time.Duration(rr.Header.TTL) * time.Second; ttl < 0 || t < ttl {
+				ttl = t
+			}
+		}
+		if next == "" {
+			break
+		}
+		target = next
+	}
+	if len(records) == 0 {
+		return nil, negativeTTL(resp), &net.DNSError{Err: "no such record", Name: name, Server: server, IsNotFound: true}
+	}
+	return records, ttl, nil
+}
+
+func negativeTTL(resp *dnsmessage.Message) time.Duration {
+	for _, rr := range resp.Authorities {
+		if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+			return time.Duration(min(rr.Header.TTL, soa.MinTTL)) * time.Second
+		}
+	}
+	return 0
+}
+
+// exchange sends q to each server in turn until one answers, over UDP and
+// again over TCP when the answer was truncated. The query ID is random so
+// that off-path attackers cannot guess it.
+func (c *Client) exchange(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, string, error) {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, "", &net.DNSError{Err: err.Error(), Name: q.Name.String()}
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:]), RecursionDesired: true},
+		Questions: []dnsmessage.Question{q},
+	}
+	var opt dnsmessage.Resource
+	opt.Header.Name = dnsmessage.MustNewName(".")
+	if err := opt.Header.SetEDNS0(1232, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, "", err
+	}
+	opt.Body = &dnsmessage.OPTResource{}
+	query.Additionals = []dnsmessage.Resource{opt}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, "", &net.DNSError{Err: err.Error(), Name: q.Name.String()}
+	}
+
+	var lastErr error
+	for _, server := range c.servers {
+		resp, err := c.roundTrip(ctx, "udp", server, packed, &query)
+		if err == nil && resp.Truncated {
+			resp, err = c.roundTrip(ctx, "tcp", server, packed, &query)
+		}
+		if err == nil {
+			return resp, server, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	dnsErr := &net.DNSError{Err: fmt.Sprint(lastErr), Name: q.Name.String(), IsTemporary: true}
+	var netErr net.Error
+	dnsErr.IsTimeout = errors.As(lastErr, &netErr) && netErr.Timeout()
+	return nil, "", dnsErr
+}
+
+// roundTrip sends the packed query to server and returns its answer.
+// Answers whose ID or question differ from the query are ignored over UDP,
+// where anyone may send them, and rejected over TCP.
+func (c *Client) roundTrip(ctx context.Context, network, server string, packed []byte, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	buf := make([]byte, 65535)
+	if network == "tcp" {
+		framed := binary.BigEndian.AppendUint16(nil, uint16(len(packed)))
+		if _, err := conn.Write(append(framed, packed...)); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return nil, err
+		}
+		n := int(binary.BigEndian.Uint16(buf[:2]))
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return nil, err
+		}
+		resp, err := answer(buf[:n], query)
+		if err != nil {
+			return nil, fmt.Errorf("answer from %s: %w", server, err)
+		}
+		return resp, nil
+	}
+
+	if _, err := conn.Write(packed); err != nil {
+		return nil, err
+	}
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Skip stray datagrams that do not answer this query.
+		if resp, err := answer(buf[:n], query); err == nil {
+			return resp, nil
+		}
+	}
+}
+
+// answer parses msg and checks that it answers query.
+func answer(msg []byte, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+	var resp dnsmessage.Message
+	if err := resp.Unpack(msg); err != nil {
+		return nil, fmt.Errorf("malformed answer: %w", err)
+	}
+	if resp.ID != query.ID || !resp.Response {
+		return nil, errors.New("unexpected answer")
+	}
+	q := query.Questions[0]
+	if len(resp.Questions) != 1 || resp.Questions[0].Type != q.Type || resp.Questions[0].Class != q.Class ||
+		!strings.EqualFold(resp.Questions[0].Name.String(), q.Name.String()) {
+		return nil, errors.New("answer is for a different question")
+	}
+	return &resp, nil
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name of ip.
+func reverseName(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", v4[3], v4[2], v4[1], v4[0])
+	}
+	const hex = "0123456789abcdef"
+	var b strings.Builder
+	ip = ip.To16()
+	for i := len(ip) - 1; i >= 0; i-- {
+		b.WriteByte(hex[ip[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hex[ip[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String()
+}
@@ -0,0 +1,215 @@
+package domainVerifier
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubServer answers DNS queries on one UDP and TCP port of 127.0.0.1.
+// udp returns the datagrams sent back for a query, tcp the answer over
+// TCP.
+type stubServer struct {
+	addr string
+	udp  func(q *dnsmessage.Message) []*dnsmessage.Message
+	tcp  func(q *dnsmessage.Message) *dnsmessage.Message
+}
+
+func newStubServer(t *testing.T, s *stubServer) *Client {
+	t.Helper()
+	var pc net.PacketConn
+	var ln net.Listener
+	for attempt := 0; ln == nil; attempt++ {
+		var err error
+		if pc, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if ln, err = net.Listen("tcp", pc.LocalAddr().String()); err != nil {
+			pc.Close()
+			if attempt == 10 {
+				t.Fatal(err)
+			}
+		}
+	}
+	t.Cleanup(func() { pc.Close(); ln.Close() })
+	s.addr = pc.LocalAddr().String()
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var q dnsmessage.Message
+			if q.Unpack(buf[:n]) != nil || s.udp == nil {
+				continue
+			}
+			for _, resp := range s.udp(&q) {
+				packed, _ := resp.Pack()
+				pc.WriteTo(packed, from)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var size [2]byte
+				if _, err := io.ReadFull(conn, size[:]); err != nil {
+					return
+				}
+				buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return
+				}
+				var q dnsmessage.Message
+				if q.Unpack(buf) != nil || s.tcp == nil {
+					return
+				}
+				packed, _ := s.tcp(&q).Pack()
+				conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packed))), packed...))
+			}()
+		}
+	}()
+
+	c, err := NewClient([]string{s.addr}, 500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// reply returns the answer to q with rrs.
+func reply(q *dnsmessage.Message, rrs ...dnsmessage.Resource) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: q.ID, Response: true, RecursionAvailable: true},
+		Questions: q.Questions,
+		Answers:   rrs,
+	}
+}
+
+func rr(name string, ttl uint32, body dnsmessage.ResourceBody) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   body,
+	}
+}
+
+func TestClientTruncatedFallsBackToTCP(t *testing.T) {
+	c := newStubServer(t, &stubServer{
+		udp: func(q *dnsmessage.Message) []*dnsmessage.Message {
+			resp := reply(q)
+			resp.Truncated = true
+			return []*dnsmessage.Message{resp}
+		},
+		tcp: func(q *dnsmessage.Message) *dnsmessage.Message {
+			return reply(q, rr("example.test.", 300, &dnsmessage.TXTResource{TXT: []string{"v=spf1 ", "-all"}}))
+		},
+	})
+
+	txts, ttl, err := c.lookupTXT(context.Background(), "example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txts) != 1 || txts[0] != "v=spf1 -all" || ttl != 300*time.Second {
+		t.Errorf("lookupTXT = %q, %v, want [v=spf1 -all], 5m0s", txts, ttl)
+	}
+}
+
+func TestClientNXDOMAINUsesSOATTL(t *testing.T) {
+	c := newStubServer(t, &stubServer{
+		udp: func(q *dnsmessage.Message) []*dnsmessage.Message {
+			resp := reply(q)
+			resp.RCode = dnsmessage.RCodeNameError
+			resp.Authorities = []dnsmessage.Resource{rr("test.", 3600, &dnsmessage.SOAResource{
+				NS:     dnsmessage.MustNewName("ns.test."),
+				MBox:   dnsmessage.MustNewName("hostmaster.test."),
+				MinTTL: 120,
+			})}
+			return []*dnsmessage.Message{resp}
+		},
+	})
+
+	_, ttl, err := c.lookupTXT(context.Background(), "missing.test")
+	if !IsNotFound(err) {
+		t.Fatalf("lookupTXT error = %v, want not found", err)
+	}
+	if ttl != 120*time.Second {
+		t.Errorf("negative TTL = %v, want the SOA minimum of 2m0s", ttl)
+	}
+}
+
+func TestClientFollowsCNAMEChain(t *testing.T) {
+	c := newStubServer(t, &stubServer{
+		udp: func(q *dnsmessage.Message) []*dnsmessage.Message {
+			chain := []dnsmessage.Resource{
+				rr("www.example.test.", 300, &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("a.example.test.")}),
+				rr("a.example.test.", 100, &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("b.example.test.")}),
+			}
+			if q.Questions[0].Name.String() == "www.example.test." {
+				chain = append(chain, rr("b.example.test.", 200, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}))
+			}
+			return []*dnsmessage.Message{reply(q, chain...)}
+		},
+	})
+
+	rrs, ttl, err := c.lookup(context.Background(), "www.example.test", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 1 || rrs[0].Body.(*dnsmessage.AResource).A != [4]byte{192, 0, 2, 1} {
+		t.Errorf("lookup = %v, want 192.0.2.1", rrs)
+	}
+	if ttl != 100*time.Second {
+		t.Errorf("TTL = %v, want the smallest in the chain, 1m40s", ttl)
+	}
+
+	// A chain that ends without the record is not found.
+	if _, _, err := c.lookup(context.Background(), "www.example.test", dnsmessage.TypeAAAA); !IsNotFound(err) {
+		t.Errorf("lookup of a dangling chain = %v, want not found", err)
+	}
+}
+
+func TestClientIgnoresAnswersToOtherQuestions(t *testing.T) {
+	c := newStubServer(t, &stubServer{
+		udp: func(q *dnsmessage.Message) []*dnsmessage.Message {
+			spoofed := reply(q, rr("evil.test.", 300, &dnsmessage.TXTResource{TXT: []string{"spoofed"}}))
+			spoofed.Questions = []dnsmessage.Question{{Name: dnsmessage.MustNewName("evil.test."), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET}}
+			return []*dnsmessage.Message{spoofed, reply(q, rr("example.test.", 300, &dnsmessage.TXTResource{TXT: []string{"genuine"}}))}
+		},
+	})
+
+	txts, err := c.LookupTXT(context.Background(), "example.test")
+	if err != nil || len(txts) != 1 || txts[0] != "genuine" {
+		t.Errorf("LookupTXT = %q, %v, want [genuine]", txts, err)
+	}
+}
+
+func TestClientRejectsTCPAnswerToOtherQuestion(t *testing.T) {
+	c := newStubServer(t, &stubServer{
+		udp: func(q *dnsmessage.Message) []*dnsmessage.Message {
+			resp := reply(q)
+			resp.Truncated = true
+			return []*dnsmessage.Message{resp}
+		},
+		tcp: func(q *dnsmessage.Message) *dnsmessage.Message {
+			resp := reply(q)
+			resp.Questions = []dnsmessage.Question{{Name: dnsmessage.MustNewName("example.test."), Type: dnsmessage.TypeMX, Class: dnsmessage.ClassINET}}
+			return resp
+		},
+	})
+
+	if _, err := c.LookupTXT(context.Background(), "example.test"); err == nil || IsNotFound(err) {
+		t.Errorf("LookupTXT = %v, want a temporary failure", err)
+	}
+}
@@ -0,0 +1,221 @@
+package domainVerifier
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MinDKIMRSABits is the smallest RSA key verifiers must accept (RFC 8301
+// section 3.2); shorter keys are treated as invalid.
+const MinDKIMRSABits = 1024
+
+// DKIMKeyRecord is a parsed DKIM key record (RFC 6376 section 3.6.1).
+type DKIMKeyRecord struct {
+	KeyType   string           // k, rsa or ed25519
+	PublicKey crypto.PublicKey // p, nil when the key has been revoked
+	// HashAlgorithms lists the h= algorithms, empty when any is allowed.
+	HashAlgorithms []string
+	ServiceTypes   []string // s, defaults to *
+	Testing        bool     // t=y, receivers treat failures as unsigned mail
+	StrictIdentity bool     // t=s, i= must not be a subdomain of d=
+	Notes          string   // n
+}
+
+// ParseDKIMKeyRecord parses the TXT record published for a DKIM selector.
+// Unknown tags, hash algorithms and flags are ignored as the RFC requires.
+func ParseDKIMKeyRecord(txt string) (*DKIMKeyRecord, error) {
+	rec := &DKIMKeyRecord{KeyType: "rsa", ServiceTypes: []string{"*"}}
+
+	seen := make(map[string]bool)
+	var p string
+	for i, part := range strings.Split(txt, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("malformed tag %q", part)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate %s= tag", name)
+		}
+		seen[name] = true
+
+		switch name {
+		case "v":
+			if i != 0 || value != "DKIM1" {
+				return nil, errors.New("v= must come first and be DKIM1")
+			}
+		case "k":
+			if value != "rsa" && value != "ed25519" {
+				return nil, fmt.Errorf("unsupported key type %q", value)
+			}
+			rec.KeyType = value
+		case "h":
+			rec.HashAlgorithms = strings.Split(stripSpace(value), ":")
+		case "s":
+			rec.ServiceTypes = strings.Split(stripSpace(value), ":")
+		case "t":
+			for _, flag := range strings.Split(stripSpace(value), ":") {
+				switch flag {
+				case "y":
+					rec.Testing = true
+				case "s":
+					rec.StrictIdentity = true
+				}
+			}
+		case "n":
+			rec.Notes = value
+		case "p":
+			p = stripSpace(value)
+		}
+	}
+	if !seen["p"] {
+		return nil, errors.New("missing required p= tag")
+	}
+	if p == "" {
+		return rec, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, errors.New("p= is not valid base64")
+	}
+	switch rec.KeyType {
+	case "rsa":
+		pub, err := x509.ParsePKIXPublicKey(raw)
+		if err != nil {
+			// Some records carry a bare PKCS#1 key.
+			if pub, err = x509.ParsePKCS1PublicKey(raw); err != nil {
+				return nil, fmt.Errorf("p= does not hold an RSA public key: %w", err)
+			}
+		}
+		rsaKey, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("p= holds a %T, not an RSA key", pub)
+		}
+		rec.PublicKey = rsaKey
+	case "ed25519":
+		if len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("ed25519 key is %d bytes, want %d", len(raw), ed25519.PublicKeySize)
+		}
+		rec.PublicKey = ed25519.PublicKey(raw)
+	}
+	return rec, nil
+}
+
+// Revoked reports whether the record has an empty p= tag.
+func (r *DKIMKeyRecord) Revoked() bool {
+	return r.PublicKey == nil
+}
+
+// Bits returns the key size: the RSA modulus length, or 256 for Ed25519.
+func (r *DKIMKeyRecord) Bits() int {
+	switch key := r.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return key.N.BitLen()
+	case ed25519.PublicKey:
+		return 256
+	}
+	return 0
+}
+
+// Check reports why mail signed with sha256 under this record would not
+// verify: a revoked or weak key, or h= and s= tags that exclude it.
+func (r *DKIMKeyRecord) Check() error {
+	if r.Revoked() {
+		return errors.New("key has been revoked")
+	}
+	if r.KeyType == "rsa" && r.Bits() < MinDKIMRSABits {
+		return fmt.Errorf("RSA key is %d bits, at least %d are required", r.Bits(), MinDKIMRSABits)
+	}
+	if len(r.HashAlgorithms) > 0 && !contains(r.HashAlgorithms, "sha256") {
+		return fmt.Errorf("h=%s does not allow sha256", strings.Join(r.HashAlgorithms, ":"))
+	}
+	if !contains(r.ServiceTypes, "*") && !contains(r.ServiceTypes, "email") {
+		return fmt.Errorf("s=%s does not allow email", strings.Join(r.ServiceTypes, ":"))
+	}
+	return nil
+}
+
+// Matches reports whether key is the private half of the record's key.
+func (r *DKIMKeyRecord) Matches(key crypto.Signer) bool {
+	pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	return ok && r.PublicKey != nil && pub.Equal(r.PublicKey)
+}
+
+// DKIMKeyRecordFor returns the TXT record value that publishes the public
+// half of key.
+func DKIMKeyRecordFor(key crypto.Signer) (string, error) {
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return "", err
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub), nil
+	default:
+		return "", fmt.Errorf("unsupported DKIM key type %T", pub)
+	}
+}
+
+// SplitTXT splits a record value into the 255 byte character-strings a
+// single TXT record is made of.
+func SplitTXT(value string) []string {
+	var parts []string
+	for len(value) > 255 {
+		parts = append(parts, value[:255])
+		value = value[255:]
+	}
+	return append(parts, value)
+}
+
+// LookupDKIMKey fetches and parses the key record of selector on domain.
+func LookupDKIMKey(ctx context.Context, r Resolver, domain, selector string) (*DKIMKeyRecord, error) {
+	name := selector + "._domainkey." + domain
+	txts, err := r.LookupTXT(ctx, name)
+	if err != nil && !IsNotFound(err) {
+		return nil, fmt.Errorf("failed to lookup DKIM record for %s: %w", name, err)
+	}
+	switch len(txts) {
+	case 0:
+		return nil, fmt.Errorf("no DKIM record found for %s", name)
+	case 1:
+	default:
+		return nil, fmt.Errorf("%s publishes %d TXT records, want one", name, len(txts))
+	}
+	rec, err := ParseDKIMKeyRecord(txts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid DKIM record for %s: %w", name, err)
+	}
+	return rec, nil
+}
+
+func stripSpace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,323 @@
+package domainVerifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// DMARC policies.
+const (
+	DMARCNone       = "none"
+	DMARCQuarantine = "quarantine"
+	DMARCReject     = "reject"
+)
+
+// DMARC identifier alignment modes.
+const (
+	AlignRelaxed = "r"
+	AlignStrict  = "s"
+)
+
+var ErrNoDMARCRecord = errors.New("no DMARC record found")
+
+// DMARCRecord is a parsed DMARC policy record (RFC 7489 section 6.3).
+// Optional tags that are absent hold their defaults.
+type DMARCRecord struct {
+	Policy          string        // p
+	SubdomainPolicy string        // sp, defaults to p
+	Percent         int           // pct, defaults to 100
+	DKIMAlignment   string        // adkim, defaults to relaxed
+	SPFAlignment    string        // aspf, defaults to relaxed
+	AggregateURIs   []ReportURI   // rua
+	FailureURIs     []ReportURI   // ruf
+	FailureOptions  []string      // fo, defaults to 0
+	ReportInterval  time.Duration // ri, defaults to one day
+	ReportFormat    string        // rf, defaults to afrf
+}
+
+// ReportURI is a reporting address with its optional size limit in bytes.
+type ReportURI struct {
+	URI     string
+	MaxSize int64
+}
+
+// ParseDMARC parses a DMARC TXT record. Unknown tags are ignored as the
+// RFC requires; everything else must be well formed.
+func ParseDMARC(txt string) (*DMARCRecord, error) {
+	rec := &DMARCRecord{
+		Percent:        100,
+		DKIMAlignment:  AlignRelaxed,
+		SPFAlignment:   AlignRelaxed,
+		FailureOptions: []string{"0"},
+		ReportInterval: 24 * time.Hour,
+		ReportFormat:   "afrf",
+	}
+
+	seen := make(map[string]bool)
+	for i, part := range strings.Split(txt, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			if i == 0 {
+				return nil, errors.New("record does not start with v=DMARC1")
+			}
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		name, value = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("malformed tag %q", part)
+		}
+		if i == 0 {
+			if name != "v" || !strings.EqualFold(value, "DMARC1") {
+				return nil, errors.New("record does not start with v=DMARC1")
+			}
+			continue
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate %s= tag", name)
+		}
+		seen[name] = true
+
+		var err error
+		switch name {
+		case "v":
+			err = errors.New("v= must be the first tag")
+		case "p":
+			rec.Policy, err = parsePolicy(value)
+		case "sp":
+			rec.SubdomainPolicy, err = parsePolicy(value)
+		case "pct":
+			rec.Percent, err = strconv.Atoi(value)
+			if err != nil || rec.Percent < 0 || rec.Percent > 100 {
+				err = fmt.Errorf("must be a number from 0 to 100, got %q", value)
+			}
+		case "adkim":
+			rec.DKIMAlignment, err = parseAlignment(value)
+		case "aspf":
+			rec.SPFAlignment, err = parseAlignment(value)
+		case "rua":
+			rec.AggregateURIs, err = parseReportURIs(value)
+		case "ruf":
+			rec.FailureURIs, err = parseReportURIs(value)
+		case "fo":
+			rec.FailureOptions, err = parseFailureOptions(value)
+		case "ri":
+			var secs uint64
+			secs, err = strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				err = fmt.Errorf("must be a number of seconds, got %q", value)
+			}
+			rec.ReportInterval = time.Duration(secs) * time.Second
+		case "rf":
+			for _, f := range strings.Split(value, ":") {
+				if !strings.EqualFold(strings.TrimSpace(f), "afrf") {
+					err = fmt.Errorf("unsupported report format %q", f)
+				}
+			}
+			rec.ReportFormat = strings.ToLower(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s= tag: %w", name, err)
+		}
+	}
+
+	if rec.Policy == "" {
+		return nil, errors.New("missing required p= tag")
+	}
+	if rec.SubdomainPolicy == "" {
+		rec.SubdomainPolicy = rec.Policy
+	}
+	return rec, nil
+}
+
+func parsePolicy(value string) (string, error) {
+	switch p := strings.ToLower(value); p {
+	case DMARCNone, DMARCQuarantine, DMARCReject:
+		return p, nil
+	}
+	return "", fmt.Errorf("policy must be none, quarantine or reject, got %q", value)
+}
+
+func parseAlignment(value string) (string, error) {
+	switch a := strings.ToLower(value); a {
+	case AlignRelaxed, AlignStrict:
+		return a, nil
+	}
+	return "", fmt.Errorf("alignment must be r or s, got %q", value)
+}
+
+// parseReportURIs parses a comma separated list of URIs, each optionally
+// followed by !<size> with a k, m, g or t unit.
+func parseReportURIs(value string) ([]ReportURI, error) {
+	var uris []ReportURI
+	for _, raw := range strings.Split(value, ",") {
+		raw = strings.TrimSpace(raw)
+		uri, size, hasSize := strings.Cut(raw, "!")
+		u, err := url.Parse(uri)
+		if err != nil || u.Scheme == "" || u.Opaque == "" && u.Host == "" {
+			return nil, fmt.Errorf("invalid report URI %q", raw)
+		}
+		r := ReportURI{URI: uri}
+		if hasSize {
+			mult := int64(1)
+			if n := len(size); n > 0 {
+				switch unit := strings.ToLower(size[n-1:]); unit {
+				case "k", "m", "g", "t":
+					mult = 1 << (10 * (strings.Index("kmgt", unit) + 1))
+					size = size[:n-1]
+				}
+			}
+			n, err := strconv.ParseInt(size, 10, 64)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid size limit in report URI %q", raw)
+			}
+			r.MaxSize = n * mult
+		}
+		uris = append(uris, r)
+	}
+	return uris, nil
+}
+
+func parseFailureOptions(value string) ([]string, error) {
+	var opts []string
+	for _, o := range strings.Split(value, ":") {
+		o = strings.ToLower(strings.TrimSpace(o))
+		switch o {
+		case "0", "1", "d", "s":
+			opts = append(opts, o)
+		default:
+			return nil, fmt.Errorf("failure option must be 0, 1, d or s, got %q", o)
+		}
+	}
+	return opts, nil
+}
+
+// AppliedPolicy returns the policy for mail from domain when the record
+// was published at recordDomain: sp= applies to subdomains that fell back
+// to their organizational domain's record.
+func (r *DMARCRecord) AppliedPolicy(domain, recordDomain string) string {
+	if !strings.EqualFold(normalize(domain), normalize(recordDomain)) {
+		return r.SubdomainPolicy
+	}
+	return r.Policy
+}
+
+// SPFAligned reports whether an SPF-authenticated domain aligns with the
+// From domain under the record's aspf= mode.
+func (r *DMARCRecord) SPFAligned(spfDomain, from string) bool {
+	return Aligned(spfDomain, from, r.SPFAlignment == AlignStrict)
+}
+
+// DKIMAligned reports whether a DKIM signing domain (d=) aligns with the
+// From domain under the record's adkim= mode.
+func (r *DMARCRecord) DKIMAligned(signingDomain, from string) bool {
+	return Aligned(signingDomain, from, r.DKIMAlignment == AlignStrict)
+}
+
+// Describe explains in plain words what the record asks receivers to do.
+func (r *DMARCRecord) Describe() string {
+	action := map[string]string{
+		DMARCNone:       "are delivered normally (monitoring only)",
+		DMARCQuarantine: "are sent to spam",
+		DMARCReject:     "are rejected",
+	}
+	alignment := map[string]string{AlignRelaxed: "relaxed", AlignStrict: "strict"}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Messages failing DMARC %s.", action[r.Policy])
+	if r.Percent < 100 && r.Policy != DMARCNone {
+		fmt.Fprintf(&b, " This applies to %d%% of them; the rest get the next weaker policy.", r.Percent)
+	}
+	if r.SubdomainPolicy != r.Policy {
+		fmt.Fprintf(&b, " For subdomains they %s.", action[r.SubdomainPolicy])
+	}
+	fmt.Fprintf(&b, " DKIM alignment is %s and SPF alignment is %s.", alignment[r.DKIMAlignment], alignment[r.SPFAlignment])
+	if len(r.AggregateURIs) == 0 {
+		b.WriteString(" No aggregate reports are requested.")
+	} else {
+		fmt.Fprintf(&b, " Aggregate reports go to %s.", joinURIs(r.AggregateURIs))
+	}
+	if len(r.FailureURIs) > 0 {
+		fmt.Fprintf(&b, " Failure reports go to %s.", joinURIs(r.FailureURIs))
+	}
+	return b.String()
+}
+
+func joinURIs(uris []ReportURI) string {
+	s := make([]string, len(uris))
+	for i, u := range uris {
+		s[i] = u.URI
+	}
+	return strings.Join(s, ", ")
+}
+
+// LookupDMARC finds the DMARC record that applies to domain: its own, or
+// else the one of its organizational domain. It returns the record and the
+// domain it was published at, or ErrNoDMARCRecord. A name publishing more
+// than one record has no usable policy (RFC 7489 section 6.6.3).
+func LookupDMARC(ctx context.Context, r Resolver, domain string) (*DMARCRecord, string, error) {
+	domain = normalize(domain)
+	candidates := []string{domain}
+	if org := OrganizationalDomain(domain); org != domain {
+		candidates = append(candidates, org)
+	}
+	for _, d := range candidates {
+		txts, err := r.LookupTXT(ctx, "_dmarc."+d)
+		if err != nil && !IsNotFound(err) {
+			return nil, "", fmt.Errorf("failed to lookup DMARC record for %s: %w", d, err)
+		}
+		var records []string
+		for _, txt := range txts {
+			if v, _, _ := strings.Cut(txt, ";"); strings.EqualFold(strings.ReplaceAll(v, " ", ""), "v=DMARC1") {
+				records = append(records, txt)
+			}
+		}
+		switch len(records) {
+		case 0:
+			continue
+		case 1:
+		default:
+			return nil, "", fmt.Errorf("%w: %s publishes %d DMARC records", ErrNoDMARCRecord, d, len(records))
+		}
+		rec, err := ParseDMARC(records[0])
+		if err != nil {
+			return nil, d, fmt.Errorf("invalid DMARC record for %s: %w", d, err)
+		}
+		return rec, d, nil
+	}
+	return nil, "", ErrNoDMARCRecord
+}
+
+// OrganizationalDomain returns the registered domain that domain belongs
+// to, one label below its public suffix, using the public suffix list
+// compiled into golang.org/x/net/publicsuffix.
+func OrganizationalDomain(domain string) string {
+	domain = normalize(domain)
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return org
+}
+
+// Aligned reports whether an authenticated identifier domain aligns with
+// the From domain: equal in strict mode, or sharing the organizational
+// domain in relaxed mode.
+func Aligned(identifier, from string, strict bool) bool {
+	identifier, from = normalize(identifier), normalize(from)
+	if identifier == from {
+		return true
+	}
+	return !strict && identifier != "" && OrganizationalDomain(identifier) == OrganizationalDomain(from)
+}
+
+func normalize(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
@@ -0,0 +1,149 @@
+package domainVerifier
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseDMARC(t *testing.T) {
+	tests := []struct {
+		name    string
+		record  string
+		wantErr bool
+		check   func(*DMARCRecord) bool
+	}{
+		{
+			name:   "defaults",
+			record: "v=DMARC1; p=reject",
+			check: func(r *DMARCRecord) bool {
+				return r.Policy == DMARCReject && r.SubdomainPolicy == DMARCReject && r.Percent == 100 &&
+					r.DKIMAlignment == AlignRelaxed && r.SPFAlignment == AlignRelaxed &&
+					len(r.FailureOptions) == 1 && r.FailureOptions[0] == "0" &&
+					r.ReportInterval == 24*time.Hour && r.ReportFormat == "afrf"
+			},
+		},
+		{
+			name:   "all tags",
+			record: "v=DMARC1;p=Quarantine;sp=none;pct=50;adkim=s;aspf=s;fo=1:d;ri=3600;rf=afrf;ruf=mailto:f@alice.test",
+			check: func(r *DMARCRecord) bool {
+				return r.Policy == DMARCQuarantine && r.SubdomainPolicy == DMARCNone && r.Percent == 50 &&
+					r.DKIMAlignment == AlignStrict && r.SPFAlignment == AlignStrict &&
+					len(r.FailureOptions) == 2 && r.FailureOptions[1] == "d" &&
+					r.ReportInterval == time.Hour && len(r.FailureURIs) == 1
+			},
+		},
+		{
+			name:   "rua size suffixes",
+			record: "v=DMARC1; p=none; rua=mailto:a@alice.test!10m, mailto:b@alice.test!512, mailto:c@alice.test!2K, https://reports.test/dmarc",
+			check: func(r *DMARCRecord) bool {
+				want := []int64{10 << 20, 512, 2 << 10, 0}
+				if len(r.AggregateURIs) != len(want) || r.AggregateURIs[0].URI != "mailto:a@alice.test" {
+					return false
+				}
+				for i, size := range want {
+					if r.AggregateURIs[i].MaxSize != size {
+						return false
+					}
+				}
+				return true
+			},
+		},
+		{
+			name:   "unknown tags are ignored",
+			record: "v=DMARC1; p=none; future=yes;",
+			check:  func(r *DMARCRecord) bool { return r.Policy == DMARCNone },
+		},
+		{name: "missing p", record: "v=DMARC1; sp=reject", wantErr: true},
+		{name: "v not first", record: "p=reject; v=DMARC1", wantErr: true},
+		{name: "v repeated", record: "v=DMARC1; p=reject; v=DMARC1", wantErr: true},
+		{name: "empty first tag", record: "; v=DMARC1; p=reject", wantErr: true},
+		{name: "wrong version", record: "v=DMARC2; p=reject", wantErr: true},
+		{name: "duplicate tag", record: "v=DMARC1; p=reject; p=none", wantErr: true},
+		{name: "unknown policy", record: "v=DMARC1; p=block", wantErr: true},
+		{name: "pct above 100", record: "v=DMARC1; p=reject; pct=101", wantErr: true},
+		{name: "pct not a number", record: "v=DMARC1; p=reject; pct=half", wantErr: true},
+		{name: "negative ri", record: "v=DMARC1; p=reject; ri=-1", wantErr: true},
+		{name: "bad fo", record: "v=DMARC1; p=reject; fo=2", wantErr: true},
+		{name: "bad alignment", record: "v=DMARC1; p=reject; adkim=x", wantErr: true},
+		{name: "bad rua size", record: "v=DMARC1; p=reject; rua=mailto:a@alice.test!0k", wantErr: true},
+		{name: "rua without scheme", record: "v=DMARC1; p=reject; rua=a@alice.test", wantErr: true},
+		{name: "malformed tag", record: "v=DMARC1; p=reject; pct", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, err := ParseDMARC(tt.record)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseDMARC(%q) = %+v, want an error", tt.record, rec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseDMARC(%q): %v", tt.record, err)
+			}
+			if !tt.check(rec) {
+				t.Errorf("ParseDMARC(%q) = %+v", tt.record, rec)
+			}
+		})
+	}
+}
+
+func TestLookupDMARC(t *testing.T) {
+	r := &StaticResolver{
+		TXT: map[string][]string{
+			"_dmarc.alice.test":     {"v=DMARC1; p=reject; sp=quarantine"},
+			"_dmarc.own.alice.test": {"v=DMARC1; p=none"},
+			"_dmarc.bob.co.uk":      {"some other record", "v=DMARC1; p=quarantine"},
+			"_dmarc.twice.test":     {"v=DMARC1; p=reject", "v = DMARC1; p=none"},
+			"_dmarc.broken.test":    {"v=DMARC1; pct=10"},
+		},
+		Errors: map[string]error{
+			"_dmarc.down.test": &net.DNSError{Err: "server misbehaving", Name: "_dmarc.down.test", IsTemporary: true},
+		},
+	}
+
+	tests := []struct {
+		domain   string
+		recordAt string
+		applied  string
+		wantErr  error
+		anyErr   bool
+	}{
+		{domain: "alice.test", recordAt: "alice.test", applied: DMARCReject},
+		{domain: "Mail.Alice.Test.", recordAt: "alice.test", applied: DMARCQuarantine},
+		{domain: "own.alice.test", recordAt: "own.alice.test", applied: DMARCNone},
+		{domain: "news.bob.co.uk", recordAt: "bob.co.uk", applied: DMARCQuarantine},
+		{domain: "twice.test", wantErr: ErrNoDMARCRecord},
+		{domain: "nobody.test", wantErr: ErrNoDMARCRecord},
+		{domain: "broken.test", anyErr: true},
+		{domain: "down.test", anyErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			rec, at, err := LookupDMARC(context.Background(), r, tt.domain)
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("LookupDMARC = %v, want %v", err, tt.wantErr)
+				}
+				return
+			case tt.anyErr:
+				if err == nil || errors.Is(err, ErrNoDMARCRecord) {
+					t.Errorf("LookupDMARC = %v, want a lookup or parse error", err)
+				}
+				return
+			case err != nil:
+				t.Fatal(err)
+			}
+			if at != tt.recordAt {
+				t.Errorf("record found at %q, want %q", at, tt.recordAt)
+			}
+			if got := rec.AppliedPolicy(tt.domain, at); got != tt.applied {
+				t.Errorf("applied policy = %q, want %q", got, tt.applied)
+			}
+		})
+	}
+}
@@ -1,73 +1,132 @@
 package domainVerifier
 
 import (
+	"context"
+	"crypto"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
+	"time"
 )
 
+// VerifyMXRecord checks that domain accepts mail: it has MX records other
+// than a null MX (RFC 7505).
 func VerifyMXRecord(domain string) error {
-	mxRecords, err := net.LookupMX(domain)
-	if err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	mxRecords, err := DefaultResolver.LookupMX(ctx, domain)
+	if err != nil && !IsNotFound(err) {
 		return fmt.Errorf("failed to lookup MX record for %s: %v", domain, err)
 	}
 	if len(mxRecords) == 0 {
 		return fmt.Errorf("no MX records found for %s", domain)
 	}
+	if len(mxRecords) == 1 && (mxRecords[0].Host == "." || mxRecords[0].Host == "") {
+		return fmt.Errorf("%s publishes a null MX and accepts no mail", domain)
+	}
 	return nil
 }
 
-func VerifySPFRecord(domain string) error {
-	txtRecords, err := net.LookupTXT(domain)
-	if err != nil {
-		return fmt.Errorf("failed to lookup SPF record for %s: %v", domain, err)
+// ErrNoMailDomain is returned by CheckMailDomain for domains that cannot
+// receive mail.
+var ErrNoMailDomain = errors.New("domain does not accept mail")
+
+// CheckMailDomain checks that domain could receive mail, looked up the way an
+// MTA would: MX records other than a null MX, or else an address record used
+// as the implicit MX (RFC 5321 5.1). It returns ErrNoMailDomain when the
+// domain cannot receive mail and the lookup error when DNS failed.
+func CheckMailDomain(domain string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	return checkMailDomain(ctx, DefaultResolver, domain)
+}
+
+func checkMailDomain(ctx context.Context, r Resolver, domain string) error {
+	mxRecords, err := r.LookupMX(ctx, domain)
+	if err != nil && !IsNotFound(err) {
+		return fmt.Errorf("failed to lookup MX record for %s: %w", domain, err)
 	}
-	for _, record := range txtRecords {
-		if strings.HasPrefix(strings.ToLower(record), "v=spf1") {
-			return nil
-		}
+	if len(mxRecords) == 1 && (mxRecords[0].Host == "." || mxRecords[0].Host == "") {
+		return fmt.Errorf("%w: %s publishes a null MX", ErrNoMailDomain, domain)
+	}
+	if len(mxRecords) > 0 {
+		return nil
+	}
+
+	addrs, err := r.LookupIPAddr(ctx, domain)
+	if err != nil && !IsNotFound(err) {
+		return fmt.Errorf("failed to lookup address of %s: %w", domain, err)
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("%w: no MX or address records for %s", ErrNoMailDomain, domain)
 	}
-	return fmt.Errorf("valid SPF record not found for %s", domain)
+	return nil
 }
 
-func VerifyDKIMRecord(domain, selector string) error {
-	dkimDomain := fmt.Sprintf("%s._domainkey.%s", selector, domain)
-	txtRecords, err := net.LookupTXT(dkimDomain)
-	if err != nil {
-		return fmt.Errorf("failed to lookup DKIM record for %s: %v", dkimDomain, err)
+// VerifySPFRecord checks that domain publishes exactly one SPF record
+// without syntax errors and, for each of sendingIPs, that mail from it
+// would pass.
+func VerifySPFRecord(domain string, sendingIPs ...net.IP) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	c := &spfCheck{ctx: ctx, r: DefaultResolver}
+	if _, res := c.record(strings.ToLower(domain)); res.Err != nil {
+		return res.Err
 	}
-	for _, record := range txtRecords {
-		if strings.HasPrefix(record, "v=DKIM1") {
-			return nil
+	for _, ip := range sendingIPs {
+		res := CheckSPF(ctx, DefaultResolver, ip, domain, "postmaster@"+domain, domain)
+		if res.Result != SPFPass {
+			return fmt.Errorf("mail from %s would get SPF %s: %v", ip, res.Result, res.Err)
 		}
 	}
-	return fmt.Errorf("valid DKIM record not found for %s", dkimDomain)
+	return nil
 }
 
-func VerifyDMARCRecord(domain string) error {
-	dmarcDomain := "_dmarc." + domain
-	txtRecords, err := net.LookupTXT(dmarcDomain)
+// VerifyDKIMRecord checks the key record of selector on domain: that it
+// parses, is strong enough and, when key is not nil, publishes its public
+// half.
+func VerifyDKIMRecord(domain, selector string, key crypto.Signer) (*DKIMKeyRecord, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	rec, err := LookupDKIMKey(ctx, DefaultResolver, strings.ToLower(domain), selector)
 	if err != nil {
-		return fmt.Errorf("failed to lookup DMARC record for %s: %v", dmarcDomain, err)
-	}
-	for _, record := range txtRecords {
-		if strings.HasPrefix(record, "v=DMARC1") {
-			// Check for required tags
-			if strings.Contains(record, "p=") {
-				return nil
-			}
-		}
+		return nil, err
 	}
-	return fmt.Errorf("valid DMARC record not found for %s", dmarcDomain)
+	if err := rec.Check(); err != nil {
+		return rec, err
+	}
+	if key != nil && !rec.Matches(key) {
+		return rec, fmt.Errorf("published key for selector %s does not match the private key held for it", selector)
+	}
+	return rec, nil
+}
+
+// VerifyDMARCRecord returns the DMARC record that applies to domain and
+// the domain it was published at, which is the organizational domain when
+// domain has no record of its own.
+func VerifyDMARCRecord(domain string) (*DMARCRecord, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	return LookupDMARC(ctx, DefaultResolver, domain)
 }
 
-func VerifyDomain(domain string) (map[string]string, error) {
+// VerifyDomain checks the MX, SPF and DMARC records of domain, and the
+// DKIM key record of each of dkimSelectors.
+func VerifyDomain(domain string, dkimSelectors ...string) (map[string]string, error) {
 	results := make(map[string]string)
 	verifiers := map[string]func(string) error{
 		"MX":    VerifyMXRecord,
-		"SPF":   VerifySPFRecord,
-		"DKIM":  func(d string) error { return VerifyDKIMRecord(d, "default") },
-		"DMARC": VerifyDMARCRecord,
+		"SPF":   func(d string) error { return VerifySPFRecord(d) },
+		"DMARC": func(d string) error { _, _, err := VerifyDMARCRecord(d); return err },
+	}
+	for _, selector := range dkimSelectors {
+		verifiers["DKIM:"+selector] = func(d string) error { _, err := VerifyDKIMRecord(d, selector, nil); return err }
 	}
 
 	for name, verifier := range verifiers {
@@ -0,0 +1,49 @@
+package domainVerifier
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestCheckMailDomain(t *testing.T) {
+	r := &StaticResolver{
+		MX: map[string][]*net.MX{
+			"mx.example":   {{Host: "mail.mx.example.", Pref: 10}},
+			"null.example": {{Host: ".", Pref: 0}},
+		},
+		IP: map[string][]net.IP{
+			"a-only.example": {net.ParseIP("192.0.2.1")},
+		},
+		Errors: map[string]error{
+			"broken.example": &net.DNSError{Err: "server misbehaving", IsTemporary: true},
+		},
+	}
+	tests := []struct {
+		domain string
+		noMail bool
+		failed bool
+	}{
+		{domain: "mx.example"},
+		{domain: "a-only.example"},
+		{domain: "null.example", noMail: true},
+		{domain: "missing.example", noMail: true},
+		{domain: "broken.example", failed: true},
+	}
+	for _, tt := range tests {
+		err := checkMailDomain(context.Background(), r, tt.domain)
+		switch {
+		case tt.noMail:
+			if !errors.Is(err, ErrNoMailDomain) {
+				t.Errorf("%s: err = %v, want ErrNoMailDomain", tt.domain, err)
+			}
+		case tt.failed:
+			if err == nil || errors.Is(err, ErrNoMailDomain) || !IsTemporary(err) {
+				t.Errorf("%s: err = %v, want a temporary lookup error", tt.domain, err)
+			}
+		case err != nil:
+			t.Errorf("%s: err = %v, want nil", tt.domain, err)
+		}
+	}
+}
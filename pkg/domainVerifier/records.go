@@ -0,0 +1,49 @@
+package domainVerifier
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// VerifyTXT checks that name publishes a TXT record equal to value.
+func VerifyTXT(ctx context.Context, r Resolver, name, value string) error {
+	txts, err := r.LookupTXT(ctx, name)
+	if err != nil && !IsNotFound(err) {
+		return fmt.Errorf("failed to lookup TXT record for %s: %w", name, err)
+	}
+	for _, txt := range txts {
+		if strings.TrimSpace(txt) == value {
+			return nil
+		}
+	}
+	return fmt.Errorf("TXT record %q not found at %s", value, name)
+}
+
+// VerifySPFInclude checks that the SPF record of domain is valid and has
+// an include: mechanism for include.
+func VerifySPFInclude(ctx context.Context, r Resolver, domain, include string) error {
+	c := &spfCheck{ctx: ctx, r: r}
+	rec, res := c.record(normalize(domain))
+	if res.Err != nil {
+		return res.Err
+	}
+	for _, t := range rec.Terms {
+		if t.Mechanism == "include" && strings.EqualFold(normalize(t.Domain), normalize(include)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("SPF record of %s does not include %s", domain, include)
+}
+
+// VerifyCNAME checks that name is an alias of target.
+func VerifyCNAME(ctx context.Context, r Resolver, name, target string) error {
+	cname, err := r.LookupCNAME(ctx, name)
+	if err != nil && !IsNotFound(err) {
+		return fmt.Errorf("failed to lookup CNAME record for %s: %w", name, err)
+	}
+	if err != nil || normalize(cname) != normalize(target) {
+		return fmt.Errorf("%s is not a CNAME for %s", name, target)
+	}
+	return nil
+}
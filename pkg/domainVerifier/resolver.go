@@ -0,0 +1,37 @@
+package domainVerifier
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// Resolver is the subset of *net.Resolver used by the DNS checks. Passing
+// a different one controls the upstream servers or keeps checks offline.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupCNAME(ctx context.Context, host string) (string, error)
+}
+
+// DefaultResolver is used by the Verify functions. It caches the answers of
+// the system's resolver; servers may replace it with a Cache around a
+// Client for the configured upstream.
+var DefaultResolver Resolver = NewCache(net.DefaultResolver, 5*time.Minute, time.Minute)
+
+// IsNotFound reports whether err means the name or the record type does
+// not exist, as opposed to a failed lookup.
+func IsNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// IsTemporary reports whether err is a DNS failure that may go away on a
+// later attempt, such as a timeout or SERVFAIL.
+func IsTemporary(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && !dnsErr.IsNotFound
+}
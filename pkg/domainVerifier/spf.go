@@ -0,0 +1,775 @@
+package domainVerifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SPF results as defined in RFC 7208 section 2.6.
+const (
+	SPFNone      = "none"
+	SPFNeutral   = "neutral"
+	SPFPass      = "pass"
+	SPFFail      = "fail"
+	SPFSoftFail  = "softfail"
+	SPFTempError = "temperror"
+	SPFPermError = "permerror"
+)
+
+// Processing limits from RFC 7208 section 4.6.4.
+const (
+	spfLookupLimit = 10 // terms that cause DNS queries
+	spfVoidLimit   = 2  // lookups that return no records
+	spfNameLimit   = 10 // MX hosts or PTR names looked at per term
+)
+
+// SPFResult is the outcome of an SPF check.
+type SPFResult struct {
+	Result string
+	// Explanation is the expanded exp= text the domain publishes for fail
+	// results, if any.
+	Explanation string
+	// Err says why the result is not pass.
+	Err error
+}
+
+// SPFRecord is a parsed SPF record.
+type SPFRecord struct {
+	Terms    []SPFTerm
+	Redirect string
+	Exp      string
+}
+
+// SPFTerm is one mechanism of an SPF record. Domain holds the unexpanded
+// domain-spec, or the address for ip4 and ip6.
+type SPFTerm struct {
+	Qualifier string
+	Mechanism string
+	Domain    string
+	V4Prefix  int
+	V6Prefix  int
+}
+
+// CheckSPF runs check_host() from RFC 7208 for a message sent from ip with
+// the given HELO name and envelope sender. domain is the domain whose
+// policy is checked: the sender's domain, or the HELO name for bounces.
+func CheckSPF(ctx context.Context, r Resolver, ip net.IP, domain, sender, helo string) SPFResult {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	if sender == "" {
+		sender = "postmaster@" + helo
+	} else if !strings.Contains(sender, "@") {
+		sender = "postmaster@" + sender
+	} else if strings.HasPrefix(sender, "@") {
+		sender = "postmaster" + sender
+	}
+	c := &spfCheck{ctx: ctx, r: r, ip: ip, sender: sender, helo: helo}
+	return c.check(strings.TrimSuffix(strings.ToLower(domain), "."), 0)
+}
+
+// ParseSPF parses an SPF record. Any syntax error is returned, since it
+// makes the whole record a permerror.
+func ParseSPF(record string) (*SPFRecord, error) {
+	fields := strings.Fields(record)
+	if len(fields) == 0 || !strings.EqualFold(fields[0], "v=spf1") {
+		return nil, errors.New("record does not start with v=spf1")
+	}
+
+	rec := &SPFRecord{}
+	seen := make(map[string]bool)
+	for _, term := range fields[1:] {
+		if name, value, ok := strings.Cut(term, "="); ok && validModifierName(name) {
+			name = strings.ToLower(name)
+			if err := checkMacros(value, false); err != nil {
+				return nil, fmt.Errorf("invalid %s modifier: %w", name, err)
+			}
+			if (name == "redirect" || name == "exp") && seen[name] {
+				return nil, fmt.Errorf("%s modifier appears more than once", name)
+			}
+			seen[name] = true
+			switch name {
+			case "redirect":
+				rec.Redirect = value
+			case "exp":
+				rec.Exp = value
+			}
+			continue
+		}
+
+		t, err := parseSPFTerm(term)
+		if err != nil {
+			return nil, err
+		}
+		rec.Terms = append(rec.Terms, t)
+	}
+	return rec, nil
+}
+
+func parseSPFTerm(term string) (SPFTerm, error) {
+	t := SPFTerm{Qualifier: SPFPass, V4Prefix: 32, V6Prefix: 128}
+	switch term[0] {
+	case '+':
+		term = term[1:]
+	case '-':
+		t.Qualifier, term = SPFFail, term[1:]
+	case '~':
+		t.Qualifier, term = SPFSoftFail, term[1:]
+	case '?':
+		t.Qualifier, term = SPFNeutral, term[1:]
+	}
+
+	name := term
+	rest := ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, rest = term[:i], term[i:]
+	}
+	t.Mechanism = strings.ToLower(name)
+	invalid := fmt.Errorf("invalid SPF mechanism %q", term)
+
+	switch t.Mechanism {
+	case "all":
+		if rest != "" {
+			return t, invalid
+		}
+	case "ip4", "ip6":
+		addr, ok := strings.CutPrefix(rest, ":")
+		if !ok {
+			return t, invalid
+		}
+		addr, prefix, hasPrefix := strings.Cut(addr, "/")
+		ip := net.ParseIP(addr)
+		if ip == nil || (t.Mechanism == "ip4") != (ip.To4() != nil && !strings.Contains(addr, ":")) {
+			return t, invalid
+		}
+		t.Domain = addr
+		if hasPrefix {
+			bits, err := strconv.Atoi(prefix)
+			if err != nil || bits < 0 || (t.Mechanism == "ip4" && bits > 32) || bits > 128 || strings.HasPrefix(prefix, "0") && prefix != "0" {
+				return t, invalid
+			}
+			t.V4Prefix, t.V6Prefix = bits, bits
+		}
+	case "a", "mx", "ptr", "include", "exists":
+		spec := rest
+		if strings.HasPrefix(spec, ":") {
+			spec = spec[1:]
+			if i := strings.Index(spec, "/"); i >= 0 && t.Mechanism != "include" && t.Mechanism != "exists" {
+				spec, rest = spec[:i], spec[i:]
+			} else {
+				rest = ""
+			}
+			if spec == "" {
+				return t, invalid
+			}
+			if err := checkMacros(spec, false); err != nil {
+				return t, fmt.Errorf("%w: %v", invalid, err)
+			}
+			t.Domain = spec
+		}
+		if (t.Mechanism == "include" || t.Mechanism == "exists") && t.Domain == "" {
+			return t, invalid
+		}
+		if rest != "" {
+			if t.Mechanism != "a" && t.Mechanism != "mx" {
+				return t, invalid
+			}
+			v4, v6, err := parseDualCIDR(rest)
+			if err != nil {
+				return t, fmt.Errorf("%w: %v", invalid, err)
+			}
+			t.V4Prefix, t.V6Prefix = v4, v6
+		}
+	default:
+		return t, fmt.Errorf("unknown SPF mechanism %q", term)
+	}
+	return t, nil
+}
+
+// parseDualCIDR parses "/v4", "//v6" or "/v4//v6".
+func parseDualCIDR(s string) (int, int, error) {
+	v4, v6 := 32, 128
+	v4s, v6s, hasV6 := strings.Cut(s, "//")
+	if hasV6 {
+		bits, err := strconv.Atoi(v6s)
+		if err != nil || bits < 0 || bits > 128 {
+			return 0, 0, fmt.Errorf("invalid IPv6 prefix length %q", v6s)
+		}
+		v6 = bits
+	}
+	if v4s != "" {
+		bits, err := strconv.Atoi(strings.TrimPrefix(v4s, "/"))
+		if !strings.HasPrefix(v4s, "/") || err != nil || bits < 0 || bits > 32 {
+			return 0, 0, fmt.Errorf("invalid IPv4 prefix length %q", v4s)
+		}
+		v4 = bits
+	}
+	return v4, v6, nil
+}
+
+func validModifierName(name string) bool {
+	if name == "" || !isAlpha(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		c := name[i]
+		if !isAlpha(c) && !(c >= '0' && c <= '9') && c != '-' && c != '_' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlpha(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+type spfCheck struct {
+	ctx     context.Context
+	r       Resolver
+	ip      net.IP
+	sender  string
+	helo    string
+	lookups int
+	voids   int
+
+	// ptrNames caches validatedNames once ptrDone is set.
+	ptrNames []string
+	ptrDone  bool
+}
+
+func (c *spfCheck) check(domain string, depth int) SPFResult {
+	if !validDomain(domain) {
+		return SPFResult{Result: SPFNone, Err: fmt.Errorf("%q is not a valid domain", domain)}
+	}
+	record, res := c.record(domain)
+	if record == nil {
+		return res
+	}
+
+	hasAll := false
+	for _, t := range record.Terms {
+		if t.Mechanism == "all" {
+			hasAll = true
+		}
+	}
+	for _, t := range record.Terms {
+		match, res := c.mechanism(domain, t, depth)
+		if res.Result != "" {
+			return res
+		}
+		if !match {
+			continue
+		}
+		if t.Qualifier == SPFPass {
+			return SPFResult{Result: SPFPass}
+		}
+		res = SPFResult{
+			Result: t.Qualifier,
+			Err:    fmt.Errorf("%s matched %s in the SPF record of %s", c.ip, termString(t), domain),
+		}
+		if t.Qualifier == SPFFail && record.Exp != "" {
+			res.Explanation = c.explain(domain, record.Exp)
+		}
+		return res
+	}
+
+	// redirect is ignored when the record has an all mechanism.
+	if record.Redirect != "" && !hasAll {
+		if err := c.count(); err != nil {
+			return SPFResult{Result: SPFPermError, Err: err}
+		}
+		target, err := c.expand(record.Redirect, domain, false)
+		if err != nil {
+			return SPFResult{Result: SPFPermError, Err: err}
+		}
+		if depth >= spfLookupLimit {
+			return SPFResult{Result: SPFPermError, Err: errors.New("SPF redirects nest too deeply")}
+		}
+		res := c.check(target, depth+1)
+		if res.Result == SPFNone {
+			return SPFResult{Result: SPFPermError, Err: fmt.Errorf("redirect target %s has no SPF record", target)}
+		}
+		return res
+	}
+	return SPFResult{Result: SPFNeutral, Err: fmt.Errorf("no mechanism matched in the SPF record of %s", domain)}
+}
+
+// record returns the parsed SPF record of domain. When there is none, or
+// it cannot be used, it returns the result to report instead.
+func (c *spfCheck) record(domain string) (*SPFRecord, SPFResult) {
+	txts, err := c.r.LookupTXT(c.ctx, domain)
+	if err != nil && !IsNotFound(err) {
+		return nil, SPFResult{Result: SPFTempError, Err: fmt.Errorf("failed to lookup SPF record for %s: %w", domain, err)}
+	}
+	var records []string
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || strings.HasPrefix(strings.ToLower(txt), "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+	switch len(records) {
+	case 0:
+		return nil, SPFResult{Result: SPFNone, Err: fmt.Errorf("no SPF record found for %s", domain)}
+	case 1:
+	default:
+		return nil, SPFResult{Result: SPFPermError, Err: fmt.Errorf("multiple SPF records found for %s", domain)}
+	}
+	rec, err := ParseSPF(records[0])
+	if err != nil {
+		return nil, SPFResult{Result: SPFPermError, Err: fmt.Errorf("invalid SPF record for %s: %w", domain, err)}
+	}
+	return rec, SPFResult{}
+}
+
+func (c *spfCheck) count() error {
+	c.lookups++
+	if c.lookups > spfLookupLimit {
+		return fmt.Errorf("SPF evaluation exceeded %d DNS lookups", spfLookupLimit)
+	}
+	return nil
+}
+
+// void records a lookup that returned no records.
+func (c *spfCheck) void() error {
+	c.voids++
+	if c.voids > spfVoidLimit {
+		return fmt.Errorf("SPF evaluation exceeded %d void DNS lookups", spfVoidLimit)
+	}
+	return nil
+}
+
+// mechanism reports whether t matches the client IP. A result with a
+// non-empty Result ends the evaluation.
+func (c *spfCheck) mechanism(domain string, t SPFTerm, depth int) (bool, SPFResult) {
+	permerror := func(err error) (bool, SPFResult) {
+		return false, SPFResult{Result: SPFPermError, Err: err}
+	}
+	temperror := func(err error) (bool, SPFResult) {
+		return false, SPFResult{Result: SPFTempError, Err: err}
+	}
+
+	switch t.Mechanism {
+	case "all":
+		return true, SPFResult{}
+	case "ip4", "ip6":
+		ip := net.ParseIP(t.Domain)
+		return c.inNetwork(ip, t.V4Prefix, t.V6Prefix), SPFResult{}
+	}
+
+	if err := c.count(); err != nil {
+		return permerror(err)
+	}
+	target := domain
+	if t.Domain != "" {
+		var err error
+		if target, err = c.expand(t.Domain, domain, false); err != nil {
+			return permerror(err)
+		}
+	}
+
+	switch t.Mechanism {
+	case "a":
+		ips, found, err := c.lookupAddresses(target, c.ip.To4() != nil)
+		if err != nil {
+			return temperror(err)
+		}
+		// Addresses of the other family only are an answer, not a void
+		// lookup.
+		if !found {
+			if err := c.void(); err != nil {
+				return permerror(err)
+			}
+		}
+		for _, ip := range ips {
+			if c.inNetwork(ip, t.V4Prefix, t.V6Prefix) {
+				return true, SPFResult{}
+			}
+		}
+	case "mx":
+		mxs, err := c.r.LookupMX(c.ctx, target)
+		if err != nil && !IsNotFound(err) {
+			return temperror(fmt.Errorf("failed to lookup MX records for %s: %w", target, err))
+		}
+		if len(mxs) == 0 {
+			if err := c.void(); err != nil {
+				return permerror(err)
+			}
+		}
+		if len(mxs) > spfNameLimit {
+			return permerror(fmt.Errorf("%s has more than %d MX records", target, spfNameLimit))
+		}
+		for _, mx := range mxs {
+			ips, err := c.addresses(strings.TrimSuffix(mx.Host, "."), c.ip.To4() != nil)
+			if err != nil {
+				return temperror(err)
+			}
+			for _, ip := range ips {
+				if c.inNetwork(ip, t.V4Prefix, t.V6Prefix) {
+					return true, SPFResult{}
+				}
+			}
+		}
+	case "ptr":
+		names, err := c.validatedNames()
+		if err != nil {
+			return permerror(err)
+		}
+		for _, name := range names {
+			if name == target || strings.HasSuffix(name, "."+target) {
+				return true, SPFResult{}
+			}
+		}
+	case "exists":
+		ips, err := c.addresses(target, true)
+		if err != nil {
+			return temperror(err)
+		}
+		if len(ips) == 0 {
+			if err := c.void(); err != nil {
+				return permerror(err)
+			}
+		}
+		return len(ips) > 0, SPFResult{}
+	case "include":
+		if depth >= spfLookupLimit {
+			return permerror(errors.New("SPF includes nest too deeply"))
+		}
+		res := c.check(target, depth+1)
+		switch res.Result {
+		case SPFPass:
+			return true, SPFResult{}
+		case SPFFail, SPFSoftFail, SPFNeutral:
+			return false, SPFResult{}
+		case SPFNone:
+			return permerror(fmt.Errorf("included domain %s has no SPF record", target))
+		}
+		return false, SPFResult{Result: res.Result, Err: res.Err}
+	}
+	return false, SPFResult{}
+}
+
+// addresses returns the IPv4 or IPv6 addresses of host. A name that does
+// not exist yields no addresses rather than an error.
+func (c *spfCheck) addresses(host string, v4 bool) ([]net.IP, error) {
+	ips, _, err := c.lookupAddresses(host, v4)
+	return ips, err
+}
+
+// lookupAddresses is addresses that also reports whether host has any
+// address at all, of either family.
+func (c *spfCheck) lookupAddresses(host string, v4 bool) ([]net.IP, bool, error) {
+	addrs, err := c.r.LookupIPAddr(c.ctx, host)
+	if err != nil && !IsNotFound(err) {
+		return nil, false, fmt.Errorf("failed to lookup addresses of %s: %w", host, err)
+	}
+	var ips []net.IP
+	for _, a := range addrs {
+		if (a.IP.To4() != nil) == v4 {
+			ips = append(ips, a.IP)
+		}
+	}
+	return ips, len(addrs) > 0, nil
+}
+
+// validatedNames returns the PTR names of the client IP that resolve back
+// to it, RFC 7208 section 5.5. Lookup errors just yield fewer names, but
+// lookups that find nothing count against the void lookup limit. The
+// names are looked up once per check.
+func (c *spfCheck) validatedNames() ([]string, error) {
+	if c.ptrDone {
+		return c.ptrNames, nil
+	}
+	c.ptrDone = true
+
+	names, err := c.r.LookupAddr(c.ctx, c.ip.String())
+	if err != nil && !IsNotFound(err) {
+		return nil, nil
+	}
+	if len(names) == 0 {
+		return nil, c.void()
+	}
+	if len(names) > spfNameLimit {
+		names = names[:spfNameLimit]
+	}
+	for _, name := range names {
+		name = strings.TrimSuffix(strings.ToLower(name), ".")
+		ips, found, err := c.lookupAddresses(name, c.ip.To4() != nil)
+		if err != nil {
+			continue
+		}
+		if !found {
+			if err := c.void(); err != nil {
+				return nil, err
+			}
+		}
+		for _, ip := range ips {
+			if ip.Equal(c.ip) {
+				c.ptrNames = append(c.ptrNames, name)
+				break
+			}
+		}
+	}
+	return c.ptrNames, nil
+}
+
+func (c *spfCheck) inNetwork(ip net.IP, v4, v6 int) bool {
+	if ip == nil {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		if c.ip.To4() == nil {
+			return false
+		}
+		return (&net.IPNet{IP: ip4, Mask: net.CIDRMask(v4, 32)}).Contains(c.ip)
+	}
+	if c.ip.To4() != nil {
+		return false
+	}
+	return (&net.IPNet{IP: ip, Mask: net.CIDRMask(v6, 128)}).Contains(c.ip)
+}
+
+// explain fetches and expands the exp= explanation. Any failure just means
+// there is no explanation.
+func (c *spfCheck) explain(domain, spec string) string {
+	target, err := c.expand(spec, domain, false)
+	if err != nil {
+		return ""
+	}
+	txts, err := c.r.LookupTXT(c.ctx, target)
+	if err != nil || len(txts) != 1 {
+		return ""
+	}
+	text, err := c.expand(txts[0], domain, true)
+	if err != nil {
+		return ""
+	}
+	return text
+}
+
+// expand applies macro expansion (RFC 7208 section 7) to s. Explanation
+// strings also allow the c, r and t macros and keep spaces; domain specs
+// are truncated to 253 characters by dropping labels from the left.
+func (c *spfCheck) expand(s, domain string, explanation bool) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 >= len(s) {
+			return "", errors.New("trailing % in macro string")
+		}
+		i++
+		switch s[i] {
+		case '%':
+			b.WriteByte('%')
+			continue
+		case '_':
+			b.WriteByte(' ')
+			continue
+		case '-':
+			b.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", fmt.Errorf("invalid macro %%%c", s[i])
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", errors.New("unterminated macro")
+		}
+		value, err := c.macro(s[i+1:i+end], domain, explanation)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+		i += end
+	}
+
+	out := b.String()
+	if !explanation {
+		out = strings.TrimSuffix(out, ".")
+		for len(out) > 253 {
+			_, rest, ok := strings.Cut(out, ".")
+			if !ok {
+				break
+			}
+			out = rest
+		}
+		out = strings.ToLower(out)
+	}
+	return out, nil
+}
+
+// macro expands the body of one %{...} macro.
+func (c *spfCheck) macro(body, domain string, explanation bool) (string, error) {
+	if body == "" {
+		return "", errors.New("empty macro")
+	}
+	letter := body[0]
+	rest := body[1:]
+
+	local, senderDomain, _ := strings.Cut(c.sender, "@")
+	var value string
+	switch letter | 0x20 {
+	case 's':
+		value = c.sender
+	case 'l':
+		value = local
+	case 'o':
+		value = senderDomain
+	case 'd':
+		value = domain
+	case 'i':
+		value = dottedIP(c.ip)
+	case 'p':
+		// The PTR query counts like a mechanism's, unless a ptr
+		// mechanism or an earlier %{p} already made it.
+		if !c.ptrDone {
+			if err := c.count(); err != nil {
+				return "", err
+			}
+		}
+		names, err := c.validatedNames()
+		if err != nil {
+			return "", err
+		}
+		value = "unknown"
+		if len(names) > 0 {
+			value = names[0]
+			for _, n := range names {
+				if n == domain || strings.HasSuffix(n, "."+domain) {
+					value = n
+					break
+				}
+			}
+		}
+	case 'v':
+		value = "ip6"
+		if c.ip.To4() != nil {
+			value = "in-addr"
+		}
+	case 'h':
+		value = c.helo
+	case 'c', 'r', 't':
+		if !explanation {
+			return "", fmt.Errorf("macro %%{%c} is only allowed in explanations", letter)
+		}
+		switch letter | 0x20 {
+		case 'c':
+			value = c.ip.String()
+		case 'r':
+			value = "unknown"
+		case 't':
+			value = strconv.FormatInt(time.Now().Unix(), 10)
+		}
+	default:
+		return "", fmt.Errorf("unknown macro letter %q", letter)
+	}
+
+	digits := 0
+	for len(rest) > 0 && rest[0] >= '0' && rest[0] <= '9' {
+		digits = digits*10 + int(rest[0]-'0')
+		rest = rest[1:]
+		if digits > 128 {
+			return "", errors.New("macro transformer out of range")
+		}
+	}
+	if digits == 0 && len(body) > 1 && body[1] == '0' {
+		return "", errors.New("macro transformer cannot be zero")
+	}
+	reverse := false
+	if len(rest) > 0 && (rest[0] == 'r' || rest[0] == 'R') {
+		reverse = true
+		rest = rest[1:]
+	}
+	delimiters := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", fmt.Errorf("invalid macro delimiters %q", rest)
+		}
+		delimiters = rest
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delimiters, r) })
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if digits > 0 && digits < len(parts) {
+		parts = parts[len(parts)-digits:]
+	}
+	value = strings.Join(parts, ".")
+
+	if letter >= 'A' && letter <= 'Z' {
+		value = url.QueryEscape(value)
+		value = strings.ReplaceAll(value, "+", "%20")
+	}
+	return value, nil
+}
+
+// checkMacros validates the macro syntax of a domain spec or explanation
+// without expanding it.
+func checkMacros(s string, explanation bool) error {
+	c := &spfCheck{ip: net.IPv4zero, r: nullResolver{}}
+	_, err := c.expand(s, "example.com", explanation)
+	return err
+}
+
+// dottedIP formats ip for the i macro: dotted quad for IPv4, dot-separated
+// nibbles for IPv6.
+func dottedIP(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	const hex = "0123456789abcdef"
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, string(hex[b>>4]), string(hex[b&0xf]))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+func termString(t SPFTerm) string {
+	s := t.Mechanism
+	if t.Domain != "" {
+		s += ":" + t.Domain
+	}
+	return s
+}
+
+// validDomain reports whether domain can be checked: a multi-label name
+// with labels of 1 to 63 characters.
+func validDomain(domain string) bool {
+	if len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+// nullResolver answers every query with "not found". It backs syntax
+// checks, which expand macros without looking anything up.
+type nullResolver struct{}
+
+func (nullResolver) LookupTXT(context.Context, string) ([]string, error) { return nil, errNotFound }
+func (nullResolver) LookupMX(context.Context, string) ([]*net.MX, error) { return nil, errNotFound }
+func (nullResolver) LookupIPAddr(context.Context, string) ([]net.IPAddr, error) {
+	return nil, errNotFound
+}
+func (nullResolver) LookupAddr(context.Context, string) ([]string, error) { return nil, errNotFound }
+func (nullResolver) LookupCNAME(context.Context, string) (string, error)  { return "", errNotFound }
+
+var errNotFound = &net.DNSError{Err: "no such host", IsNotFound: true}
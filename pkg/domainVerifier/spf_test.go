@@ -0,0 +1,78 @@
+package domainVerifier
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCheckSPFLimits(t *testing.T) {
+	client := net.ParseIP("192.0.2.1")
+	r := &StaticResolver{
+		TXT: map[string][]string{},
+		IP: map[string][]net.IP{
+			"client.test": {client},
+			"v6only.test": {net.ParseIP("2001:db8::1")},
+		},
+	}
+	var hosts []string
+	for i := 1; i <= 9; i++ {
+		host := fmt.Sprintf("h%d.test", i)
+		r.IP[host] = []net.IP{net.ParseIP(fmt.Sprintf("198.51.100.%d", i))}
+		hosts = append(hosts, "a:"+host)
+	}
+	r.IP["client.test.p.test"] = []net.IP{net.ParseIP("127.0.0.2")}
+	r.IP["unknown.p.test"] = []net.IP{net.ParseIP("127.0.0.2")}
+
+	tests := []struct {
+		name   string
+		record string
+		ptr    bool // client has a PTR record
+		want   string
+	}{
+		{
+			name:   "p macro counts as a lookup",
+			record: "v=spf1 " + strings.Join(hosts, " ") + " exists:%{p}.p.test -all",
+			ptr:    true,
+			want:   SPFPermError,
+		},
+		{
+			name:   "p macro within the limit",
+			record: "v=spf1 " + strings.Join(hosts[:8], " ") + " exists:%{p}.p.test -all",
+			ptr:    true,
+			want:   SPFPass,
+		},
+		{
+			name:   "missing PTR is a void lookup",
+			record: "v=spf1 a:void1.test a:void2.test exists:%{p}.p.test -all",
+			want:   SPFPermError,
+		},
+		{
+			name:   "addresses of the other family are not void",
+			record: "v=spf1 a:v6only.test a:v6only.test a:v6only.test -all",
+			ptr:    true,
+			want:   SPFFail,
+		},
+		{
+			name:   "missing names are void",
+			record: "v=spf1 a:void1.test a:void2.test a:void3.test -all",
+			ptr:    true,
+			want:   SPFPermError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r.TXT["example.test"] = []string{tt.record}
+			r.PTR = nil
+			if tt.ptr {
+				r.PTR = map[string][]string{"192.0.2.1": {"client.test."}}
+			}
+			res := CheckSPF(context.Background(), r, client, "example.test", "a@example.test", "client.test")
+			if res.Result != tt.want {
+				t.Errorf("CheckSPF = %s (%v), want %s", res.Result, res.Err, tt.want)
+			}
+		})
+	}
+}
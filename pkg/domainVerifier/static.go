@@ -0,0 +1,90 @@
+package domainVerifier
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// StaticResolver answers from in-memory records, for tests and offline
+// checks. Maps are keyed by lower case names without a trailing dot, which
+// queries are normalized to, and PTR by the address string. A name without
+// records is not found, unless Errors holds an error for it.
+type StaticResolver struct {
+	TXT   map[string][]string
+	MX    map[string][]*net.MX
+	IP    map[string][]net.IP
+	PTR   map[string][]string
+	CNAME map[string]string
+
+	// Errors is returned for lookups of any type at a name, for example a
+	// &net.DNSError{IsTimeout: true} to simulate a failing server.
+	Errors map[string]error
+}
+
+func (r *StaticResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if err := r.err(name); err != nil {
+		return nil, err
+	}
+	if txts, ok := r.TXT[cacheKey(name)]; ok {
+		return append([]string(nil), txts...), nil
+	}
+	return nil, notFound(name)
+}
+
+func (r *StaticResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if err := r.err(name); err != nil {
+		return nil, err
+	}
+	if mxs, ok := r.MX[cacheKey(name)]; ok {
+		return append([]*net.MX(nil), mxs...), nil
+	}
+	return nil, notFound(name)
+}
+
+func (r *StaticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if err := r.err(host); err != nil {
+		return nil, err
+	}
+	ips, ok := r.IP[cacheKey(host)]
+	if !ok {
+		return nil, notFound(host)
+	}
+	addrs := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+	return addrs, nil
+}
+
+func (r *StaticResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if err := r.err(addr); err != nil {
+		return nil, err
+	}
+	if names, ok := r.PTR[addr]; ok {
+		return append([]string(nil), names...), nil
+	}
+	return nil, notFound(addr)
+}
+
+func (r *StaticResolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	if err := r.err(host); err != nil {
+		return "", err
+	}
+	if cname, ok := r.CNAME[cacheKey(host)]; ok {
+		return cname, nil
+	}
+	return "", notFound(host)
+}
+
+func (r *StaticResolver) err(name string) error {
+	if err, ok := r.Errors[cacheKey(name)]; ok {
+		return err
+	}
+	return r.Errors[name]
+}
+
+// notFound returns the error net.Resolver gives for a missing record.
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: strings.TrimSuffix(name, "."), IsNotFound: true}
+}